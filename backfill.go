@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+
+	"github.com/viscerous/goplaxt/lib/api"
+	"github.com/viscerous/goplaxt/lib/backfill"
+)
+
+// runBackfill implements "goplaxt backfill", which adds the watches in a
+// Plex or Tautulli history export to a user's Trakt history
+func runBackfill(args []string) error {
+	flags := flag.NewFlagSet("backfill", flag.ContinueOnError)
+	userID := flags.String("user", "", "Plaxt user ID to backfill")
+	file := flags.String("file", "", "Plex or Tautulli history export, as CSV or JSON")
+	dryRun := flags.Bool("dry-run", false, "resolve watches on Trakt without adding them")
+	checkpoint := flags.String("checkpoint", "", "file recording sent watches, so an interrupted run can resume (default <file>.checkpoint)")
+	batch := flags.Int("batch", backfill.DefaultBatchSize, "watches sent to Trakt per request")
+	allAccounts := flags.Bool("all-accounts", false, "include watches from Plex accounts not matched to the user")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *userID == "" || *file == "" {
+		flags.Usage()
+		return errors.New("-user and -file are required")
+	}
+	if *checkpoint == "" {
+		*checkpoint = *file + ".checkpoint"
+	}
+
+	storage := openStorage()
+	user := storage.GetUser(*userID)
+	if user == nil {
+		return fmt.Errorf("user %q not found", *userID)
+	}
+	if user.AccessToken == "" {
+		return errors.New("user is not connected to Trakt, sign in to Plaxt first")
+	}
+	client := newTraktClient(storage)
+	apiHandler := api.New(storage, staticContent, client)
+	if err := apiHandler.EnsureToken(user); err != nil {
+		return err
+	}
+
+	f, err := os.Open(*file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	records, err := backfill.Read(f)
+	if err != nil {
+		return err
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	summary, err := backfill.Run(ctx, client, *user, records, backfill.Options{
+		DryRun:      *dryRun,
+		Checkpoint:  *checkpoint,
+		BatchSize:   *batch,
+		AllAccounts: *allAccounts,
+		Out:         os.Stdout,
+	})
+	verb := "Added"
+	if *dryRun {
+		verb = "Would add"
+	}
+	fmt.Printf("%s %d watches, %d skipped, %d not found on Trakt\n", verb, summary.Added, summary.Skipped, summary.Unresolved)
+	return err
+}
@@ -2,6 +2,7 @@ package api
 
 import (
 	"encoding/json"
+	"errors"
 	"log/slog"
 	"net/http"
 
@@ -11,7 +12,7 @@ import (
 
 // StartAuth initiates device code authentication flow
 func (a *API) StartAuth(w http.ResponseWriter, r *http.Request) {
-	codeData, err := trakt.GetDeviceCode()
+	codeData, err := a.Trakt.GetDeviceCode()
 	if err != nil {
 		slog.Error("Failed to get device code", "error", err)
 		http.Error(w, "Failed to start auth", http.StatusInternalServerError)
@@ -32,15 +33,19 @@ func (a *API) PollAuth(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	result, err := trakt.PollDeviceToken(deviceCode)
+	result, err := a.Trakt.PollDeviceToken(deviceCode)
 	if err != nil {
 		slog.Warn("Poll failed", "device_code", deviceCode, "error", err)
-		switch err.Error() {
-		case "invalid code":
+		var apiErr *trakt.APIError
+		errors.As(err, &apiErr)
+		switch {
+		case apiErr == nil:
+			http.Error(w, err.Error(), http.StatusBadRequest)
+		case apiErr.Status == http.StatusNotFound:
 			http.Error(w, "Invalid code", http.StatusNotFound)
-		case "expired code":
+		case apiErr.Status == http.StatusGone:
 			http.Error(w, "Expired code", http.StatusGone)
-		case "already used code":
+		case apiErr.Status == http.StatusConflict:
 			http.Error(w, "Code already used", http.StatusConflict)
 		default:
 			http.Error(w, err.Error(), http.StatusBadRequest)
@@ -63,7 +68,7 @@ func (a *API) PollAuth(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Fetch user profile
-	profile, err := trakt.GetUserProfile(accessToken)
+	profile, err := a.Trakt.GetUserProfile(accessToken)
 	if err != nil {
 		slog.Error("Failed to fetch user profile", "error", err)
 		http.Error(w, "Failed to fetch user profile", http.StatusInternalServerError)
@@ -83,6 +88,11 @@ func (a *API) PollAuth(w http.ResponseWriter, r *http.Request) {
 	if existingUser != nil {
 		slog.Info("Updating existing user", "id", existingUser.ID, "username", username)
 		existingUser.UpdateUser(accessToken, refreshToken, expiresIn, createdAt)
+		if existingUser.WebhookSecret == "" {
+			if err := existingUser.RotateWebhookSecret(); err != nil {
+				slog.Error("Failed to create webhook secret", "user_id", existingUser.ID, "error", err)
+			}
+		}
 		user = *existingUser
 	} else {
 		// Attempt recovery from cookie
@@ -93,7 +103,11 @@ func (a *API) PollAuth(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	a.setCookie(w, r, user.ID)
+	if err := a.startSession(w, r, &user); err != nil {
+		slog.Error("Failed to start session", "user_id", user.ID, "error", err)
+		http.Error(w, "Failed to start session", http.StatusInternalServerError)
+		return
+	}
 	w.WriteHeader(http.StatusOK)
 }
 
@@ -110,18 +124,19 @@ func extractUsername(profile map[string]interface{}) string {
 	return ""
 }
 
-// tryRecoverUser attempts to recover a user from cookie
+// tryRecoverUser recreates a user lost from storage under the ID in their session,
+// so that legacy webhook URLs keep working. Only sessions signed by this server are trusted.
 func (a *API) tryRecoverUser(r *http.Request, username, accessToken, refreshToken string, expiresIn, createdAt int64) *store.User {
-	cookie, err := r.Cookie("goplaxt_user")
-	if err != nil || cookie.Value == "" {
+	s, err := a.requestSession(r)
+	if err != nil {
 		return nil
 	}
 
-	if a.Storage.GetUser(cookie.Value) != nil {
+	if a.Storage.GetUser(s.UserID) != nil {
 		return nil // User exists, no recovery needed
 	}
 
-	slog.Info("Recovering lost user from cookie", "id", cookie.Value, "username", username)
-	user := store.NewUserWithID(cookie.Value, username, accessToken, refreshToken, expiresIn, createdAt, a.Storage)
+	slog.Info("Recovering lost user from session", "id", s.UserID, "username", username)
+	user := store.NewUserWithID(s.UserID, username, accessToken, refreshToken, expiresIn, createdAt, a.Storage)
 	return &user
 }
@@ -1,8 +1,10 @@
 package api
 
 import (
+	"fmt"
 	"log/slog"
 	"net/http"
+	"strconv"
 	"strings"
 
 	"github.com/viscerous/goplaxt/lib/store"
@@ -21,14 +23,9 @@ func (a *API) ConfigHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	userID := r.Form.Get("id")
-	if userID == "" {
-		userID = getUserIDFromRequest(r)
-	}
-
-	user := a.Storage.GetUser(userID)
+	user := a.sessionUser(r)
 	if user == nil {
-		w.WriteHeader(http.StatusNotFound)
+		w.WriteHeader(http.StatusUnauthorized)
 		return
 	}
 
@@ -52,14 +49,85 @@ func (a *API) ConfigHandler(w http.ResponseWriter, r *http.Request) {
 		EpisodeCollection:    boolPtr(r.Form.Get("episode_collection") == "on"),
 		ShowRate:             boolPtr(r.Form.Get("show_rate") == "on"),
 		SeasonRate:           boolPtr(r.Form.Get("season_rate") == "on"),
+
+		MovieCollectionRemove:   boolPtr(r.Form.Get("movie_collection_remove") == "on"),
+		EpisodeCollectionRemove: boolPtr(r.Form.Get("episode_collection_remove") == "on"),
+		LibraryReconcile:        boolPtr(r.Form.Get("library_reconcile") == "on"),
+
+		// Only the dashboard has the scrobble and filter settings, so keep them when saving the setup wizard
+		WatchedThreshold: user.Config.WatchedThreshold,
+		MinProgress:      user.Config.MinProgress,
+		UseScrobbleEvent: user.Config.UseScrobbleEvent,
+		Libraries:        user.Config.Libraries,
+		Servers:          user.Config.Servers,
+		MediaTypes:       user.Config.MediaTypes,
+		Players:          user.Config.Players,
+		PlayerAddresses:  user.Config.PlayerAddresses,
+		PlayerLocation:   user.Config.PlayerLocation,
+	}
+	if r.Form.Has("scrobble_settings") {
+		config.UseScrobbleEvent = boolPtr(r.Form.Get("use_scrobble_event") == "on")
+		if threshold, ok := percentField(r, "watched_threshold", store.MinWatchedThreshold, 100); ok {
+			config.WatchedThreshold = &threshold
+		}
+		if floor, ok := percentField(r, "min_progress", store.DefaultMinProgress, store.MaxMinProgress); ok {
+			config.MinProgress = &floor
+		}
+	}
+	if r.Form.Has("filter_settings") {
+		config.Libraries = store.ParseRules(r.Form.Get("libraries_include"), r.Form.Get("libraries_exclude"))
+		config.Servers = store.ParseRules(r.Form.Get("servers_include"), r.Form.Get("servers_exclude"))
+		config.MediaTypes = store.ParseRules(r.Form.Get("media_types_include"), r.Form.Get("media_types_exclude"))
+		config.Players = store.ParseRules(r.Form.Get("players_include"), r.Form.Get("players_exclude"))
+		config.PlayerAddresses = store.ParseRules(r.Form.Get("player_addresses_include"), r.Form.Get("player_addresses_exclude"))
+		switch location := r.Form.Get("player_location"); location {
+		case store.PlayerLocationLocal, store.PlayerLocationRemote:
+			config.PlayerLocation = location
+		default:
+			config.PlayerLocation = store.PlayerLocationAny
+		}
+	}
+
+	// Only the dashboard lists further Plex accounts
+	plexAccounts := user.PlexAccounts
+	if r.Form.Has("account_settings") {
+		plexAccounts = store.ParseLines(r.Form.Get("plex_accounts"))
+	}
+
+	// The server webhook routes an account's events to every user who lists it
+	if account := a.claimedAccount(user.ID, append([]string{plexUsername}, plexAccounts...)); account != "" {
+		slog.Warn("Rejected Plex account used by another user", "user_id", user.ID, "account", account)
+		http.Error(w, fmt.Sprintf("Plex account %q is already used by another user", account), http.StatusConflict)
+		return
 	}
 
-	user.UpdateConfiguration(config, plexUsername)
-	slog.Info("User configuration updated", "user_id", userID)
+	user.UpdateConfiguration(config, plexUsername, plexAccounts)
+	slog.Info("User configuration updated", "user_id", user.ID)
 
 	http.Redirect(w, r, "/", http.StatusSeeOther)
 }
 
+// claimedAccount returns the first of the given Plex account titles or IDs that another user already lists
+func (a *API) claimedAccount(userID string, accounts []string) string {
+	for _, account := range accounts {
+		for _, other := range a.Storage.GetUsersByPlexAccount(account, account) {
+			if other.ID != userID {
+				return account
+			}
+		}
+	}
+	return ""
+}
+
+// percentField parses a whole percentage form field, rejecting values outside [lo, hi]
+func percentField(r *http.Request, name string, lo, hi int) (int, bool) {
+	value, err := strconv.Atoi(strings.TrimSpace(r.Form.Get(name)))
+	if err != nil || value < lo || value > hi {
+		return 0, false
+	}
+	return value, true
+}
+
 // LogoutHandler handles user logout and data deletion
 func (a *API) LogoutHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method != "POST" {
@@ -67,14 +135,15 @@ func (a *API) LogoutHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	cookie, err := r.Cookie("goplaxt_user")
-	if err != nil || cookie.Value == "" {
+	user := a.sessionUser(r)
+	if user == nil {
+		a.clearCookie(w, r)
 		http.Redirect(w, r, "/", http.StatusSeeOther)
 		return
 	}
 
-	slog.Info("Logging out and deleting user", "id", cookie.Value)
-	a.Storage.DeleteUser(cookie.Value)
+	slog.Info("Logging out and deleting user", "id", user.ID)
+	a.Storage.DeleteUser(user.ID)
 	a.clearCookie(w, r)
 
 	http.Redirect(w, r, "/", http.StatusSeeOther)
@@ -0,0 +1,56 @@
+package api
+
+import (
+	"fmt"
+	"log/slog"
+
+	"github.com/viscerous/goplaxt/lib/media"
+	"github.com/viscerous/goplaxt/lib/store"
+)
+
+// eventFilter is one of a user's rule lists and the event values it is checked against
+type eventFilter struct {
+	name   string
+	rules  store.Rules
+	values []string
+}
+
+// eventFilters returns the user's filters for an event
+func eventFilters(c store.Config, e media.MediaEvent) []eventFilter {
+	return []eventFilter{
+		{"library", c.Libraries, []string{e.Library.Name, e.Library.ID}},
+		{"server", c.Servers, []string{e.Server.Name, e.Server.UUID}},
+		{"media type", c.MediaTypes, []string{e.Kind}},
+		{"player", c.Players, []string{e.Player.Name, e.Player.UUID}},
+		{"player address", c.PlayerAddresses, []string{e.Player.Address}},
+	}
+}
+
+// playerLocation returns where the player is relative to the server
+func playerLocation(e media.MediaEvent) string {
+	if e.Player.Local {
+		return store.PlayerLocationLocal
+	}
+	return store.PlayerLocationRemote
+}
+
+// filterEvent applies the user's filters, returning why the event should be skipped or "" to process it
+func filterEvent(user *store.User, e media.MediaEvent) string {
+	for _, f := range eventFilters(user.Config, e) {
+		allowed, rule := f.rules.Check(f.values...)
+		if rule != "" {
+			slog.Debug("Filter rule matched", "user_id", user.ID, "filter", f.name, "rule", rule, "allowed", allowed)
+		}
+		if !allowed {
+			return fmt.Sprintf("%s filtered (%s)", f.name, rule)
+		}
+	}
+
+	if want := user.Config.PlayerLocation; want != store.PlayerLocationAny {
+		if got := playerLocation(e); got != want {
+			slog.Debug("Filter rule matched", "user_id", user.ID, "filter", "player location", "rule", want, "allowed", false)
+			return fmt.Sprintf("player filtered (%s)", got)
+		}
+	}
+	return ""
+}
@@ -2,6 +2,7 @@ package api
 
 import (
 	"context"
+	"crypto/subtle"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -14,29 +15,59 @@ import (
 	"sync"
 	"time"
 
+	"github.com/viscerous/goplaxt/lib/config"
+	"github.com/viscerous/goplaxt/lib/media"
+	"github.com/viscerous/goplaxt/lib/plex"
+	"github.com/viscerous/goplaxt/lib/queue"
 	"github.com/viscerous/goplaxt/lib/store"
 	"github.com/viscerous/goplaxt/lib/trakt"
-	"github.com/xanderstrike/plexhooks"
 )
 
+// webhookWorkers is the number of workers draining the webhook queue
+const webhookWorkers = 4
+
+// errTokenRejected marks a job whose access token Trakt rejected. The token is
+// refreshed before the job's next attempt, so it is worth retrying.
+var errTokenRejected = errors.New("access token rejected")
+
 // API is the main application handler
 type API struct {
 	Storage           store.Store
+	Queue             *queue.Queue
 	UserLocks         sync.Map
+	Sessions          *trakt.SessionTracker
+	Trakt             *trakt.RealTraktClient
 	AuthoriseTemplate *template.Template
+
+	sessionKey []byte
+
+	// AllowLegacyWebhooks accepts the old /api?id=<user ID> webhook URLs
+	AllowLegacyWebhooks bool
+
+	// ServerWebhookToken enables the /api/server webhook shared by every user of a Plex server
+	ServerWebhookToken string
+
+	// Plex reads the library of the Plex server, if one is configured
+	Plex *plex.Client
 }
 
 // New creates a new API instance
-func New(storage store.Store, content fs.FS) *API {
+func New(storage store.Store, content fs.FS, client *trakt.RealTraktClient) *API {
 	tpl, err := template.ParseFS(content, "static/index.html")
 	if err != nil {
 		panic(fmt.Errorf("failed to parse templates: %w", err))
 	}
 
-	return &API{
-		Storage:           storage,
-		AuthoriseTemplate: tpl,
+	a := &API{
+		Storage:            storage,
+		Sessions:           trakt.NewSessionTracker(),
+		Trakt:              client,
+		AuthoriseTemplate:  tpl,
+		sessionKey:         sessionKey(),
+		ServerWebhookToken: config.ServerWebhookToken,
 	}
+	a.Queue = queue.New(storage, webhookWorkers, a.processJob)
+	return a
 }
 
 // AuthorisePage holds data for the main page template
@@ -46,27 +77,18 @@ type AuthorisePage struct {
 	URL         string
 	User        store.User
 	CurrentStep int // 1=Auth, 2=Webhook, 3=Config, 4=Dashboard
+	CSRFToken   string
 }
 
 // RootHandler renders the main page
 func (a *API) RootHandler(w http.ResponseWriter, r *http.Request) {
-	userID := getUserIDFromRequest(r)
-
-	// Set cookie if ID was in query params
-	if id := r.URL.Query().Get("id"); id != "" && id == userID {
-		a.setCookie(w, r, userID)
-	}
-
-	var user *store.User
 	var apiURL string
 	authorised := false
 
-	if userID != "" {
-		user = a.Storage.GetUser(userID)
-		if user != nil {
-			authorised = true
-			apiURL = fmt.Sprintf("%s/api?id=%s", SelfRoot(r), user.ID)
-		}
+	user := a.sessionUser(r)
+	if user != nil {
+		authorised = true
+		apiURL = webhookURL(r, user)
 	}
 
 	currentStep := determineStep(authorised, user)
@@ -80,6 +102,7 @@ func (a *API) RootHandler(w http.ResponseWriter, r *http.Request) {
 
 	if authorised && user != nil {
 		data.User = *user
+		data.CSRFToken = a.csrfToken(r)
 	}
 
 	if err := a.AuthoriseTemplate.Execute(w, data); err != nil {
@@ -103,57 +126,187 @@ func determineStep(authorised bool, user *store.User) int {
 	return 2 // Needs webhook setup
 }
 
+// MigrateWebhookSecrets gives users created before webhook secrets existed a secret
+func (a *API) MigrateWebhookSecrets() {
+	for _, user := range a.Storage.ListUsers() {
+		if user.WebhookSecret != "" {
+			continue
+		}
+		if err := user.RotateWebhookSecret(); err != nil {
+			slog.Error("Failed to create webhook secret", "user_id", user.ID, "error", err)
+			continue
+		}
+		slog.Info("Created webhook secret", "user_id", user.ID)
+	}
+}
+
+// webhookURL returns the Plex webhook URL for a user
+func webhookURL(r *http.Request, user *store.User) string {
+	return fmt.Sprintf("%s/api?token=%s", SelfRoot(r), user.WebhookSecret)
+}
+
+// webhookUser resolves the user a webhook request is for
+func (a *API) webhookUser(r *http.Request) (*store.User, error) {
+	query := r.URL.Query()
+	if token := query.Get("token"); token != "" {
+		user := a.Storage.GetUserByWebhookSecret(token)
+		if user == nil || subtle.ConstantTimeCompare([]byte(user.WebhookSecret), []byte(token)) != 1 {
+			return nil, fmt.Errorf("invalid token")
+		}
+		return user, nil
+	}
+
+	if id := query.Get("id"); id != "" {
+		if !a.AllowLegacyWebhooks {
+			return nil, fmt.Errorf("legacy webhook URLs are disabled")
+		}
+		user := a.Storage.GetUser(id)
+		if user == nil {
+			return nil, fmt.Errorf("user not found")
+		}
+		return user, nil
+	}
+
+	return nil, fmt.Errorf("missing token")
+}
+
 // WebhookHandler handles incoming Plex webhook events
 func (a *API) WebhookHandler(w http.ResponseWriter, r *http.Request) {
-	userID := r.URL.Query().Get("id")
-	if userID == "" {
-		http.Error(w, "Missing id", http.StatusBadRequest)
+	a.receiveWebhook(w, r, media.SourcePlex, "payload")
+}
+
+// JellyfinHandler handles incoming Jellyfin webhook plugin events
+func (a *API) JellyfinHandler(w http.ResponseWriter, r *http.Request) {
+	a.receiveWebhook(w, r, media.SourceJellyfin, "payload")
+}
+
+// EmbyHandler handles incoming Emby webhook events
+func (a *API) EmbyHandler(w http.ResponseWriter, r *http.Request) {
+	a.receiveWebhook(w, r, media.SourceEmby, "data")
+}
+
+// TautulliHandler handles incoming Tautulli webhook notifications
+func (a *API) TautulliHandler(w http.ResponseWriter, r *http.Request) {
+	a.receiveWebhook(w, r, media.SourceTautulli, "payload")
+}
+
+// ServerWebhookHandler handles Plex webhooks sent to one URL for a whole server.
+// Each event is queued for every user that lists its Plex account.
+func (a *API) ServerWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	token := r.URL.Query().Get("token")
+	if a.ServerWebhookToken == "" || subtle.ConstantTimeCompare([]byte(token), []byte(a.ServerWebhookToken)) != 1 {
+		slog.Warn("Server webhook rejected", "error", "invalid token")
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode("invalid token")
 		return
 	}
-	slog.Info("Webhook received", "user_id", userID)
+	slog.Info("Server webhook received", "source", media.SourcePlex)
 
-	// Validate user exists
-	initialUser := a.Storage.GetUser(userID)
-	if initialUser == nil {
-		slog.Warn("Webhook rejected: user not found", "id", userID)
-		w.WriteHeader(http.StatusNotFound)
-		json.NewEncoder(w).Encode("user not found")
+	a.queueWebhook(w, r, media.SourcePlex, "payload", func(event media.MediaEvent) []string {
+		var ids []string
+		for _, user := range a.Storage.GetUsersByPlexAccount(event.Account.ID, event.Account.Name) {
+			ids = append(ids, user.ID)
+		}
+		return ids
+	})
+}
+
+// receiveWebhook authenticates a webhook, converts it to a media event and queues it.
+// field is the multipart form field holding the payload.
+func (a *API) receiveWebhook(w http.ResponseWriter, r *http.Request, source, field string) {
+	initialUser, err := a.webhookUser(r)
+	if err != nil {
+		slog.Warn("Webhook rejected", "source", source, "error", err)
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(err.Error())
 		return
 	}
+	userID := initialUser.ID
+	slog.Info("Webhook received", "source", source, "user_id", userID)
 
+	a.queueWebhook(w, r, source, field, func(media.MediaEvent) []string {
+		return []string{userID}
+	})
+}
+
+// queueWebhook converts a webhook to a media event and queues it for each of the given users
+func (a *API) queueWebhook(w http.ResponseWriter, r *http.Request, source, field string, users func(media.MediaEvent) []string) {
 	// Extract payload
-	payload, err := a.extractPayload(r)
+	payload, err := a.extractPayload(r, field)
 	if err != nil {
 		slog.Debug("No payload in request", "error", err)
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	// Parse webhook
-	plexEvent, err := plexhooks.ParseWebhook(payload)
+	event, err := media.Parse(source, payload)
+	if errors.Is(err, media.ErrIgnored) {
+		slog.Debug("Webhook ignored", "source", source)
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode("ignored")
+		return
+	}
 	if err != nil {
-		slog.Error("Error parsing webhook", "error", err)
+		slog.Error("Error parsing webhook", "source", source, "error", err)
 		http.Error(w, "Invalid Webhook", http.StatusBadRequest)
 		return
 	}
 
-	// Respond immediately
+	userIDs := users(event)
+	if len(userIDs) == 0 {
+		slog.Debug("No user for account", "source", source, "account", event.Account.Name, "account_id", event.Account.ID)
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode("no matching user")
+		return
+	}
+
+	payload, err = json.Marshal(event)
+	if err != nil {
+		slog.Error("Failed to encode webhook", "source", source, "error", err)
+		http.Error(w, "Failed to queue webhook", http.StatusInternalServerError)
+		return
+	}
+
+	// Persist before acknowledging so the event survives a restart
+	for _, userID := range userIDs {
+		if err := a.Queue.Enqueue(userID, payload); err != nil {
+			slog.Error("Failed to queue webhook", "user_id", userID, "event", event.Event, "error", err)
+			http.Error(w, "Failed to queue webhook", http.StatusInternalServerError)
+			return
+		}
+	}
+
 	w.WriteHeader(http.StatusOK)
 	json.NewEncoder(w).Encode("processing in background")
+}
+
+// RotateWebhookHandler replaces the current user's webhook secret and returns the new webhook URL
+func (a *API) RotateWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	user := a.sessionUser(r)
+	if user == nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
 
-	// Process asynchronously
-	go a.processWebhook(userID, payload, plexEvent)
+	if err := user.RotateWebhookSecret(); err != nil {
+		slog.Error("Failed to rotate webhook secret", "user_id", user.ID, "error", err)
+		http.Error(w, "Failed to rotate webhook secret", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"url": webhookURL(r, user)})
 }
 
 // extractPayload extracts the webhook payload from the request
-func (a *API) extractPayload(r *http.Request) ([]byte, error) {
+func (a *API) extractPayload(r *http.Request, field string) ([]byte, error) {
 	contentType := r.Header.Get("Content-Type")
 
 	if strings.HasPrefix(contentType, "multipart/form-data") {
 		if err := r.ParseMultipartForm(32 << 20); err != nil {
 			return nil, fmt.Errorf("invalid multipart form: %w", err)
 		}
-		payload := []byte(r.FormValue("payload"))
+		payload := []byte(r.FormValue(field))
 		if len(payload) == 0 {
 			return nil, fmt.Errorf("missing payload")
 		}
@@ -171,52 +324,110 @@ func (a *API) extractPayload(r *http.Request) ([]byte, error) {
 	return payload, nil
 }
 
-// processWebhook handles webhook processing in the background
-func (a *API) processWebhook(userID string, payload []byte, plexEvent plexhooks.PlexResponse) {
-	ctx := context.Background()
+// processJob handles a queued webhook. Returning an error schedules a retry,
+// unless Trakt rejected the request in a way that retrying won't fix.
+func (a *API) processJob(ctx context.Context, job store.Job) error {
+	event, err := media.Decode(job.Payload)
+	if errors.Is(err, media.ErrIgnored) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("invalid queued webhook: %w", err)
+	}
+
+	err = a.processWebhook(ctx, job.UserID, event)
+	if err != nil && isTransientPlayback(event.Event) {
+		// A late "watching" status would overwrite whatever happened since, so don't retry it
+		slog.Warn("Dropping failed playback update", "user_id", job.UserID, "event", event.Event, "error", err)
+		return nil
+	}
+	if err != nil && !trakt.IsRetryable(err) && !errors.Is(err, errTokenRejected) {
+		return queue.Permanent(err)
+	}
+	return err
+}
 
+// isTransientPlayback reports whether an event only updates the "now watching" status on Trakt
+func isTransientPlayback(event string) bool {
+	switch event {
+	case media.EventPlay, media.EventPause, media.EventResume:
+		return true
+	}
+	return false
+}
+
+// processWebhook handles webhook processing in the background
+func (a *API) processWebhook(ctx context.Context, userID string, event media.MediaEvent) error {
 	// Per-user mutex
-	mutex, _ := a.UserLocks.LoadOrStore(userID, &sync.Mutex{})
-	mtx := mutex.(*sync.Mutex)
-	mtx.Lock()
-	defer mtx.Unlock()
+	defer a.lockUser(userID)()
 
 	// Reload user for latest state
 	user := a.Storage.GetUser(userID)
 	if user == nil {
 		slog.Warn("User disappeared during processing", "user_id", userID)
-		return
+		return nil
 	}
 
-	// Refresh token if expired
-	if time.Now().After(user.TokenExpiresAt) {
-		if err := a.refreshToken(user); err != nil {
-			slog.Error("Token refresh failed", "user_id", user.ID, "error", err)
-			return
-		}
-	}
-
-	// Match user
-	if user.PlexUsername == "" || !strings.EqualFold(plexEvent.Account.Title, user.PlexUsername) {
+	// Match user. Library events without an account belong to whoever's webhook URL received them.
+	ownedLibraryEvent := event.IsLibraryEvent() && event.Account == (media.Account{})
+	if !ownedLibraryEvent && !user.MatchesAccount(event.Account.ID, event.Account.Name) {
 		expected := user.PlexUsername
 		if expected == "" {
 			expected = user.Username
 		}
-		slog.Debug("Plex user mismatch", "got", plexEvent.Account.Title, "expected", expected)
-		return
+		slog.Debug("Plex user mismatch", "got", event.Account.Name, "account_id", event.Account.ID, "expected", expected, "accounts", user.PlexAccounts)
+		return nil
+	}
+
+	if reason := filterEvent(user, event); reason != "" {
+		slog.Debug("Event filtered", "user_id", user.ID, "reason", reason)
+		a.recordHistory(user.ID, event, trakt.Result{Skipped: reason}, nil)
+		return nil
+	}
+
+	if err := a.EnsureToken(user); err != nil {
+		a.recordHistory(user.ID, event, trakt.Result{}, err)
+		return err
 	}
 
-	client := &trakt.RealTraktClient{}
-	trakt.Handle(ctx, client, plexEvent, payload, *user)
+	a.addServerEpisodes(ctx, &event)
+	result, err := trakt.Handle(ctx, a.Trakt, a.Sessions, event, *user)
+	switch {
+	case errors.Is(err, trakt.ErrInvalidToken):
+		// The access token was revoked, so refresh it before the next event
+		slog.Warn("Trakt rejected access token", "user_id", user.ID)
+		user.TokenExpiresAt = time.Time{}
+		user.Save()
+	case errors.Is(err, trakt.ErrLocked):
+		slog.Warn("Trakt account is locked", "user_id", user.ID)
+	case err == nil:
+		a.recordCollected(ctx, user.ID, event, result.Collected)
+	}
+	a.recordHistory(user.ID, event, result, err)
+	if errors.Is(err, trakt.ErrInvalidToken) {
+		return fmt.Errorf("%w: %w", errTokenRejected, err)
+	}
+	return err
+}
+
+// EnsureToken refreshes the user's Trakt token if it has expired
+func (a *API) EnsureToken(user *store.User) error {
+	if !time.Now().After(user.TokenExpiresAt) {
+		return nil
+	}
+	if err := a.refreshToken(user); err != nil {
+		return fmt.Errorf("token refresh failed: %w", err)
+	}
+	return nil
 }
 
 // refreshToken refreshes an expired Trakt token
 func (a *API) refreshToken(user *store.User) error {
 	slog.Info("Refreshing Trakt token", "user_id", user.ID)
 
-	result, err := trakt.AuthRequest("", "", user.RefreshToken, "refresh_token")
+	result, err := a.Trakt.AuthRequest("", "", user.RefreshToken, "refresh_token")
 	if err != nil {
-		if errors.Is(err, trakt.ErrInvalidToken) {
+		if errors.Is(err, trakt.ErrInvalidGrant) {
 			slog.Warn("Trakt session revoked, clearing tokens", "user_id", user.ID)
 			user.AccessToken = ""
 			user.RefreshToken = ""
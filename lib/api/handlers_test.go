@@ -1,20 +1,32 @@
 package api
 
 import (
+	"context"
 	"testing/fstest"
 
 	"github.com/gorilla/handlers"
 	"github.com/stretchr/testify/assert"
 
+	"encoding/json"
 	"errors"
+	"io"
 
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"os"
+	"slices"
+	"strconv"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
+	"github.com/viscerous/goplaxt/lib/media"
+	"github.com/viscerous/goplaxt/lib/plex"
+	"github.com/viscerous/goplaxt/lib/queue"
 	"github.com/viscerous/goplaxt/lib/store"
+	"github.com/viscerous/goplaxt/lib/trakt"
 )
 
 func TestSelfRoot(t *testing.T) {
@@ -96,7 +108,7 @@ func TestAllowedHostsHandler_mismatch_hostname(t *testing.T) {
 }
 
 func TestAllowedHostsHandler_alwaysAllowHealthcheck(t *testing.T) {
-	api := New(&MockSuccessStore{}, fstest.MapFS{"static/index.html": {Data: []byte("TEST")}})
+	api := New(&MockSuccessStore{}, fstest.MapFS{"static/index.html": {Data: []byte("TEST")}}, trakt.NewClient())
 	f := api.AllowedHostsHandler("unknown.host")
 
 	rr := httptest.NewRecorder()
@@ -116,18 +128,42 @@ func (s MockSuccessStore) Ping() error                     { return nil }
 func (s MockSuccessStore) WriteUser(user store.User) error { return nil }
 func (s MockSuccessStore) GetUser(id string) *store.User {
 	if id == "user123" {
-		return &store.User{ID: "user123", Username: "traktuser", Store: s}
+		return &store.User{ID: "user123", Username: "traktuser", WebhookSecret: "secret123", Store: s}
 	}
 	return nil
 }
 func (s MockSuccessStore) GetUserByUsername(username string) *store.User { return nil }
-func (s MockSuccessStore) DeleteUser(id string) bool                     { return true }
+func (s MockSuccessStore) GetUserByWebhookSecret(secret string) *store.User {
+	if secret == "secret123" {
+		return s.GetUser("user123")
+	}
+	return nil
+}
+func (s MockSuccessStore) GetUsersByPlexAccount(id, name string) []*store.User { return nil }
+func (s MockSuccessStore) ListUsers() []*store.User                            { return nil }
+func (s MockSuccessStore) DeleteUser(id string) bool                           { return true }
+func (s MockSuccessStore) WriteJob(job store.Job) error                        { return nil }
+func (s MockSuccessStore) GetJobs() []store.Job                                { return nil }
+func (s MockSuccessStore) DeleteJob(id string) bool                            { return true }
+func (s MockSuccessStore) WriteHistory(entry store.HistoryEntry) error         { return nil }
+func (s MockSuccessStore) GetHistory(userID string) []store.HistoryEntry       { return nil }
+func (s MockSuccessStore) WriteCollected(userID string, items []store.CollectedItem) error {
+	return nil
+}
+func (s MockSuccessStore) GetCollected(userID string) []store.CollectedItem { return nil }
+func (s MockSuccessStore) DeleteCollected(userID string, items []store.CollectedItem) error {
+	return nil
+}
+func (s MockSuccessStore) GetCache(key string) ([]byte, bool) { return nil, false }
+func (s MockSuccessStore) WriteCache(key string, value []byte, ttl time.Duration) error {
+	return nil
+}
 
 func TestAPI_Multipart(t *testing.T) {
-	api := New(&MockSuccessStore{}, fstest.MapFS{"static/index.html": {Data: []byte("TEST")}})
+	api := New(&MockSuccessStore{}, fstest.MapFS{"static/index.html": {Data: []byte("TEST")}}, trakt.NewClient())
 
 	// Create a multipart form request
-	body := "{\"event\": \"media.play\", \"Account\": {\"title\": \"traktuser\"}}"
+	body := `{"event": "media.play", "Account": {"title": "traktuser"}, "Metadata": {"type": "movie", "title": "Inception"}}`
 
 	// manually construct multipart to avoid complex writer setup for a simple test
 	boundary := "---test-boundary"
@@ -137,7 +173,7 @@ func TestAPI_Multipart(t *testing.T) {
 		body + "\r\n" +
 		"--" + boundary + "--\r\n"
 
-	r, err := http.NewRequest("POST", "/api?id=user123", strings.NewReader(payload))
+	r, err := http.NewRequest("POST", "/api?token=secret123", strings.NewReader(payload))
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -150,13 +186,563 @@ func TestAPI_Multipart(t *testing.T) {
 	assert.Contains(t, rr.Body.String(), "processing in background")
 }
 
+func TestAPI_WebhookAuth(t *testing.T) {
+	api := New(&MockSuccessStore{}, fstest.MapFS{"static/index.html": {Data: []byte("TEST")}}, trakt.NewClient())
+	body := `{"event": "media.play", "Account": {"title": "traktuser"}, "Metadata": {"type": "movie", "title": "Inception"}}`
+
+	send := func(query string) int {
+		r, _ := http.NewRequest("POST", "/api"+query, strings.NewReader(body))
+		r.Header.Set("Content-Type", "application/json")
+		rr := httptest.NewRecorder()
+		api.WebhookHandler(rr, r)
+		return rr.Result().StatusCode
+	}
+
+	assert.Equal(t, http.StatusUnauthorized, send(""))
+	assert.Equal(t, http.StatusUnauthorized, send("?token=wrong"))
+
+	// The user ID is only accepted when legacy URLs are enabled
+	assert.Equal(t, http.StatusUnauthorized, send("?id=user123"))
+	api.AllowLegacyWebhooks = true
+	assert.Equal(t, http.StatusOK, send("?id=user123"))
+	assert.Equal(t, http.StatusUnauthorized, send("?id=unknown"))
+}
+
+func TestRotateWebhookHandler(t *testing.T) {
+	api := New(&MockSuccessStore{}, fstest.MapFS{"static/index.html": {Data: []byte("TEST")}}, trakt.NewClient())
+
+	r, _ := http.NewRequest("POST", "/api/webhook/rotate", nil)
+	r.Host = "plaxt.example.com"
+	r.AddCookie(sessionCookie(t, api, "user123"))
+	rr := httptest.NewRecorder()
+	api.RotateWebhookHandler(rr, r)
+
+	assert.Equal(t, http.StatusOK, rr.Result().StatusCode)
+	assert.Contains(t, rr.Body.String(), "http://plaxt.example.com/api?token=")
+	assert.NotContains(t, rr.Body.String(), "secret123")
+	assert.NotContains(t, rr.Body.String(), "user123")
+
+	r, _ = http.NewRequest("POST", "/api/webhook/rotate", nil)
+	rr = httptest.NewRecorder()
+	api.RotateWebhookHandler(rr, r)
+	assert.Equal(t, http.StatusUnauthorized, rr.Result().StatusCode)
+}
+
+func TestMigrateWebhookSecrets(t *testing.T) {
+	os.RemoveAll("keystore")
+	defer os.RemoveAll("keystore")
+
+	storage := store.NewDiskStore()
+	assert.NoError(t, storage.WriteUser(store.User{ID: "legacy", Username: "legacy"}))
+	current := store.NewUser("current", "access", "refresh", 3600, time.Now().Unix(), storage)
+	api := New(storage, fstest.MapFS{"static/index.html": {Data: []byte("TEST")}}, trakt.NewClient())
+
+	// Viewing the page doesn't change the user
+	r := httptest.NewRequest("GET", "/", nil)
+	r.AddCookie(sessionCookie(t, api, "legacy"))
+	api.RootHandler(httptest.NewRecorder(), r)
+	assert.Empty(t, storage.GetUser("legacy").WebhookSecret)
+
+	api.MigrateWebhookSecrets()
+	legacy := storage.GetUser("legacy")
+	assert.NotEmpty(t, legacy.WebhookSecret)
+	assert.Equal(t, "legacy", storage.GetUserByWebhookSecret(legacy.WebhookSecret).ID)
+	assert.Equal(t, current.WebhookSecret, storage.GetUser(current.ID).WebhookSecret)
+}
+
+type JobSpyStore struct {
+	MockSuccessStore
+	Jobs []store.Job
+}
+
+func (s *JobSpyStore) WriteJob(job store.Job) error {
+	s.Jobs = append(s.Jobs, job)
+	return nil
+}
+
+func TestAPI_OtherMediaServers(t *testing.T) {
+	spyStore := &JobSpyStore{}
+	api := New(spyStore, fstest.MapFS{"static/index.html": {Data: []byte("TEST")}}, trakt.NewClient())
+
+	// Jellyfin sends raw JSON
+	body := `{"NotificationType":"PlaybackStart","NotificationUsername":"traktuser","ItemType":"Movie","Name":"Inception","Year":2010}`
+	r := httptest.NewRequest("POST", "/api/jellyfin?token=secret123", strings.NewReader(body))
+	r.Header.Set("Content-Type", "application/json")
+	rr := httptest.NewRecorder()
+	api.JellyfinHandler(rr, r)
+	assert.Equal(t, http.StatusOK, rr.Result().StatusCode)
+	assert.Contains(t, rr.Body.String(), "processing in background")
+
+	// Emby sends the payload in the "data" form field
+	boundary := "---test-boundary"
+	payload := "--" + boundary + "\r\n" +
+		"Content-Disposition: form-data; name=\"data\"\r\n" +
+		"\r\n" +
+		`{"Event":"playback.start","User":{"Name":"traktuser"},"Item":{"Type":"Movie","Name":"Inception"}}` + "\r\n" +
+		"--" + boundary + "--\r\n"
+	r = httptest.NewRequest("POST", "/api/emby?token=secret123", strings.NewReader(payload))
+	r.Header.Set("Content-Type", "multipart/form-data; boundary="+boundary)
+	rr = httptest.NewRecorder()
+	api.EmbyHandler(rr, r)
+	assert.Equal(t, http.StatusOK, rr.Result().StatusCode)
+
+	// Tautulli sends raw JSON built from its template
+	r = httptest.NewRequest("POST", "/api/tautulli?token=secret123", strings.NewReader(`{"action":"play","username":"traktuser","media_type":"movie","title":"Inception"}`))
+	r.Header.Set("Content-Type", "application/json")
+	rr = httptest.NewRecorder()
+	api.TautulliHandler(rr, r)
+	assert.Equal(t, http.StatusOK, rr.Result().StatusCode)
+
+	// All are queued as media events
+	if assert.Len(t, spyStore.Jobs, 3) {
+		for i, source := range []string{media.SourceJellyfin, media.SourceEmby, media.SourceTautulli} {
+			e, err := media.Decode(spyStore.Jobs[i].Payload)
+			assert.NoError(t, err)
+			assert.Equal(t, source, e.Source)
+			assert.Equal(t, media.EventPlay, e.Event)
+			assert.Equal(t, "traktuser", e.Account.Name)
+			assert.Equal(t, "Inception", e.Title)
+		}
+	}
+
+	// Unsupported events are acknowledged but not queued
+	r = httptest.NewRequest("POST", "/api/jellyfin?token=secret123", strings.NewReader(`{"NotificationType":"PlaybackProgress","ItemType":"Movie"}`))
+	rr = httptest.NewRecorder()
+	api.JellyfinHandler(rr, r)
+	assert.Equal(t, http.StatusOK, rr.Result().StatusCode)
+	assert.Contains(t, rr.Body.String(), "ignored")
+	assert.Len(t, spyStore.Jobs, 3)
+
+	// The webhook secret is required
+	r = httptest.NewRequest("POST", "/api/jellyfin", strings.NewReader(body))
+	rr = httptest.NewRecorder()
+	api.JellyfinHandler(rr, r)
+	assert.Equal(t, http.StatusUnauthorized, rr.Result().StatusCode)
+}
+
+// traktStub is a stand-in Trakt API that finds every movie as Inception and every
+// show as Severance, has Inception and Tenet collected, and records what is synced
+type traktStub struct {
+	*httptest.Server
+	mu     sync.Mutex
+	synced []string
+	bodies []string
+}
+
+func newTraktStub() *traktStub {
+	stub := &traktStub{}
+	stub.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/search/show":
+			w.Write([]byte(`[{"show":{"title":"Severance","year":2022,"ids":{"trakt":154997}}}]`))
+		case r.URL.Query().Get("query") == "Unknown":
+			w.Write([]byte(`[]`))
+		case strings.HasPrefix(r.URL.Path, "/search/"):
+			w.Write([]byte(`[{"movie":{"title":"Inception","year":2010,"ids":{"trakt":1,"imdb":"tt1375666"}}}]`))
+		case r.URL.Path == "/shows/154997/seasons":
+			w.Write([]byte(`[{"number":1,"episodes":[
+				{"season":1,"number":1,"title":"Good News About Hell","ids":{"trakt":11},"first_aired":"2022-02-18T02:00:00.000Z"},
+				{"season":1,"number":2,"title":"Half Loop","ids":{"trakt":12},"first_aired":"2022-02-18T02:00:00.000Z"}
+			]}]`))
+		case strings.HasPrefix(r.URL.Path, "/sync/"):
+			body, _ := io.ReadAll(r.Body)
+			stub.mu.Lock()
+			stub.synced = append(stub.synced, r.URL.Path)
+			stub.bodies = append(stub.bodies, string(body))
+			stub.mu.Unlock()
+			w.WriteHeader(http.StatusCreated)
+			w.Write([]byte(`{}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	return stub
+}
+
+// Synced returns the sync endpoints called so far
+func (s *traktStub) Synced() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return slices.Clone(s.synced)
+}
+
+// Bodies returns the sync requests' bodies so far
+func (s *traktStub) Bodies() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return slices.Clone(s.bodies)
+}
+
+// Client returns a Trakt client that talks to the stub
+func (s *traktStub) Client() *trakt.RealTraktClient {
+	return trakt.NewClient(trakt.WithBaseURL(s.URL), trakt.WithRetryPolicy(trakt.RetryPolicy{Attempts: 1}))
+}
+
+// processQueued runs and removes every queued job
+func processQueued(t *testing.T, api *API, storage store.Store) {
+	t.Helper()
+	for _, job := range storage.GetJobs() {
+		assert.NoError(t, api.processJob(context.Background(), job))
+		storage.DeleteJob(job.ID)
+	}
+}
+
+func TestLibraryEventsWithoutAccount(t *testing.T) {
+	os.RemoveAll("keystore")
+	defer os.RemoveAll("keystore")
+
+	stub := newTraktStub()
+	defer stub.Close()
+
+	storage := store.NewDiskStore()
+	enabled := true
+	user := store.NewUser("traktuser", "access", "refresh", 3600, time.Now().Unix(), storage)
+	user.UpdateConfiguration(store.Config{MovieCollection: &enabled}, "traktuser", nil)
+	api := New(storage, fstest.MapFS{"static/index.html": {Data: []byte("TEST")}}, stub.Client())
+
+	send := func(handler http.HandlerFunc, path, body string) {
+		r := httptest.NewRequest("POST", path+"?token="+user.WebhookSecret, strings.NewReader(body))
+		r.Header.Set("Content-Type", "application/json")
+		rr := httptest.NewRecorder()
+		handler(rr, r)
+		assert.Equal(t, http.StatusOK, rr.Result().StatusCode)
+		assert.Contains(t, rr.Body.String(), "processing in background")
+	}
+
+	// Jellyfin and Emby announce new items without a user
+	send(api.JellyfinHandler, "/api/jellyfin", `{"NotificationType":"ItemAdded","ItemType":"Movie","Name":"Inception","Year":2010,"Provider_imdb":"tt1375666"}`)
+	send(api.EmbyHandler, "/api/emby", `{"Event":"library.new","Item":{"Type":"Movie","Name":"Inception","ProductionYear":2010,"ProviderIds":{"Imdb":"tt1375666"}}}`)
+	jobs := storage.GetJobs()
+	if assert.Len(t, jobs, 2) {
+		for _, job := range jobs {
+			e, err := media.Decode(job.Payload)
+			assert.NoError(t, err)
+			assert.Equal(t, media.EventAdded, e.Event)
+			assert.Empty(t, e.Account)
+		}
+	}
+
+	// They belong to the owner of the webhook URL
+	processQueued(t, api, storage)
+	assert.Equal(t, []string{"/sync/collection", "/sync/collection"}, stub.Synced())
+	history := storage.GetHistory(user.ID)
+	if assert.Len(t, history, 2) {
+		assert.Equal(t, store.OutcomeSuccess, history[0].Outcome)
+		assert.Equal(t, "collection", history[0].Action)
+	}
+
+	// Library events from another account are still ignored
+	send(api.JellyfinHandler, "/api/jellyfin", `{"NotificationType":"ItemAdded","NotificationUsername":"someone","ItemType":"Movie","Name":"Inception"}`)
+	processQueued(t, api, storage)
+	assert.Len(t, stub.Synced(), 2)
+}
+
+func TestTautulliRecentlyAdded(t *testing.T) {
+	os.RemoveAll("keystore")
+	defer os.RemoveAll("keystore")
+
+	stub := newTraktStub()
+	defer stub.Close()
+
+	storage := store.NewDiskStore()
+	enabled := true
+	user := store.NewUser("traktuser", "access", "refresh", 3600, time.Now().Unix(), storage)
+	user.UpdateConfiguration(store.Config{MovieCollection: &enabled, EpisodeCollection: &enabled}, "traktuser", nil)
+	api := New(storage, fstest.MapFS{"static/index.html": {Data: []byte("TEST")}}, stub.Client())
+
+	send := func(body string) {
+		r := httptest.NewRequest("POST", "/api/tautulli?token="+user.WebhookSecret, strings.NewReader(body))
+		r.Header.Set("Content-Type", "application/json")
+		rr := httptest.NewRecorder()
+		api.TautulliHandler(rr, r)
+		assert.Equal(t, http.StatusOK, rr.Result().StatusCode)
+		assert.Len(t, storage.GetJobs(), 1)
+		processQueued(t, api, storage)
+	}
+
+	// Tautulli's recently added notification leaves {username} empty
+	send(`{"action":"created","username":"","media_type":"movie","title":"Inception","year":"2010","imdb_id":"tt1375666"}`)
+	assert.Equal(t, []string{"/sync/collection"}, stub.Synced())
+	if history := storage.GetHistory(user.ID); assert.Len(t, history, 1) {
+		assert.Equal(t, store.OutcomeSuccess, history[0].Outcome)
+	}
+
+	// Several episodes added at once are announced as their season
+	send(`{"action":"created","username":"","media_type":"season","title":"Season 1","show_name":"Severance","season_num":"1"}`)
+	if bodies := stub.Bodies(); assert.Len(t, bodies, 2) {
+		var body trakt.CollectionBody
+		assert.NoError(t, json.Unmarshal([]byte(bodies[1]), &body))
+		if assert.Len(t, body.Shows, 1) && assert.Len(t, body.Shows[0].Seasons, 1) {
+			assert.Len(t, body.Shows[0].Seasons[0].Episodes, 2)
+		}
+	}
+	if history := storage.GetHistory(user.ID); assert.Len(t, history, 2) {
+		assert.Equal(t, store.OutcomeSuccess, history[0].Outcome)
+		assert.Equal(t, "Severance - Season 1", history[0].Title)
+	}
+}
+
+func TestPlexSeasonCollection(t *testing.T) {
+	os.RemoveAll("keystore")
+	defer os.RemoveAll("keystore")
+
+	stub := newTraktStub()
+	defer stub.Close()
+	plexServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/identity":
+			w.Write([]byte(`{"MediaContainer": {"machineIdentifier": "plex-uuid"}}`))
+		case "/library/metadata/200/allLeaves":
+			w.Write([]byte(`{"MediaContainer": {"Metadata": [{"type": "episode", "parentIndex": 1, "index": 2, "Guid": [{"id": "tvdb://8229222"}]}]}}`))
+		default:
+			t.Errorf("unexpected Plex request %s", r.URL.Path)
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer plexServer.Close()
+
+	storage := store.NewDiskStore()
+	enabled := true
+	user := store.NewUser("traktuser", "access", "refresh", 3600, time.Now().Unix(), storage)
+	user.UpdateConfiguration(store.Config{EpisodeCollection: &enabled}, "traktuser", nil)
+	api := New(storage, fstest.MapFS{"static/index.html": {Data: []byte("TEST")}}, stub.Client())
+	api.Plex = plex.NewClient(plexServer.URL, "plex-token")
+
+	collected := func(i int) []int {
+		var numbers []int
+		if bodies := stub.Bodies(); assert.Len(t, bodies, i+1) {
+			var body trakt.CollectionBody
+			assert.NoError(t, json.Unmarshal([]byte(bodies[i]), &body))
+			if assert.Len(t, body.Shows, 1) && assert.Len(t, body.Shows[0].Seasons, 1) {
+				for _, episode := range body.Shows[0].Seasons[0].Episodes {
+					numbers = append(numbers, episode.Number)
+				}
+			}
+		}
+		return numbers
+	}
+
+	// Only the episode the server holds is collected
+	event := media.MediaEvent{Source: media.SourcePlex, Event: media.EventAdded, Kind: media.KindSeason, ItemID: "200", ShowTitle: "Severance", Season: 1, Account: media.Account{Name: "traktuser"}, Server: media.Server{UUID: "plex-uuid"}}
+	assert.NoError(t, api.processWebhook(context.Background(), user.ID, event))
+	assert.Equal(t, []int{2}, collected(0))
+	// and recorded, so that it can be removed once the server no longer holds it
+	halfLoop := store.CollectedItem{Server: "plex-uuid", Kind: media.KindEpisode, Trakt: 12, Title: "Half Loop", IDs: []string{"tvdb://8229222"}}
+	assert.Equal(t, []store.CollectedItem{halfLoop}, storage.GetCollected(user.ID))
+
+	// Rating keys from another server mean something else on this one, so aired episodes are collected
+	event.Server.UUID = "other-uuid"
+	assert.NoError(t, api.processWebhook(context.Background(), user.ID, event))
+	assert.Equal(t, []int{1, 2}, collected(1))
+	assert.Equal(t, []store.CollectedItem{halfLoop}, storage.GetCollected(user.ID))
+}
+
+func TestJellyfinDeletion(t *testing.T) {
+	os.RemoveAll("keystore")
+	defer os.RemoveAll("keystore")
+
+	stub := newTraktStub()
+	defer stub.Close()
+
+	storage := store.NewDiskStore()
+	enabled := true
+	user := store.NewUser("traktuser", "access", "refresh", 3600, time.Now().Unix(), storage)
+	user.UpdateConfiguration(store.Config{MovieCollectionRemove: &enabled}, "traktuser", nil)
+	api := New(storage, fstest.MapFS{"static/index.html": {Data: []byte("TEST")}}, stub.Client())
+
+	// Jellyfin reports deletions without a user
+	body := `{"NotificationType":"ItemDeleted","ItemType":"Movie","Name":"Inception","Year":2010,"Provider_imdb":"tt1375666"}`
+	r := httptest.NewRequest("POST", "/api/jellyfin?token="+user.WebhookSecret, strings.NewReader(body))
+	r.Header.Set("Content-Type", "application/json")
+	rr := httptest.NewRecorder()
+	api.JellyfinHandler(rr, r)
+	assert.Equal(t, http.StatusOK, rr.Result().StatusCode)
+
+	processQueued(t, api, storage)
+	assert.Equal(t, []string{"/sync/collection/remove"}, stub.Synced())
+	if history := storage.GetHistory(user.ID); assert.Len(t, history, 1) {
+		assert.Equal(t, store.OutcomeSuccess, history[0].Outcome)
+		assert.Equal(t, "collection/remove", history[0].Action)
+	}
+}
+
+func TestReconcileLibrary(t *testing.T) {
+	os.RemoveAll("keystore")
+	defer os.RemoveAll("keystore")
+
+	stub := newTraktStub()
+	defer stub.Close()
+	var mu sync.Mutex
+	movies := `[{"ratingKey": "10", "type": "movie", "Guid": [{"id": "imdb://tt1375666"}]}, {"ratingKey": "11", "type": "movie"}]`
+	plexServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		switch r.URL.Path {
+		case "/identity":
+			w.Write([]byte(`{"MediaContainer": {"machineIdentifier": "plex-uuid"}}`))
+		case "/library/sections":
+			w.Write([]byte(`{"MediaContainer": {"Directory": [{"key": "1", "type": "movie"}]}}`))
+		case "/library/sections/1/all":
+			w.Write([]byte(`{"MediaContainer": {"Metadata": ` + movies + `}}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer plexServer.Close()
+
+	storage := store.NewDiskStore()
+	enabled := true
+	inception := store.CollectedItem{Server: "plex-uuid", Kind: media.KindMovie, Trakt: 1, Title: "Inception", IDs: []string{"imdb://tt1375666"}}
+	tenet := store.CollectedItem{Server: "plex-uuid", Kind: media.KindMovie, Trakt: 2, Title: "Tenet", IDs: []string{"imdb://tt6723592"}}
+	dune := store.CollectedItem{Server: "other-uuid", Kind: media.KindMovie, Trakt: 3, Title: "Dune", IDs: []string{"imdb://tt1160419"}}
+	reconciler := store.NewUser("reconciler", "access", "refresh", 3600, time.Now().Unix(), storage)
+	reconciler.UpdateConfiguration(store.Config{LibraryReconcile: &enabled}, "reconciler", nil)
+	assert.NoError(t, storage.WriteCollected(reconciler.ID, []store.CollectedItem{inception, tenet, dune}))
+	// Library removals for Jellyfin and Emby don't opt in to reconciliation
+	remover := store.NewUser("remover", "access", "refresh", 3600, time.Now().Unix(), storage)
+	remover.UpdateConfiguration(store.Config{MovieCollectionRemove: &enabled}, "remover", nil)
+	assert.NoError(t, storage.WriteCollected(remover.ID, []store.CollectedItem{tenet}))
+	api := New(storage, fstest.MapFS{"static/index.html": {Data: []byte("TEST")}}, stub.Client())
+	api.Plex = plex.NewClient(plexServer.URL, "plex-token")
+
+	// A movie without IDs could be Tenet, so the collection is left alone
+	api.reconcileLibrary(context.Background())
+	assert.Empty(t, stub.Synced())
+	assert.Len(t, storage.GetCollected(reconciler.ID), 3)
+	if history := storage.GetHistory(reconciler.ID); assert.Len(t, history, 1) {
+		assert.Equal(t, store.OutcomeSkipped, history[0].Outcome)
+	}
+
+	// Once the library is identified, Tenet is removed, but not Dune, which was collected from another server
+	mu.Lock()
+	movies = `[{"ratingKey": "10", "type": "movie", "Guid": [{"id": "imdb://tt1375666"}]}]`
+	mu.Unlock()
+	api.reconcileLibrary(context.Background())
+	assert.Equal(t, []string{"/sync/collection/remove"}, stub.Synced())
+	if bodies := stub.Bodies(); assert.Len(t, bodies, 1) {
+		var body trakt.CollectionBody
+		assert.NoError(t, json.Unmarshal([]byte(bodies[0]), &body))
+		if assert.Len(t, body.Movies, 1) {
+			assert.Equal(t, 2, body.Movies[0].Ids.Trakt)
+		}
+	}
+	assert.ElementsMatch(t, []store.CollectedItem{inception, dune}, storage.GetCollected(reconciler.ID))
+	if history := storage.GetHistory(reconciler.ID); assert.Len(t, history, 2) {
+		assert.Equal(t, store.OutcomeSuccess, history[0].Outcome)
+		assert.Equal(t, eventReconcile, history[0].Event)
+	}
+	assert.Empty(t, storage.GetHistory(remover.ID))
+	assert.Equal(t, []store.CollectedItem{tenet}, storage.GetCollected(remover.ID))
+}
+
+func TestServerWebhookHandler(t *testing.T) {
+	os.RemoveAll("keystore")
+	defer os.RemoveAll("keystore")
+
+	storage := store.NewDiskStore()
+	dad := store.NewUser("dad", "access", "refresh", 3600, time.Now().Unix(), storage)
+	dad.UpdateConfiguration(store.Config{}, "Dad", []string{"Dad-Bedroom"})
+	family := store.NewUser("family", "access", "refresh", 3600, time.Now().Unix(), storage)
+	family.UpdateConfiguration(store.Config{}, "Family", []string{"12345"})
+	store.NewUser("other", "access", "refresh", 3600, time.Now().Unix(), storage)
+
+	api := New(storage, fstest.MapFS{"static/index.html": {Data: []byte("TEST")}}, trakt.NewClient())
+	api.ServerWebhookToken = "server-token"
+
+	send := func(token, account string) *httptest.ResponseRecorder {
+		body := `{"event": "media.play", "Account": ` + account + `, "Metadata": {"type": "movie", "title": "Inception"}}`
+		r := httptest.NewRequest("POST", "/api/server?token="+token, strings.NewReader(body))
+		r.Header.Set("Content-Type", "application/json")
+		rr := httptest.NewRecorder()
+		api.ServerWebhookHandler(rr, r)
+		return rr
+	}
+	queued := func() []string {
+		var ids []string
+		for _, job := range storage.GetJobs() {
+			ids = append(ids, job.UserID)
+		}
+		return ids
+	}
+
+	// A user's webhook secret doesn't open the server webhook
+	assert.Equal(t, http.StatusUnauthorized, send(dad.WebhookSecret, `{"title": "Dad"}`).Result().StatusCode)
+	assert.Equal(t, http.StatusUnauthorized, send("", `{"title": "Dad"}`).Result().StatusCode)
+
+	// Events are routed by account title or ID
+	rr := send("server-token", `{"id": 1, "title": "dad-bedroom"}`)
+	assert.Equal(t, http.StatusOK, rr.Result().StatusCode)
+	assert.Contains(t, rr.Body.String(), "processing in background")
+	assert.Equal(t, []string{dad.ID}, queued())
+
+	rr = send("server-token", `{"id": 12345, "title": "Renamed"}`)
+	assert.Equal(t, http.StatusOK, rr.Result().StatusCode)
+	assert.ElementsMatch(t, []string{dad.ID, family.ID}, queued())
+
+	// Unknown accounts are acknowledged but not queued
+	rr = send("server-token", `{"id": 99, "title": "Guest"}`)
+	assert.Equal(t, http.StatusOK, rr.Result().StatusCode)
+	assert.Contains(t, rr.Body.String(), "no matching user")
+	assert.Len(t, queued(), 2)
+
+	// Without a token the server webhook is disabled
+	api.ServerWebhookToken = ""
+	assert.Equal(t, http.StatusUnauthorized, send("", `{"title": "Dad"}`).Result().StatusCode)
+}
+
+type MockJobFailStore struct {
+	MockSuccessStore
+}
+
+func (s MockJobFailStore) WriteJob(job store.Job) error { return errors.New("OH NO") }
+
+func TestAPI_WebhookQueueFailure(t *testing.T) {
+	api := New(&MockJobFailStore{}, fstest.MapFS{"static/index.html": {Data: []byte("TEST")}}, trakt.NewClient())
+
+	body := `{"event": "media.play", "Account": {"title": "traktuser"}, "Metadata": {"type": "movie", "title": "Inception"}}`
+	r, err := http.NewRequest("POST", "/api?token=secret123", strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Header.Set("Content-Type", "application/json")
+
+	rr := httptest.NewRecorder()
+	api.WebhookHandler(rr, r)
+
+	// Webhook must not be acknowledged if it could not be persisted
+	assert.Equal(t, http.StatusInternalServerError, rr.Result().StatusCode)
+}
+
 type MockFailStore struct{}
 
 func (s MockFailStore) Ping() error                                   { return errors.New("OH NO") }
 func (s MockFailStore) WriteUser(user store.User) error               { return errors.New("OH NO") }
 func (s MockFailStore) GetUser(id string) *store.User                 { panic(errors.New("OH NO")) }
 func (s MockFailStore) GetUserByUsername(username string) *store.User { panic(errors.New("OH NO")) }
+func (s MockFailStore) GetUserByWebhookSecret(secret string) *store.User {
+	panic(errors.New("OH NO"))
+}
+func (s MockFailStore) GetUsersByPlexAccount(id, name string) []*store.User {
+	panic(errors.New("OH NO"))
+}
+func (s MockFailStore) ListUsers() []*store.User                      { panic(errors.New("OH NO")) }
 func (s MockFailStore) DeleteUser(id string) bool                     { return false }
+func (s MockFailStore) WriteJob(job store.Job) error                  { return errors.New("OH NO") }
+func (s MockFailStore) GetJobs() []store.Job                          { panic(errors.New("OH NO")) }
+func (s MockFailStore) DeleteJob(id string) bool                      { return false }
+func (s MockFailStore) WriteHistory(entry store.HistoryEntry) error   { return errors.New("OH NO") }
+func (s MockFailStore) GetHistory(userID string) []store.HistoryEntry { panic(errors.New("OH NO")) }
+func (s MockFailStore) WriteCollected(userID string, items []store.CollectedItem) error {
+	return errors.New("OH NO")
+}
+func (s MockFailStore) GetCollected(userID string) []store.CollectedItem { panic(errors.New("OH NO")) }
+func (s MockFailStore) DeleteCollected(userID string, items []store.CollectedItem) error {
+	return errors.New("OH NO")
+}
+func (s MockFailStore) GetCache(key string) ([]byte, bool) { return nil, false }
+func (s MockFailStore) WriteCache(key string, value []byte, ttl time.Duration) error {
+	return errors.New("OH NO")
+}
 
 func TestHealthcheck(t *testing.T) {
 	var rr *httptest.ResponseRecorder
@@ -166,19 +752,59 @@ func TestHealthcheck(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	api := New(&MockSuccessStore{}, fstest.MapFS{"static/index.html": {Data: []byte("TEST")}})
+	api := New(&MockSuccessStore{}, fstest.MapFS{"static/index.html": {Data: []byte("TEST")}}, trakt.NewClient())
 	rr = httptest.NewRecorder()
 	http.Handler(api.HealthcheckHandler()).ServeHTTP(rr, r)
 	assert.Equal(t, http.StatusOK, rr.Result().StatusCode)
 	assert.Equal(t, "{\"status\":\"OK\"}\n", rr.Body.String())
 
-	apiFail := New(&MockFailStore{}, fstest.MapFS{"static/index.html": {Data: []byte("TEST")}})
+	apiFail := New(&MockFailStore{}, fstest.MapFS{"static/index.html": {Data: []byte("TEST")}}, trakt.NewClient())
 	rr = httptest.NewRecorder()
 	http.Handler(apiFail.HealthcheckHandler()).ServeHTTP(rr, r)
 	assert.Equal(t, http.StatusServiceUnavailable, rr.Result().StatusCode)
 	assert.Equal(t, "{\"status\":\"Service Unavailable\",\"errors\":{\"storage\":\"OH NO\"}}\n", rr.Body.String())
 }
 
+func TestRateLimitHandler(t *testing.T) {
+	os.RemoveAll("keystore")
+	defer os.RemoveAll("keystore")
+
+	storage := store.NewDiskStore()
+	user := store.NewUser("traktuser", "access", "refresh", 3600, time.Now().Unix(), storage)
+	api := New(storage, fstest.MapFS{"static/index.html": {Data: []byte("TEST")}}, trakt.NewClient())
+
+	// Only signed in users can see the limits
+	rr := httptest.NewRecorder()
+	api.RateLimitHandler(rr, httptest.NewRequest("GET", "/api/ratelimit", nil))
+	assert.Equal(t, http.StatusUnauthorized, rr.Result().StatusCode)
+
+	r := httptest.NewRequest("GET", "/api/ratelimit", nil)
+	r.AddCookie(sessionCookie(t, api, user.ID))
+	rr = httptest.NewRecorder()
+	api.RateLimitHandler(rr, r)
+	assert.Equal(t, http.StatusOK, rr.Result().StatusCode)
+	assert.JSONEq(t, `{"rate":2,"burst":5,"throttled":0,"limits":[]}`, rr.Body.String())
+}
+
+func TestPollAuth(t *testing.T) {
+	statuses := map[string]int{"pending": 400, "invalid": 404, "used": 409, "expired": 410, "locked": 423}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var values map[string]string
+		json.NewDecoder(r.Body).Decode(&values)
+		w.WriteHeader(statuses[values["code"]])
+	}))
+	defer server.Close()
+
+	client := trakt.NewClient(trakt.WithBaseURL(server.URL), trakt.WithRetryPolicy(trakt.RetryPolicy{Attempts: 1}))
+	api := New(&MockSuccessStore{}, fstest.MapFS{"static/index.html": {Data: []byte("TEST")}}, client)
+
+	for code, want := range map[string]int{"pending": 202, "invalid": 404, "used": 409, "expired": 410, "locked": 400} {
+		rr := httptest.NewRecorder()
+		api.PollAuth(rr, httptest.NewRequest("GET", "/auth/poll?device_code="+code, nil))
+		assert.Equal(t, want, rr.Result().StatusCode, code)
+	}
+}
+
 type SpyStore struct {
 	MockSuccessStore
 	DeletedUsers []string
@@ -191,11 +817,11 @@ func (s *SpyStore) DeleteUser(id string) bool {
 
 func TestLogoutHandler(t *testing.T) {
 	spyStore := &SpyStore{}
-	api := New(spyStore, fstest.MapFS{"static/index.html": {Data: []byte("TEST")}})
+	api := New(spyStore, fstest.MapFS{"static/index.html": {Data: []byte("TEST")}}, trakt.NewClient())
 
 	// 1. Valid Logout
 	r, _ := http.NewRequest("POST", "/logout", nil)
-	r.AddCookie(&http.Cookie{Name: "goplaxt_user", Value: "user123"})
+	r.AddCookie(sessionCookie(t, api, "user123"))
 	rr := httptest.NewRecorder()
 
 	api.LogoutHandler(rr, r)
@@ -208,7 +834,7 @@ func TestLogoutHandler(t *testing.T) {
 	assert.NotEmpty(t, cookies)
 	found := false
 	for _, c := range cookies {
-		if c.Name == "goplaxt_user" {
+		if c.Name == CookieName {
 			found = true
 			assert.Equal(t, "", c.Value)
 			assert.True(t, c.Expires.Before(time.Now())) // Should be expired
@@ -235,3 +861,553 @@ func TestLogoutHandler(t *testing.T) {
 	// Should not delete anything
 	assert.Equal(t, 1, len(spyStore.DeletedUsers)) // Count same as before
 }
+
+// sessionCookie returns a signed session cookie for a stored user
+func sessionCookie(t *testing.T, api *API, userID string) *http.Cookie {
+	user := api.Storage.GetUser(userID)
+	if user == nil {
+		t.Fatalf("user %s not found", userID)
+	}
+	token, err := api.newSessionToken(user, time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &http.Cookie{Name: CookieName, Value: token}
+}
+
+func TestSession(t *testing.T) {
+	api := New(&MockSuccessStore{}, fstest.MapFS{"static/index.html": {Data: []byte("TEST")}}, trakt.NewClient())
+	user := api.Storage.GetUser("user123")
+
+	token, err := api.newSessionToken(user, time.Now().Add(time.Hour))
+	assert.NoError(t, err)
+	s, err := api.parseSessionToken(token)
+	assert.NoError(t, err)
+	assert.Equal(t, "user123", s.UserID)
+
+	// Tokens are unique per login
+	other, _ := api.newSessionToken(user, time.Now().Add(time.Hour))
+	assert.NotEqual(t, token, other)
+
+	// Tampered, unsigned and expired tokens are rejected
+	_, err = api.parseSessionToken(token + "x")
+	assert.Error(t, err)
+	_, err = api.parseSessionToken("user123")
+	assert.Error(t, err)
+	expired, _ := api.newSessionToken(user, time.Now().Add(-time.Minute))
+	_, err = api.parseSessionToken(expired)
+	assert.Error(t, err)
+
+	// Tokens signed with another key are rejected
+	otherAPI := New(&MockSuccessStore{}, fstest.MapFS{"static/index.html": {Data: []byte("TEST")}}, trakt.NewClient())
+	otherAPI.sessionKey = []byte("another key")
+	_, err = otherAPI.parseSessionToken(token)
+	assert.Error(t, err)
+
+	// The raw user ID is no longer accepted from the cookie or the query string
+	for _, r := range []*http.Request{
+		httptest.NewRequest("GET", "/api/history?id=user123", nil),
+		httptest.NewRequest("GET", "/api/history", nil),
+	} {
+		r.AddCookie(&http.Cookie{Name: CookieName, Value: "user123"})
+		assert.Nil(t, api.sessionUser(r))
+	}
+
+	r := httptest.NewRequest("GET", "/", nil)
+	r.AddCookie(&http.Cookie{Name: CookieName, Value: token})
+	assert.NotNil(t, api.sessionUser(r))
+}
+
+func TestLogoutOthersHandler(t *testing.T) {
+	os.RemoveAll("keystore")
+	defer os.RemoveAll("keystore")
+
+	storage := store.NewDiskStore()
+	user := store.NewUser("traktuser", "access", "refresh", 3600, time.Now().Unix(), storage)
+	api := New(storage, fstest.MapFS{"static/index.html": {Data: []byte("TEST")}}, trakt.NewClient())
+
+	thisDevice := sessionCookie(t, api, user.ID)
+	otherDevice := sessionCookie(t, api, user.ID)
+
+	r := httptest.NewRequest("POST", "/logout/others", nil)
+	r.AddCookie(thisDevice)
+	rr := httptest.NewRecorder()
+	api.LogoutOthersHandler(rr, r)
+	assert.Equal(t, http.StatusSeeOther, rr.Result().StatusCode)
+
+	// Both old sessions are revoked
+	for _, cookie := range []*http.Cookie{thisDevice, otherDevice} {
+		r = httptest.NewRequest("GET", "/", nil)
+		r.AddCookie(cookie)
+		assert.Nil(t, api.sessionUser(r))
+	}
+
+	// This device received a fresh session
+	var renewed *http.Cookie
+	for _, c := range rr.Result().Cookies() {
+		if c.Name == CookieName {
+			renewed = c
+		}
+	}
+	if assert.NotNil(t, renewed) {
+		r = httptest.NewRequest("GET", "/", nil)
+		r.AddCookie(renewed)
+		found := api.sessionUser(r)
+		assert.NotNil(t, found)
+		assert.Equal(t, user.ID, found.ID)
+	}
+}
+
+func TestRefreshExpiringTokens(t *testing.T) {
+	os.RemoveAll("keystore")
+	defer os.RemoveAll("keystore")
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var values map[string]string
+		json.NewDecoder(r.Body).Decode(&values)
+		switch values["refresh_token"] {
+		case "good":
+			w.Write([]byte(`{"access_token": "new-access", "refresh_token": "new-refresh", "expires_in": 86400, "created_at": ` + strconv.FormatInt(time.Now().Unix(), 10) + `}`))
+		case "revoked":
+			w.WriteHeader(http.StatusUnauthorized)
+			w.Write([]byte(`{"error": "invalid_grant"}`))
+		case "expired":
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"error": "invalid_grant", "error_description": "The provided authorization grant is invalid"}`))
+		case "misconfigured":
+			w.WriteHeader(http.StatusUnauthorized)
+			w.Write([]byte(`{"error": "invalid_client"}`))
+		default:
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer server.Close()
+
+	storage := store.NewDiskStore()
+	client := trakt.NewClient(trakt.WithBaseURL(server.URL), trakt.WithRetryPolicy(trakt.RetryPolicy{Attempts: 1}))
+	api := New(storage, fstest.MapFS{"static/index.html": {Data: []byte("TEST")}}, client)
+
+	now := time.Now().Unix()
+	expiring := store.NewUser("expiring", "access", "good", 3600, now, storage)
+	later := store.NewUser("later", "access", "good", 30*86400, now, storage)
+	revoked := store.NewUser("revoked", "access", "revoked", 3600, now, storage)
+	flaky := store.NewUser("flaky", "access", "flaky", 3600, now, storage)
+	expired := store.NewUser("expired", "access", "expired", 3600, now, storage)
+	misconfigured := store.NewUser("misconfigured", "access", "misconfigured", 3600, now, storage)
+
+	api.refreshExpiringTokens(context.Background(), time.Now().Add(tokenRefreshWindow))
+
+	// Tokens close to expiry are refreshed
+	user := storage.GetUser(expiring.ID)
+	assert.Equal(t, "new-access", user.AccessToken)
+	assert.Equal(t, "new-refresh", user.RefreshToken)
+	assert.Empty(t, storage.GetHistory(expiring.ID))
+	assert.Equal(t, "access", storage.GetUser(later.ID).AccessToken)
+
+	// Only a refresh token Trakt rejects as invalid_grant clears the user's tokens
+	for _, id := range []string{revoked.ID, expired.ID} {
+		user = storage.GetUser(id)
+		assert.Empty(t, user.AccessToken)
+		assert.Empty(t, user.RefreshToken)
+	}
+	for _, id := range []string{flaky.ID, misconfigured.ID} {
+		user = storage.GetUser(id)
+		assert.Equal(t, "access", user.AccessToken)
+		assert.NotEmpty(t, user.RefreshToken)
+	}
+	if history := storage.GetHistory(misconfigured.ID); assert.Len(t, history, 1) {
+		assert.Equal(t, store.OutcomeFailed, history[0].Outcome)
+		assert.Contains(t, history[0].Detail, "invalid_client")
+	}
+
+	// Failures are recorded in the user's history
+	history := storage.GetHistory(flaky.ID)
+	if assert.Len(t, history, 1) {
+		assert.Equal(t, eventTokenRefresh, history[0].Event)
+		assert.Equal(t, store.OutcomeFailed, history[0].Outcome)
+		assert.Contains(t, history[0].Detail, "server error: 503")
+	}
+	assert.Len(t, storage.GetHistory(revoked.ID), 1)
+
+	// Cleared tokens are not retried
+	api.refreshExpiringTokens(context.Background(), time.Now().Add(tokenRefreshWindow))
+	assert.Len(t, storage.GetHistory(revoked.ID), 1)
+	assert.Len(t, storage.GetHistory(flaky.ID), 2)
+}
+
+func TestRejectedTokenRetried(t *testing.T) {
+	os.RemoveAll("keystore")
+	defer os.RemoveAll("keystore")
+
+	var scrobbles []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/oauth/token":
+			w.Write([]byte(`{"access_token": "new-access", "refresh_token": "new-refresh", "expires_in": 86400, "created_at": ` + strconv.FormatInt(time.Now().Unix(), 10) + `}`))
+		case strings.HasPrefix(r.URL.Path, "/search/"):
+			w.Write([]byte(`[{"movie":{"title":"Inception","year":2010,"ids":{"trakt":1}}}]`))
+		case r.URL.Path == "/scrobble/stop":
+			auth := r.Header.Get("Authorization")
+			scrobbles = append(scrobbles, auth)
+			if auth != "Bearer new-access" {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			w.WriteHeader(http.StatusCreated)
+			w.Write([]byte(`{}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	storage := store.NewDiskStore()
+	client := trakt.NewClient(trakt.WithBaseURL(server.URL), trakt.WithRetryPolicy(trakt.RetryPolicy{Attempts: 1}))
+	api := New(storage, fstest.MapFS{"static/index.html": {Data: []byte("TEST")}}, client)
+	user := store.NewUser("traktuser", "revoked-access", "refresh", 3600, time.Now().Unix(), storage)
+	user.UpdateConfiguration(store.Config{}, "traktuser", nil)
+
+	payload, err := json.Marshal(media.MediaEvent{Event: media.EventStop, Kind: media.KindMovie, Title: "Inception", Progress: 95, Account: media.Account{Name: "traktuser"}})
+	assert.NoError(t, err)
+	job := store.NewJob(user.ID, payload)
+
+	// A rejected access token is retried rather than dead-lettered, once it is marked for refresh
+	err = api.processJob(context.Background(), job)
+	assert.ErrorIs(t, err, trakt.ErrInvalidToken)
+	assert.False(t, queue.IsPermanent(err))
+	assert.True(t, storage.GetUser(user.ID).TokenExpiresAt.IsZero())
+
+	// The retry refreshes the token and succeeds
+	assert.NoError(t, api.processJob(context.Background(), job))
+	assert.Equal(t, []string{"Bearer revoked-access", "Bearer new-access"}, scrobbles)
+	assert.Equal(t, "new-access", storage.GetUser(user.ID).AccessToken)
+	if history := storage.GetHistory(user.ID); assert.Len(t, history, 2) {
+		assert.Equal(t, store.OutcomeSuccess, history[0].Outcome)
+		assert.Equal(t, store.OutcomeFailed, history[1].Outcome)
+	}
+}
+
+func TestNotFoundSkipped(t *testing.T) {
+	os.RemoveAll("keystore")
+	defer os.RemoveAll("keystore")
+
+	stub := newTraktStub()
+	defer stub.Close()
+
+	storage := store.NewDiskStore()
+	api := New(storage, fstest.MapFS{"static/index.html": {Data: []byte("TEST")}}, stub.Client())
+	user := store.NewUser("traktuser", "access", "refresh", 3600, time.Now().Unix(), storage)
+	user.UpdateConfiguration(store.Config{}, "traktuser", nil)
+
+	payload, err := json.Marshal(media.MediaEvent{Event: media.EventStop, Kind: media.KindMovie, Title: "Unknown", Progress: 95, Account: media.Account{Name: "traktuser"}})
+	assert.NoError(t, err)
+
+	// Retrying won't find an item Trakt doesn't have, so the job is done and recorded as skipped
+	assert.NoError(t, api.processJob(context.Background(), store.NewJob(user.ID, payload)))
+	assert.Empty(t, stub.Synced())
+	if history := storage.GetHistory(user.ID); assert.Len(t, history, 1) {
+		assert.Equal(t, store.OutcomeSkipped, history[0].Outcome)
+		assert.Equal(t, "could not find movie on Trakt", history[0].Detail)
+	}
+}
+
+func TestConfigHandler(t *testing.T) {
+	os.RemoveAll("keystore")
+	defer os.RemoveAll("keystore")
+
+	storage := store.NewDiskStore()
+	user := store.NewUser("traktuser", "access", "refresh", 3600, time.Now().Unix(), storage)
+	api := New(storage, fstest.MapFS{"static/index.html": {Data: []byte("TEST")}}, trakt.NewClient())
+	cookie := sessionCookie(t, api, user.ID)
+
+	post := func(form url.Values) int {
+		r := httptest.NewRequest("POST", "/config", strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		r.AddCookie(cookie)
+		rr := httptest.NewRecorder()
+		api.ConfigHandler(rr, r)
+		return rr.Result().StatusCode
+	}
+	save := func(form url.Values) store.Config {
+		assert.Equal(t, http.StatusSeeOther, post(form))
+		return storage.GetUser(user.ID).Config
+	}
+
+	// Defaults apply until the scrobble settings are saved
+	config := save(url.Values{"movie_rate": {"on"}})
+	assert.True(t, config.GetMovieRate())
+	assert.False(t, config.GetMovieCollectionRemove())
+	assert.False(t, config.GetEpisodeCollectionRemove())
+	assert.False(t, config.GetLibraryReconcile())
+	assert.Equal(t, store.DefaultWatchedThreshold, config.GetWatchedThreshold())
+	assert.Equal(t, store.DefaultMinProgress, config.GetMinProgress())
+	assert.True(t, config.GetUseScrobbleEvent())
+
+	config = save(url.Values{"scrobble_settings": {"1"}, "watched_threshold": {"85"}, "min_progress": {"5"}})
+	assert.Equal(t, 85, config.GetWatchedThreshold())
+	assert.Equal(t, 5, config.GetMinProgress())
+	assert.False(t, config.GetUseScrobbleEvent())
+
+	// Out of range values are ignored
+	config = save(url.Values{"scrobble_settings": {"1"}, "watched_threshold": {"50"}, "min_progress": {"abc"}, "use_scrobble_event": {"on"}})
+	assert.Equal(t, 85, config.GetWatchedThreshold())
+	assert.Equal(t, 5, config.GetMinProgress())
+	assert.True(t, config.GetUseScrobbleEvent())
+
+	config = save(url.Values{"filter_settings": {"1"}, "libraries_exclude": {"Home Videos\r\n\r\n Kids \n"}, "media_types_include": {"movie"}})
+	assert.Equal(t, []string{"Home Videos", "Kids"}, config.Libraries.Exclude)
+	assert.Equal(t, []string{"movie"}, config.MediaTypes.Include)
+	assert.True(t, config.Servers.IsEmpty())
+	assert.Equal(t, store.PlayerLocationAny, config.PlayerLocation)
+
+	config = save(url.Values{"filter_settings": {"1"}, "players_exclude": {"Kids Tablet"}, "player_location": {"remote"}})
+	assert.Equal(t, []string{"Kids Tablet"}, config.Players.Exclude)
+	assert.Equal(t, store.PlayerLocationRemote, config.PlayerLocation)
+	assert.True(t, config.Libraries.IsEmpty())
+	config = save(url.Values{"filter_settings": {"1"}, "libraries_exclude": {"Home Videos\nKids"}, "media_types_include": {"movie"}, "player_location": {"moon"}})
+	assert.Equal(t, store.PlayerLocationAny, config.PlayerLocation)
+
+	save(url.Values{"account_settings": {"1"}, "plex_accounts": {"Dad-Bedroom\n 12345 \n"}})
+	assert.Equal(t, []string{"Dad-Bedroom", "12345"}, storage.GetUser(user.ID).PlexAccounts)
+
+	// The setup wizard leaves them alone
+	config = save(url.Values{"episode_rate": {"on"}})
+	assert.Equal(t, 85, config.GetWatchedThreshold())
+	assert.Equal(t, []string{"Home Videos", "Kids"}, config.Libraries.Exclude)
+	assert.False(t, config.GetMovieRate())
+	assert.Equal(t, []string{"Dad-Bedroom", "12345"}, storage.GetUser(user.ID).PlexAccounts)
+
+	// The server webhook routes each account to the users who list it, so accounts can't be claimed twice
+	family := store.NewUser("family", "access", "refresh", 3600, time.Now().Unix(), storage)
+	family.UpdateConfiguration(store.Config{}, "Family", []string{"Kids", "67890"})
+	assert.Equal(t, http.StatusConflict, post(url.Values{"account_settings": {"1"}, "plex_accounts": {"Dad-Bedroom\nkids"}}))
+	assert.Equal(t, http.StatusConflict, post(url.Values{"account_settings": {"1"}, "plex_accounts": {"67890"}}))
+	assert.Equal(t, http.StatusConflict, post(url.Values{"plex_username": {"FAMILY"}}))
+	assert.Equal(t, []string{"Dad-Bedroom", "12345"}, storage.GetUser(user.ID).PlexAccounts)
+	assert.Equal(t, "traktuser", storage.GetUser(user.ID).PlexUsername)
+}
+
+func TestFilterEvent(t *testing.T) {
+	user := &store.User{ID: "user123", Config: store.Config{
+		Libraries:  store.Rules{Exclude: []string{"home videos", "7"}},
+		Servers:    store.Rules{Include: []string{"server-1", "Living Room"}},
+		MediaTypes: store.Rules{Exclude: []string{"episode"}},
+	}}
+	movie := media.MediaEvent{
+		Kind:    media.KindMovie,
+		Library: media.Library{ID: "1", Name: "Movies"},
+		Server:  media.Server{Name: "My Server", UUID: "server-1"},
+	}
+	assert.Equal(t, "", filterEvent(user, movie))
+
+	excluded := movie
+	excluded.Library = media.Library{ID: "3", Name: "Home Videos"}
+	assert.Equal(t, "library filtered (exclude home videos)", filterEvent(user, excluded))
+	excluded.Library = media.Library{ID: "7", Name: "Kids"}
+	assert.Equal(t, "library filtered (exclude 7)", filterEvent(user, excluded))
+
+	friend := movie
+	friend.Server = media.Server{Name: "Friend", UUID: "server-2"}
+	assert.Equal(t, "server filtered (not included)", filterEvent(user, friend))
+	friend.Server.Name = "living room"
+	assert.Equal(t, "", filterEvent(user, friend))
+
+	episode := movie
+	episode.Kind = media.KindEpisode
+	assert.Equal(t, "media type filtered (exclude episode)", filterEvent(user, episode))
+
+	// Player rules
+	user.Config = store.Config{
+		Players:         store.Rules{Exclude: []string{"Kids Tablet", "tv-uuid"}},
+		PlayerAddresses: store.Rules{Include: []string{"203.0.113.7"}},
+		PlayerLocation:  store.PlayerLocationLocal,
+	}
+	movie.Player = media.Player{Name: "Shield", UUID: "shield-uuid", Local: true, Address: "203.0.113.7"}
+	assert.Equal(t, "", filterEvent(user, movie))
+
+	tablet := movie
+	tablet.Player.Name = "kids tablet"
+	assert.Equal(t, "player filtered (exclude Kids Tablet)", filterEvent(user, tablet))
+	tablet.Player = media.Player{Name: "Living Room", UUID: "tv-uuid", Local: true, Address: "203.0.113.7"}
+	assert.Equal(t, "player filtered (exclude tv-uuid)", filterEvent(user, tablet))
+
+	away := movie
+	away.Player.Address = "198.51.100.1"
+	assert.Equal(t, "player address filtered (not included)", filterEvent(user, away))
+	away.Player.Address = "203.0.113.7"
+	away.Player.Local = false
+	assert.Equal(t, "player filtered (remote)", filterEvent(user, away))
+}
+
+func TestTryRecoverUser(t *testing.T) {
+	os.RemoveAll("keystore")
+	defer os.RemoveAll("keystore")
+
+	storage := store.NewDiskStore()
+	lost := store.NewUser("traktuser", "access", "refresh", 3600, time.Now().Unix(), storage)
+	api := New(storage, fstest.MapFS{"static/index.html": {Data: []byte("TEST")}}, trakt.NewClient())
+	cookie := sessionCookie(t, api, lost.ID)
+	storage.DeleteUser(lost.ID)
+
+	// An unsigned cookie cannot claim a user ID
+	r := httptest.NewRequest("GET", "/api/auth/device/poll", nil)
+	r.AddCookie(&http.Cookie{Name: CookieName, Value: lost.ID})
+	assert.Nil(t, api.tryRecoverUser(r, "traktuser", "access", "refresh", 3600, time.Now().Unix()))
+
+	// A session signed by this server restores the user under the same ID
+	r = httptest.NewRequest("GET", "/api/auth/device/poll", nil)
+	r.AddCookie(cookie)
+	recovered := api.tryRecoverUser(r, "traktuser", "access", "refresh", 3600, time.Now().Unix())
+	if assert.NotNil(t, recovered) {
+		assert.Equal(t, lost.ID, recovered.ID)
+	}
+}
+
+func TestCSRFHandler(t *testing.T) {
+	api := New(&MockSuccessStore{}, fstest.MapFS{"static/index.html": {Data: []byte("TEST")}}, trakt.NewClient())
+	h := api.CSRFHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	cookie := sessionCookie(t, api, "user123")
+	withSession := httptest.NewRequest("GET", "/", nil)
+	withSession.AddCookie(cookie)
+	token := api.csrfToken(withSession)
+	assert.NotEmpty(t, token)
+
+	send := func(r *http.Request) int {
+		rr := httptest.NewRecorder()
+		h.ServeHTTP(rr, r)
+		return rr.Result().StatusCode
+	}
+
+	// Safe methods are not checked
+	assert.Equal(t, http.StatusOK, send(httptest.NewRequest("GET", "/", nil)))
+
+	// Missing token
+	r := httptest.NewRequest("POST", "/logout", nil)
+	r.AddCookie(cookie)
+	assert.Equal(t, http.StatusForbidden, send(r))
+
+	// Form field
+	r = httptest.NewRequest("POST", "/logout", strings.NewReader("csrf_token="+token))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	r.AddCookie(cookie)
+	assert.Equal(t, http.StatusOK, send(r))
+
+	// Header
+	r = httptest.NewRequest("POST", "/api/webhook/rotate", nil)
+	r.Header.Set("X-CSRF-Token", token)
+	r.AddCookie(cookie)
+	assert.Equal(t, http.StatusOK, send(r))
+
+	// A token is only valid for the session it was issued to
+	r = httptest.NewRequest("POST", "/logout", nil)
+	r.Header.Set("X-CSRF-Token", token)
+	r.AddCookie(sessionCookie(t, api, "user123"))
+	assert.Equal(t, http.StatusForbidden, send(r))
+
+	// No session
+	r = httptest.NewRequest("POST", "/logout", nil)
+	r.Header.Set("X-CSRF-Token", token)
+	assert.Equal(t, http.StatusForbidden, send(r))
+}
+
+type MockDeadJobStore struct {
+	MockSuccessStore
+}
+
+func (s MockDeadJobStore) GetJobs() []store.Job {
+	return []store.Job{
+		{ID: "job1", UserID: "user123", Payload: []byte(`{"event":"media.scrobble","Metadata":{"type":"movie","title":"Inception"}}`), Attempts: 12, LastError: "server error: 503", Dead: true},
+		{ID: "job2", UserID: "user123", Payload: []byte(`{"event":"media.play"}`), Attempts: 1},
+		{ID: "job3", UserID: "other", Payload: []byte(`{"event":"media.rate"}`), Dead: true},
+	}
+}
+
+func TestDeadJobsHandler(t *testing.T) {
+	api := New(&MockDeadJobStore{}, fstest.MapFS{"static/index.html": {Data: []byte("TEST")}}, trakt.NewClient())
+
+	// Only the user's own dead jobs are listed
+	r, _ := http.NewRequest("GET", "/api/jobs/failed", nil)
+	r.AddCookie(sessionCookie(t, api, "user123"))
+	rr := httptest.NewRecorder()
+	api.DeadJobsHandler(rr, r)
+	assert.Equal(t, http.StatusOK, rr.Result().StatusCode)
+	assert.Contains(t, rr.Body.String(), `"id":"job1"`)
+	assert.Contains(t, rr.Body.String(), `"title":"Inception"`)
+	assert.NotContains(t, rr.Body.String(), "job2")
+	assert.NotContains(t, rr.Body.String(), "job3")
+
+	// Another user's job cannot be requeued
+	r, _ = http.NewRequest("POST", "/api/jobs/failed/job3/retry", nil)
+	r.SetPathValue("id", "job3")
+	r.AddCookie(sessionCookie(t, api, "user123"))
+	rr = httptest.NewRecorder()
+	api.RequeueJobHandler(rr, r)
+	assert.Equal(t, http.StatusNotFound, rr.Result().StatusCode)
+
+	r, _ = http.NewRequest("POST", "/api/jobs/failed/job1/retry", nil)
+	r.SetPathValue("id", "job1")
+	r.AddCookie(sessionCookie(t, api, "user123"))
+	rr = httptest.NewRecorder()
+	api.RequeueJobHandler(rr, r)
+	assert.Equal(t, http.StatusAccepted, rr.Result().StatusCode)
+
+	// Anonymous requests are rejected
+	r, _ = http.NewRequest("GET", "/api/jobs/failed", nil)
+	rr = httptest.NewRecorder()
+	api.DeadJobsHandler(rr, r)
+	assert.Equal(t, http.StatusUnauthorized, rr.Result().StatusCode)
+}
+
+type HistorySpyStore struct {
+	MockSuccessStore
+	Entries []store.HistoryEntry
+}
+
+func (s *HistorySpyStore) WriteHistory(entry store.HistoryEntry) error {
+	s.Entries = append([]store.HistoryEntry{entry}, s.Entries...)
+	return nil
+}
+
+func (s *HistorySpyStore) GetHistory(userID string) []store.HistoryEntry {
+	return s.Entries
+}
+
+func TestHistory(t *testing.T) {
+	spyStore := &HistorySpyStore{}
+	api := New(spyStore, fstest.MapFS{"static/index.html": {Data: []byte("TEST")}}, trakt.NewClient())
+
+	event := media.MediaEvent{
+		Event:     media.EventScrobble,
+		Kind:      media.KindEpisode,
+		Title:     "Who Is Alive?",
+		ShowTitle: "Severance",
+		Season:    2,
+		Episode:   3,
+	}
+	api.recordHistory("user123", event, trakt.Result{Action: "scrobble/stop", Ids: trakt.Ids{Trakt: 12103029}}, nil)
+	api.recordHistory("user123", media.MediaEvent{Event: media.EventPlay}, trakt.Result{Skipped: "start scrobble disabled"}, nil)
+	api.recordHistory("user123", media.MediaEvent{Event: media.EventRate}, trakt.Result{Action: "ratings"}, errors.New("trakt api returned bad status: 422"))
+
+	assert.Len(t, spyStore.Entries, 3)
+	assert.Equal(t, store.OutcomeFailed, spyStore.Entries[0].Outcome)
+	assert.Equal(t, "trakt api returned bad status: 422", spyStore.Entries[0].Detail)
+	assert.Equal(t, store.OutcomeSkipped, spyStore.Entries[1].Outcome)
+	assert.Equal(t, "start scrobble disabled", spyStore.Entries[1].Detail)
+	assert.Equal(t, store.OutcomeSuccess, spyStore.Entries[2].Outcome)
+	assert.Equal(t, "Severance S02E03 - Who Is Alive?", spyStore.Entries[2].Title)
+	assert.Equal(t, 12103029, spyStore.Entries[2].TraktIDs.Trakt)
+
+	r, _ := http.NewRequest("GET", "/api/history", nil)
+	r.AddCookie(sessionCookie(t, api, "user123"))
+	rr := httptest.NewRecorder()
+	api.HistoryHandler(rr, r)
+	assert.Equal(t, http.StatusOK, rr.Result().StatusCode)
+	assert.Contains(t, rr.Body.String(), `"action":"scrobble/stop"`)
+	assert.Contains(t, rr.Body.String(), `"trakt":12103029`)
+
+	r, _ = http.NewRequest("GET", "/api/history", nil)
+	rr = httptest.NewRecorder()
+	api.HistoryHandler(rr, r)
+	assert.Equal(t, http.StatusUnauthorized, rr.Result().StatusCode)
+}
@@ -9,8 +9,12 @@ import (
 )
 
 const (
-	// CookieName is the name of the persistent user session cookie
-	CookieName = "goplaxt_user"
+	// CookieName is the name of the signed user session cookie
+	CookieName = "goplaxt_session"
+
+	// csrfField and csrfHeader carry the CSRF token on state-changing requests
+	csrfField  = "csrf_token"
+	csrfHeader = "X-CSRF-Token"
 )
 
 // Pre-compiled regex for hostname validation
@@ -37,13 +41,13 @@ func (a *API) isSecure(r *http.Request) bool {
 	return r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https"
 }
 
-// setCookie sets a persistent user cookie
-func (a *API) setCookie(w http.ResponseWriter, r *http.Request, userID string) {
+// setCookie sets the user session cookie
+func (a *API) setCookie(w http.ResponseWriter, r *http.Request, value string, expires time.Time) {
 	http.SetCookie(w, &http.Cookie{
 		Name:     CookieName,
-		Value:    userID,
+		Value:    value,
 		Path:     "/",
-		Expires:  time.Now().Add(365 * 24 * time.Hour),
+		Expires:  expires,
 		HttpOnly: true,
 		SameSite: http.SameSiteLaxMode,
 		Secure:   a.isSecure(r),
@@ -63,19 +67,6 @@ func (a *API) clearCookie(w http.ResponseWriter, r *http.Request) {
 	})
 }
 
-// getUserIDFromRequest gets user ID from query params or cookie
-func getUserIDFromRequest(r *http.Request) string {
-	// Check query params first (legacy)
-	if id := r.URL.Query().Get("id"); id != "" {
-		return id
-	}
-	// Check cookie
-	if cookie, err := r.Cookie(CookieName); err == nil {
-		return cookie.Value
-	}
-	return ""
-}
-
 // tokenResponse is the typed structure for Trakt OAuth responses
 type tokenResponse struct {
 	AccessToken  string `json:"access_token"`
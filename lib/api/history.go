@@ -0,0 +1,78 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/viscerous/goplaxt/lib/media"
+	"github.com/viscerous/goplaxt/lib/store"
+	"github.com/viscerous/goplaxt/lib/trakt"
+)
+
+// recordHistory stores the outcome of a processed webhook in the user's history
+func (a *API) recordHistory(userID string, event media.MediaEvent, result trakt.Result, err error) {
+	entry := store.HistoryEntry{
+		UserID: userID,
+		Time:   time.Now().UTC(),
+		Event:  event.Event,
+		Title:  describeMedia(event),
+		Action: result.Action,
+		TraktIDs: store.TraktIDs{
+			Trakt: result.Ids.Trakt,
+			Imdb:  result.Ids.Imdb,
+			Tmdb:  result.Ids.Tmdb,
+			Tvdb:  result.Ids.Tvdb,
+		},
+	}
+
+	switch {
+	case err != nil:
+		entry.Outcome = store.OutcomeFailed
+		entry.Detail = err.Error()
+	case result.Skipped != "":
+		entry.Outcome = store.OutcomeSkipped
+		entry.Detail = result.Skipped
+	default:
+		entry.Outcome = store.OutcomeSuccess
+	}
+
+	if err := a.Storage.WriteHistory(entry); err != nil {
+		slog.Warn("Failed to record history", "user_id", userID, "error", err)
+	}
+}
+
+// describeMedia returns a human readable title for the item in an event
+func describeMedia(e media.MediaEvent) string {
+	switch e.Kind {
+	case media.KindEpisode:
+		return fmt.Sprintf("%s S%02dE%02d - %s", e.ShowTitle, e.Season, e.Episode, e.Title)
+	case media.KindSeason:
+		return fmt.Sprintf("%s - Season %d", e.ShowTitle, e.Season)
+	}
+	if e.Year > 0 {
+		return fmt.Sprintf("%s (%d)", e.Title, e.Year)
+	}
+	return e.Title
+}
+
+// HistoryHandler returns the current user's recently processed webhooks, newest first
+func (a *API) HistoryHandler(w http.ResponseWriter, r *http.Request) {
+	user := a.sessionUser(r)
+	if user == nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	entries := a.Storage.GetHistory(user.ID)
+	if entries == nil {
+		entries = []store.HistoryEntry{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(entries); err != nil {
+		slog.Error("Failed to encode history", "error", err)
+	}
+}
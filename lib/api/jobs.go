@@ -0,0 +1,72 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/viscerous/goplaxt/lib/media"
+	"github.com/viscerous/goplaxt/lib/queue"
+)
+
+// deadJob is the JSON view of a dead-lettered webhook
+type deadJob struct {
+	ID        string    `json:"id"`
+	Event     string    `json:"event"`
+	Title     string    `json:"title"`
+	Attempts  int       `json:"attempts"`
+	LastError string    `json:"last_error"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// DeadJobsHandler lists the current user's webhooks that failed permanently
+func (a *API) DeadJobsHandler(w http.ResponseWriter, r *http.Request) {
+	user := a.sessionUser(r)
+	if user == nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	jobs := []deadJob{}
+	for _, job := range a.Queue.DeadJobs(user.ID) {
+		entry := deadJob{
+			ID:        job.ID,
+			Attempts:  job.Attempts,
+			LastError: job.LastError,
+			CreatedAt: job.CreatedAt,
+		}
+		if event, err := media.Decode(job.Payload); err == nil {
+			entry.Event = event.Event
+			entry.Title = describeMedia(event)
+		}
+		jobs = append(jobs, entry)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(jobs); err != nil {
+		slog.Error("Failed to encode dead jobs", "error", err)
+	}
+}
+
+// RequeueJobHandler puts one of the current user's dead-lettered webhooks back on the queue
+func (a *API) RequeueJobHandler(w http.ResponseWriter, r *http.Request) {
+	user := a.sessionUser(r)
+	if user == nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	if err := a.Queue.Requeue(user.ID, r.PathValue("id")); err != nil {
+		if errors.Is(err, queue.ErrJobNotFound) {
+			http.Error(w, "Job not found", http.StatusNotFound)
+			return
+		}
+		slog.Error("Failed to requeue job", "user_id", user.ID, "job_id", r.PathValue("id"), "error", err)
+		http.Error(w, "Failed to requeue job", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+}
@@ -0,0 +1,163 @@
+package api
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	"github.com/viscerous/goplaxt/lib/media"
+	"github.com/viscerous/goplaxt/lib/store"
+	"github.com/viscerous/goplaxt/lib/trakt"
+)
+
+// addServerEpisodes lists the episodes Plex holds of a new show or season, so that
+// only those are collected. Without them, every aired episode is collected instead.
+func (a *API) addServerEpisodes(ctx context.Context, event *media.MediaEvent) {
+	if a.Plex == nil || event.Source != media.SourcePlex || event.Event != media.EventAdded || event.ItemID == "" {
+		return
+	}
+	if event.Kind != media.KindShow && event.Kind != media.KindSeason {
+		return
+	}
+	// The item ID is a rating key, which only identifies the item on the server that sent it
+	if !a.isPlexServer(ctx, event.Server.UUID) {
+		return
+	}
+
+	episodes, err := a.Plex.Episodes(ctx, event.ItemID)
+	if err != nil {
+		slog.Warn("Failed to list episodes on Plex, collecting aired episodes instead", "item_id", event.ItemID, "error", err)
+		return
+	}
+	event.Episodes = episodes
+}
+
+// isPlexServer reports whether events from the server with the given UUID come from the PLEX_URL server
+func (a *API) isPlexServer(ctx context.Context, uuid string) bool {
+	machineID, err := a.Plex.MachineIdentifier(ctx)
+	if err != nil {
+		slog.Warn("Failed to identify Plex server", "error", err)
+		return false
+	}
+	if uuid != machineID {
+		slog.Debug("Event is from another Plex server", "server_uuid", uuid, "plex_server", machineID)
+		return false
+	}
+	return true
+}
+
+const (
+	// reconcileInterval is how often collections are checked against the Plex library
+	reconcileInterval = 24 * time.Hour
+
+	// eventReconcile is the history event recorded when collections are checked against the Plex library
+	eventReconcile = "library.reconcile"
+)
+
+// StartLibraryReconcile regularly removes media deleted from Plex from the collections
+// of users who enabled library reconciliation, as Plex webhooks don't report deletions
+func (a *API) StartLibraryReconcile(ctx context.Context) {
+	if a.Plex == nil {
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(reconcileInterval)
+		defer ticker.Stop()
+
+		for {
+			a.reconcileLibrary(ctx)
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// reconcileLibrary checks the items every user who enabled reconciliation collected
+// from the Plex server against its library
+func (a *API) reconcileLibrary(ctx context.Context) {
+	var userIDs []string
+	for _, user := range a.Storage.ListUsers() {
+		if user.AccessToken != "" && user.Config.GetLibraryReconcile() {
+			userIDs = append(userIDs, user.ID)
+		}
+	}
+	if len(userIDs) == 0 {
+		return
+	}
+
+	machineID, err := a.Plex.MachineIdentifier(ctx)
+	if err != nil {
+		slog.Warn("Failed to identify Plex server, skipping collection reconciliation", "error", err)
+		return
+	}
+	held, err := a.Plex.Library(ctx)
+	if err != nil {
+		slog.Warn("Failed to read Plex library, skipping collection reconciliation", "error", err)
+		return
+	}
+	for _, userID := range userIDs {
+		if ctx.Err() != nil {
+			return
+		}
+		a.reconcileUser(ctx, userID, machineID, held)
+	}
+}
+
+// reconcileUser removes media the server no longer holds from a user's collection
+func (a *API) reconcileUser(ctx context.Context, userID, machineID string, held []media.LibraryItem) {
+	unlock := a.lockUser(userID)
+	defer unlock()
+
+	user := a.Storage.GetUser(userID)
+	if user == nil {
+		return
+	}
+	var collected []store.CollectedItem
+	for _, item := range a.Storage.GetCollected(user.ID) {
+		if item.Server == machineID {
+			collected = append(collected, item)
+		}
+	}
+	if len(collected) == 0 {
+		return
+	}
+
+	event := media.MediaEvent{Source: media.SourcePlex, Event: eventReconcile, Title: "Plex library"}
+	if err := a.EnsureToken(user); err != nil {
+		a.recordHistory(user.ID, event, trakt.Result{}, err)
+		return
+	}
+
+	result, removed, err := trakt.Reconcile(ctx, a.Trakt, held, collected, *user)
+	if err != nil {
+		slog.Warn("Collection reconciliation failed", "user_id", user.ID, "error", err)
+	} else if len(removed) > 0 {
+		if err := a.Storage.DeleteCollected(user.ID, removed); err != nil {
+			slog.Warn("Failed to forget removed collection items", "user_id", user.ID, "error", err)
+		}
+	}
+	if result.Title != "" {
+		event.Title += ": removed " + result.Title
+	}
+	a.recordHistory(user.ID, event, result, err)
+}
+
+// recordCollected remembers the items a Plex event from the PLEX_URL server collected,
+// so that library reconciliation can remove them once the server no longer holds them
+func (a *API) recordCollected(ctx context.Context, userID string, event media.MediaEvent, items []store.CollectedItem) {
+	if a.Plex == nil || event.Source != media.SourcePlex || len(items) == 0 {
+		return
+	}
+	if !a.isPlexServer(ctx, event.Server.UUID) {
+		return
+	}
+	for i := range items {
+		items[i].Server = event.Server.UUID
+	}
+	if err := a.Storage.WriteCollected(userID, items); err != nil {
+		slog.Warn("Failed to record collected items", "user_id", userID, "error", err)
+	}
+}
@@ -2,6 +2,7 @@ package api
 
 import (
 	"context"
+	"crypto/hmac"
 	"fmt"
 	"log/slog"
 	"net/http"
@@ -46,6 +47,32 @@ func (a *API) AllowedHostsHandler(allowedHostnames string) func(http.Handler) ht
 	}
 }
 
+// CSRFHandler rejects state-changing requests that do not carry the CSRF token of the current session,
+// either in the csrf_token form field or the X-CSRF-Token header
+func (a *API) CSRFHandler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet, http.MethodHead, http.MethodOptions:
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		token := r.Header.Get(csrfHeader)
+		if token == "" {
+			token = r.PostFormValue(csrfField)
+		}
+
+		expected := a.csrfToken(r)
+		if expected == "" || !hmac.Equal([]byte(token), []byte(expected)) {
+			slog.Warn("Rejected request with invalid CSRF token", "path", r.URL.Path)
+			http.Error(w, "Invalid CSRF token", http.StatusForbidden)
+			return
+		}
+
+		h.ServeHTTP(w, r)
+	})
+}
+
 // HealthcheckHandler returns a health check handler
 func (a *API) HealthcheckHandler() http.Handler {
 	return healthcheck.Handler(
@@ -0,0 +1,20 @@
+package api
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+)
+
+// RateLimitHandler reports the Trakt client's rate limit state to signed in users
+func (a *API) RateLimitHandler(w http.ResponseWriter, r *http.Request) {
+	if a.sessionUser(r) == nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(a.Trakt.RateLimitStatus()); err != nil {
+		slog.Error("Failed to encode rate limit status", "error", err)
+	}
+}
@@ -0,0 +1,167 @@
+package api
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/viscerous/goplaxt/lib/config"
+	"github.com/viscerous/goplaxt/lib/store"
+)
+
+// sessionTTL is how long a login lasts before the user must reconnect with Trakt
+const sessionTTL = 90 * 24 * time.Hour
+
+var errInvalidSession = errors.New("invalid session")
+
+// session is the signed payload of the session cookie
+type session struct {
+	UserID     string `json:"uid"`
+	Generation int    `json:"gen"`
+	Expires    int64  `json:"exp"`
+	Nonce      string `json:"n"`
+}
+
+// sessionKey returns the key used to sign session cookies.
+// SESSION_SECRET is preferred; otherwise a key is derived from the Trakt client secret.
+func sessionKey() []byte {
+	if config.SessionSecret != "" {
+		return []byte(config.SessionSecret)
+	}
+	if config.TraktClientSecret != "" {
+		mac := hmac.New(sha256.New, []byte(config.TraktClientSecret))
+		mac.Write([]byte("goplaxt session"))
+		return mac.Sum(nil)
+	}
+
+	slog.Warn("No SESSION_SECRET or TRAKT_SECRET set, sessions will not survive a restart")
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		panic(fmt.Errorf("failed to generate session key: %w", err))
+	}
+	return key
+}
+
+// sign returns the base64 HMAC of data
+func (a *API) sign(data string) string {
+	mac := hmac.New(sha256.New, a.sessionKey)
+	mac.Write([]byte(data))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// newSessionToken creates a signed session token for the user
+func (a *API) newSessionToken(user *store.User, expires time.Time) (string, error) {
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		return "", fmt.Errorf("failed to generate nonce: %w", err)
+	}
+
+	data, err := json.Marshal(session{
+		UserID:     user.ID,
+		Generation: user.SessionGeneration,
+		Expires:    expires.Unix(),
+		Nonce:      hex.EncodeToString(nonce),
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal session: %w", err)
+	}
+
+	payload := base64.RawURLEncoding.EncodeToString(data)
+	return payload + "." + a.sign(payload), nil
+}
+
+// parseSessionToken verifies a session token's signature and expiry
+func (a *API) parseSessionToken(token string) (session, error) {
+	var s session
+
+	payload, signature, ok := strings.Cut(token, ".")
+	if !ok || !hmac.Equal([]byte(signature), []byte(a.sign(payload))) {
+		return s, errInvalidSession
+	}
+
+	data, err := base64.RawURLEncoding.DecodeString(payload)
+	if err != nil {
+		return s, errInvalidSession
+	}
+	if err := json.Unmarshal(data, &s); err != nil {
+		return s, errInvalidSession
+	}
+
+	if time.Now().Unix() > s.Expires {
+		return s, errors.New("session expired")
+	}
+	return s, nil
+}
+
+// startSession logs the user in on this device
+func (a *API) startSession(w http.ResponseWriter, r *http.Request, user *store.User) error {
+	expires := time.Now().Add(sessionTTL)
+	token, err := a.newSessionToken(user, expires)
+	if err != nil {
+		return err
+	}
+	a.setCookie(w, r, token, expires)
+	return nil
+}
+
+// requestSession returns the verified session from the request cookie
+func (a *API) requestSession(r *http.Request) (session, error) {
+	cookie, err := r.Cookie(CookieName)
+	if err != nil || cookie.Value == "" {
+		return session{}, errInvalidSession
+	}
+	return a.parseSessionToken(cookie.Value)
+}
+
+// sessionUser returns the logged in user, or nil if the session is missing, invalid or revoked
+func (a *API) sessionUser(r *http.Request) *store.User {
+	s, err := a.requestSession(r)
+	if err != nil {
+		return nil
+	}
+
+	user := a.Storage.GetUser(s.UserID)
+	if user == nil || user.SessionGeneration != s.Generation {
+		return nil
+	}
+	return user
+}
+
+// csrfToken returns the CSRF token bound to the request's session, or "" without a valid session
+func (a *API) csrfToken(r *http.Request) string {
+	s, err := a.requestSession(r)
+	if err != nil {
+		return ""
+	}
+	return a.sign("csrf:" + s.Nonce)
+}
+
+// LogoutOthersHandler ends every session for the current user except this one
+func (a *API) LogoutOthersHandler(w http.ResponseWriter, r *http.Request) {
+	user := a.sessionUser(r)
+	if user == nil {
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}
+
+	user.SessionGeneration++
+	if err := user.Save(); err != nil {
+		http.Error(w, "Failed to log out other devices", http.StatusInternalServerError)
+		return
+	}
+	slog.Info("Logged out other devices", "user_id", user.ID)
+
+	if err := a.startSession(w, r, user); err != nil {
+		slog.Error("Failed to start session", "user_id", user.ID, "error", err)
+	}
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
@@ -0,0 +1,94 @@
+package api
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/viscerous/goplaxt/lib/store"
+)
+
+const (
+	// tokenRefreshInterval is how often users are checked for tokens close to expiry
+	tokenRefreshInterval = time.Hour
+
+	// tokenRefreshWindow is how long before expiry a token is refreshed. It spans several
+	// checks so that a failed refresh is retried before the token expires.
+	tokenRefreshWindow = 6 * time.Hour
+
+	// eventTokenRefresh is the history event recorded when a background refresh fails
+	eventTokenRefresh = "token.refresh"
+)
+
+// StartTokenRefresh refreshes Trakt tokens in the background before they expire,
+// so that webhooks don't wait on a refresh or fail with it
+func (a *API) StartTokenRefresh(ctx context.Context) {
+	go func() {
+		ticker := time.NewTicker(tokenRefreshInterval)
+		defer ticker.Stop()
+
+		for {
+			a.refreshExpiringTokens(ctx, time.Now().Add(tokenRefreshWindow))
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// refreshExpiringTokens refreshes every token that expires before the deadline
+func (a *API) refreshExpiringTokens(ctx context.Context, deadline time.Time) {
+	for _, user := range a.Storage.ListUsers() {
+		if ctx.Err() != nil {
+			return
+		}
+		if expiresBefore(user, deadline) {
+			a.refreshUserToken(user.ID, deadline)
+		}
+	}
+}
+
+// refreshUserToken refreshes a user's token while holding their lock, so it
+// can't race a webhook into using the same refresh token twice
+func (a *API) refreshUserToken(userID string, deadline time.Time) {
+	unlock := a.lockUser(userID)
+	defer unlock()
+
+	// A webhook may have refreshed the token while we waited
+	user := a.Storage.GetUser(userID)
+	if user == nil || !expiresBefore(user, deadline) {
+		return
+	}
+
+	if err := a.refreshToken(user); err != nil {
+		slog.Warn("Background token refresh failed", "user_id", user.ID, "expires_at", user.TokenExpiresAt, "error", err)
+		entry := store.HistoryEntry{
+			UserID:  user.ID,
+			Time:    time.Now().UTC(),
+			Event:   eventTokenRefresh,
+			Title:   "Trakt token refresh",
+			Action:  "oauth/token",
+			Outcome: store.OutcomeFailed,
+			Detail:  err.Error(),
+		}
+		if err := a.Storage.WriteHistory(entry); err != nil {
+			slog.Warn("Failed to record history", "user_id", user.ID, "error", err)
+		}
+	}
+}
+
+// expiresBefore reports whether a user has a refreshable token that expires before the deadline
+func expiresBefore(user *store.User, deadline time.Time) bool {
+	return user.RefreshToken != "" && user.TokenExpiresAt.Before(deadline)
+}
+
+// lockUser holds the user's lock until the returned function is called
+func (a *API) lockUser(userID string) func() {
+	mutex, _ := a.UserLocks.LoadOrStore(userID, &sync.Mutex{})
+	mtx := mutex.(*sync.Mutex)
+	mtx.Lock()
+	return mtx.Unlock
+}
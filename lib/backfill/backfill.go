@@ -0,0 +1,209 @@
+// Package backfill sends watches from a Plex or Tautulli history export to Trakt,
+// so history from before Plaxt was set up isn't lost.
+package backfill
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"time"
+
+	"github.com/viscerous/goplaxt/lib/media"
+	"github.com/viscerous/goplaxt/lib/store"
+	"github.com/viscerous/goplaxt/lib/trakt"
+)
+
+// DefaultBatchSize is how many watches are sent to Trakt per request
+const DefaultBatchSize = 100
+
+// Record is one watch read from an export
+type Record struct {
+	Event     media.MediaEvent
+	WatchedAt time.Time
+	// Account is the Plex account that watched the item, if the export says
+	Account media.Account
+}
+
+// Key identifies the watch in a checkpoint
+func (r Record) Key() string {
+	item := r.Event.ItemID
+	if item == "" {
+		item = fmt.Sprintf("%s/%s/%d/%d", r.Event.ShowTitle, r.Event.Title, r.Event.Season, r.Event.Episode)
+	}
+	return fmt.Sprintf("%s:%s@%d", r.Event.Kind, item, r.WatchedAt.Unix())
+}
+
+// Options control a backfill run
+type Options struct {
+	// DryRun resolves watches without sending them to Trakt or writing the checkpoint
+	DryRun bool
+	// Checkpoint is the file recording watches already sent, so an interrupted run can resume
+	Checkpoint string
+	BatchSize  int
+	// AllAccounts keeps watches from Plex accounts the user isn't matched to
+	AllAccounts bool
+	// Out receives a line per watch. Nothing is written if nil.
+	Out io.Writer
+}
+
+// Summary counts the outcome of a run
+type Summary struct {
+	Added int
+	// Skipped watches were sent by an earlier run or belong to another account
+	Skipped    int
+	Unresolved int
+}
+
+// checkpoint is the set of watches already sent
+type checkpoint map[string]bool
+
+// loadCheckpoint reads a checkpoint file. A missing file is an empty checkpoint.
+func loadCheckpoint(path string) (checkpoint, error) {
+	done := checkpoint{}
+	if path == "" {
+		return done, nil
+	}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return done, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read checkpoint: %w", err)
+	}
+	var keys []string
+	if err := json.Unmarshal(data, &keys); err != nil {
+		return nil, fmt.Errorf("invalid checkpoint: %w", err)
+	}
+	for _, key := range keys {
+		done[key] = true
+	}
+	return done, nil
+}
+
+// save writes the checkpoint atomically
+func (c checkpoint) save(path string) error {
+	if path == "" {
+		return nil
+	}
+	keys := make([]string, 0, len(c))
+	for key := range c {
+		keys = append(keys, key)
+	}
+	data, err := json.Marshal(keys)
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return fmt.Errorf("failed to write checkpoint: %w", err)
+	}
+	return os.Rename(tmp, path)
+}
+
+// Run resolves each watch on Trakt and adds them to the user's history in batches.
+// The checkpoint is saved after every batch, so a failed run can be repeated.
+func Run(ctx context.Context, client trakt.Client, user store.User, records []Record, opts Options) (Summary, error) {
+	var summary Summary
+	done, err := loadCheckpoint(opts.Checkpoint)
+	if err != nil {
+		return summary, err
+	}
+	batchSize := opts.BatchSize
+	if batchSize <= 0 {
+		batchSize = DefaultBatchSize
+	}
+	report := func(format string, args ...any) {
+		if opts.Out != nil {
+			fmt.Fprintf(opts.Out, format+"\n", args...)
+		}
+	}
+	filterAccounts := !opts.AllAccounts && (user.PlexUsername != "" || len(user.PlexAccounts) > 0)
+
+	var body trakt.HistoryBody
+	var pending []string
+	flush := func() error {
+		if body.Len() == 0 {
+			return nil
+		}
+		if !opts.DryRun {
+			if err := trakt.AddHistory(ctx, client, body, user.AccessToken); err != nil {
+				return err
+			}
+			for _, key := range pending {
+				done[key] = true
+			}
+			if err := done.save(opts.Checkpoint); err != nil {
+				return err
+			}
+		}
+		summary.Added += body.Len()
+		body, pending = trakt.HistoryBody{}, nil
+		return nil
+	}
+
+	for _, record := range records {
+		if err := ctx.Err(); err != nil {
+			return summary, err
+		}
+		key := record.Key()
+		if done[key] || (filterAccounts && record.Account != (media.Account{}) && !user.MatchesAccount(record.Account.ID, record.Account.Name)) {
+			summary.Skipped++
+			continue
+		}
+
+		item, err := trakt.FindHistoryItem(ctx, client, record.Event, record.WatchedAt)
+		if isTraktFailure(err) {
+			// Every later watch would fail the same way, so the resolved ones are sent
+			// and the run stops where it can be resumed
+			if flushErr := flush(); flushErr != nil {
+				return summary, flushErr
+			}
+			return summary, fmt.Errorf("failed to look up %s: %w", describe(record.Event), err)
+		}
+		if err != nil {
+			slog.Debug("Backfill item not found", "key", key, "error", err)
+			report("not found: %s", describe(record.Event))
+			summary.Unresolved++
+			continue
+		}
+		report("%s: %s", item.WatchedAt, describe(record.Event))
+
+		if record.Event.Kind == media.KindMovie {
+			body.Movies = append(body.Movies, item)
+		} else {
+			body.Episodes = append(body.Episodes, item)
+		}
+		pending = append(pending, key)
+		if body.Len() >= batchSize {
+			if err := flush(); err != nil {
+				return summary, err
+			}
+		}
+	}
+	return summary, flush()
+}
+
+// isTraktFailure reports whether a lookup failed because Trakt couldn't be reached or
+// rejected the token, rather than because it has no match for the watch
+func isTraktFailure(err error) bool {
+	if errors.Is(err, trakt.ErrInvalidToken) {
+		return true
+	}
+	var apiErr *trakt.APIError
+	return errors.As(err, &apiErr) && trakt.IsRetryable(err)
+}
+
+// describe names a watch for the run's output
+func describe(e media.MediaEvent) string {
+	if e.Kind == media.KindEpisode {
+		return fmt.Sprintf("%s S%02dE%02d", e.ShowTitle, e.Season, e.Episode)
+	}
+	if e.Year != 0 {
+		return fmt.Sprintf("%s (%d)", e.Title, e.Year)
+	}
+	return e.Title
+}
@@ -0,0 +1,177 @@
+package backfill
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/viscerous/goplaxt/lib/media"
+	"github.com/viscerous/goplaxt/lib/store"
+	"github.com/viscerous/goplaxt/lib/trakt"
+)
+
+// fakeClient answers searches from a map and records history sent to Trakt
+type fakeClient struct {
+	responses map[string]string
+	sent      []trakt.HistoryBody
+	fail      bool
+	// searchErr is returned for searches missing from responses
+	searchErr error
+}
+
+func (c *fakeClient) MakeRequest(ctx context.Context, url string) ([]byte, error) {
+	if resp, ok := c.responses[url]; ok {
+		return []byte(resp), nil
+	}
+	if c.searchErr != nil {
+		return nil, c.searchErr
+	}
+	return nil, fmt.Errorf("unexpected request %s", url)
+}
+
+func (c *fakeClient) ScrobbleRequest(ctx context.Context, action string, body []byte, token string) ([]byte, error) {
+	return nil, errors.New("not implemented")
+}
+
+func (c *fakeClient) SyncRequest(ctx context.Context, endpoint string, body []byte, token string) ([]byte, error) {
+	if c.fail || endpoint != "history" || token != "token" {
+		return nil, errors.New("sync failed")
+	}
+	var history trakt.HistoryBody
+	if err := json.Unmarshal(body, &history); err != nil {
+		return nil, err
+	}
+	c.sent = append(c.sent, history)
+	return []byte(`{}`), nil
+}
+
+func (c *fakeClient) DeleteCheckin(ctx context.Context, token string) error {
+	return nil
+}
+
+func TestRead(t *testing.T) {
+	tautulli := `{"response": {"result": "success", "data": {"recordsTotal": 3, "data": [
+		{"date": 1700000000, "stopped": 1700005000, "user": "alice", "user_id": 1, "media_type": "movie", "rating_key": 10, "title": "Inception", "year": 2010, "watched_status": 1, "guid": "plex://movie/5d7768"},
+		{"date": 1700100000, "stopped": 1700102000, "user": "alice", "media_type": "episode", "rating_key": 11, "title": "Good News About Hell", "grandparent_title": "Severance", "parent_media_index": "1", "media_index": "1", "watched_status": 0.5},
+		{"date": 1700200000, "user": "alice", "media_type": "track", "title": "Song", "watched_status": 1}
+	]}}}`
+	records, err := Read(strings.NewReader(tautulli))
+	assert.NoError(t, err)
+	assert.Equal(t, []Record{{
+		Event:     media.MediaEvent{Event: media.EventScrobble, Kind: media.KindMovie, ItemID: "10", Title: "Inception", Year: 2010},
+		WatchedAt: time.Unix(1700005000, 0).UTC(),
+		Account:   media.Account{ID: "1", Name: "alice"},
+	}}, records)
+
+	plex := `{"MediaContainer": {"Metadata": [
+		{"type": "episode", "ratingKey": "11", "title": "Good News About Hell", "grandparentTitle": "Severance", "parentIndex": 1, "index": 1, "originallyAvailableAt": "2022-02-18", "viewedAt": 1700102000, "accountID": 1}
+	]}}`
+	records, err = Read(strings.NewReader(plex))
+	assert.NoError(t, err)
+	assert.Equal(t, []Record{{
+		Event:     media.MediaEvent{Event: media.EventScrobble, Kind: media.KindEpisode, ItemID: "11", Title: "Good News About Hell", ShowTitle: "Severance", Season: 1, Episode: 1, Year: 2022},
+		WatchedAt: time.Unix(1700102000, 0).UTC(),
+		Account:   media.Account{ID: "1"},
+	}}, records)
+
+	csv := "\ufeffMedia Type,Title,Year,Watched At,Guids\n" +
+		"movie,Heat,1995,2023-11-14 22:13:20,\"imdb://tt0113277,tmdb://949\"\n" +
+		"movie,Undated,1995,,\n"
+	records, err = Read(strings.NewReader(csv))
+	assert.NoError(t, err)
+	assert.Len(t, records, 1)
+	assert.Equal(t, []media.ExternalID{{Service: "imdb", ID: "tt0113277"}, {Service: "tmdb", ID: "949"}}, records[0].Event.IDs)
+	assert.Equal(t, time.Date(2023, 11, 14, 22, 13, 20, 0, time.UTC), records[0].WatchedAt)
+
+	_, err = Read(strings.NewReader(`{"response": {"data": "oops"}}`))
+	assert.Error(t, err)
+}
+
+func TestRun(t *testing.T) {
+	user := store.User{ID: "user1", AccessToken: "token", PlexUsername: "alice"}
+	watched := time.Date(2023, 11, 14, 22, 13, 20, 0, time.UTC)
+	records := []Record{
+		{Event: media.MediaEvent{Kind: media.KindMovie, ItemID: "1", Title: "Heat", IDs: []media.ExternalID{{Service: "imdb", ID: "tt0113277"}}}, WatchedAt: watched, Account: media.Account{Name: "Alice"}},
+		{Event: media.MediaEvent{Kind: media.KindMovie, ItemID: "2", Title: "Inception"}, WatchedAt: watched},
+		{Event: media.MediaEvent{Kind: media.KindMovie, ItemID: "3", Title: "Unknown"}, WatchedAt: watched},
+		{Event: media.MediaEvent{Kind: media.KindMovie, ItemID: "4", Title: "Heat", IDs: []media.ExternalID{{Service: "imdb", ID: "tt0113277"}}}, WatchedAt: watched, Account: media.Account{Name: "bob"}},
+	}
+	client := &fakeClient{responses: map[string]string{
+		"/search/imdb/tt0113277?type=movie": `[{"movie":{"title":"Heat","year":1995,"ids":{"trakt":1}}}]`,
+		"/search/movie?query=Inception":     `[{"movie":{"title":"Inception","year":2010,"ids":{"trakt":2}}}]`,
+		"/search/movie?query=Unknown":       `[]`,
+	}}
+	checkpoint := filepath.Join(t.TempDir(), "checkpoint.json")
+
+	// A dry run sends and records nothing
+	summary, err := Run(context.Background(), client, user, records, Options{DryRun: true, Checkpoint: checkpoint})
+	assert.NoError(t, err)
+	assert.Equal(t, Summary{Added: 2, Skipped: 1, Unresolved: 1}, summary)
+	assert.Empty(t, client.sent)
+	assert.NoFileExists(t, checkpoint)
+
+	summary, err = Run(context.Background(), client, user, records, Options{Checkpoint: checkpoint, BatchSize: 1})
+	assert.NoError(t, err)
+	assert.Equal(t, Summary{Added: 2, Skipped: 1, Unresolved: 1}, summary)
+	assert.Len(t, client.sent, 2)
+	assert.Equal(t, trakt.HistoryItem{Ids: trakt.Ids{Trakt: 1}, WatchedAt: "2023-11-14T22:13:20Z"}, client.sent[0].Movies[0])
+
+	// A repeated run resumes from the checkpoint
+	summary, err = Run(context.Background(), client, user, records, Options{Checkpoint: checkpoint})
+	assert.NoError(t, err)
+	assert.Equal(t, Summary{Skipped: 3, Unresolved: 1}, summary)
+	assert.Len(t, client.sent, 2)
+
+	// Other accounts can be included
+	summary, err = Run(context.Background(), client, user, records[3:], Options{DryRun: true, AllAccounts: true})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, summary.Added)
+
+	// Failed batches are not checkpointed
+	client.fail = true
+	_, err = Run(context.Background(), client, user, records[3:], Options{Checkpoint: checkpoint, AllAccounts: true})
+	assert.Error(t, err)
+	done, err := loadCheckpoint(checkpoint)
+	assert.NoError(t, err)
+	assert.Len(t, done, 2)
+}
+
+func TestRunStopsOnTraktFailure(t *testing.T) {
+	user := store.User{ID: "user1", AccessToken: "token"}
+	watched := time.Date(2023, 11, 14, 22, 13, 20, 0, time.UTC)
+	records := []Record{
+		{Event: media.MediaEvent{Kind: media.KindMovie, ItemID: "1", Title: "Heat"}, WatchedAt: watched},
+		{Event: media.MediaEvent{Kind: media.KindMovie, ItemID: "2", Title: "Inception"}, WatchedAt: watched},
+		{Event: media.MediaEvent{Kind: media.KindMovie, ItemID: "3", Title: "Unknown"}, WatchedAt: watched},
+	}
+	responses := map[string]string{
+		"/search/movie?query=Heat":    `[{"movie":{"title":"Heat","year":1995,"ids":{"trakt":1}}}]`,
+		"/search/movie?query=Unknown": `[]`,
+	}
+
+	for name, searchErr := range map[string]error{
+		"unavailable":   &trakt.APIError{Status: 503, Retryable: true},
+		"unreachable":   &trakt.APIError{Err: errors.New("connection refused"), Retryable: true},
+		"invalid token": &trakt.APIError{Status: 401},
+	} {
+		t.Run(name, func(t *testing.T) {
+			client := &fakeClient{responses: responses, searchErr: searchErr}
+			checkpoint := filepath.Join(t.TempDir(), "checkpoint.json")
+
+			// The watches resolved so far are sent and checkpointed, and the rest aren't counted as unresolved
+			summary, err := Run(context.Background(), client, user, records, Options{Checkpoint: checkpoint})
+			assert.ErrorIs(t, err, searchErr)
+			assert.Equal(t, Summary{Added: 1}, summary)
+			assert.Len(t, client.sent, 1)
+			done, err := loadCheckpoint(checkpoint)
+			assert.NoError(t, err)
+			assert.Len(t, done, 1)
+		})
+	}
+}
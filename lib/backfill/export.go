@@ -0,0 +1,247 @@
+package backfill
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/viscerous/goplaxt/lib/media"
+)
+
+// fields lists the column names each value is read from, normalised by normalise.
+// They cover Tautulli's get_history, Tautulli exports and Plex's history endpoint.
+var fields = map[string][]string{
+	"type":      {"mediatype", "type"},
+	"title":     {"title"},
+	"show":      {"grandparenttitle", "showname", "showtitle"},
+	"season":    {"parentmediaindex", "parentindex", "seasonnum", "season"},
+	"episode":   {"mediaindex", "index", "episodenum", "episode"},
+	"year":      {"year", "originallyavailableat"},
+	"watched":   {"watchedat", "viewedat", "stopped", "date"},
+	"status":    {"watchedstatus"},
+	"item":      {"ratingkey"},
+	"guids":     {"guids", "guid"},
+	"account":   {"user", "username"},
+	"accountID": {"userid", "accountid"},
+	"imdb":      {"imdbid"},
+	"tmdb":      {"tmdbid", "themoviedbid"},
+	"tvdb":      {"tvdbid", "thetvdbid"},
+}
+
+// timeLayouts are the timestamp formats accepted besides Unix seconds
+var timeLayouts = []string{time.RFC3339, "2006-01-02 15:04:05", "2006-01-02T15:04:05", "2006-01-02"}
+
+// normalise lower-cases a column name and drops separators, so "grandparent_title"
+// and "grandparentTitle" are the same column
+func normalise(name string) string {
+	return strings.NewReplacer("_", "", " ", "", "-", "").Replace(strings.ToLower(strings.TrimSpace(name)))
+}
+
+// row is one entry of an export keyed by normalised column name
+type row map[string]string
+
+// get returns the first non-empty column for a field
+func (r row) get(field string) string {
+	for _, name := range fields[field] {
+		if value := strings.TrimSpace(r[name]); value != "" {
+			return value
+		}
+	}
+	return ""
+}
+
+// Read parses a CSV or JSON history export. Music, unwatched and undated entries are left out.
+func Read(reader io.Reader) ([]Record, error) {
+	data, err := io.ReadAll(reader)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read export: %w", err)
+	}
+	data = bytes.TrimPrefix(bytes.TrimSpace(data), []byte("\ufeff"))
+
+	var rows []row
+	if len(data) > 0 && (data[0] == '{' || data[0] == '[') {
+		rows, err = readJSON(data)
+	} else {
+		rows, err = readCSV(data)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var records []Record
+	for _, r := range rows {
+		if record, ok := r.record(); ok {
+			records = append(records, record)
+		}
+	}
+	return records, nil
+}
+
+// readCSV reads an export with a header row
+func readCSV(data []byte) ([]row, error) {
+	lines, err := csv.NewReader(bytes.NewReader(data)).ReadAll()
+	if err != nil {
+		return nil, fmt.Errorf("invalid csv export: %w", err)
+	}
+	if len(lines) == 0 {
+		return nil, nil
+	}
+	header := lines[0]
+	var rows []row
+	for _, line := range lines[1:] {
+		r := row{}
+		for i, name := range header {
+			if i < len(line) {
+				r[normalise(name)] = line[i]
+			}
+		}
+		rows = append(rows, r)
+	}
+	return rows, nil
+}
+
+// readJSON reads a list of entries, alone or wrapped in a Tautulli or Plex response
+func readJSON(data []byte) ([]row, error) {
+	var export struct {
+		Response struct {
+			Data json.RawMessage `json:"data"`
+		} `json:"response"`
+		MediaContainer struct {
+			Metadata []map[string]any `json:"Metadata"`
+		} `json:"MediaContainer"`
+	}
+	var entries []map[string]any
+	if data[0] == '[' {
+		if err := json.Unmarshal(data, &entries); err != nil {
+			return nil, fmt.Errorf("invalid json export: %w", err)
+		}
+	} else {
+		if err := json.Unmarshal(data, &export); err != nil {
+			return nil, fmt.Errorf("invalid json export: %w", err)
+		}
+		entries = export.MediaContainer.Metadata
+		if len(export.Response.Data) > 0 {
+			// get_history pages its results under data.data
+			var page struct {
+				Data []map[string]any `json:"data"`
+			}
+			if err := json.Unmarshal(export.Response.Data, &page); err != nil {
+				if err := json.Unmarshal(export.Response.Data, &entries); err != nil {
+					return nil, fmt.Errorf("invalid tautulli response: %w", err)
+				}
+			} else {
+				entries = page.Data
+			}
+		}
+	}
+
+	rows := make([]row, 0, len(entries))
+	for _, entry := range entries {
+		r := row{}
+		for name, value := range entry {
+			r[normalise(name)] = text(value)
+		}
+		rows = append(rows, r)
+	}
+	return rows, nil
+}
+
+// text flattens a JSON value. Lists of GUIDs, as strings or {"id": ...} objects, are comma separated.
+func text(value any) string {
+	switch v := value.(type) {
+	case string:
+		return v
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case bool:
+		return strconv.FormatBool(v)
+	case []any:
+		var parts []string
+		for _, item := range v {
+			if object, ok := item.(map[string]any); ok {
+				item = object["id"]
+			}
+			if s, ok := item.(string); ok {
+				parts = append(parts, s)
+			}
+		}
+		return strings.Join(parts, ",")
+	}
+	return ""
+}
+
+// parseTime reads Unix seconds or one of timeLayouts
+func parseTime(value string) (time.Time, bool) {
+	if seconds, err := strconv.ParseInt(value, 10, 64); err == nil && seconds > 0 {
+		return time.Unix(seconds, 0).UTC(), true
+	}
+	for _, layout := range timeLayouts {
+		if t, err := time.Parse(layout, value); err == nil {
+			return t.UTC(), true
+		}
+	}
+	return time.Time{}, false
+}
+
+// number reads an integer column, ignoring any decimals
+func number(value string) int {
+	f, _ := strconv.ParseFloat(value, 64)
+	return int(f)
+}
+
+// record converts an entry to a watch
+func (r row) record() (Record, bool) {
+	e := media.MediaEvent{
+		Event:  media.EventScrobble,
+		ItemID: r.get("item"),
+		Title:  r.get("title"),
+	}
+	switch strings.ToLower(r.get("type")) {
+	case "movie":
+		e.Kind = media.KindMovie
+	case "episode":
+		e.Kind = media.KindEpisode
+		e.ShowTitle = r.get("show")
+		e.Season = number(r.get("season"))
+		e.Episode = number(r.get("episode"))
+	default:
+		return Record{}, false
+	}
+
+	// Tautulli marks partial plays with a watched status below 1
+	if status := r.get("status"); status != "" && number(status) < 1 {
+		return Record{}, false
+	}
+	watchedAt, ok := parseTime(r.get("watched"))
+	if !ok {
+		return Record{}, false
+	}
+
+	// originallyAvailableAt is a date, so only its year is used
+	year, _, _ := strings.Cut(r.get("year"), "-")
+	e.Year = number(year)
+
+	for _, service := range []string{"imdb", "tmdb", "tvdb"} {
+		if id := r.get(service); id != "" {
+			e.IDs = append(e.IDs, media.ExternalID{Service: service, ID: id})
+		}
+	}
+	for guid := range strings.SplitSeq(r.get("guids"), ",") {
+		service, id, ok := strings.Cut(strings.TrimSpace(guid), "://")
+		// Plex's own GUIDs can't be looked up on Trakt
+		if ok && id != "" && service != "plex" && !strings.HasPrefix(service, "com.plexapp") {
+			e.IDs = append(e.IDs, media.ExternalID{Service: service, ID: id})
+		}
+	}
+
+	return Record{
+		Event:     e,
+		WatchedAt: watchedAt,
+		Account:   media.Account{ID: r.get("accountID"), Name: r.get("account")},
+	}, true
+}
@@ -4,16 +4,56 @@ import (
 	"cmp"
 	"log/slog"
 	"os"
+	"strconv"
 	"strings"
 )
 
 var TraktClientId string = getConfig("TRAKT_ID")
 var TraktClientSecret string = getConfig("TRAKT_SECRET")
+var TraktAPIURL string = os.Getenv("TRAKT_API_URL")
+var SessionSecret string = getConfig("SESSION_SECRET")
+var ServerWebhookToken string = getConfig("SERVER_WEBHOOK_TOKEN")
+var PlexURL string = os.Getenv("PLEX_URL")
+var PlexToken string = getConfig("PLEX_TOKEN")
+
+// AllowLegacyWebhooks accepts the old /api?id=<user ID> webhook URLs
+var AllowLegacyWebhooks bool = getBool("ALLOW_LEGACY_WEBHOOKS")
+
+// WebhookMaxAttempts is how many times a webhook is tried before it is dead-lettered, or 0 for the default
+var WebhookMaxAttempts int = getPositiveInt("WEBHOOK_MAX_ATTEMPTS")
 
 func getConfig(name string) string {
 	return cmp.Or(os.Getenv(name), readSecretFile(name+"_FILE"))
 }
 
+// getPositiveInt reads a positive number, returning 0 if it is unset or invalid
+func getPositiveInt(name string) int {
+	value := os.Getenv(name)
+	if value == "" {
+		return 0
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(value))
+	if err != nil || n < 1 {
+		slog.Warn("Ignoring invalid setting, expected a positive number", "env_var", name, "value", value)
+		return 0
+	}
+	return n
+}
+
+// getBool reads a true or false setting, returning false if it is unset or invalid
+func getBool(name string) bool {
+	value := os.Getenv(name)
+	if value == "" {
+		return false
+	}
+	b, err := strconv.ParseBool(strings.TrimSpace(value))
+	if err != nil {
+		slog.Warn("Ignoring invalid setting, expected true or false", "env_var", name, "value", value)
+		return false
+	}
+	return b
+}
+
 func readSecretFile(name string) string {
 	path := os.Getenv(name)
 	if path == "" {
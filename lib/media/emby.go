@@ -0,0 +1,102 @@
+package media
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// EmbyPayload is a notification from Emby's built-in webhooks
+type EmbyPayload struct {
+	Event string `json:"Event"`
+	User  struct {
+		ID   string `json:"Id"`
+		Name string `json:"Name"`
+	} `json:"User"`
+	Server struct {
+		ID   string `json:"Id"`
+		Name string `json:"Name"`
+	} `json:"Server"`
+	Session struct {
+		DeviceName     string `json:"DeviceName"`
+		DeviceID       string `json:"DeviceId"`
+		RemoteEndPoint string `json:"RemoteEndPoint"`
+	} `json:"Session"`
+	Item struct {
+		ID                string            `json:"Id"`
+		Type              string            `json:"Type"`
+		Name              string            `json:"Name"`
+		SeriesName        string            `json:"SeriesName"`
+		ParentIndexNumber int               `json:"ParentIndexNumber"`
+		IndexNumber       int               `json:"IndexNumber"`
+		ProductionYear    int               `json:"ProductionYear"`
+		RunTimeTicks      int64             `json:"RunTimeTicks"`
+		DateCreated       string            `json:"DateCreated"`
+		ProviderIds       map[string]string `json:"ProviderIds"`
+		UserData          struct {
+			Rating *float64 `json:"Rating"`
+		} `json:"UserData"`
+	} `json:"Item"`
+	PlaybackInfo struct {
+		PositionTicks      int64 `json:"PositionTicks"`
+		PlayedToCompletion bool  `json:"PlayedToCompletion"`
+	} `json:"PlaybackInfo"`
+}
+
+// FromEmby converts an Emby webhook into a MediaEvent
+func FromEmby(body []byte) (MediaEvent, error) {
+	var p EmbyPayload
+	if err := json.Unmarshal(body, &p); err != nil {
+		return MediaEvent{}, fmt.Errorf("invalid emby payload: %w", err)
+	}
+
+	e, err := item{
+		Type:          p.Item.Type,
+		Name:          p.Item.Name,
+		SeriesName:    p.Item.SeriesName,
+		SeasonNumber:  p.Item.ParentIndexNumber,
+		EpisodeNumber: p.Item.IndexNumber,
+		Year:          p.Item.ProductionYear,
+		ProviderIDs:   p.Item.ProviderIds,
+	}.event()
+	if err != nil {
+		return e, err
+	}
+
+	e.ItemID = p.Item.ID
+	e.Progress = progress(p.PlaybackInfo.PositionTicks, p.Item.RunTimeTicks)
+	e.Account = Account{ID: p.User.ID, Name: p.User.Name}
+	e.Player = Player{Name: p.Session.DeviceName, UUID: p.Session.DeviceID, Address: p.Session.RemoteEndPoint}
+	e.Server = Server{Name: p.Server.Name, UUID: p.Server.ID}
+
+	switch p.Event {
+	case "playback.start":
+		e.Event = EventPlay
+	case "playback.pause":
+		e.Event = EventPause
+	case "playback.unpause":
+		e.Event = EventResume
+	case "playback.stop":
+		e.Event = EventStop
+		if p.PlaybackInfo.PlayedToCompletion {
+			e.Event = EventScrobble
+		}
+	case "item.markplayed":
+		e.Event = EventScrobble
+	case "item.rate":
+		// Likes and favourites also trigger item.rate but carry no rating
+		if p.Item.UserData.Rating == nil {
+			return e, ErrIgnored
+		}
+		e.Event = EventRate
+		e.Rating = *p.Item.UserData.Rating
+	case "library.new":
+		e.Event = EventAdded
+		e.AddedAt = addedAt(p.Item.DateCreated)
+	case "library.deleted":
+		e.Event = EventRemoved
+	default:
+		return e, ErrIgnored
+	}
+
+	return e, nil
+}
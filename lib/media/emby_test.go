@@ -0,0 +1,71 @@
+package media
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFromEmby(t *testing.T) {
+	movie := `{
+		"Title": "alice has finished playing Inception on Living Room TV",
+		"Event": "playback.stop",
+		"User": {"Name": "alice", "Id": "user-1"},
+		"Server": {"Name": "Living Room", "Id": "server-1"},
+		"Session": {"DeviceName": "Living Room TV"},
+		"Item": {
+			"Type": "Movie",
+			"Name": "Inception",
+			"ProductionYear": 2010,
+			"RunTimeTicks": 88800000000,
+			"ProviderIds": {"Imdb": "tt1375666", "Tmdb": "27205"}
+		},
+		"PlaybackInfo": {"PositionTicks": 88000000000, "PlayedToCompletion": true}
+	}`
+
+	e, err := FromEmby([]byte(movie))
+	assert.NoError(t, err)
+	assert.Equal(t, EventScrobble, e.Event)
+	assert.Equal(t, "alice", e.Account.Name)
+	assert.Equal(t, "user-1", e.Account.ID)
+	assert.Equal(t, "Living Room TV", e.Player.Name)
+	assert.Equal(t, KindMovie, e.Kind)
+	assert.Equal(t, "Inception", e.Title)
+	assert.Equal(t, 2010, e.Year)
+	assert.Equal(t, []ExternalID{{"imdb", "tt1375666"}, {"tmdb", "27205"}}, e.IDs)
+	assert.InDelta(t, 99.1, e.Progress, 0.01)
+
+	tests := []struct {
+		event string
+		want  string
+	}{
+		{"playback.start", "media.play"},
+		{"playback.pause", "media.pause"},
+		{"playback.unpause", "media.resume"},
+		{"item.markplayed", "media.scrobble"},
+		{"library.new", "library.new"},
+		{"library.deleted", "library.deleted"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.event, func(t *testing.T) {
+			body := `{"Event":"` + tt.event + `","Item":{"Type":"Episode","SeriesName":"Severance","ParentIndexNumber":1,"IndexNumber":2}}`
+			e, err := FromEmby([]byte(body))
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, e.Event)
+			assert.Equal(t, KindEpisode, e.Kind)
+			assert.Equal(t, "Severance", e.ShowTitle)
+		})
+	}
+
+	// Ratings are carried over, likes without a rating are ignored
+	e, err = FromEmby([]byte(`{"Event":"item.rate","Item":{"Type":"Movie","UserData":{"Rating":7}}}`))
+	assert.NoError(t, err)
+	assert.Equal(t, 7.0, e.Rating)
+
+	_, err = FromEmby([]byte(`{"Event":"item.rate","Item":{"Type":"Movie","UserData":{"IsFavorite":true}}}`))
+	assert.ErrorIs(t, err, ErrIgnored)
+	_, err = FromEmby([]byte(`{"Event":"user.authenticated","Item":{"Type":"Movie"}}`))
+	assert.ErrorIs(t, err, ErrIgnored)
+	_, err = FromEmby([]byte(`{"Event":"playback.start","Item":{"Type":"Audio"}}`))
+	assert.ErrorIs(t, err, ErrIgnored)
+}
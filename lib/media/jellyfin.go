@@ -0,0 +1,91 @@
+package media
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// JellyfinPayload is a notification from the Jellyfin webhook plugin with "Send All Properties" enabled
+type JellyfinPayload struct {
+	NotificationType      string   `json:"NotificationType"`
+	NotificationUsername  string   `json:"NotificationUsername"`
+	UserID                string   `json:"UserId"`
+	ServerID              string   `json:"ServerId"`
+	ServerName            string   `json:"ServerName"`
+	DeviceName            string   `json:"DeviceName"`
+	DeviceID              string   `json:"DeviceId"`
+	UtcTimestamp          string   `json:"UtcTimestamp"`
+	ItemID                string   `json:"ItemId"`
+	ItemType              string   `json:"ItemType"`
+	Name                  string   `json:"Name"`
+	SeriesName            string   `json:"SeriesName"`
+	SeasonNumber          int      `json:"SeasonNumber"`
+	EpisodeNumber         int      `json:"EpisodeNumber"`
+	Year                  int      `json:"Year"`
+	RunTimeTicks          int64    `json:"RunTimeTicks"`
+	PlaybackPositionTicks int64    `json:"PlaybackPositionTicks"`
+	PlayedToCompletion    bool     `json:"PlayedToCompletion"`
+	ProviderImdb          string   `json:"Provider_imdb"`
+	ProviderTmdb          string   `json:"Provider_tmdb"`
+	ProviderTvdb          string   `json:"Provider_tvdb"`
+	SaveReason            string   `json:"SaveReason"`
+	Played                bool     `json:"Played"`
+	Rating                *float64 `json:"Rating"`
+}
+
+// FromJellyfin converts a Jellyfin webhook into a MediaEvent.
+// Progress updates are ignored as the plugin sends them every few seconds during playback.
+func FromJellyfin(body []byte) (MediaEvent, error) {
+	var p JellyfinPayload
+	if err := json.Unmarshal(body, &p); err != nil {
+		return MediaEvent{}, fmt.Errorf("invalid jellyfin payload: %w", err)
+	}
+
+	e, err := item{
+		Type:          p.ItemType,
+		Name:          p.Name,
+		SeriesName:    p.SeriesName,
+		SeasonNumber:  p.SeasonNumber,
+		EpisodeNumber: p.EpisodeNumber,
+		Year:          p.Year,
+		ProviderIDs:   map[string]string{"imdb": p.ProviderImdb, "tmdb": p.ProviderTmdb, "tvdb": p.ProviderTvdb},
+	}.event()
+	if err != nil {
+		return e, err
+	}
+
+	e.ItemID = p.ItemID
+	e.Progress = progress(p.PlaybackPositionTicks, p.RunTimeTicks)
+	e.Account = Account{ID: p.UserID, Name: p.NotificationUsername}
+	e.Player = Player{Name: p.DeviceName, UUID: p.DeviceID}
+	e.Server = Server{Name: p.ServerName, UUID: p.ServerID}
+
+	switch p.NotificationType {
+	case "PlaybackStart":
+		e.Event = EventPlay
+	case "PlaybackStop":
+		e.Event = EventStop
+		if p.PlayedToCompletion {
+			e.Event = EventScrobble
+		}
+	case "ItemAdded":
+		e.Event = EventAdded
+		e.AddedAt = addedAt(p.UtcTimestamp)
+	case "ItemDeleted":
+		e.Event = EventRemoved
+	case "UserDataSaved":
+		switch {
+		case p.SaveReason == "TogglePlayed" && p.Played:
+			e.Event = EventScrobble
+		case p.SaveReason == "UpdateUserRating" && p.Rating != nil:
+			e.Event = EventRate
+			e.Rating = *p.Rating
+		default:
+			return e, ErrIgnored
+		}
+	default:
+		return e, ErrIgnored
+	}
+
+	return e, nil
+}
@@ -0,0 +1,82 @@
+package media
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFromJellyfin(t *testing.T) {
+	episode := `{
+		"NotificationType": "PlaybackStop",
+		"NotificationUsername": "alice",
+		"ServerId": "server-1",
+		"ServerName": "Living Room",
+		"ItemType": "Episode",
+		"Name": "Who Is Alive?",
+		"SeriesName": "Severance",
+		"SeasonNumber": 2,
+		"EpisodeNumber": 3,
+		"Year": 2025,
+		"RunTimeTicks": 30000000000,
+		"PlaybackPositionTicks": 28500000000,
+		"PlayedToCompletion": false,
+		"Provider_imdb": "tt12345678",
+		"Provider_tvdb": "10293847"
+	}`
+
+	e, err := FromJellyfin([]byte(episode))
+	assert.NoError(t, err)
+	assert.Equal(t, EventStop, e.Event)
+	assert.Equal(t, "alice", e.Account.Name)
+	assert.Equal(t, "Living Room", e.Server.Name)
+	assert.Equal(t, KindEpisode, e.Kind)
+	assert.Equal(t, "Who Is Alive?", e.Title)
+	assert.Equal(t, "Severance", e.ShowTitle)
+	assert.Equal(t, 2, e.Season)
+	assert.Equal(t, 3, e.Episode)
+	assert.Equal(t, []ExternalID{{"imdb", "tt12345678"}, {"tvdb", "10293847"}}, e.IDs)
+	assert.InDelta(t, 95.0, e.Progress, 0.01)
+
+	tests := []struct {
+		name  string
+		body  string
+		event string
+	}{
+		{"start", `{"NotificationType":"PlaybackStart","ItemType":"Movie"}`, "media.play"},
+		{"completed", `{"NotificationType":"PlaybackStop","ItemType":"Movie","PlayedToCompletion":true}`, "media.scrobble"},
+		{"added", `{"NotificationType":"ItemAdded","ItemType":"Movie","UtcTimestamp":"2025-01-17T08:00:00.0000000Z"}`, "library.new"},
+		{"deleted", `{"NotificationType":"ItemDeleted","ItemType":"Movie"}`, "library.deleted"},
+		{"marked played", `{"NotificationType":"UserDataSaved","ItemType":"Movie","SaveReason":"TogglePlayed","Played":true}`, "media.scrobble"},
+		{"rated", `{"NotificationType":"UserDataSaved","ItemType":"Movie","SaveReason":"UpdateUserRating","Rating":8}`, "media.rate"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e, err := FromJellyfin([]byte(tt.body))
+			assert.NoError(t, err)
+			assert.Equal(t, tt.event, e.Event)
+			assert.Equal(t, KindMovie, e.Kind)
+		})
+	}
+
+	// Rating and added time are carried over
+	e, _ = FromJellyfin([]byte(tests[5].body))
+	assert.Equal(t, 8.0, e.Rating)
+	e, _ = FromJellyfin([]byte(tests[2].body))
+	assert.Equal(t, time.Date(2025, 1, 17, 8, 0, 0, 0, time.UTC), e.AddedAt)
+
+	// Events and items Plaxt doesn't use are ignored
+	for _, body := range []string{
+		`{"NotificationType":"PlaybackProgress","ItemType":"Movie"}`,
+		`{"NotificationType":"UserDataSaved","ItemType":"Movie","SaveReason":"PlaybackProgress"}`,
+		`{"NotificationType":"PlaybackStart","ItemType":"Audio"}`,
+	} {
+		_, err := FromJellyfin([]byte(body))
+		assert.ErrorIs(t, err, ErrIgnored)
+	}
+
+	_, err = FromJellyfin([]byte("not json"))
+	assert.Error(t, err)
+	assert.NotErrorIs(t, err, ErrIgnored)
+}
@@ -0,0 +1,237 @@
+// Package media converts webhooks from Plex and other media servers into
+// provider-neutral MediaEvents understood by the rest of Plaxt.
+package media
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// ErrIgnored is returned for webhooks that Plaxt has no use for and should be dropped
+var ErrIgnored = errors.New("event ignored")
+
+// Sources of webhooks
+const (
+	SourcePlex     = "plex"
+	SourceJellyfin = "jellyfin"
+	SourceEmby     = "emby"
+	SourceTautulli = "tautulli"
+)
+
+// Events use the Plex names so history recorded by earlier versions stays comparable
+const (
+	EventPlay     = "media.play"
+	EventPause    = "media.pause"
+	EventResume   = "media.resume"
+	EventStop     = "media.stop"
+	EventScrobble = "media.scrobble"
+	EventRate     = "media.rate"
+	EventAdded    = "library.new"
+	// EventRemoved is named after Emby's event as Plex doesn't report deletions
+	EventRemoved = "library.deleted"
+)
+
+// Kinds of media item
+const (
+	KindMovie   = "movie"
+	KindEpisode = "episode"
+	KindShow    = "show"
+	KindSeason  = "season"
+)
+
+// ExternalID identifies an item in an external database
+type ExternalID struct {
+	// Service is "imdb", "tmdb" or "tvdb"
+	Service string `json:"service"`
+	ID      string `json:"id"`
+}
+
+// Account is the media server user who triggered the event
+type Account struct {
+	ID   string `json:"id,omitempty"`
+	Name string `json:"name"`
+}
+
+// Player is the client the event happened on
+type Player struct {
+	Name    string `json:"name,omitempty"`
+	UUID    string `json:"uuid,omitempty"`
+	Local   bool   `json:"local,omitempty"`
+	Address string `json:"address,omitempty"`
+}
+
+// Server is the media server that sent the event
+type Server struct {
+	Name string `json:"name,omitempty"`
+	UUID string `json:"uuid,omitempty"`
+}
+
+// Library is the library section holding the item
+type Library struct {
+	ID   string `json:"id,omitempty"`
+	Name string `json:"name,omitempty"`
+}
+
+// File describes the copy of an item the media server holds
+type File struct {
+	// Resolution is "4k", "1080", "720", "576", "480" or "sd"
+	Resolution string `json:"resolution,omitempty"`
+	Interlaced bool   `json:"interlaced,omitempty"`
+	// HDR is "dolby_vision", "hdr10", "hdr10_plus" or "hlg"
+	HDR string `json:"hdr,omitempty"`
+	// AudioCodec is the codec's ffmpeg name, e.g. "truehd", "eac3" or "dca"
+	AudioCodec string `json:"audio_codec,omitempty"`
+	// AudioProfile tells DTS variants apart: "ma", "hra" or "x"
+	AudioProfile string `json:"audio_profile,omitempty"`
+	Atmos        bool   `json:"atmos,omitempty"`
+	// AudioChannels is the channel layout, e.g. "5.1"
+	AudioChannels string `json:"audio_channels,omitempty"`
+	ThreeD        bool   `json:"3d,omitempty"`
+}
+
+// EpisodeNumber identifies an episode within its show
+type EpisodeNumber struct {
+	Season  int `json:"season"`
+	Episode int `json:"episode"`
+	// IDs are the episode's own external IDs, if the server knows them
+	IDs []ExternalID `json:"ids,omitempty"`
+}
+
+// LibraryItem is a movie or episode a media server holds
+type LibraryItem struct {
+	Kind string
+	// IDs are the item's own external IDs, as in its webhooks
+	IDs []ExternalID
+}
+
+// MediaEvent is a webhook event from any supported media server
+type MediaEvent struct {
+	Source string `json:"source"`
+	Event  string `json:"event"`
+	Kind   string `json:"kind"`
+	// ItemID is the media server's own ID for the item
+	ItemID string `json:"item_id,omitempty"`
+	Title  string `json:"title"`
+	// ShowTitle, Season and Episode are set for episodes and seasons
+	ShowTitle string `json:"show_title,omitempty"`
+	Season    int    `json:"season,omitempty"`
+	Episode   int    `json:"episode,omitempty"`
+	Year      int    `json:"year,omitempty"`
+	// IDs are in the order they should be tried when searching Trakt
+	IDs []ExternalID `json:"ids,omitempty"`
+	// Progress is the playback position as a percentage of the duration
+	Progress float64   `json:"progress,omitempty"`
+	Rating   float64   `json:"rating,omitempty"`
+	AddedAt  time.Time `json:"added_at,omitzero"`
+	Account  Account   `json:"account"`
+	Player   Player    `json:"player"`
+	Server   Server    `json:"server"`
+	Library  Library   `json:"library"`
+	// File is set for library.new events when the server describes the file
+	File File `json:"file,omitzero"`
+	// Episodes lists what the server holds of a new show or season, when known
+	Episodes []EpisodeNumber `json:"episodes,omitempty"`
+}
+
+// IsLibraryEvent reports whether the event describes the server's library rather than
+// something a viewer did. Servers often send these without an account.
+func (e MediaEvent) IsLibraryEvent() bool {
+	return e.Event == EventAdded || e.Event == EventRemoved
+}
+
+// adapters convert a webhook body from each source into a MediaEvent
+var adapters = map[string]func([]byte) (MediaEvent, error){
+	SourcePlex:     FromPlex,
+	SourceJellyfin: FromJellyfin,
+	SourceEmby:     FromEmby,
+	SourceTautulli: FromTautulli,
+}
+
+// Parse converts a webhook body from the given source into a MediaEvent
+func Parse(source string, body []byte) (MediaEvent, error) {
+	adapter, ok := adapters[source]
+	if !ok {
+		return MediaEvent{}, fmt.Errorf("unknown webhook source %q", source)
+	}
+	event, err := adapter(body)
+	if err != nil {
+		return event, err
+	}
+	event.Source = source
+	return event, nil
+}
+
+// Decode reads an event stored with json.Marshal.
+// Jobs queued by earlier versions hold Plex webhooks and are converted instead.
+func Decode(data []byte) (MediaEvent, error) {
+	var event MediaEvent
+	if err := json.Unmarshal(data, &event); err == nil && event.Kind != "" {
+		return event, nil
+	}
+	return Parse(SourcePlex, data)
+}
+
+// item holds the fields shared by Jellyfin, Emby and Tautulli items
+type item struct {
+	Type          string
+	Name          string
+	SeriesName    string
+	SeasonNumber  int
+	EpisodeNumber int
+	Year          int
+	ProviderIDs   map[string]string
+}
+
+// event builds a MediaEvent for the item. Only movies and episodes are supported.
+func (i item) event() (MediaEvent, error) {
+	e := MediaEvent{
+		Title: i.Name,
+		Year:  i.Year,
+		IDs:   externalIDs(i.ProviderIDs),
+	}
+
+	switch strings.ToLower(i.Type) {
+	case "movie":
+		e.Kind = KindMovie
+	case "episode":
+		e.Kind = KindEpisode
+		e.ShowTitle = i.SeriesName
+		e.Season = i.SeasonNumber
+		e.Episode = i.EpisodeNumber
+	default:
+		return e, ErrIgnored
+	}
+	return e, nil
+}
+
+// externalIDs orders provider IDs as imdb, tmdb then tvdb
+func externalIDs(providerIDs map[string]string) []ExternalID {
+	var result []ExternalID
+	for _, service := range []string{"imdb", "tmdb", "tvdb"} {
+		for key, id := range providerIDs {
+			if strings.EqualFold(key, service) && id != "" {
+				result = append(result, ExternalID{Service: service, ID: id})
+			}
+		}
+	}
+	return result
+}
+
+// progress returns position as a percentage of duration, capped at 100
+func progress(position, duration int64) float64 {
+	if duration <= 0 {
+		return 0
+	}
+	return min(float64(position)/float64(duration)*100, 100)
+}
+
+// addedAt parses a server timestamp, falling back to now
+func addedAt(timestamp string) time.Time {
+	if t, err := time.Parse(time.RFC3339Nano, timestamp); err == nil {
+		return t.UTC()
+	}
+	return time.Now().UTC()
+}
@@ -0,0 +1,228 @@
+package media
+
+import (
+	"encoding/json"
+	"fmt"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// PlexPayload is the subset of a Plex webhook that Plaxt reads
+type PlexPayload struct {
+	Event      string `json:"event"`
+	ViewOffset int64  `json:"viewOffset"`
+	Account    struct {
+		ID    int    `json:"id"`
+		Title string `json:"title"`
+	} `json:"Account"`
+	Server struct {
+		Title string `json:"title"`
+		UUID  string `json:"uuid"`
+	} `json:"Server"`
+	Player struct {
+		Local         bool   `json:"local"`
+		PublicAddress string `json:"publicAddress"`
+		Title         string `json:"title"`
+		UUID          string `json:"uuid"`
+	} `json:"Player"`
+	Metadata struct {
+		LibrarySectionType  string `json:"librarySectionType"`
+		LibrarySectionTitle string `json:"librarySectionTitle"`
+		LibrarySectionID    int    `json:"librarySectionID"`
+		RatingKey           string `json:"ratingKey"`
+		Type                string `json:"type"`
+		Title               string `json:"title"`
+		ParentTitle         string `json:"parentTitle"`
+		GrandparentTitle    string `json:"grandparentTitle"`
+		Index               int    `json:"index"`
+		ParentIndex         int    `json:"parentIndex"`
+		Year                int    `json:"year"`
+		// Guid is Plex's own ID; it must be declared so it isn't matched against Guids
+		Guid  string `json:"guid"`
+		Guids []struct {
+			ID string `json:"id"`
+		} `json:"Guid"`
+		Duration   int64       `json:"duration"`
+		ViewOffset int64       `json:"viewOffset"`
+		UserRating float64     `json:"userRating"`
+		RawRating  interface{} `json:"rating"` // Could be float or array
+		AddedAt    int64       `json:"addedAt"`
+		Media      []plexMedia `json:"Media"`
+	} `json:"Metadata"`
+}
+
+// plexMedia is one copy of an item on the Plex server
+type plexMedia struct {
+	VideoResolution string `json:"videoResolution"`
+	AudioCodec      string `json:"audioCodec"`
+	AudioChannels   int    `json:"audioChannels"`
+	AudioProfile    string `json:"audioProfile"`
+	Part            []struct {
+		File   string       `json:"file"`
+		Stream []plexStream `json:"Stream"`
+	} `json:"Part"`
+}
+
+// plexStream is a video or audio stream within a file
+type plexStream struct {
+	// StreamType is 1 for video and 2 for audio
+	StreamType           int    `json:"streamType"`
+	Selected             bool   `json:"selected"`
+	Codec                string `json:"codec"`
+	Profile              string `json:"profile"`
+	AudioChannelLayout   string `json:"audioChannelLayout"`
+	ScanType             string `json:"scanType"`
+	DOVIPresent          bool   `json:"DOVIPresent"`
+	ColorTrc             string `json:"colorTrc"`
+	DisplayTitle         string `json:"displayTitle"`
+	ExtendedDisplayTitle string `json:"extendedDisplayTitle"`
+}
+
+// plexChannels maps Plex's channel counts to layouts
+var plexChannels = map[int]string{1: "1.0", 2: "2.0", 3: "2.1", 4: "4.0", 5: "5.0", 6: "5.1", 7: "6.1", 8: "7.1"}
+
+// plex3D matches the file name tags Plex users give 3D copies
+var plex3D = []string{"3d", "sbs", "hsbs", "htab", "mvc"}
+
+// file describes the copy from the media's summary, refined by its first part's streams
+func (m plexMedia) file() File {
+	f := File{
+		Resolution:    strings.ToLower(m.VideoResolution),
+		AudioCodec:    strings.ToLower(m.AudioCodec),
+		AudioProfile:  strings.ToLower(m.AudioProfile),
+		AudioChannels: plexChannels[m.AudioChannels],
+	}
+	if len(m.Part) == 0 {
+		return f
+	}
+	part := m.Part[0]
+
+	name := strings.ToLower(strings.TrimSuffix(path.Base(strings.ReplaceAll(part.File, `\`, "/")), path.Ext(part.File)))
+	for _, tag := range strings.FieldsFunc(name, func(r rune) bool { return !unicode.IsLetter(r) && !unicode.IsDigit(r) }) {
+		if slices.Contains(plex3D, tag) {
+			f.ThreeD = true
+		}
+	}
+
+	var audio *plexStream
+	for i, stream := range part.Stream {
+		switch stream.StreamType {
+		case 1:
+			f.Interlaced = stream.ScanType == "interlaced"
+			switch title := stream.DisplayTitle + " " + stream.ExtendedDisplayTitle; {
+			case stream.DOVIPresent:
+				f.HDR = "dolby_vision"
+			case strings.Contains(title, "HDR10+"):
+				f.HDR = "hdr10_plus"
+			case stream.ColorTrc == "smpte2084":
+				f.HDR = "hdr10"
+			case stream.ColorTrc == "arib-std-b67":
+				f.HDR = "hlg"
+			}
+		case 2:
+			// The default audio stream is the one that was summarised
+			if audio == nil || stream.Selected {
+				audio = &part.Stream[i]
+			}
+		}
+	}
+	if audio != nil {
+		f.AudioCodec = strings.ToLower(audio.Codec)
+		f.AudioProfile = strings.ToLower(audio.Profile)
+		if layout, _, _ := strings.Cut(audio.AudioChannelLayout, "("); layout != "" {
+			f.AudioChannels = layout
+		}
+		f.Atmos = strings.Contains(strings.ToLower(audio.DisplayTitle+" "+audio.ExtendedDisplayTitle), "atmos")
+	}
+	return f
+}
+
+// FromPlex converts a Plex webhook into a MediaEvent. Music, photos and server events are ignored.
+func FromPlex(body []byte) (MediaEvent, error) {
+	var p PlexPayload
+	if err := json.Unmarshal(body, &p); err != nil {
+		return MediaEvent{}, fmt.Errorf("invalid plex payload: %w", err)
+	}
+	m := p.Metadata
+
+	e := MediaEvent{
+		Event:   p.Event,
+		ItemID:  m.RatingKey,
+		Title:   m.Title,
+		Year:    m.Year,
+		Rating:  plexRating(m.UserRating, m.RawRating),
+		Account: Account{Name: p.Account.Title},
+		Player:  Player{Name: p.Player.Title, UUID: p.Player.UUID, Local: p.Player.Local, Address: p.Player.PublicAddress},
+		Server:  Server{Name: p.Server.Title, UUID: p.Server.UUID},
+		Library: Library{Name: m.LibrarySectionTitle},
+	}
+	if p.Account.ID != 0 {
+		e.Account.ID = strconv.Itoa(p.Account.ID)
+	}
+	if m.LibrarySectionID != 0 {
+		e.Library.ID = strconv.Itoa(m.LibrarySectionID)
+	}
+	if m.AddedAt != 0 {
+		e.AddedAt = time.Unix(m.AddedAt, 0).UTC()
+	}
+
+	// The offset is normally top level, but some clients only send it with the item
+	offset := p.ViewOffset
+	if offset == 0 {
+		offset = m.ViewOffset
+	}
+	e.Progress = progress(offset, m.Duration)
+
+	if len(m.Media) > 0 {
+		e.File = m.Media[0].file()
+	}
+
+	for _, guid := range m.Guids {
+		service, id, ok := strings.Cut(guid.ID, "://")
+		if ok && id != "" {
+			e.IDs = append(e.IDs, ExternalID{Service: service, ID: id})
+		}
+	}
+
+	switch m.Type {
+	case "movie":
+		e.Kind = KindMovie
+	case "episode":
+		e.Kind = KindEpisode
+		e.ShowTitle = m.GrandparentTitle
+		e.Season = m.ParentIndex
+		e.Episode = m.Index
+	case "show":
+		e.Kind = KindShow
+		e.ShowTitle = m.Title
+	case "season":
+		e.Kind = KindSeason
+		e.ShowTitle = m.ParentTitle
+		e.Season = m.Index
+	default:
+		return e, ErrIgnored
+	}
+	return e, nil
+}
+
+// plexRating returns userRating, falling back to the 'rating' field which can be a float or an array
+func plexRating(userRating float64, raw interface{}) float64 {
+	if userRating != 0 {
+		return userRating
+	}
+	switch val := raw.(type) {
+	case float64:
+		return val
+	case []interface{}:
+		if len(val) > 0 {
+			if r, ok := val[0].(float64); ok {
+				return r
+			}
+		}
+	}
+	return 0
+}
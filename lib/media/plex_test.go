@@ -0,0 +1,147 @@
+package media
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFromPlex(t *testing.T) {
+	episode := `{
+		"event": "media.stop",
+		"viewOffset": 2850000,
+		"Account": {"id": 1, "title": "alice"},
+		"Server": {"title": "Living Room", "uuid": "server-1"},
+		"Player": {"local": true, "publicAddress": "10.0.0.2", "title": "Living Room TV", "uuid": "player-1"},
+		"Metadata": {
+			"librarySectionType": "show",
+			"librarySectionTitle": "TV Shows",
+			"librarySectionID": 2,
+			"ratingKey": "1234",
+			"type": "episode",
+			"title": "Who Is Alive?",
+			"grandparentTitle": "Severance",
+			"parentIndex": 2,
+			"index": 3,
+			"year": 2025,
+			"guid": "plex://episode/669013e833d03eeac35f5d09",
+			"Guid": [{"id": "tvdb://10592760"}, {"id": "tmdb://5469117"}, {"id": "imdb://tt15241840"}],
+			"duration": 3000000,
+			"addedAt": 1707494400
+		}
+	}`
+
+	e, err := FromPlex([]byte(episode))
+	assert.NoError(t, err)
+	assert.Equal(t, MediaEvent{
+		Event:     EventStop,
+		Kind:      KindEpisode,
+		ItemID:    "1234",
+		Title:     "Who Is Alive?",
+		ShowTitle: "Severance",
+		Season:    2,
+		Episode:   3,
+		Year:      2025,
+		// Plex's GUID order is kept
+		IDs:      []ExternalID{{"tvdb", "10592760"}, {"tmdb", "5469117"}, {"imdb", "tt15241840"}},
+		Progress: 95,
+		AddedAt:  time.Date(2024, 2, 9, 16, 0, 0, 0, time.UTC),
+		Account:  Account{ID: "1", Name: "alice"},
+		Player:   Player{Name: "Living Room TV", UUID: "player-1", Local: true, Address: "10.0.0.2"},
+		Server:   Server{Name: "Living Room", UUID: "server-1"},
+		Library:  Library{ID: "2", Name: "TV Shows"},
+	}, e)
+
+	tests := []struct {
+		name     string
+		body     string
+		kind     string
+		rating   float64
+		progress float64
+	}{
+		{"user rating", `{"event":"media.rate","Metadata":{"type":"movie","userRating":8}}`, KindMovie, 8, 0},
+		{"rating fallback", `{"event":"media.rate","Metadata":{"type":"movie","rating":7.5}}`, KindMovie, 7.5, 0},
+		{"rating array", `{"event":"media.rate","Metadata":{"type":"movie","rating":[6]}}`, KindMovie, 6, 0},
+		{"offset on item", `{"event":"media.pause","Metadata":{"type":"movie","viewOffset":500,"duration":1000}}`, KindMovie, 0, 50},
+		{"offset past end", `{"event":"media.stop","viewOffset":1200,"Metadata":{"type":"movie","duration":1000}}`, KindMovie, 0, 100},
+		{"show", `{"event":"media.rate","Metadata":{"type":"show","title":"Severance"}}`, KindShow, 0, 0},
+		{"season", `{"event":"media.rate","Metadata":{"type":"season","parentTitle":"Severance","index":2}}`, KindSeason, 0, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e, err := FromPlex([]byte(tt.body))
+			assert.NoError(t, err)
+			assert.Equal(t, tt.kind, e.Kind)
+			assert.Equal(t, tt.rating, e.Rating)
+			assert.InDelta(t, tt.progress, e.Progress, 0.01)
+		})
+	}
+
+	// Music, photos and server events are ignored
+	for _, body := range []string{
+		`{"event":"media.play","Metadata":{"type":"track"}}`,
+		`{"event":"admin.database.backup"}`,
+	} {
+		_, err := FromPlex([]byte(body))
+		assert.ErrorIs(t, err, ErrIgnored)
+	}
+
+	// The file is described from its streams
+	movie := `{
+		"event": "library.new",
+		"Metadata": {
+			"type": "movie",
+			"title": "Avatar",
+			"Media": [{
+				"videoResolution": "4k",
+				"audioCodec": "truehd",
+				"audioChannels": 8,
+				"Part": [{
+					"file": "/movies/Avatar (2009)/Avatar (2009) 3D HSBS.mkv",
+					"Stream": [
+						{"streamType": 1, "codec": "hevc", "DOVIPresent": true, "colorTrc": "smpte2084", "scanType": "progressive"},
+						{"streamType": 2, "codec": "ac3", "audioChannelLayout": "5.1(side)", "displayTitle": "Commentary (AC3 5.1)"},
+						{"streamType": 2, "selected": true, "codec": "truehd", "audioChannelLayout": "7.1", "extendedDisplayTitle": "English (TrueHD 7.1 Atmos)"}
+					]
+				}]
+			}]
+		}
+	}`
+	e, err = FromPlex([]byte(movie))
+	assert.NoError(t, err)
+	assert.Equal(t, File{Resolution: "4k", HDR: "dolby_vision", AudioCodec: "truehd", Atmos: true, AudioChannels: "7.1", ThreeD: true}, e.File)
+
+	e, err = FromPlex([]byte(`{"event":"library.new","Metadata":{"type":"movie","Media":[{"videoResolution":"1080","audioCodec":"dca","audioProfile":"ma","audioChannels":6,"Part":[{"file":"C:\\Movies\\Heat (1995).mkv"}]}]}}`))
+	assert.NoError(t, err)
+	assert.Equal(t, File{Resolution: "1080", AudioCodec: "dca", AudioProfile: "ma", AudioChannels: "5.1"}, e.File)
+
+	_, err = FromPlex([]byte("{invalid}"))
+	assert.Error(t, err)
+	assert.NotErrorIs(t, err, ErrIgnored)
+}
+
+func TestParse(t *testing.T) {
+	e, err := Parse(SourceJellyfin, []byte(`{"NotificationType":"PlaybackStart","ItemType":"Movie","Name":"Inception"}`))
+	assert.NoError(t, err)
+	assert.Equal(t, SourceJellyfin, e.Source)
+	assert.Equal(t, EventPlay, e.Event)
+
+	_, err = Parse("kodi", []byte(`{}`))
+	assert.Error(t, err)
+
+	// Queued events round trip through JSON
+	data, err := json.Marshal(e)
+	assert.NoError(t, err)
+	decoded, err := Decode(data)
+	assert.NoError(t, err)
+	assert.Equal(t, e, decoded)
+
+	// Plex webhooks queued by earlier versions are still understood
+	decoded, err = Decode([]byte(`{"event":"media.scrobble","Account":{"title":"alice"},"Metadata":{"type":"movie","title":"Inception"}}`))
+	assert.NoError(t, err)
+	assert.Equal(t, SourcePlex, decoded.Source)
+	assert.Equal(t, KindMovie, decoded.Kind)
+	assert.Equal(t, "alice", decoded.Account.Name)
+}
@@ -0,0 +1,133 @@
+package media
+
+import (
+	"cmp"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// TautulliTemplate is the JSON data to configure in Tautulli's webhook notification agent
+const TautulliTemplate = `{
+  "action": "{action}",
+  "username": "{username}",
+  "user_id": "{user_id}",
+  "rating_key": "{rating_key}",
+  "media_type": "{media_type}",
+  "title": "{title}",
+  "episode_name": "{episode_name}",
+  "show_name": "{show_name}",
+  "season_num": "{season_num}",
+  "episode_num": "{episode_num}",
+  "year": "{year}",
+  "imdb_id": "{imdb_id}",
+  "tmdb_id": "{themoviedb_id}",
+  "tvdb_id": "{thetvdb_id}",
+  "progress_percent": "{progress_percent}",
+  "server_name": "{server_name}",
+  "server_id": "{server_machine_id}",
+  "player": "{player}"
+}`
+
+// number is a Tautulli template value. Templates substitute numbers into
+// strings, and unknown or empty parameters are treated as zero.
+type number float64
+
+// UnmarshalJSON accepts both JSON numbers and numeric strings
+func (n *number) UnmarshalJSON(data []byte) error {
+	s := strings.Trim(string(data), `"`)
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		f = 0
+	}
+	*n = number(f)
+	return nil
+}
+
+// TautulliPayload is a notification sent with TautulliTemplate
+type TautulliPayload struct {
+	Action          string `json:"action"`
+	Username        string `json:"username"`
+	UserID          string `json:"user_id"`
+	RatingKey       string `json:"rating_key"`
+	MediaType       string `json:"media_type"`
+	Title           string `json:"title"`
+	EpisodeName     string `json:"episode_name"`
+	ShowName        string `json:"show_name"`
+	SeasonNum       number `json:"season_num"`
+	EpisodeNum      number `json:"episode_num"`
+	Year            number `json:"year"`
+	ImdbID          string `json:"imdb_id"`
+	TmdbID          string `json:"tmdb_id"`
+	TvdbID          string `json:"tvdb_id"`
+	ProgressPercent number `json:"progress_percent"`
+	ServerName      string `json:"server_name"`
+	ServerID        string `json:"server_id"`
+	Player          string `json:"player"`
+}
+
+// FromTautulli converts a Tautulli webhook into a MediaEvent
+func FromTautulli(body []byte) (MediaEvent, error) {
+	var p TautulliPayload
+	if err := json.Unmarshal(body, &p); err != nil {
+		return MediaEvent{}, fmt.Errorf("invalid tautulli payload: %w", err)
+	}
+
+	i := item{
+		Type:          p.MediaType,
+		Name:          p.Title,
+		SeriesName:    p.ShowName,
+		SeasonNumber:  int(p.SeasonNum),
+		EpisodeNumber: int(p.EpisodeNum),
+		Year:          int(p.Year),
+		ProviderIDs:   map[string]string{"imdb": p.ImdbID, "tmdb": p.TmdbID, "tvdb": p.TvdbID},
+	}
+	if p.EpisodeName != "" {
+		i.Name = p.EpisodeName
+	}
+	var e MediaEvent
+	switch strings.ToLower(p.MediaType) {
+	case "show", "season":
+		// Only additions are reported for a whole show or season
+		if p.Action != "created" {
+			return e, ErrIgnored
+		}
+		e = MediaEvent{Kind: KindShow, ShowTitle: cmp.Or(p.ShowName, p.Title), Year: int(p.Year), IDs: externalIDs(i.ProviderIDs)}
+		if strings.EqualFold(p.MediaType, "season") {
+			e.Kind, e.Season = KindSeason, int(p.SeasonNum)
+		}
+	default:
+		var err error
+		if e, err = i.event(); err != nil {
+			return e, err
+		}
+	}
+
+	e.ItemID = p.RatingKey
+	e.Progress = min(float64(p.ProgressPercent), 100)
+	e.Account = Account{ID: p.UserID, Name: p.Username}
+	e.Player = Player{Name: p.Player}
+	e.Server = Server{Name: p.ServerName, UUID: p.ServerID}
+
+	switch p.Action {
+	case "play":
+		e.Event = EventPlay
+	case "pause":
+		e.Event = EventPause
+	case "resume":
+		e.Event = EventResume
+	case "stop":
+		e.Event = EventStop
+	case "watched":
+		e.Event = EventScrobble
+	case "created":
+		e.Event = EventAdded
+		e.AddedAt = time.Now().UTC()
+	default:
+		return e, ErrIgnored
+	}
+
+	return e, nil
+}
@@ -0,0 +1,87 @@
+package media
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFromTautulli(t *testing.T) {
+	// Fill the template the way Tautulli does
+	body := strings.NewReplacer(
+		"{action}", "stop",
+		"{username}", "alice",
+		"{user_id}", "42",
+		"{rating_key}", "1234",
+		"{media_type}", "episode",
+		"{title}", "Severance - Who Is Alive?",
+		"{episode_name}", "Who Is Alive?",
+		"{show_name}", "Severance",
+		"{season_num}", "2",
+		"{episode_num}", "3",
+		"{year}", "2025",
+		"{imdb_id}", "",
+		"{themoviedb_id}", "",
+		"{thetvdb_id}", "10293847",
+		"{progress_percent}", "93",
+		"{server_name}", "Living Room",
+		"{server_machine_id}", "machine-1",
+		"{player}", "Living Room TV",
+	).Replace(TautulliTemplate)
+
+	e, err := FromTautulli([]byte(body))
+	assert.NoError(t, err)
+	assert.Equal(t, EventStop, e.Event)
+	assert.Equal(t, "alice", e.Account.Name)
+	assert.Equal(t, "42", e.Account.ID)
+	assert.Equal(t, "1234", e.ItemID)
+	assert.Equal(t, "machine-1", e.Server.UUID)
+	assert.Equal(t, KindEpisode, e.Kind)
+	assert.Equal(t, "Who Is Alive?", e.Title)
+	assert.Equal(t, "Severance", e.ShowTitle)
+	assert.Equal(t, 2, e.Season)
+	assert.Equal(t, 3, e.Episode)
+	assert.Equal(t, []ExternalID{{"tvdb", "10293847"}}, e.IDs)
+
+	// Progress comes from Tautulli's percentage, including unquoted numbers
+	assert.Equal(t, 93.0, e.Progress)
+	e, err = FromTautulli([]byte(`{"action":"pause","media_type":"movie","title":"Inception","progress_percent":42}`))
+	assert.NoError(t, err)
+	assert.Equal(t, 42.0, e.Progress)
+
+	tests := map[string]string{
+		"play":    "media.play",
+		"pause":   "media.pause",
+		"resume":  "media.resume",
+		"watched": "media.scrobble",
+		"created": "library.new",
+	}
+	for action, event := range tests {
+		e, err := FromTautulli([]byte(`{"action":"` + action + `","media_type":"movie","title":"Inception","year":"2010"}`))
+		assert.NoError(t, err)
+		assert.Equal(t, event, e.Event, action)
+		assert.Equal(t, 2010, e.Year)
+	}
+
+	// Whole shows and seasons are only added
+	e, err = FromTautulli([]byte(`{"action":"created","media_type":"show","title":"Severance","show_name":"Severance","year":"2022","tvdb_id":"371980"}`))
+	assert.NoError(t, err)
+	assert.Equal(t, EventAdded, e.Event)
+	assert.Equal(t, KindShow, e.Kind)
+	assert.Equal(t, "Severance", e.ShowTitle)
+	assert.Equal(t, 2022, e.Year)
+	assert.Equal(t, []ExternalID{{"tvdb", "371980"}}, e.IDs)
+	e, err = FromTautulli([]byte(`{"action":"created","media_type":"season","title":"Season 2","show_name":"Severance","season_num":"2"}`))
+	assert.NoError(t, err)
+	assert.Equal(t, KindSeason, e.Kind)
+	assert.Equal(t, "Severance", e.ShowTitle)
+	assert.Equal(t, 2, e.Season)
+	_, err = FromTautulli([]byte(`{"action":"play","media_type":"season","show_name":"Severance","season_num":"2"}`))
+	assert.ErrorIs(t, err, ErrIgnored)
+
+	_, err = FromTautulli([]byte(`{"action":"buffer","media_type":"movie"}`))
+	assert.ErrorIs(t, err, ErrIgnored)
+	_, err = FromTautulli([]byte(`{"action":"play","media_type":"track"}`))
+	assert.ErrorIs(t, err, ErrIgnored)
+}
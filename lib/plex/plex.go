@@ -0,0 +1,164 @@
+// Package plex reads the library of a Plex Media Server, for what its webhooks don't say
+package plex
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/viscerous/goplaxt/lib/media"
+)
+
+// httpTimeout bounds each request to the server
+const httpTimeout = 30 * time.Second
+
+// Client reads a Plex Media Server's library. Create one with NewClient.
+type Client struct {
+	baseURL    string
+	token      string
+	httpClient *http.Client
+
+	mu sync.Mutex
+	// machineID is the server's identifier, once known
+	machineID string
+}
+
+// NewClient creates a client for the server at baseURL, e.g. http://plex:32400,
+// authenticated with an X-Plex-Token
+func NewClient(baseURL, token string) *Client {
+	return &Client{
+		baseURL:    strings.TrimSuffix(baseURL, "/"),
+		token:      token,
+		httpClient: &http.Client{Timeout: httpTimeout},
+	}
+}
+
+// metadata is the part of a library item Plaxt uses
+type metadata struct {
+	Type        string `json:"type"`
+	ParentIndex int    `json:"parentIndex"`
+	Index       int    `json:"index"`
+	Guids       []struct {
+		ID string `json:"id"`
+	} `json:"Guid"`
+}
+
+// ids returns the item's IMDb, TMDB and TVDB IDs
+func (m metadata) ids() []media.ExternalID {
+	var ids []media.ExternalID
+	for _, guid := range m.Guids {
+		service, id, ok := strings.Cut(guid.ID, "://")
+		if ok && id != "" {
+			ids = append(ids, media.ExternalID{Service: service, ID: id})
+		}
+	}
+	return ids
+}
+
+// container is the JSON envelope of Plex's responses
+type container struct {
+	MediaContainer struct {
+		MachineIdentifier string     `json:"machineIdentifier"`
+		Metadata          []metadata `json:"Metadata"`
+		Directory         []struct {
+			Key  string `json:"key"`
+			Type string `json:"type"`
+		} `json:"Directory"`
+	} `json:"MediaContainer"`
+}
+
+// MachineIdentifier returns the server's identifier, which webhooks from it carry as
+// the server UUID. Rating keys are only meaningful on the server that issued them.
+func (c *Client) MachineIdentifier(ctx context.Context) (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.machineID != "" {
+		return c.machineID, nil
+	}
+
+	var resp container
+	if err := c.get(ctx, "/identity", &resp); err != nil {
+		return "", err
+	}
+	if resp.MediaContainer.MachineIdentifier == "" {
+		return "", fmt.Errorf("plex didn't return a machine identifier")
+	}
+	c.machineID = resp.MediaContainer.MachineIdentifier
+	return c.machineID, nil
+}
+
+// Episodes lists the episodes the server holds of a show or season, given its rating key
+func (c *Client) Episodes(ctx context.Context, ratingKey string) ([]media.EpisodeNumber, error) {
+	var resp container
+	if err := c.get(ctx, "/library/metadata/"+url.PathEscape(ratingKey)+"/allLeaves?includeGuids=1", &resp); err != nil {
+		return nil, err
+	}
+
+	var episodes []media.EpisodeNumber
+	for _, m := range resp.MediaContainer.Metadata {
+		if m.Type == "episode" {
+			episodes = append(episodes, media.EpisodeNumber{Season: m.ParentIndex, Episode: m.Index, IDs: m.ids()})
+		}
+	}
+	return episodes, nil
+}
+
+// Library lists every movie and episode in the server's movie and show libraries
+func (c *Client) Library(ctx context.Context) ([]media.LibraryItem, error) {
+	var sections container
+	if err := c.get(ctx, "/library/sections", &sections); err != nil {
+		return nil, err
+	}
+
+	var items []media.LibraryItem
+	for _, section := range sections.MediaContainer.Directory {
+		// Plex's types are 1 for movies and 4 for episodes
+		var kind, itemType string
+		switch section.Type {
+		case "movie":
+			kind, itemType = media.KindMovie, "1"
+		case "show":
+			kind, itemType = media.KindEpisode, "4"
+		default:
+			continue
+		}
+
+		var resp container
+		if err := c.get(ctx, "/library/sections/"+url.PathEscape(section.Key)+"/all?type="+itemType+"&includeGuids=1", &resp); err != nil {
+			return nil, err
+		}
+		for _, m := range resp.MediaContainer.Metadata {
+			items = append(items, media.LibraryItem{Kind: kind, IDs: m.ids()})
+		}
+	}
+	return items, nil
+}
+
+// get fetches a path of the server's API as JSON
+func (c *Client) get(ctx context.Context, path string, v any) error {
+	req, err := http.NewRequestWithContext(ctx, "GET", c.baseURL+path, nil)
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("X-Plex-Token", c.token)
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("plex request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("plex returned bad status: %d", resp.StatusCode)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		return fmt.Errorf("failed to decode plex response: %w", err)
+	}
+	return nil
+}
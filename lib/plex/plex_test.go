@@ -0,0 +1,90 @@
+package plex
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/viscerous/goplaxt/lib/media"
+)
+
+func TestEpisodes(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "plex-token", r.Header.Get("X-Plex-Token"))
+		assert.Equal(t, "application/json", r.Header.Get("Accept"))
+		if r.URL.RequestURI() != "/library/metadata/100/allLeaves?includeGuids=1" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Write([]byte(`{"MediaContainer": {"Metadata": [
+			{"type": "episode", "parentIndex": 1, "index": 1, "Guid": [{"id": "tvdb://8229221"}]},
+			{"type": "episode", "parentIndex": 1, "index": 3}
+		]}}`))
+	}))
+	defer server.Close()
+
+	client := NewClient(server.URL+"/", "plex-token")
+	episodes, err := client.Episodes(context.Background(), "100")
+	assert.NoError(t, err)
+	assert.Equal(t, []media.EpisodeNumber{
+		{Season: 1, Episode: 1, IDs: []media.ExternalID{{Service: "tvdb", ID: "8229221"}}},
+		{Season: 1, Episode: 3},
+	}, episodes)
+
+	_, err = client.Episodes(context.Background(), "404")
+	assert.EqualError(t, err, "plex returned bad status: 404")
+}
+
+func TestLibrary(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.RequestURI() {
+		case "/library/sections":
+			w.Write([]byte(`{"MediaContainer": {"Directory": [
+				{"key": "1", "type": "movie"},
+				{"key": "2", "type": "show"},
+				{"key": "3", "type": "artist"}
+			]}}`))
+		case "/library/sections/1/all?type=1&includeGuids=1":
+			w.Write([]byte(`{"MediaContainer": {"Metadata": [
+				{"ratingKey": "10", "type": "movie", "Guid": [{"id": "imdb://tt1375666"}, {"id": "tmdb://27205"}]}
+			]}}`))
+		case "/library/sections/2/all?type=4&includeGuids=1":
+			w.Write([]byte(`{"MediaContainer": {"Metadata": [
+				{"ratingKey": "21", "type": "episode", "parentIndex": 1, "index": 2, "Guid": [{"id": "tvdb://8229222"}]},
+				{"ratingKey": "22", "type": "episode", "parentIndex": 1, "index": 3}
+			]}}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	items, err := NewClient(server.URL, "plex-token").Library(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, []media.LibraryItem{
+		{Kind: media.KindMovie, IDs: []media.ExternalID{{Service: "imdb", ID: "tt1375666"}, {Service: "tmdb", ID: "27205"}}},
+		{Kind: media.KindEpisode, IDs: []media.ExternalID{{Service: "tvdb", ID: "8229222"}}},
+		{Kind: media.KindEpisode},
+	}, items)
+}
+
+func TestMachineIdentifier(t *testing.T) {
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		assert.Equal(t, "/identity", r.URL.Path)
+		w.Write([]byte(`{"MediaContainer": {"machineIdentifier": "plex-uuid"}}`))
+	}))
+	defer server.Close()
+
+	client := NewClient(server.URL, "plex-token")
+	for range 2 {
+		id, err := client.MachineIdentifier(context.Background())
+		assert.NoError(t, err)
+		assert.Equal(t, "plex-uuid", id)
+	}
+	// The identifier doesn't change, so it is only fetched once
+	assert.Equal(t, 1, requests)
+}
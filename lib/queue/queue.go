@@ -0,0 +1,246 @@
+package queue
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/viscerous/goplaxt/lib/store"
+)
+
+const (
+	// workerBuffer is the number of jobs each worker can hold before dispatch blocks
+	workerBuffer = 100
+
+	// DefaultMaxAttempts is how many times a job runs before it is dead-lettered
+	DefaultMaxAttempts = 12
+
+	// pollInterval is how often the store is scanned for jobs due a retry
+	pollInterval = 15 * time.Second
+
+	// Retry delays double from baseBackoff up to maxBackoff
+	baseBackoff = 30 * time.Second
+	maxBackoff  = 6 * time.Hour
+)
+
+// ErrJobNotFound is returned when a dead-lettered job does not exist for the user
+var ErrJobNotFound = errors.New("job not found")
+
+// permanentError is a failure that retrying won't fix
+type permanentError struct {
+	err error
+}
+
+func (e permanentError) Error() string { return e.err.Error() }
+func (e permanentError) Unwrap() error { return e.err }
+
+// Permanent marks a handler's error as one that retrying won't fix,
+// so the job is dead-lettered straight away
+func Permanent(err error) error {
+	if err == nil {
+		return nil
+	}
+	return permanentError{err}
+}
+
+// IsPermanent reports whether err was marked with Permanent
+func IsPermanent(err error) bool {
+	return errors.As(err, new(permanentError))
+}
+
+// Handler processes a single job
+type Handler func(ctx context.Context, job store.Job) error
+
+// Queue is a durable job queue that persists every job in the store before it is processed.
+// Failed jobs are retried with exponential backoff and dead-lettered once MaxAttempts is reached.
+type Queue struct {
+	MaxAttempts int
+
+	storage      store.Store
+	handler      Handler
+	workers      []chan store.Job
+	pollInterval time.Duration
+
+	mu       sync.Mutex
+	inFlight map[string]struct{}
+	// settled holds jobs that finished since the current scan started, whose
+	// state in the scan's snapshot may already be stale
+	settled map[string]struct{}
+}
+
+// New creates a queue with the given number of workers
+func New(storage store.Store, workers int, handler Handler) *Queue {
+	if workers < 1 {
+		workers = 1
+	}
+	q := &Queue{
+		MaxAttempts:  DefaultMaxAttempts,
+		storage:      storage,
+		handler:      handler,
+		workers:      make([]chan store.Job, workers),
+		pollInterval: pollInterval,
+		inFlight:     make(map[string]struct{}),
+		settled:      make(map[string]struct{}),
+	}
+	for i := range q.workers {
+		q.workers[i] = make(chan store.Job, workerBuffer)
+	}
+	return q
+}
+
+// Start launches the worker pool and the retry scheduler.
+// Jobs left over from a previous run are dispatched before Start returns.
+func (q *Queue) Start(ctx context.Context) {
+	for i, jobs := range q.workers {
+		go q.work(ctx, i, jobs)
+	}
+	q.scan()
+	go q.schedule(ctx)
+}
+
+// Enqueue persists a job for the user and schedules it for processing
+func (q *Queue) Enqueue(userID string, payload []byte) error {
+	job := store.NewJob(userID, payload)
+	if err := q.storage.WriteJob(job); err != nil {
+		return fmt.Errorf("failed to persist job: %w", err)
+	}
+	q.dispatch(job)
+	return nil
+}
+
+// DeadJobs returns the dead-lettered jobs belonging to a user, oldest first
+func (q *Queue) DeadJobs(userID string) []store.Job {
+	var dead []store.Job
+	for _, job := range q.storage.GetJobs() {
+		if job.Dead && job.UserID == userID {
+			dead = append(dead, job)
+		}
+	}
+	return dead
+}
+
+// Requeue resets a dead-lettered job belonging to the user and runs it again
+func (q *Queue) Requeue(userID, jobID string) error {
+	for _, job := range q.DeadJobs(userID) {
+		if job.ID != jobID {
+			continue
+		}
+		job.Dead = false
+		job.Attempts = 0
+		job.NextRunAt = time.Now().UTC()
+		if err := q.storage.WriteJob(job); err != nil {
+			return fmt.Errorf("failed to persist job: %w", err)
+		}
+		slog.Info("Job requeued", "job_id", job.ID, "user_id", userID)
+		q.dispatch(job)
+		return nil
+	}
+	return ErrJobNotFound
+}
+
+// dispatch hands a job to a worker unless it is already being processed.
+// Jobs for the same user always go to the same worker so that events are
+// processed in the order they were received.
+func (q *Queue) dispatch(job store.Job) {
+	q.mu.Lock()
+	if _, ok := q.inFlight[job.ID]; ok {
+		q.mu.Unlock()
+		return
+	}
+	q.inFlight[job.ID] = struct{}{}
+	q.mu.Unlock()
+
+	h := fnv.New32a()
+	h.Write([]byte(job.UserID))
+	q.workers[h.Sum32()%uint32(len(q.workers))] <- job
+}
+
+// schedule periodically dispatches jobs that are due a retry
+func (q *Queue) schedule(ctx context.Context) {
+	ticker := time.NewTicker(q.pollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			q.scan()
+		}
+	}
+}
+
+// scan dispatches every stored job that is due
+func (q *Queue) scan() {
+	q.mu.Lock()
+	clear(q.settled)
+	q.mu.Unlock()
+
+	now := time.Now()
+	for _, job := range q.storage.GetJobs() {
+		if job.Dead || job.NextRunAt.After(now) {
+			continue
+		}
+		q.mu.Lock()
+		_, stale := q.settled[job.ID]
+		q.mu.Unlock()
+		if !stale {
+			q.dispatch(job)
+		}
+	}
+}
+
+// work processes jobs until the context is cancelled
+func (q *Queue) work(ctx context.Context, id int, jobs <-chan store.Job) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case job := <-jobs:
+			q.process(ctx, id, job)
+		}
+	}
+}
+
+// process runs a job and either removes it or schedules a retry
+func (q *Queue) process(ctx context.Context, worker int, job store.Job) {
+	defer func() {
+		q.mu.Lock()
+		delete(q.inFlight, job.ID)
+		q.settled[job.ID] = struct{}{}
+		q.mu.Unlock()
+	}()
+
+	err := q.handler(ctx, job)
+	if err == nil {
+		q.storage.DeleteJob(job.ID)
+		return
+	}
+
+	job.Attempts++
+	job.LastError = err.Error()
+	if job.Attempts >= q.MaxAttempts || IsPermanent(err) {
+		job.Dead = true
+		slog.Error("Job failed permanently, moved to dead-letter list", "worker", worker, "job_id", job.ID, "user_id", job.UserID, "attempts", job.Attempts, "error", err)
+	} else {
+		job.NextRunAt = time.Now().UTC().Add(backoff(job.Attempts))
+		slog.Warn("Job failed, retry scheduled", "worker", worker, "job_id", job.ID, "user_id", job.UserID, "attempts", job.Attempts, "next_run_at", job.NextRunAt, "error", err)
+	}
+
+	if err := q.storage.WriteJob(job); err != nil {
+		slog.Error("Failed to persist job retry state", "job_id", job.ID, "error", err)
+	}
+}
+
+// backoff returns the delay before the next attempt of a job that has failed the given number of times
+func backoff(attempts int) time.Duration {
+	delay := baseBackoff
+	for i := 1; i < attempts && delay < maxBackoff; i++ {
+		delay *= 2
+	}
+	return min(delay, maxBackoff)
+}
@@ -0,0 +1,141 @@
+package queue
+
+import (
+	"context"
+	"errors"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/viscerous/goplaxt/lib/store"
+)
+
+func TestQueue_ResumesPendingJobs(t *testing.T) {
+	os.RemoveAll("keystore")
+	defer os.RemoveAll("keystore")
+
+	storage := store.NewDiskStore()
+
+	// Simulate a job left behind by a previous run
+	leftover := store.NewJob("user123", []byte(`{"event":"media.stop"}`))
+	assert.NoError(t, storage.WriteJob(leftover))
+
+	processed := make(chan store.Job, 2)
+	q := New(storage, 2, func(ctx context.Context, job store.Job) error {
+		processed <- job
+		return nil
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	q.Start(ctx)
+
+	assert.NoError(t, q.Enqueue("user123", []byte(`{"event":"media.play"}`)))
+
+	var got []string
+	for i := 0; i < 2; i++ {
+		select {
+		case job := <-processed:
+			got = append(got, string(job.Payload))
+		case <-time.After(2 * time.Second):
+			t.Fatal("timed out waiting for jobs")
+		}
+	}
+
+	// Same user, so the leftover job must be processed first
+	assert.Equal(t, []string{`{"event":"media.stop"}`, `{"event":"media.play"}`}, got)
+
+	// Finished jobs are removed from the store
+	assert.Eventually(t, func() bool { return len(storage.GetJobs()) == 0 }, time.Second, 10*time.Millisecond)
+}
+
+func TestQueue_RetryAndDeadLetter(t *testing.T) {
+	os.RemoveAll("keystore")
+	defer os.RemoveAll("keystore")
+
+	storage := store.NewDiskStore()
+
+	fail := true
+	done := make(chan struct{}, 1)
+	q := New(storage, 1, func(ctx context.Context, job store.Job) error {
+		defer func() { done <- struct{}{} }()
+		if fail {
+			return errors.New("server error: 503")
+		}
+		return nil
+	})
+	q.MaxAttempts = 2
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	q.Start(ctx)
+
+	waitDone := func() {
+		select {
+		case <-done:
+		case <-time.After(2 * time.Second):
+			t.Fatal("timed out waiting for job")
+		}
+	}
+
+	// First failure schedules a retry with backoff
+	assert.NoError(t, q.Enqueue("user123", []byte(`{"event":"media.scrobble"}`)))
+	waitDone()
+	var job store.Job
+	assert.Eventually(t, func() bool {
+		jobs := storage.GetJobs()
+		if len(jobs) != 1 || jobs[0].Attempts != 1 {
+			return false
+		}
+		job = jobs[0]
+		return true
+	}, time.Second, 10*time.Millisecond)
+	assert.False(t, job.Dead)
+	assert.Equal(t, "server error: 503", job.LastError)
+	assert.True(t, job.NextRunAt.After(time.Now()))
+
+	// Second failure exhausts the attempts
+	job.NextRunAt = time.Now()
+	assert.NoError(t, storage.WriteJob(job))
+	q.scan()
+	waitDone()
+	assert.Eventually(t, func() bool { return len(q.DeadJobs("user123")) == 1 }, time.Second, 10*time.Millisecond)
+	assert.Empty(t, q.DeadJobs("someone-else"))
+
+	// Requeue only works for the owner
+	assert.ErrorIs(t, q.Requeue("someone-else", job.ID), ErrJobNotFound)
+
+	fail = false
+	assert.NoError(t, q.Requeue("user123", job.ID))
+	waitDone()
+	assert.Eventually(t, func() bool { return len(storage.GetJobs()) == 0 }, time.Second, 10*time.Millisecond)
+}
+
+func TestQueue_PermanentFailure(t *testing.T) {
+	os.RemoveAll("keystore")
+	defer os.RemoveAll("keystore")
+
+	storage := store.NewDiskStore()
+	q := New(storage, 1, func(ctx context.Context, job store.Job) error {
+		return Permanent(errors.New("trakt api returned bad status: 422"))
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	q.Start(ctx)
+
+	// Errors that retrying won't fix are dead-lettered after one attempt
+	assert.NoError(t, q.Enqueue("user123", []byte(`{"event":"media.scrobble"}`)))
+	assert.Eventually(t, func() bool { return len(q.DeadJobs("user123")) == 1 }, time.Second, 10*time.Millisecond)
+	job := q.DeadJobs("user123")[0]
+	assert.Equal(t, 1, job.Attempts)
+	assert.Equal(t, "trakt api returned bad status: 422", job.LastError)
+}
+
+func TestBackoff(t *testing.T) {
+	assert.Equal(t, 30*time.Second, backoff(1))
+	assert.Equal(t, time.Minute, backoff(2))
+	assert.Equal(t, 4*time.Minute, backoff(4))
+	assert.Equal(t, 6*time.Hour, backoff(20))
+}
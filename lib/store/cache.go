@@ -0,0 +1,63 @@
+package store
+
+import (
+	"sync"
+	"time"
+)
+
+// Cache holds values that can be rebuilt, such as Trakt search results, for a limited time
+type Cache interface {
+	GetCache(key string) ([]byte, bool)
+	WriteCache(key string, value []byte, ttl time.Duration) error
+}
+
+// cacheEntry is a cached value and when it expires
+type cacheEntry struct {
+	value   []byte
+	expires time.Time
+}
+
+// MemoryCache is a Cache kept in memory. The zero value is ready to use.
+type MemoryCache struct {
+	mu      sync.Mutex
+	entries map[string]cacheEntry
+	now     func() time.Time
+}
+
+// clock returns the current time
+func (c *MemoryCache) clock() time.Time {
+	if c.now != nil {
+		return c.now()
+	}
+	return time.Now()
+}
+
+// GetCache returns an unexpired value
+func (c *MemoryCache) GetCache(key string) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry, ok := c.entries[key]
+	if !ok || !c.clock().Before(entry.expires) {
+		return nil, false
+	}
+	return entry.value, true
+}
+
+// WriteCache stores a value until the TTL passes, dropping any expired values
+func (c *MemoryCache) WriteCache(key string, value []byte, ttl time.Duration) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := c.clock()
+	if c.entries == nil {
+		c.entries = make(map[string]cacheEntry)
+	}
+	for k, entry := range c.entries {
+		if !now.Before(entry.expires) {
+			delete(c.entries, k)
+		}
+	}
+	c.entries[key] = cacheEntry{value: value, expires: now.Add(ttl)}
+	return nil
+}
@@ -0,0 +1,30 @@
+package store
+
+import (
+	"fmt"
+	"sort"
+)
+
+// CollectedItem is a movie or episode Plaxt added to a user's Trakt collection from a
+// media server, so that it can be removed again once the server no longer holds it
+type CollectedItem struct {
+	// Server is the UUID of the server the item was added on
+	Server string `json:"server"`
+	Kind   string `json:"kind"`
+	// Trakt is the Trakt ID of the movie or episode
+	Trakt int    `json:"trakt"`
+	Title string `json:"title,omitempty"`
+	// IDs are the server's own external IDs for the item, as "service://id"
+	IDs []string `json:"ids"`
+}
+
+// Key identifies the item among a user's collected items
+func (c CollectedItem) Key() string {
+	return fmt.Sprintf("%s/%s/%d", c.Server, c.Kind, c.Trakt)
+}
+
+// sortCollected orders items by key, so every backend lists them the same way
+func sortCollected(items []CollectedItem) []CollectedItem {
+	sort.Slice(items, func(i, j int) bool { return items[i].Key() < items[j].Key() })
+	return items
+}
@@ -6,26 +6,38 @@ import (
 	"log/slog"
 	"os"
 	"path/filepath"
+	"slices"
+	"sort"
 	"strings"
 	"sync"
+	"time"
 )
 
 const (
 	keystorePath = "keystore"
 	indexFile    = "usernames.json"
+	secretsFile  = "webhook_secrets.json"
+	accountsFile = "plex_accounts.json"
+	jobsDir      = "jobs"
+	historyDir   = "history"
+	collectedDir = "collected"
 )
 
 // DiskStore is a storage backend using local filesystem with JSON files
 type DiskStore struct {
 	basePath string
 	mu       sync.RWMutex
+	// cache is kept in memory as it is cheap to rebuild
+	cache MemoryCache
 }
 
 // NewDiskStore creates a new disk-based storage
 func NewDiskStore() *DiskStore {
 	// Ensure keystore directory exists
-	if err := os.MkdirAll(keystorePath, 0755); err != nil {
-		slog.Error("Failed to create keystore directory", "error", err)
+	for _, dir := range []string{jobsDir, historyDir, collectedDir} {
+		if err := os.MkdirAll(filepath.Join(keystorePath, dir), 0755); err != nil {
+			slog.Error("Failed to create keystore directory", "error", err)
+		}
 	}
 	return &DiskStore{basePath: keystorePath}
 }
@@ -55,11 +67,21 @@ func (s *DiskStore) WriteUser(user User) error {
 
 	// Update username index
 	if user.Username != "" {
-		if err := s.updateIndex(user.Username, user.ID); err != nil {
+		if err := s.updateIndex(indexFile, strings.ToLower(user.Username), user.ID); err != nil {
 			slog.Warn("Failed to update username index", "error", err)
 		}
 	}
 
+	// Update webhook secret index, dropping any rotated secret
+	if err := s.updateSecretIndex(user.WebhookSecret, user.ID); err != nil {
+		slog.Warn("Failed to update webhook secret index", "error", err)
+	}
+
+	// Update Plex account index
+	if err := s.updateAccountIndex(user); err != nil {
+		slog.Warn("Failed to update plex account index", "error", err)
+	}
+
 	return nil
 }
 
@@ -90,7 +112,7 @@ func (s *DiskStore) GetUser(id string) *User {
 // GetUserByUsername looks up a user by their username
 func (s *DiskStore) GetUserByUsername(username string) *User {
 	s.mu.RLock()
-	index := s.loadIndex()
+	index := s.loadIndex(indexFile)
 	s.mu.RUnlock()
 
 	id, ok := index[strings.ToLower(username)]
@@ -100,7 +122,70 @@ func (s *DiskStore) GetUserByUsername(username string) *User {
 	return s.GetUser(id)
 }
 
-// DeleteUser removes a user and their index entry
+// GetUserByWebhookSecret looks up a user by their webhook secret
+func (s *DiskStore) GetUserByWebhookSecret(secret string) *User {
+	if secret == "" {
+		return nil
+	}
+
+	s.mu.RLock()
+	index := s.loadIndex(secretsFile)
+	s.mu.RUnlock()
+
+	id, ok := index[secret]
+	if !ok {
+		return nil
+	}
+	return s.GetUser(id)
+}
+
+// GetUsersByPlexAccount finds the users a Plex account, given by ID or title, scrobbles to
+func (s *DiskStore) GetUsersByPlexAccount(id, name string) []*User {
+	s.mu.Lock()
+	index := s.loadAccountIndex()
+	s.mu.Unlock()
+
+	var ids []string
+	for _, key := range lookupKeys(id, name) {
+		for _, userID := range index[key] {
+			if !slices.Contains(ids, userID) {
+				ids = append(ids, userID)
+			}
+		}
+	}
+	sort.Strings(ids)
+
+	users := make([]*User, 0, len(ids))
+	for _, userID := range ids {
+		users = append(users, s.GetUser(userID))
+	}
+	return matchingUsers(users, id, name)
+}
+
+// ListUsers returns every user, ordered by ID
+func (s *DiskStore) ListUsers() []*User {
+	s.mu.RLock()
+	entries, err := os.ReadDir(s.basePath)
+	s.mu.RUnlock()
+	if err != nil {
+		slog.Error("Failed to read keystore directory", "error", err)
+		return nil
+	}
+
+	var users []*User
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || filepath.Ext(name) != ".json" || slices.Contains([]string{indexFile, secretsFile, accountsFile}, name) {
+			continue
+		}
+		if user := s.GetUser(strings.TrimSuffix(name, ".json")); user != nil {
+			users = append(users, user)
+		}
+	}
+	return users
+}
+
+// DeleteUser removes a user, their index entries and everything stored for them
 func (s *DiskStore) DeleteUser(id string) bool {
 	s.mu.Lock()
 	defer s.mu.Unlock()
@@ -110,10 +195,27 @@ func (s *DiskStore) DeleteUser(id string) bool {
 	data, err := os.ReadFile(userPath)
 	if err == nil {
 		var user User
-		if json.Unmarshal(data, &user) == nil && user.Username != "" {
-			s.removeFromIndex(user.Username)
+		if json.Unmarshal(data, &user) == nil {
+			if user.Username != "" {
+				s.removeFromIndex(indexFile, strings.ToLower(user.Username))
+			}
+			if user.WebhookSecret != "" {
+				s.removeFromIndex(secretsFile, user.WebhookSecret)
+			}
 		}
 	}
+	if err := s.updateAccountIndex(User{ID: id}); err != nil {
+		slog.Warn("Failed to update plex account index", "error", err)
+	}
+
+	// Delete history and collected items
+	if err := os.Remove(filepath.Join(s.basePath, historyDir, id+".json")); err != nil && !os.IsNotExist(err) {
+		slog.Warn("Failed to delete history file", "id", id, "error", err)
+	}
+	if err := os.Remove(filepath.Join(s.basePath, collectedDir, id+".json")); err != nil && !os.IsNotExist(err) {
+		slog.Warn("Failed to delete collected items file", "id", id, "error", err)
+	}
+	s.deleteUserJobs(id)
 
 	// Delete user file
 	if err := os.Remove(userPath); err != nil && !os.IsNotExist(err) {
@@ -124,6 +226,229 @@ func (s *DiskStore) DeleteUser(id string) bool {
 	return true
 }
 
+// deleteUserJobs removes a user's queued and dead jobs. The caller holds the lock.
+func (s *DiskStore) deleteUserJobs(userID string) {
+	dir := filepath.Join(s.basePath, jobsDir)
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return
+	}
+	for _, entry := range entries {
+		if entry.IsDir() || filepath.Ext(entry.Name()) != ".json" {
+			continue
+		}
+		path := filepath.Join(dir, entry.Name())
+		data, err := os.ReadFile(path)
+		if err != nil {
+			continue
+		}
+		var job Job
+		if json.Unmarshal(data, &job) != nil || job.UserID != userID {
+			continue
+		}
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			slog.Warn("Failed to delete job file", "id", job.ID, "error", err)
+		}
+	}
+}
+
+// WriteJob saves a pending job to disk as a single JSON file
+func (s *DiskStore) WriteJob(job Job) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	data, err := json.Marshal(job)
+	if err != nil {
+		return fmt.Errorf("failed to marshal job: %w", err)
+	}
+
+	jobPath := filepath.Join(s.basePath, jobsDir, job.ID+".json")
+	if err := s.atomicWrite(jobPath, data); err != nil {
+		return fmt.Errorf("failed to write job file: %w", err)
+	}
+	return nil
+}
+
+// GetJobs loads all pending jobs, oldest first
+func (s *DiskStore) GetJobs() []Job {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	dir := filepath.Join(s.basePath, jobsDir)
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			slog.Error("Failed to read jobs directory", "error", err)
+		}
+		return nil
+	}
+
+	jobs := make([]Job, 0, len(entries))
+	for _, entry := range entries {
+		if entry.IsDir() || filepath.Ext(entry.Name()) != ".json" {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(dir, entry.Name()))
+		if err != nil {
+			slog.Debug("Failed to read job file", "file", entry.Name(), "error", err)
+			continue
+		}
+		var job Job
+		if err := json.Unmarshal(data, &job); err != nil {
+			slog.Error("Failed to unmarshal job", "file", entry.Name(), "error", err)
+			continue
+		}
+		jobs = append(jobs, job)
+	}
+
+	sort.Slice(jobs, func(i, j int) bool { return jobs[i].CreatedAt.Before(jobs[j].CreatedAt) })
+	return jobs
+}
+
+// DeleteJob removes a finished job
+func (s *DiskStore) DeleteJob(id string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	jobPath := filepath.Join(s.basePath, jobsDir, id+".json")
+	if err := os.Remove(jobPath); err != nil && !os.IsNotExist(err) {
+		slog.Error("Failed to delete job file", "id", id, "error", err)
+		return false
+	}
+	return true
+}
+
+// WriteHistory prepends an entry to the user's history file
+func (s *DiskStore) WriteHistory(entry HistoryEntry) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	entries := trimHistory(append([]HistoryEntry{entry}, s.loadHistory(entry.UserID)...))
+	data, err := json.MarshalIndent(entries, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal history: %w", err)
+	}
+
+	historyPath := filepath.Join(s.basePath, historyDir, entry.UserID+".json")
+	if err := s.atomicWrite(historyPath, data); err != nil {
+		return fmt.Errorf("failed to write history file: %w", err)
+	}
+	return nil
+}
+
+// GetHistory loads a user's history, newest first
+func (s *DiskStore) GetHistory(userID string) []HistoryEntry {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return trimHistory(s.loadHistory(userID))
+}
+
+// loadHistory reads a user's history file
+func (s *DiskStore) loadHistory(userID string) []HistoryEntry {
+	data, err := os.ReadFile(filepath.Join(s.basePath, historyDir, userID+".json"))
+	if err != nil {
+		if !os.IsNotExist(err) {
+			slog.Debug("Failed to read history file", "id", userID, "error", err)
+		}
+		return nil
+	}
+
+	var entries []HistoryEntry
+	if err := json.Unmarshal(data, &entries); err != nil {
+		slog.Warn("Failed to parse history file", "id", userID, "error", err)
+		return nil
+	}
+	for i := range entries {
+		entries[i].UserID = userID
+	}
+	return entries
+}
+
+// WriteCollected adds items to the user's collected items file, replacing any with the same key
+func (s *DiskStore) WriteCollected(userID string, items []CollectedItem) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	collected := s.loadCollected(userID)
+	for _, item := range items {
+		collected[item.Key()] = item
+	}
+	return s.writeCollected(userID, collected)
+}
+
+// GetCollected loads the user's collected items
+func (s *DiskStore) GetCollected(userID string) []CollectedItem {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var items []CollectedItem
+	for _, item := range s.loadCollected(userID) {
+		items = append(items, item)
+	}
+	return sortCollected(items)
+}
+
+// DeleteCollected removes items from the user's collected items file
+func (s *DiskStore) DeleteCollected(userID string, items []CollectedItem) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	collected := s.loadCollected(userID)
+	for _, item := range items {
+		delete(collected, item.Key())
+	}
+	return s.writeCollected(userID, collected)
+}
+
+// loadCollected reads a user's collected items file, keyed by item
+func (s *DiskStore) loadCollected(userID string) map[string]CollectedItem {
+	collected := make(map[string]CollectedItem)
+	data, err := os.ReadFile(filepath.Join(s.basePath, collectedDir, userID+".json"))
+	if err != nil {
+		if !os.IsNotExist(err) {
+			slog.Debug("Failed to read collected items file", "id", userID, "error", err)
+		}
+		return collected
+	}
+
+	var items []CollectedItem
+	if err := json.Unmarshal(data, &items); err != nil {
+		slog.Warn("Failed to parse collected items file", "id", userID, "error", err)
+		return collected
+	}
+	for _, item := range items {
+		collected[item.Key()] = item
+	}
+	return collected
+}
+
+// writeCollected saves a user's collected items file
+func (s *DiskStore) writeCollected(userID string, collected map[string]CollectedItem) error {
+	items := make([]CollectedItem, 0, len(collected))
+	for _, item := range collected {
+		items = append(items, item)
+	}
+	data, err := json.MarshalIndent(sortCollected(items), "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal collected items: %w", err)
+	}
+	if err := s.atomicWrite(filepath.Join(s.basePath, collectedDir, userID+".json"), data); err != nil {
+		return fmt.Errorf("failed to write collected items file: %w", err)
+	}
+	return nil
+}
+
+// GetCache returns an unexpired cached value
+func (s *DiskStore) GetCache(key string) ([]byte, bool) {
+	return s.cache.GetCache(key)
+}
+
+// WriteCache caches a value in memory until the TTL passes
+func (s *DiskStore) WriteCache(key string, value []byte, ttl time.Duration) error {
+	return s.cache.WriteCache(key, value, ttl)
+}
+
 // atomicWrite writes data to a file atomically using a temp file
 func (s *DiskStore) atomicWrite(path string, data []byte) error {
 	tempPath := path + ".tmp"
@@ -133,9 +458,9 @@ func (s *DiskStore) atomicWrite(path string, data []byte) error {
 	return os.Rename(tempPath, path)
 }
 
-// loadIndex reads the username -> ID mapping
-func (s *DiskStore) loadIndex() map[string]string {
-	indexPath := filepath.Join(s.basePath, indexFile)
+// loadIndex reads a key -> ID mapping from an index file
+func (s *DiskStore) loadIndex(file string) map[string]string {
+	indexPath := filepath.Join(s.basePath, file)
 	data, err := os.ReadFile(indexPath)
 	if err != nil {
 		return make(map[string]string)
@@ -143,32 +468,114 @@ func (s *DiskStore) loadIndex() map[string]string {
 
 	var index map[string]string
 	if err := json.Unmarshal(data, &index); err != nil {
-		slog.Warn("Failed to parse username index", "error", err)
+		slog.Warn("Failed to parse index", "file", file, "error", err)
 		return make(map[string]string)
 	}
 	return index
 }
 
-// updateIndex adds or updates a username -> ID mapping
-func (s *DiskStore) updateIndex(username, id string) error {
-	index := s.loadIndex()
-	index[strings.ToLower(username)] = id
-
+// writeIndex saves a key -> ID mapping to an index file
+func (s *DiskStore) writeIndex(file string, index map[string]string) error {
 	data, err := json.MarshalIndent(index, "", "  ")
 	if err != nil {
 		return err
 	}
 
-	indexPath := filepath.Join(s.basePath, indexFile)
+	indexPath := filepath.Join(s.basePath, file)
 	return s.atomicWrite(indexPath, data)
 }
 
-// removeFromIndex removes a username from the index
-func (s *DiskStore) removeFromIndex(username string) {
-	index := s.loadIndex()
-	delete(index, strings.ToLower(username))
+// updateIndex adds or updates a key -> ID mapping
+func (s *DiskStore) updateIndex(file, key, id string) error {
+	index := s.loadIndex(file)
+	index[key] = id
+	return s.writeIndex(file, index)
+}
 
-	data, _ := json.MarshalIndent(index, "", "  ")
-	indexPath := filepath.Join(s.basePath, indexFile)
-	s.atomicWrite(indexPath, data)
+// updateSecretIndex points the secret at the user and removes their previous secrets
+func (s *DiskStore) updateSecretIndex(secret, id string) error {
+	index := s.loadIndex(secretsFile)
+	for key, value := range index {
+		if value == id && key != secret {
+			delete(index, key)
+		}
+	}
+	if secret != "" {
+		index[secret] = id
+	}
+	return s.writeIndex(secretsFile, index)
+}
+
+// removeFromIndex removes a key from an index file
+func (s *DiskStore) removeFromIndex(file, key string) {
+	index := s.loadIndex(file)
+	delete(index, key)
+	s.writeIndex(file, index)
+}
+
+// loadAccountIndex reads the Plex account -> user IDs index, building it from the
+// user files if it doesn't exist yet. The caller must hold the write lock.
+func (s *DiskStore) loadAccountIndex() map[string][]string {
+	index := make(map[string][]string)
+	data, err := os.ReadFile(filepath.Join(s.basePath, accountsFile))
+	if err == nil {
+		if err := json.Unmarshal(data, &index); err != nil {
+			slog.Warn("Failed to parse index", "file", accountsFile, "error", err)
+		}
+		return index
+	}
+	if !os.IsNotExist(err) {
+		slog.Warn("Failed to read index", "file", accountsFile, "error", err)
+		return index
+	}
+
+	// Users saved before the index existed
+	paths, _ := filepath.Glob(filepath.Join(s.basePath, "*.json"))
+	for _, path := range paths {
+		switch filepath.Base(path) {
+		case indexFile, secretsFile, accountsFile:
+			continue
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			continue
+		}
+		var user User
+		if json.Unmarshal(data, &user) != nil || user.ID == "" {
+			continue
+		}
+		for _, key := range user.accountKeys() {
+			index[key] = append(index[key], user.ID)
+		}
+	}
+	if err := s.writeAccountIndex(index); err != nil {
+		slog.Warn("Failed to write index", "file", accountsFile, "error", err)
+	}
+	return index
+}
+
+// writeAccountIndex saves the Plex account -> user IDs index
+func (s *DiskStore) writeAccountIndex(index map[string][]string) error {
+	data, err := json.MarshalIndent(index, "", "  ")
+	if err != nil {
+		return err
+	}
+	return s.atomicWrite(filepath.Join(s.basePath, accountsFile), data)
+}
+
+// updateAccountIndex points the user's Plex accounts at them and removes accounts they no longer list
+func (s *DiskStore) updateAccountIndex(user User) error {
+	index := s.loadAccountIndex()
+	for key, ids := range index {
+		ids = slices.DeleteFunc(ids, func(id string) bool { return id == user.ID })
+		if len(ids) == 0 {
+			delete(index, key)
+		} else {
+			index[key] = ids
+		}
+	}
+	for _, key := range user.accountKeys() {
+		index[key] = append(index[key], user.ID)
+	}
+	return s.writeAccountIndex(index)
 }
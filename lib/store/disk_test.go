@@ -3,6 +3,7 @@ package store
 import (
 	"os"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -68,3 +69,191 @@ func TestDiskStoreIndex(t *testing.T) {
 	assert.NotNil(t, found)
 	assert.Equal(t, user.ID, found.ID)
 }
+
+func TestDiskStoreWebhookSecret(t *testing.T) {
+	os.RemoveAll("keystore")
+	defer os.RemoveAll("keystore")
+
+	store := NewDiskStore()
+	user := NewUser("SecretUser", "Access", "Refresh", 3600, 1000, store)
+	assert.NotEmpty(t, user.WebhookSecret)
+	assert.NotEqual(t, user.ID, user.WebhookSecret)
+
+	found := store.GetUserByWebhookSecret(user.WebhookSecret)
+	assert.NotNil(t, found)
+	assert.Equal(t, user.ID, found.ID)
+
+	// Rotating invalidates the old secret
+	oldSecret := user.WebhookSecret
+	assert.NoError(t, user.RotateWebhookSecret())
+	assert.NotEqual(t, oldSecret, user.WebhookSecret)
+	assert.Nil(t, store.GetUserByWebhookSecret(oldSecret))
+	assert.NotNil(t, store.GetUserByWebhookSecret(user.WebhookSecret))
+	assert.Nil(t, store.GetUserByWebhookSecret(""))
+
+	assert.True(t, store.DeleteUser(user.ID))
+	assert.Nil(t, store.GetUserByWebhookSecret(user.WebhookSecret))
+}
+
+func TestDiskStorePlexAccounts(t *testing.T) {
+	os.RemoveAll("keystore")
+	defer os.RemoveAll("keystore")
+
+	store := NewDiskStore()
+	dad := NewUser("dad", "Access", "Refresh", 3600, 1000, store)
+	dad.UpdateConfiguration(Config{}, "Dad", []string{"Dad-Bedroom", "12345"})
+	mum := NewUser("mum", "Access", "Refresh", 3600, 1000, store)
+	mum.UpdateConfiguration(Config{}, "Mum", []string{"dad-bedroom"})
+
+	users := store.GetUsersByPlexAccount("", "DAD-BEDROOM")
+	assert.Len(t, users, 2)
+	users = store.GetUsersByPlexAccount("12345", "Renamed")
+	if assert.Len(t, users, 1) {
+		assert.Equal(t, dad.ID, users[0].ID)
+	}
+
+	// Accounts that are no longer listed are dropped
+	mum.UpdateConfiguration(Config{}, "Mum", nil)
+	assert.Len(t, store.GetUsersByPlexAccount("", "Dad-Bedroom"), 1)
+	assert.Empty(t, store.GetUsersByPlexAccount("", ""))
+
+	// Users saved before the index existed are found
+	assert.NoError(t, os.Remove("keystore/"+accountsFile))
+	assert.Len(t, store.GetUsersByPlexAccount("", "Mum"), 1)
+
+	assert.True(t, store.DeleteUser(dad.ID))
+	assert.Empty(t, store.GetUsersByPlexAccount("12345", "Dad"))
+}
+
+func TestDiskStoreListUsers(t *testing.T) {
+	os.RemoveAll("keystore")
+	defer os.RemoveAll("keystore")
+
+	store := NewDiskStore()
+	assert.Empty(t, store.ListUsers())
+
+	mum := NewUser("mum", "Access", "Refresh", 3600, 1000, store)
+	dad := NewUser("dad", "Access", "Refresh", 3600, 1000, store)
+	assert.NoError(t, store.WriteJob(NewJob(dad.ID, []byte(`{}`))))
+
+	// Index files and jobs are not users
+	users := store.ListUsers()
+	if assert.Len(t, users, 2) {
+		assert.ElementsMatch(t, []string{mum.ID, dad.ID}, []string{users[0].ID, users[1].ID})
+		assert.Less(t, users[0].ID, users[1].ID)
+	}
+
+	assert.True(t, store.DeleteUser(dad.ID))
+	assert.Len(t, store.ListUsers(), 1)
+}
+
+func TestDiskStoreJobs(t *testing.T) {
+	os.RemoveAll("keystore")
+	defer os.RemoveAll("keystore")
+
+	store := NewDiskStore()
+	first := NewJob("user1", []byte(`{"event":"media.play"}`))
+	second := NewJob("user1", []byte(`{"event":"media.stop"}`))
+	second.CreatedAt = first.CreatedAt.Add(time.Second)
+
+	assert.NoError(t, store.WriteJob(second))
+	assert.NoError(t, store.WriteJob(first))
+
+	// Jobs come back oldest first
+	jobs := store.GetJobs()
+	assert.Len(t, jobs, 2)
+	assert.Equal(t, first.ID, jobs[0].ID)
+	assert.Equal(t, first.Payload, jobs[0].Payload)
+	assert.Equal(t, second.ID, jobs[1].ID)
+
+	assert.True(t, store.DeleteJob(first.ID))
+	jobs = store.GetJobs()
+	assert.Len(t, jobs, 1)
+	assert.Equal(t, second.ID, jobs[0].ID)
+
+	// Queued and dead jobs are removed with the user
+	dead := NewJob("user1", []byte(`{"event":"media.scrobble"}`))
+	dead.Dead = true
+	assert.NoError(t, store.WriteJob(dead))
+	other := NewJob("user2", []byte(`{"event":"media.play"}`))
+	assert.NoError(t, store.WriteJob(other))
+	user := NewUserWithID("user1", "JobsUser", "Access", "Refresh", 3600, 1000, store)
+	assert.True(t, store.DeleteUser(user.ID))
+	jobs = store.GetJobs()
+	if assert.Len(t, jobs, 1) {
+		assert.Equal(t, other.ID, jobs[0].ID)
+	}
+}
+
+func TestDiskStoreHistory(t *testing.T) {
+	os.RemoveAll("keystore")
+	defer os.RemoveAll("keystore")
+
+	store := NewDiskStore()
+	now := time.Now().UTC()
+
+	// Entries older than the age limit are dropped
+	assert.NoError(t, store.WriteHistory(HistoryEntry{UserID: "user1", Time: now.Add(-MaxHistoryAge - time.Hour), Event: "media.play"}))
+	for i := 0; i < MaxHistoryEntries+5; i++ {
+		assert.NoError(t, store.WriteHistory(HistoryEntry{UserID: "user1", Time: now, Event: "media.play", Outcome: OutcomeSuccess}))
+	}
+	assert.NoError(t, store.WriteHistory(HistoryEntry{UserID: "user1", Time: now, Event: "media.scrobble", Outcome: OutcomeFailed, Detail: "boom"}))
+
+	history := store.GetHistory("user1")
+	assert.Len(t, history, MaxHistoryEntries)
+	assert.Equal(t, "media.scrobble", history[0].Event)
+	assert.Equal(t, "boom", history[0].Detail)
+	assert.Equal(t, "user1", history[0].UserID)
+	assert.Empty(t, store.GetHistory("user2"))
+
+	// History is removed with the user
+	user := NewUserWithID("user1", "HistoryUser", "Access", "Refresh", 3600, 1000, store)
+	assert.True(t, store.DeleteUser(user.ID))
+	assert.Empty(t, store.GetHistory("user1"))
+}
+
+func TestDiskStoreCache(t *testing.T) {
+	os.RemoveAll("keystore")
+	defer os.RemoveAll("keystore")
+
+	store := NewDiskStore()
+	now := time.Now()
+	store.cache.now = func() time.Time { return now }
+
+	assert.NoError(t, store.WriteCache("key", []byte("value"), time.Hour))
+	value, ok := store.GetCache("key")
+	assert.True(t, ok)
+	assert.Equal(t, []byte("value"), value)
+	_, ok = store.GetCache("other")
+	assert.False(t, ok)
+
+	// Values expire and are dropped on the next write
+	now = now.Add(time.Hour)
+	_, ok = store.GetCache("key")
+	assert.False(t, ok)
+	assert.NoError(t, store.WriteCache("other", []byte("value"), time.Hour))
+	assert.Len(t, store.cache.entries, 1)
+}
+
+func TestDiskStoreCollected(t *testing.T) {
+	os.RemoveAll("keystore")
+	defer os.RemoveAll("keystore")
+
+	store := NewDiskStore()
+	inception := CollectedItem{Server: "plex-uuid", Kind: "movie", Trakt: 1, Title: "Inception", IDs: []string{"imdb://tt1375666"}}
+	tenet := CollectedItem{Server: "plex-uuid", Kind: "movie", Trakt: 2, Title: "Tenet", IDs: []string{"imdb://tt6723592"}}
+
+	assert.NoError(t, store.WriteCollected("user1", []CollectedItem{tenet, inception}))
+	// Collecting an item again replaces it
+	assert.NoError(t, store.WriteCollected("user1", []CollectedItem{inception}))
+	assert.Equal(t, []CollectedItem{inception, tenet}, store.GetCollected("user1"))
+	assert.Empty(t, store.GetCollected("user2"))
+
+	assert.NoError(t, store.DeleteCollected("user1", []CollectedItem{inception}))
+	assert.Equal(t, []CollectedItem{tenet}, store.GetCollected("user1"))
+
+	// Collected items are removed with the user
+	user := NewUserWithID("user1", "CollectedUser", "Access", "Refresh", 3600, 1000, store)
+	assert.True(t, store.DeleteUser(user.ID))
+	assert.Empty(t, store.GetCollected("user1"))
+}
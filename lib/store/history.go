@@ -0,0 +1,51 @@
+package store
+
+import "time"
+
+// History limits applied by every backend
+const (
+	// MaxHistoryEntries is the number of entries kept per user
+	MaxHistoryEntries = 100
+
+	// MaxHistoryAge is how long an entry is kept
+	MaxHistoryAge = 30 * 24 * time.Hour
+)
+
+// Outcomes of a processed webhook
+const (
+	OutcomeSuccess = "success"
+	OutcomeSkipped = "skipped"
+	OutcomeFailed  = "failed"
+)
+
+// TraktIDs identifies the Trakt item a webhook was matched to
+type TraktIDs struct {
+	Trakt int    `json:"trakt,omitempty"`
+	Imdb  string `json:"imdb,omitempty"`
+	Tmdb  int    `json:"tmdb,omitempty"`
+	Tvdb  int    `json:"tvdb,omitempty"`
+}
+
+// HistoryEntry records what Plaxt did with a single webhook for a user
+type HistoryEntry struct {
+	UserID   string    `json:"-"`
+	Time     time.Time `json:"time"`
+	Event    string    `json:"event"`
+	Title    string    `json:"title"`
+	TraktIDs TraktIDs  `json:"trakt_ids"`
+	Action   string    `json:"action,omitempty"`
+	Outcome  string    `json:"outcome"`
+	// Detail holds the error for failed entries or the reason for skipped ones
+	Detail string `json:"detail,omitempty"`
+}
+
+// trimHistory drops entries beyond the history limits from a newest-first list
+func trimHistory(entries []HistoryEntry) []HistoryEntry {
+	cutoff := time.Now().Add(-MaxHistoryAge)
+	for i, entry := range entries {
+		if i >= MaxHistoryEntries || entry.Time.Before(cutoff) {
+			return entries[:i]
+		}
+	}
+	return entries
+}
@@ -0,0 +1,28 @@
+package store
+
+import "time"
+
+// Job is an accepted webhook that has not finished processing yet
+type Job struct {
+	ID        string    `json:"id"`
+	UserID    string    `json:"user_id"`
+	Payload   []byte    `json:"payload"`
+	CreatedAt time.Time `json:"created_at"`
+	Attempts  int       `json:"attempts"`
+	NextRunAt time.Time `json:"next_run_at"`
+	LastError string    `json:"last_error,omitempty"`
+	// Dead jobs have exhausted their retries and wait for a manual requeue
+	Dead bool `json:"dead"`
+}
+
+// NewJob creates a job for a webhook payload belonging to a user
+func NewJob(userID string, payload []byte) Job {
+	now := time.Now().UTC()
+	return Job{
+		ID:        uuid(),
+		UserID:    userID,
+		Payload:   payload,
+		CreatedAt: now,
+		NextRunAt: now,
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"log/slog"
+	"time"
 
 	// PostgreSQL driver
 	_ "github.com/jackc/pgx/v5/stdlib"
@@ -43,6 +44,90 @@ func NewPostgresqlClient(connStr string) *sql.DB {
 	// Create username index
 	_, _ = db.Exec(`CREATE INDEX IF NOT EXISTS idx_users_username_lower ON users (LOWER(username))`)
 
+	// Webhook secret, kept separate from the user ID, and session revocation counter
+	_, err = db.Exec(`
+		ALTER TABLE users
+			ADD COLUMN IF NOT EXISTS webhook_secret VARCHAR(255) NOT NULL DEFAULT '',
+			ADD COLUMN IF NOT EXISTS session_generation INTEGER NOT NULL DEFAULT 0,
+			ADD COLUMN IF NOT EXISTS plex_accounts JSONB NOT NULL DEFAULT '[]'
+	`)
+	if err != nil {
+		slog.Error("Failed to migrate users table", "error", err)
+		return nil
+	}
+	_, _ = db.Exec(`CREATE UNIQUE INDEX IF NOT EXISTS idx_users_webhook_secret ON users (webhook_secret) WHERE webhook_secret <> ''`)
+	_, _ = db.Exec(`CREATE INDEX IF NOT EXISTS idx_users_plex_username_lower ON users (LOWER(plex_username))`)
+
+	// Create jobs table for pending webhooks
+	_, err = db.Exec(`
+		CREATE TABLE IF NOT EXISTS jobs (
+			id VARCHAR(255) PRIMARY KEY,
+			user_id VARCHAR(255) NOT NULL,
+			payload BYTEA NOT NULL,
+			created_at TIMESTAMP WITH TIME ZONE NOT NULL
+		)
+	`)
+	if err != nil {
+		slog.Error("Failed to create jobs table", "error", err)
+		return nil
+	}
+
+	// Retry bookkeeping for jobs
+	_, err = db.Exec(`
+		ALTER TABLE jobs
+			ADD COLUMN IF NOT EXISTS attempts INTEGER NOT NULL DEFAULT 0,
+			ADD COLUMN IF NOT EXISTS next_run_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+			ADD COLUMN IF NOT EXISTS last_error TEXT NOT NULL DEFAULT '',
+			ADD COLUMN IF NOT EXISTS dead BOOLEAN NOT NULL DEFAULT FALSE
+	`)
+	if err != nil {
+		slog.Error("Failed to migrate jobs table", "error", err)
+		return nil
+	}
+
+	// Create history table
+	_, err = db.Exec(`
+		CREATE TABLE IF NOT EXISTS history (
+			id BIGSERIAL PRIMARY KEY,
+			user_id VARCHAR(255) NOT NULL,
+			time TIMESTAMP WITH TIME ZONE NOT NULL,
+			entry JSONB NOT NULL
+		)
+	`)
+	if err != nil {
+		slog.Error("Failed to create history table", "error", err)
+		return nil
+	}
+	_, _ = db.Exec(`CREATE INDEX IF NOT EXISTS idx_history_user_time ON history (user_id, time DESC)`)
+
+	// Create collected items table
+	_, err = db.Exec(`
+		CREATE TABLE IF NOT EXISTS collected (
+			user_id VARCHAR(255) NOT NULL,
+			key VARCHAR(512) NOT NULL,
+			item JSONB NOT NULL,
+			PRIMARY KEY (user_id, key)
+		)
+	`)
+	if err != nil {
+		slog.Error("Failed to create collected table", "error", err)
+		return nil
+	}
+
+	// Create cache table. Expired rows are skipped when read and removed at startup.
+	_, err = db.Exec(`
+		CREATE TABLE IF NOT EXISTS cache (
+			key VARCHAR(512) PRIMARY KEY,
+			value BYTEA NOT NULL,
+			expires_at TIMESTAMP WITH TIME ZONE NOT NULL
+		)
+	`)
+	if err != nil {
+		slog.Error("Failed to create cache table", "error", err)
+		return nil
+	}
+	_, _ = db.Exec(`DELETE FROM cache WHERE expires_at <= NOW()`)
+
 	return db
 }
 
@@ -62,18 +147,29 @@ func (s PostgresqlStore) WriteUser(user User) error {
 	if err != nil {
 		return fmt.Errorf("failed to marshal config: %w", err)
 	}
+	accounts := user.PlexAccounts
+	if accounts == nil {
+		accounts = []string{}
+	}
+	accountsJSON, err := json.Marshal(accounts)
+	if err != nil {
+		return fmt.Errorf("failed to marshal plex accounts: %w", err)
+	}
 
 	_, err = s.db.Exec(`
-		INSERT INTO users (id, username, plex_username, access_token, refresh_token, token_expires_at, config)
-		VALUES ($1, $2, $3, $4, $5, $6, $7)
+		INSERT INTO users (id, username, plex_username, plex_accounts, access_token, refresh_token, token_expires_at, webhook_secret, session_generation, config)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
 		ON CONFLICT (id) DO UPDATE SET
 			username = EXCLUDED.username,
 			plex_username = EXCLUDED.plex_username,
+			plex_accounts = EXCLUDED.plex_accounts,
 			access_token = EXCLUDED.access_token,
 			refresh_token = EXCLUDED.refresh_token,
 			token_expires_at = EXCLUDED.token_expires_at,
+			webhook_secret = EXCLUDED.webhook_secret,
+			session_generation = EXCLUDED.session_generation,
 			config = EXCLUDED.config
-	`, user.ID, user.Username, user.PlexUsername, user.AccessToken, user.RefreshToken, user.TokenExpiresAt, configJSON)
+	`, user.ID, user.Username, user.PlexUsername, accountsJSON, user.AccessToken, user.RefreshToken, user.TokenExpiresAt, user.WebhookSecret, user.SessionGeneration, configJSON)
 
 	if err != nil {
 		slog.Error("Failed to write user", "id", user.ID, "error", err)
@@ -85,18 +181,21 @@ func (s PostgresqlStore) WriteUser(user User) error {
 // GetUser loads a user by ID
 func (s PostgresqlStore) GetUser(id string) *User {
 	var user User
-	var configJSON []byte
+	var accountsJSON, configJSON []byte
 
 	err := s.db.QueryRow(`
-		SELECT id, username, plex_username, access_token, refresh_token, token_expires_at, config
+		SELECT id, username, plex_username, plex_accounts, access_token, refresh_token, token_expires_at, webhook_secret, session_generation, config
 		FROM users WHERE id = $1
 	`, id).Scan(
 		&user.ID,
 		&user.Username,
 		&user.PlexUsername,
+		&accountsJSON,
 		&user.AccessToken,
 		&user.RefreshToken,
 		&user.TokenExpiresAt,
+		&user.WebhookSecret,
+		&user.SessionGeneration,
 		&configJSON,
 	)
 
@@ -107,6 +206,9 @@ func (s PostgresqlStore) GetUser(id string) *User {
 		return nil
 	}
 
+	if err := json.Unmarshal(accountsJSON, &user.PlexAccounts); err != nil {
+		slog.Warn("Failed to unmarshal plex accounts", "id", id, "error", err)
+	}
 	if err := json.Unmarshal(configJSON, &user.Config); err != nil {
 		slog.Warn("Failed to unmarshal config", "id", id, "error", err)
 	}
@@ -132,8 +234,98 @@ func (s PostgresqlStore) GetUserByUsername(username string) *User {
 	return s.GetUser(id)
 }
 
-// DeleteUser removes a user
+// GetUserByWebhookSecret looks up a user by their webhook secret
+func (s PostgresqlStore) GetUserByWebhookSecret(secret string) *User {
+	if secret == "" {
+		return nil
+	}
+
+	var id string
+	err := s.db.QueryRow(`SELECT id FROM users WHERE webhook_secret = $1`, secret).Scan(&id)
+	if err != nil {
+		if err != sql.ErrNoRows {
+			slog.Debug("Failed to look up webhook secret", "error", err)
+		}
+		return nil
+	}
+
+	return s.GetUser(id)
+}
+
+// GetUsersByPlexAccount finds the users a Plex account, given by ID or title, scrobbles to
+func (s PostgresqlStore) GetUsersByPlexAccount(id, name string) []*User {
+	rows, err := s.db.Query(`
+		SELECT id FROM users
+		WHERE LOWER(plex_username) IN (LOWER($1), LOWER($2))
+			OR EXISTS (
+				SELECT 1 FROM jsonb_array_elements_text(plex_accounts) AS account
+				WHERE LOWER(account) IN (LOWER($1), LOWER($2))
+			)
+		ORDER BY id
+	`, id, name)
+	if err != nil {
+		slog.Error("Failed to look up plex account", "error", err)
+		return nil
+	}
+	defer rows.Close()
+
+	var ids []string
+	for rows.Next() {
+		var userID string
+		if err := rows.Scan(&userID); err != nil {
+			slog.Warn("Failed to scan user", "error", err)
+			continue
+		}
+		ids = append(ids, userID)
+	}
+
+	users := make([]*User, 0, len(ids))
+	for _, userID := range ids {
+		users = append(users, s.GetUser(userID))
+	}
+	return matchingUsers(users, id, name)
+}
+
+// ListUsers returns every user, ordered by ID
+func (s PostgresqlStore) ListUsers() []*User {
+	rows, err := s.db.Query(`SELECT id FROM users ORDER BY id`)
+	if err != nil {
+		slog.Error("Failed to list users", "error", err)
+		return nil
+	}
+	defer rows.Close()
+
+	var ids []string
+	for rows.Next() {
+		var userID string
+		if err := rows.Scan(&userID); err != nil {
+			slog.Warn("Failed to scan user", "error", err)
+			continue
+		}
+		ids = append(ids, userID)
+	}
+
+	users := make([]*User, 0, len(ids))
+	for _, userID := range ids {
+		if user := s.GetUser(userID); user != nil {
+			users = append(users, user)
+		}
+	}
+	return users
+}
+
+// DeleteUser removes a user, their history, their collected items and their queued or dead jobs
 func (s PostgresqlStore) DeleteUser(id string) bool {
+	if _, err := s.db.Exec(`DELETE FROM history WHERE user_id = $1`, id); err != nil {
+		slog.Warn("Failed to delete history", "id", id, "error", err)
+	}
+	if _, err := s.db.Exec(`DELETE FROM collected WHERE user_id = $1`, id); err != nil {
+		slog.Warn("Failed to delete collected items", "id", id, "error", err)
+	}
+	if _, err := s.db.Exec(`DELETE FROM jobs WHERE user_id = $1`, id); err != nil {
+		slog.Warn("Failed to delete jobs", "id", id, "error", err)
+	}
+
 	_, err := s.db.Exec(`DELETE FROM users WHERE id = $1`, id)
 	if err != nil {
 		slog.Error("Failed to delete user", "id", id, "error", err)
@@ -141,3 +333,193 @@ func (s PostgresqlStore) DeleteUser(id string) bool {
 	}
 	return true
 }
+
+// WriteJob saves a pending job
+func (s PostgresqlStore) WriteJob(job Job) error {
+	_, err := s.db.Exec(`
+		INSERT INTO jobs (id, user_id, payload, created_at, attempts, next_run_at, last_error, dead)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+		ON CONFLICT (id) DO UPDATE SET
+			user_id = EXCLUDED.user_id,
+			payload = EXCLUDED.payload,
+			created_at = EXCLUDED.created_at,
+			attempts = EXCLUDED.attempts,
+			next_run_at = EXCLUDED.next_run_at,
+			last_error = EXCLUDED.last_error,
+			dead = EXCLUDED.dead
+	`, job.ID, job.UserID, job.Payload, job.CreatedAt, job.Attempts, job.NextRunAt, job.LastError, job.Dead)
+
+	if err != nil {
+		slog.Error("Failed to write job", "id", job.ID, "error", err)
+		return err
+	}
+	return nil
+}
+
+// GetJobs loads all pending jobs, oldest first
+func (s PostgresqlStore) GetJobs() []Job {
+	rows, err := s.db.Query(`
+		SELECT id, user_id, payload, created_at, attempts, next_run_at, last_error, dead
+		FROM jobs ORDER BY created_at
+	`)
+	if err != nil {
+		slog.Error("Failed to get jobs", "error", err)
+		return nil
+	}
+	defer rows.Close()
+
+	var jobs []Job
+	for rows.Next() {
+		var job Job
+		if err := rows.Scan(&job.ID, &job.UserID, &job.Payload, &job.CreatedAt, &job.Attempts, &job.NextRunAt, &job.LastError, &job.Dead); err != nil {
+			slog.Error("Failed to scan job", "error", err)
+			continue
+		}
+		jobs = append(jobs, job)
+	}
+	return jobs
+}
+
+// DeleteJob removes a finished job
+func (s PostgresqlStore) DeleteJob(id string) bool {
+	_, err := s.db.Exec(`DELETE FROM jobs WHERE id = $1`, id)
+	if err != nil {
+		slog.Error("Failed to delete job", "id", id, "error", err)
+		return false
+	}
+	return true
+}
+
+// WriteHistory records an entry and prunes the user's history to the limits
+func (s PostgresqlStore) WriteHistory(entry HistoryEntry) error {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return fmt.Errorf("failed to marshal history entry: %w", err)
+	}
+
+	_, err = s.db.Exec(`INSERT INTO history (user_id, time, entry) VALUES ($1, $2, $3)`, entry.UserID, entry.Time, data)
+	if err != nil {
+		slog.Error("Failed to write history", "id", entry.UserID, "error", err)
+		return err
+	}
+
+	_, err = s.db.Exec(`
+		DELETE FROM history WHERE user_id = $1 AND (
+			time < $2 OR id NOT IN (
+				SELECT id FROM history WHERE user_id = $1 ORDER BY time DESC LIMIT $3
+			)
+		)
+	`, entry.UserID, time.Now().Add(-MaxHistoryAge), MaxHistoryEntries)
+	if err != nil {
+		slog.Warn("Failed to prune history", "id", entry.UserID, "error", err)
+	}
+	return nil
+}
+
+// GetHistory loads a user's history, newest first
+func (s PostgresqlStore) GetHistory(userID string) []HistoryEntry {
+	rows, err := s.db.Query(`
+		SELECT entry FROM history WHERE user_id = $1 ORDER BY time DESC LIMIT $2
+	`, userID, MaxHistoryEntries)
+	if err != nil {
+		slog.Debug("Failed to get history", "id", userID, "error", err)
+		return nil
+	}
+	defer rows.Close()
+
+	var entries []HistoryEntry
+	for rows.Next() {
+		var data []byte
+		if err := rows.Scan(&data); err != nil {
+			slog.Error("Failed to scan history entry", "error", err)
+			continue
+		}
+		var entry HistoryEntry
+		if err := json.Unmarshal(data, &entry); err != nil {
+			slog.Warn("Failed to unmarshal history entry", "id", userID, "error", err)
+			continue
+		}
+		entry.UserID = userID
+		entries = append(entries, entry)
+	}
+	return trimHistory(entries)
+}
+
+// WriteCollected records items the user collected, replacing any with the same key
+func (s PostgresqlStore) WriteCollected(userID string, items []CollectedItem) error {
+	for _, item := range items {
+		data, err := json.Marshal(item)
+		if err != nil {
+			return fmt.Errorf("failed to marshal collected item: %w", err)
+		}
+		_, err = s.db.Exec(`
+			INSERT INTO collected (user_id, key, item) VALUES ($1, $2, $3)
+			ON CONFLICT (user_id, key) DO UPDATE SET item = EXCLUDED.item
+		`, userID, item.Key(), data)
+		if err != nil {
+			return fmt.Errorf("failed to write collected item: %w", err)
+		}
+	}
+	return nil
+}
+
+// GetCollected loads the user's collected items
+func (s PostgresqlStore) GetCollected(userID string) []CollectedItem {
+	rows, err := s.db.Query(`SELECT item FROM collected WHERE user_id = $1 ORDER BY key`, userID)
+	if err != nil {
+		slog.Debug("Failed to get collected items", "id", userID, "error", err)
+		return nil
+	}
+	defer rows.Close()
+
+	var items []CollectedItem
+	for rows.Next() {
+		var data []byte
+		if err := rows.Scan(&data); err != nil {
+			slog.Error("Failed to scan collected item", "error", err)
+			continue
+		}
+		var item CollectedItem
+		if err := json.Unmarshal(data, &item); err != nil {
+			slog.Warn("Failed to unmarshal collected item", "id", userID, "error", err)
+			continue
+		}
+		items = append(items, item)
+	}
+	return items
+}
+
+// DeleteCollected removes items from the user's collected items
+func (s PostgresqlStore) DeleteCollected(userID string, items []CollectedItem) error {
+	for _, item := range items {
+		if _, err := s.db.Exec(`DELETE FROM collected WHERE user_id = $1 AND key = $2`, userID, item.Key()); err != nil {
+			return fmt.Errorf("failed to delete collected item: %w", err)
+		}
+	}
+	return nil
+}
+
+// GetCache returns an unexpired cached value
+func (s PostgresqlStore) GetCache(key string) ([]byte, bool) {
+	var value []byte
+	err := s.db.QueryRow(`SELECT value FROM cache WHERE key = $1 AND expires_at > NOW()`, key).Scan(&value)
+	if err != nil {
+		if err != sql.ErrNoRows {
+			slog.Debug("Failed to get cached value", "key", key, "error", err)
+		}
+		return nil, false
+	}
+	return value, true
+}
+
+// WriteCache stores a value until the TTL passes
+func (s PostgresqlStore) WriteCache(key string, value []byte, ttl time.Duration) error {
+	_, err := s.db.Exec(`
+		INSERT INTO cache (key, value, expires_at) VALUES ($1, $2, $3)
+		ON CONFLICT (key) DO UPDATE SET value = EXCLUDED.value, expires_at = EXCLUDED.expires_at
+	`, key, value, time.Now().Add(ttl))
+	if err != nil {
+		return fmt.Errorf("failed to write cache: %w", err)
+	}
+	return nil
+}
@@ -1,6 +1,7 @@
 package store
 
 import (
+	"database/sql"
 	"testing"
 	"time"
 
@@ -46,13 +47,15 @@ func TestPostgresqlStore(t *testing.T) {
 
 	// Test GetUser
 	mock.ExpectQuery("SELECT .+ FROM users WHERE id = ").WithArgs("test-id").WillReturnRows(
-		sqlmock.NewRows([]string{"id", "username", "plex_username", "access_token", "refresh_token", "token_expires_at", "config"}).
-			AddRow("test-id", "TestUser", "PlexTest", "access123", "refresh123", fixedTime, configJSON),
+		sqlmock.NewRows([]string{"id", "username", "plex_username", "plex_accounts", "access_token", "refresh_token", "token_expires_at", "webhook_secret", "session_generation", "config"}).
+			AddRow("test-id", "TestUser", "PlexTest", []byte(`["Dad-Bedroom"]`), "access123", "refresh123", fixedTime, "secret123", 0, configJSON),
 	)
 
 	actual := store.GetUser("test-id")
 	assert.NotNil(t, actual)
 	assert.Equal(t, "TestUser", actual.Username)
+	assert.Equal(t, "secret123", actual.WebhookSecret)
+	assert.Equal(t, []string{"Dad-Bedroom"}, actual.PlexAccounts)
 	assert.True(t, actual.Config.GetMovieScrobbleStart())
 	assert.True(t, actual.IsConfigured())
 
@@ -75,8 +78,8 @@ func TestPostgresqlGetByUsername(t *testing.T) {
 		sqlmock.NewRows([]string{"id"}).AddRow("test-id"),
 	)
 	mock.ExpectQuery("SELECT .+ FROM users WHERE id = ").WithArgs("test-id").WillReturnRows(
-		sqlmock.NewRows([]string{"id", "username", "plex_username", "access_token", "refresh_token", "token_expires_at", "config"}).
-			AddRow("test-id", "TestUser", "", "access", "refresh", fixedTime, configJSON),
+		sqlmock.NewRows([]string{"id", "username", "plex_username", "plex_accounts", "access_token", "refresh_token", "token_expires_at", "webhook_secret", "session_generation", "config"}).
+			AddRow("test-id", "TestUser", "", []byte(`[]`), "access", "refresh", fixedTime, "", 0, configJSON),
 	)
 
 	actual := store.GetUserByUsername("testuser")
@@ -85,3 +88,215 @@ func TestPostgresqlGetByUsername(t *testing.T) {
 
 	assert.NoError(t, mock.ExpectationsWereMet())
 }
+
+func TestPostgresqlGetByWebhookSecret(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer db.Close()
+
+	store := NewPostgresqlStore(db)
+	fixedTime := time.Now()
+	configJSON := []byte(`{}`)
+
+	mock.ExpectQuery("SELECT id FROM users WHERE webhook_secret = ").WithArgs("secret123").WillReturnRows(
+		sqlmock.NewRows([]string{"id"}).AddRow("test-id"),
+	)
+	mock.ExpectQuery("SELECT .+ FROM users WHERE id = ").WithArgs("test-id").WillReturnRows(
+		sqlmock.NewRows([]string{"id", "username", "plex_username", "plex_accounts", "access_token", "refresh_token", "token_expires_at", "webhook_secret", "session_generation", "config"}).
+			AddRow("test-id", "TestUser", "", []byte(`[]`), "access", "refresh", fixedTime, "secret123", 0, configJSON),
+	)
+
+	actual := store.GetUserByWebhookSecret("secret123")
+	assert.NotNil(t, actual)
+	assert.Equal(t, "test-id", actual.ID)
+
+	// Empty secrets never match
+	assert.Nil(t, store.GetUserByWebhookSecret(""))
+
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestPostgresqlGetByPlexAccount(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer db.Close()
+
+	store := NewPostgresqlStore(db)
+	fixedTime := time.Now()
+	configJSON := []byte(`{}`)
+
+	mock.ExpectQuery("SELECT id FROM users WHERE .+jsonb_array_elements_text").WithArgs("12345", "Renamed").WillReturnRows(
+		sqlmock.NewRows([]string{"id"}).AddRow("user-1").AddRow("user-2"),
+	)
+	mock.ExpectQuery("SELECT .+ FROM users WHERE id = ").WithArgs("user-1").WillReturnRows(
+		sqlmock.NewRows([]string{"id", "username", "plex_username", "plex_accounts", "access_token", "refresh_token", "token_expires_at", "webhook_secret", "session_generation", "config"}).
+			AddRow("user-1", "dad", "Dad", []byte(`["12345"]`), "access", "refresh", fixedTime, "", 0, configJSON),
+	)
+	// Index matches are checked against the user's accounts
+	mock.ExpectQuery("SELECT .+ FROM users WHERE id = ").WithArgs("user-2").WillReturnRows(
+		sqlmock.NewRows([]string{"id", "username", "plex_username", "plex_accounts", "access_token", "refresh_token", "token_expires_at", "webhook_secret", "session_generation", "config"}).
+			AddRow("user-2", "mum", "Mum", []byte(`[]`), "access", "refresh", fixedTime, "", 0, configJSON),
+	)
+
+	users := store.GetUsersByPlexAccount("12345", "Renamed")
+	if assert.Len(t, users, 1) {
+		assert.Equal(t, "user-1", users[0].ID)
+	}
+
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestPostgresqlListUsers(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer db.Close()
+
+	store := NewPostgresqlStore(db)
+	fixedTime := time.Now()
+
+	mock.ExpectQuery("SELECT id FROM users ORDER BY id").WillReturnRows(
+		sqlmock.NewRows([]string{"id"}).AddRow("user-1").AddRow("user-2"),
+	)
+	mock.ExpectQuery("SELECT .+ FROM users WHERE id = ").WithArgs("user-1").WillReturnRows(
+		sqlmock.NewRows([]string{"id", "username", "plex_username", "plex_accounts", "access_token", "refresh_token", "token_expires_at", "webhook_secret", "session_generation", "config"}).
+			AddRow("user-1", "dad", "Dad", []byte(`[]`), "access", "refresh", fixedTime, "", 0, []byte(`{}`)),
+	)
+	// Users deleted in the meantime are left out
+	mock.ExpectQuery("SELECT .+ FROM users WHERE id = ").WithArgs("user-2").WillReturnError(sql.ErrNoRows)
+
+	users := store.ListUsers()
+	if assert.Len(t, users, 1) {
+		assert.Equal(t, "user-1", users[0].ID)
+		assert.Equal(t, "refresh", users[0].RefreshToken)
+	}
+
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestPostgresqlStoreJobs(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer db.Close()
+
+	store := NewPostgresqlStore(db)
+	fixedTime := time.Date(2025, 3, 28, 22, 30, 55, 0, time.UTC)
+	job := Job{
+		ID:        "job-id",
+		UserID:    "test-id",
+		Payload:   []byte(`{"event":"media.stop"}`),
+		CreatedAt: fixedTime,
+		Attempts:  2,
+		NextRunAt: fixedTime.Add(time.Minute),
+		LastError: "server error: 503",
+	}
+
+	mock.ExpectExec("INSERT INTO jobs").
+		WithArgs(job.ID, job.UserID, job.Payload, job.CreatedAt, job.Attempts, job.NextRunAt, job.LastError, job.Dead).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	assert.NoError(t, store.WriteJob(job))
+
+	mock.ExpectQuery("SELECT .+ FROM jobs ORDER BY created_at").WillReturnRows(
+		sqlmock.NewRows([]string{"id", "user_id", "payload", "created_at", "attempts", "next_run_at", "last_error", "dead"}).
+			AddRow(job.ID, job.UserID, job.Payload, fixedTime, job.Attempts, job.NextRunAt, job.LastError, job.Dead),
+	)
+	jobs := store.GetJobs()
+	assert.Len(t, jobs, 1)
+	assert.Equal(t, job, jobs[0])
+
+	mock.ExpectExec("DELETE FROM jobs WHERE id = ").WithArgs(job.ID).WillReturnResult(sqlmock.NewResult(0, 1))
+	assert.True(t, store.DeleteJob(job.ID))
+
+	// Queued and dead jobs are removed with the user
+	mock.ExpectExec("DELETE FROM history WHERE user_id = ").WithArgs("test-id").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("DELETE FROM collected WHERE user_id = ").WithArgs("test-id").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("DELETE FROM jobs WHERE user_id = ").WithArgs("test-id").WillReturnResult(sqlmock.NewResult(0, 2))
+	mock.ExpectExec("DELETE FROM users WHERE id = ").WithArgs("test-id").WillReturnResult(sqlmock.NewResult(0, 1))
+	assert.True(t, store.DeleteUser("test-id"))
+
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestPostgresqlStoreHistory(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer db.Close()
+
+	store := NewPostgresqlStore(db)
+	entry := HistoryEntry{UserID: "test-id", Time: time.Now().UTC(), Event: "media.scrobble", Title: "Inception (2010)", Outcome: OutcomeSuccess}
+
+	mock.ExpectExec("INSERT INTO history").WithArgs("test-id", entry.Time, sqlmock.AnyArg()).WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec("DELETE FROM history WHERE user_id = ").WithArgs("test-id", sqlmock.AnyArg(), MaxHistoryEntries).WillReturnResult(sqlmock.NewResult(0, 0))
+	assert.NoError(t, store.WriteHistory(entry))
+
+	mock.ExpectQuery("SELECT entry FROM history WHERE user_id = ").WithArgs("test-id", MaxHistoryEntries).WillReturnRows(
+		sqlmock.NewRows([]string{"entry"}).
+			AddRow([]byte(`{"time":"` + entry.Time.Format(time.RFC3339Nano) + `","event":"media.scrobble","title":"Inception (2010)","trakt_ids":{},"outcome":"success"}`)),
+	)
+	history := store.GetHistory("test-id")
+	assert.Len(t, history, 1)
+	assert.Equal(t, "Inception (2010)", history[0].Title)
+	assert.Equal(t, "test-id", history[0].UserID)
+
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestPostgresqlStoreCache(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer db.Close()
+
+	store := NewPostgresqlStore(db)
+
+	mock.ExpectExec("INSERT INTO cache").WithArgs("key", []byte("value"), sqlmock.AnyArg()).WillReturnResult(sqlmock.NewResult(1, 1))
+	assert.NoError(t, store.WriteCache("key", []byte("value"), time.Hour))
+
+	mock.ExpectQuery("SELECT value FROM cache WHERE key = .+ AND expires_at > NOW()").WithArgs("key").WillReturnRows(
+		sqlmock.NewRows([]string{"value"}).AddRow([]byte("value")),
+	)
+	value, ok := store.GetCache("key")
+	assert.True(t, ok)
+	assert.Equal(t, []byte("value"), value)
+
+	mock.ExpectQuery("SELECT value FROM cache").WithArgs("other").WillReturnError(sql.ErrNoRows)
+	_, ok = store.GetCache("other")
+	assert.False(t, ok)
+
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestPostgresqlStoreCollected(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer db.Close()
+
+	store := NewPostgresqlStore(db)
+	item := CollectedItem{Server: "plex-uuid", Kind: "movie", Trakt: 1, Title: "Inception", IDs: []string{"imdb://tt1375666"}}
+
+	mock.ExpectExec("INSERT INTO collected").WithArgs("test-id", "plex-uuid/movie/1", sqlmock.AnyArg()).WillReturnResult(sqlmock.NewResult(1, 1))
+	assert.NoError(t, store.WriteCollected("test-id", []CollectedItem{item}))
+
+	mock.ExpectQuery("SELECT item FROM collected WHERE user_id = ").WithArgs("test-id").WillReturnRows(
+		sqlmock.NewRows([]string{"item"}).
+			AddRow([]byte(`{"server":"plex-uuid","kind":"movie","trakt":1,"title":"Inception","ids":["imdb://tt1375666"]}`)),
+	)
+	assert.Equal(t, []CollectedItem{item}, store.GetCollected("test-id"))
+
+	mock.ExpectExec("DELETE FROM collected WHERE user_id = .+ AND key = ").WithArgs("test-id", "plex-uuid/movie/1").WillReturnResult(sqlmock.NewResult(0, 1))
+	assert.NoError(t, store.DeleteCollected("test-id", []CollectedItem{item}))
+
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
@@ -6,8 +6,11 @@ import (
 	"fmt"
 	"log/slog"
 	"os"
+	"slices"
+	"sort"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/redis/go-redis/v9"
 )
@@ -36,7 +39,29 @@ func NewRedisClient(addr, password string) *redis.Client {
 
 // NewRedisStore creates a new Redis-backed store
 func NewRedisStore(client *redis.Client) *RedisStore {
-	return &RedisStore{client: client}
+	s := &RedisStore{client: client}
+	s.indexPlexAccounts()
+	return s
+}
+
+// indexPlexAccounts adds users saved before the Plex account index existed to it
+func (s *RedisStore) indexPlexAccounts() {
+	ctx := context.Background()
+	if created, err := s.client.SetNX(ctx, "goplaxt:plexaccounts:indexed", 1, 0).Result(); err != nil || !created {
+		return
+	}
+
+	iter := s.client.Scan(ctx, 0, "goplaxt:user:*", 0).Iterator()
+	for iter.Next(ctx) {
+		if user := s.GetUser(strings.TrimPrefix(iter.Val(), "goplaxt:user:")); user != nil {
+			for _, key := range user.accountKeys() {
+				s.client.SAdd(ctx, "goplaxt:plexaccount:"+key, user.ID)
+			}
+		}
+	}
+	if err := iter.Err(); err != nil {
+		slog.Warn("Failed to index plex accounts", "error", err)
+	}
 }
 
 // Ping verifies Redis connectivity
@@ -58,6 +83,14 @@ func (s *RedisStore) WriteUser(user User) error {
 		return fmt.Errorf("failed to marshal user: %w", err)
 	}
 
+	// Find any secret and Plex accounts this write replaces
+	var previousSecret string
+	var previousAccounts []string
+	if previous := s.GetUser(user.ID); previous != nil {
+		previousSecret = previous.WebhookSecret
+		previousAccounts = previous.accountKeys()
+	}
+
 	// Store user data
 	if err := s.client.Set(ctx, key, data, 0).Err(); err != nil {
 		return fmt.Errorf("failed to write user: %w", err)
@@ -71,6 +104,29 @@ func (s *RedisStore) WriteUser(user User) error {
 		}
 	}
 
+	// Update webhook secret index
+	if previousSecret != "" && previousSecret != user.WebhookSecret {
+		s.client.Del(ctx, "goplaxt:webhook:"+previousSecret)
+	}
+	if user.WebhookSecret != "" {
+		if err := s.client.Set(ctx, "goplaxt:webhook:"+user.WebhookSecret, user.ID, 0).Err(); err != nil {
+			slog.Warn("Failed to update webhook secret index", "error", err)
+		}
+	}
+
+	// Update Plex account index
+	accounts := user.accountKeys()
+	for _, key := range previousAccounts {
+		if !slices.Contains(accounts, key) {
+			s.client.SRem(ctx, "goplaxt:plexaccount:"+key, user.ID)
+		}
+	}
+	for _, key := range accounts {
+		if err := s.client.SAdd(ctx, "goplaxt:plexaccount:"+key, user.ID).Err(); err != nil {
+			slog.Warn("Failed to update plex account index", "error", err)
+		}
+	}
+
 	return nil
 }
 
@@ -113,7 +169,74 @@ func (s *RedisStore) GetUserByUsername(username string) *User {
 	return s.GetUser(id)
 }
 
-// DeleteUser removes a user and their index entry
+// GetUserByWebhookSecret looks up a user by their webhook secret
+func (s *RedisStore) GetUserByWebhookSecret(secret string) *User {
+	if secret == "" {
+		return nil
+	}
+
+	id, err := s.client.Get(context.Background(), "goplaxt:webhook:"+secret).Result()
+	if err != nil {
+		if err != redis.Nil {
+			slog.Debug("Failed to look up webhook secret", "error", err)
+		}
+		return nil
+	}
+
+	return s.GetUser(id)
+}
+
+// GetUsersByPlexAccount finds the users a Plex account, given by ID or title, scrobbles to
+func (s *RedisStore) GetUsersByPlexAccount(id, name string) []*User {
+	ctx := context.Background()
+
+	var ids []string
+	for _, key := range lookupKeys(id, name) {
+		members, err := s.client.SMembers(ctx, "goplaxt:plexaccount:"+key).Result()
+		if err != nil {
+			slog.Debug("Failed to look up plex account", "error", err)
+			continue
+		}
+		for _, userID := range members {
+			if !slices.Contains(ids, userID) {
+				ids = append(ids, userID)
+			}
+		}
+	}
+	sort.Strings(ids)
+
+	users := make([]*User, 0, len(ids))
+	for _, userID := range ids {
+		users = append(users, s.GetUser(userID))
+	}
+	return matchingUsers(users, id, name)
+}
+
+// ListUsers returns every user, ordered by ID
+func (s *RedisStore) ListUsers() []*User {
+	ctx := context.Background()
+
+	var ids []string
+	iter := s.client.Scan(ctx, 0, "goplaxt:user:*", 0).Iterator()
+	for iter.Next(ctx) {
+		ids = append(ids, strings.TrimPrefix(iter.Val(), "goplaxt:user:"))
+	}
+	if err := iter.Err(); err != nil {
+		slog.Error("Failed to list users", "error", err)
+		return nil
+	}
+	sort.Strings(ids)
+
+	users := make([]*User, 0, len(ids))
+	for _, id := range ids {
+		if user := s.GetUser(id); user != nil {
+			users = append(users, user)
+		}
+	}
+	return users
+}
+
+// DeleteUser removes a user, their index entries and everything stored for them
 func (s *RedisStore) DeleteUser(id string) bool {
 	s.mu.Lock()
 	defer s.mu.Unlock()
@@ -121,9 +244,31 @@ func (s *RedisStore) DeleteUser(id string) bool {
 	ctx := context.Background()
 
 	// Get user to remove from index
-	if user := s.GetUser(id); user != nil && user.Username != "" {
-		indexKey := "goplaxt:username:" + strings.ToLower(user.Username)
-		s.client.Del(ctx, indexKey)
+	if user := s.GetUser(id); user != nil {
+		if user.Username != "" {
+			indexKey := "goplaxt:username:" + strings.ToLower(user.Username)
+			s.client.Del(ctx, indexKey)
+		}
+		if user.WebhookSecret != "" {
+			s.client.Del(ctx, "goplaxt:webhook:"+user.WebhookSecret)
+		}
+		for _, key := range user.accountKeys() {
+			s.client.SRem(ctx, "goplaxt:plexaccount:"+key, user.ID)
+		}
+	}
+
+	// Delete history, collected items and queued or dead jobs
+	s.client.Del(ctx, "goplaxt:history:"+id, "goplaxt:collected:"+id)
+	var jobIDs []string
+	for _, job := range s.GetJobs() {
+		if job.UserID == id {
+			jobIDs = append(jobIDs, job.ID)
+		}
+	}
+	if len(jobIDs) > 0 {
+		if err := s.client.HDel(ctx, "goplaxt:jobs", jobIDs...).Err(); err != nil {
+			slog.Warn("Failed to delete jobs", "id", id, "error", err)
+		}
 	}
 
 	// Delete user data
@@ -135,3 +280,162 @@ func (s *RedisStore) DeleteUser(id string) bool {
 
 	return true
 }
+
+// WriteJob saves a pending job in the jobs hash
+func (s *RedisStore) WriteJob(job Job) error {
+	data, err := json.Marshal(job)
+	if err != nil {
+		return fmt.Errorf("failed to marshal job: %w", err)
+	}
+
+	if err := s.client.HSet(context.Background(), "goplaxt:jobs", job.ID, data).Err(); err != nil {
+		return fmt.Errorf("failed to write job: %w", err)
+	}
+	return nil
+}
+
+// GetJobs loads all pending jobs, oldest first
+func (s *RedisStore) GetJobs() []Job {
+	values, err := s.client.HGetAll(context.Background(), "goplaxt:jobs").Result()
+	if err != nil {
+		slog.Error("Failed to get jobs", "error", err)
+		return nil
+	}
+
+	jobs := make([]Job, 0, len(values))
+	for id, data := range values {
+		var job Job
+		if err := json.Unmarshal([]byte(data), &job); err != nil {
+			slog.Error("Failed to unmarshal job", "id", id, "error", err)
+			continue
+		}
+		jobs = append(jobs, job)
+	}
+
+	sort.Slice(jobs, func(i, j int) bool { return jobs[i].CreatedAt.Before(jobs[j].CreatedAt) })
+	return jobs
+}
+
+// DeleteJob removes a finished job
+func (s *RedisStore) DeleteJob(id string) bool {
+	if err := s.client.HDel(context.Background(), "goplaxt:jobs", id).Err(); err != nil {
+		slog.Error("Failed to delete job", "id", id, "error", err)
+		return false
+	}
+	return true
+}
+
+// WriteHistory prepends an entry to the user's history list
+func (s *RedisStore) WriteHistory(entry HistoryEntry) error {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return fmt.Errorf("failed to marshal history entry: %w", err)
+	}
+
+	ctx := context.Background()
+	key := "goplaxt:history:" + entry.UserID
+
+	pipe := s.client.TxPipeline()
+	pipe.LPush(ctx, key, data)
+	pipe.LTrim(ctx, key, 0, MaxHistoryEntries-1)
+	pipe.Expire(ctx, key, MaxHistoryAge)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return fmt.Errorf("failed to write history: %w", err)
+	}
+	return nil
+}
+
+// GetHistory loads a user's history, newest first
+func (s *RedisStore) GetHistory(userID string) []HistoryEntry {
+	values, err := s.client.LRange(context.Background(), "goplaxt:history:"+userID, 0, -1).Result()
+	if err != nil {
+		slog.Debug("Failed to get history", "id", userID, "error", err)
+		return nil
+	}
+
+	entries := make([]HistoryEntry, 0, len(values))
+	for _, data := range values {
+		var entry HistoryEntry
+		if err := json.Unmarshal([]byte(data), &entry); err != nil {
+			slog.Warn("Failed to unmarshal history entry", "id", userID, "error", err)
+			continue
+		}
+		entry.UserID = userID
+		entries = append(entries, entry)
+	}
+	return trimHistory(entries)
+}
+
+// WriteCollected adds items to the user's collected items hash, replacing any with the same key
+func (s *RedisStore) WriteCollected(userID string, items []CollectedItem) error {
+	if len(items) == 0 {
+		return nil
+	}
+	values := make(map[string]any, len(items))
+	for _, item := range items {
+		data, err := json.Marshal(item)
+		if err != nil {
+			return fmt.Errorf("failed to marshal collected item: %w", err)
+		}
+		values[item.Key()] = data
+	}
+	if err := s.client.HSet(context.Background(), "goplaxt:collected:"+userID, values).Err(); err != nil {
+		return fmt.Errorf("failed to write collected items: %w", err)
+	}
+	return nil
+}
+
+// GetCollected loads the user's collected items
+func (s *RedisStore) GetCollected(userID string) []CollectedItem {
+	values, err := s.client.HGetAll(context.Background(), "goplaxt:collected:"+userID).Result()
+	if err != nil {
+		slog.Debug("Failed to get collected items", "id", userID, "error", err)
+		return nil
+	}
+
+	items := make([]CollectedItem, 0, len(values))
+	for key, data := range values {
+		var item CollectedItem
+		if err := json.Unmarshal([]byte(data), &item); err != nil {
+			slog.Warn("Failed to unmarshal collected item", "id", userID, "key", key, "error", err)
+			continue
+		}
+		items = append(items, item)
+	}
+	return sortCollected(items)
+}
+
+// DeleteCollected removes items from the user's collected items hash
+func (s *RedisStore) DeleteCollected(userID string, items []CollectedItem) error {
+	if len(items) == 0 {
+		return nil
+	}
+	keys := make([]string, 0, len(items))
+	for _, item := range items {
+		keys = append(keys, item.Key())
+	}
+	if err := s.client.HDel(context.Background(), "goplaxt:collected:"+userID, keys...).Err(); err != nil {
+		return fmt.Errorf("failed to delete collected items: %w", err)
+	}
+	return nil
+}
+
+// GetCache returns an unexpired cached value
+func (s *RedisStore) GetCache(key string) ([]byte, bool) {
+	data, err := s.client.Get(context.Background(), "goplaxt:cache:"+key).Bytes()
+	if err != nil {
+		if err != redis.Nil {
+			slog.Debug("Failed to get cached value", "key", key, "error", err)
+		}
+		return nil, false
+	}
+	return data, true
+}
+
+// WriteCache stores a value that Redis expires when the TTL passes
+func (s *RedisStore) WriteCache(key string, value []byte, ttl time.Duration) error {
+	if err := s.client.Set(context.Background(), "goplaxt:cache:"+key, value, ttl).Err(); err != nil {
+		return fmt.Errorf("failed to write cache: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,69 @@
+package store
+
+import "strings"
+
+// Rules limit which webhook events are processed. Each rule is compared
+// case-insensitively with the event's values, such as a library's title and ID.
+type Rules struct {
+	Include []string `json:"include,omitempty"`
+	Exclude []string `json:"exclude,omitempty"`
+}
+
+// Check reports whether an event with the given values is allowed, and the rule that decided it.
+// Exclusions win; when there are inclusions, one of them must match.
+func (r Rules) Check(values ...string) (bool, string) {
+	for _, rule := range r.Exclude {
+		if matchesAny(rule, values) {
+			return false, "exclude " + rule
+		}
+	}
+	if len(r.Include) == 0 {
+		return true, ""
+	}
+	for _, rule := range r.Include {
+		if matchesAny(rule, values) {
+			return true, "include " + rule
+		}
+	}
+	return false, "not included"
+}
+
+// IsEmpty reports whether there are no rules
+func (r Rules) IsEmpty() bool {
+	return len(r.Include) == 0 && len(r.Exclude) == 0
+}
+
+func matchesAny(rule string, values []string) bool {
+	for _, value := range values {
+		if value != "" && strings.EqualFold(rule, value) {
+			return true
+		}
+	}
+	return false
+}
+
+// ParseRules builds rules from newline separated lists, ignoring blank lines
+func ParseRules(include, exclude string) Rules {
+	return Rules{Include: ParseLines(include), Exclude: ParseLines(exclude)}
+}
+
+// ParseLines splits a newline separated list, ignoring blank lines
+func ParseLines(s string) []string {
+	var lines []string
+	for _, line := range strings.Split(s, "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			lines = append(lines, line)
+		}
+	}
+	return lines
+}
+
+// IncludeLines returns the inclusions one per line, for editing
+func (r Rules) IncludeLines() string {
+	return strings.Join(r.Include, "\n")
+}
+
+// ExcludeLines returns the exclusions one per line, for editing
+func (r Rules) ExcludeLines() string {
+	return strings.Join(r.Exclude, "\n")
+}
@@ -2,8 +2,11 @@ package store
 
 import (
 	"crypto/rand"
+	"encoding/hex"
 	"fmt"
 	"log/slog"
+	"slices"
+	"strings"
 	"time"
 )
 
@@ -12,7 +15,19 @@ type Store interface {
 	WriteUser(user User) error
 	GetUser(id string) *User
 	GetUserByUsername(username string) *User
+	GetUserByWebhookSecret(secret string) *User
+	GetUsersByPlexAccount(id, name string) []*User
+	ListUsers() []*User
 	DeleteUser(id string) bool
+	WriteJob(job Job) error
+	GetJobs() []Job
+	DeleteJob(id string) bool
+	WriteHistory(entry HistoryEntry) error
+	GetHistory(userID string) []HistoryEntry
+	WriteCollected(userID string, items []CollectedItem) error
+	GetCollected(userID string) []CollectedItem
+	DeleteCollected(userID string, items []CollectedItem) error
+	Cache
 	Ping() error
 }
 
@@ -28,18 +43,64 @@ type Config struct {
 	EpisodeCollection    *bool `json:"episode_collection"`
 	ShowRate             *bool `json:"show_rate"`
 	SeasonRate           *bool `json:"season_rate"`
+
+	// MovieCollectionRemove and EpisodeCollectionRemove remove deleted items from the Trakt collection
+	MovieCollectionRemove   *bool `json:"movie_collection_remove"`
+	EpisodeCollectionRemove *bool `json:"episode_collection_remove"`
+	// LibraryReconcile removes items Plaxt collected from the PLEX_URL server once the server no longer holds them
+	LibraryReconcile *bool `json:"library_reconcile"`
+
+	// WatchedThreshold is the progress percentage at which a stopped item is marked as watched
+	WatchedThreshold *int `json:"watched_threshold"`
+	// MinProgress is the progress percentage below which a pause or stop clears "now watching" instead
+	MinProgress *int `json:"min_progress"`
+	// UseScrobbleEvent marks items watched when the media server sends a scrobble event
+	UseScrobbleEvent *bool `json:"use_scrobble_event"`
+
+	// Libraries, Servers and MediaTypes filter which events are processed
+	Libraries  Rules `json:"libraries,omitzero"`
+	Servers    Rules `json:"servers,omitzero"`
+	MediaTypes Rules `json:"media_types,omitzero"`
+
+	// Players (title or UUID), PlayerAddresses and PlayerLocation filter events by the player used
+	Players         Rules  `json:"players,omitzero"`
+	PlayerAddresses Rules  `json:"player_addresses,omitzero"`
+	PlayerLocation  string `json:"player_location,omitempty"`
 }
 
+// Player locations
+const (
+	PlayerLocationAny    = ""
+	PlayerLocationLocal  = "local"
+	PlayerLocationRemote = "remote"
+)
+
+// Scrobble progress limits, as percentages
+const (
+	DefaultWatchedThreshold = 90
+	// MinWatchedThreshold is the lowest progress Trakt accepts as watched
+	MinWatchedThreshold = 80
+	// MinProgress must be at least 1% as Trakt rejects pauses and stops at 0%
+	DefaultMinProgress = 1
+	MaxMinProgress     = 50
+)
+
 // User represents an authenticated user with their configuration
 type User struct {
-	ID             string    `json:"id"`
-	Username       string    `json:"username"`
-	PlexUsername   string    `json:"plex_username,omitempty"`
+	ID           string `json:"id"`
+	Username     string `json:"username"`
+	PlexUsername string `json:"plex_username,omitempty"`
+	// PlexAccounts are further Plex account titles or IDs that scrobble to this user
+	PlexAccounts   []string  `json:"plex_accounts,omitempty"`
 	AccessToken    string    `json:"access_token"`
 	RefreshToken   string    `json:"refresh_token"`
 	TokenExpiresAt time.Time `json:"token_expires_at"`
+	WebhookSecret  string    `json:"webhook_secret,omitempty"`
 	Config         Config    `json:"config"`
 
+	// SessionGeneration is bumped to invalidate every existing login
+	SessionGeneration int `json:"session_generation,omitempty"`
+
 	// Store reference (not serialised)
 	Store Store `json:"-"`
 }
@@ -55,6 +116,15 @@ func uuid() string {
 	return fmt.Sprintf("%x%x%x%x%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
 }
 
+// newSecret generates a random secret for use in webhook URLs
+func newSecret() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("failed to generate secret: %w", err)
+	}
+	return hex.EncodeToString(b), nil
+}
+
 // NewUser creates a new user with default configuration
 func NewUser(username, accessToken, refreshToken string, expiresIn, createdAt int64, store Store) User {
 	return NewUserWithID(uuid(), username, accessToken, refreshToken, expiresIn, createdAt, store)
@@ -63,12 +133,17 @@ func NewUser(username, accessToken, refreshToken string, expiresIn, createdAt in
 // NewUserWithID creates a new user with a specific ID
 func NewUserWithID(id, username, accessToken, refreshToken string, expiresIn, createdAt int64, store Store) User {
 	tokenExpiresAt := time.Unix(createdAt, 0).Add(time.Duration(expiresIn) * time.Second)
+	secret, err := newSecret()
+	if err != nil {
+		slog.Error("Error generating webhook secret", "error", err)
+	}
 	user := User{
 		ID:             id,
 		Username:       username,
 		AccessToken:    accessToken,
 		RefreshToken:   refreshToken,
 		TokenExpiresAt: tokenExpiresAt,
+		WebhookSecret:  secret,
 		Store:          store,
 		// Config fields remain nil (unconfigured)
 	}
@@ -86,14 +161,80 @@ func (user *User) UpdateUser(accessToken, refreshToken string, expiresIn, create
 	user.Save()
 }
 
-// UpdateConfiguration updates the user's sync preferences
-func (user *User) UpdateConfiguration(config Config, plexUsername string) {
+// UpdateConfiguration updates the user's sync preferences and Plex accounts
+func (user *User) UpdateConfiguration(config Config, plexUsername string, plexAccounts []string) {
 	user.PlexUsername = plexUsername
+	user.PlexAccounts = plexAccounts
 	user.Config = config
 	slog.Info("User configuration updated", "id", user.ID)
 	user.Save()
 }
 
+// RotateWebhookSecret replaces the webhook secret, invalidating the previous webhook URL
+func (user *User) RotateWebhookSecret() error {
+	secret, err := newSecret()
+	if err != nil {
+		return err
+	}
+	user.WebhookSecret = secret
+	slog.Info("Webhook secret rotated", "id", user.ID)
+	return user.Save()
+}
+
+// MatchesAccount reports whether events from a media server account belong to the user.
+// Accounts match the Plex username or one of the Plex accounts, by title (ignoring case) or by ID.
+// IDs survive a renamed Plex profile.
+func (user User) MatchesAccount(id, name string) bool {
+	for _, account := range append([]string{user.PlexUsername}, user.PlexAccounts...) {
+		if account == "" {
+			continue
+		}
+		if (id != "" && account == id) || (name != "" && strings.EqualFold(account, name)) {
+			return true
+		}
+	}
+	return false
+}
+
+// accountKeys returns the lower-cased Plex accounts the user is indexed under
+func (user User) accountKeys() []string {
+	var keys []string
+	for _, account := range append([]string{user.PlexUsername}, user.PlexAccounts...) {
+		if account != "" && !slices.Contains(keys, strings.ToLower(account)) {
+			keys = append(keys, strings.ToLower(account))
+		}
+	}
+	return keys
+}
+
+// lookupKeys returns the index keys for a media server account
+func lookupKeys(id, name string) []string {
+	var keys []string
+	for _, value := range []string{id, name} {
+		if value != "" && !slices.Contains(keys, strings.ToLower(value)) {
+			keys = append(keys, strings.ToLower(value))
+		}
+	}
+	return keys
+}
+
+// matchingUsers keeps the users an account matches. Index keys are lower-cased,
+// so an ID that only differs in case from a listed account is dropped here.
+func matchingUsers(users []*User, id, name string) []*User {
+	var matched []*User
+	for _, user := range users {
+		if user != nil && user.MatchesAccount(id, name) {
+			matched = append(matched, user)
+		}
+	}
+	return matched
+}
+
+// PlexAccountLines returns the Plex accounts one per line, for editing
+func (user User) PlexAccountLines() string {
+	return strings.Join(user.PlexAccounts, "\n")
+}
+
 // IsConfigured returns true if the user has complete configuration saved.
 // All core settings must be present (not nil) for a valid configuration.
 func (user User) IsConfigured() bool {
@@ -148,6 +289,20 @@ func (c Config) GetMovieCollection() bool {
 	return *c.MovieCollection
 }
 
+func (c Config) GetMovieCollectionRemove() bool {
+	if c.MovieCollectionRemove == nil {
+		return false // Default: disabled, removal is destructive
+	}
+	return *c.MovieCollectionRemove
+}
+
+func (c Config) GetLibraryReconcile() bool {
+	if c.LibraryReconcile == nil {
+		return false // Default: disabled, removal is destructive
+	}
+	return *c.LibraryReconcile
+}
+
 func (c Config) GetEpisodeScrobbleStart() bool {
 	if c.EpisodeScrobbleStart == nil {
 		return true
@@ -176,6 +331,13 @@ func (c Config) GetEpisodeCollection() bool {
 	return *c.EpisodeCollection
 }
 
+func (c Config) GetEpisodeCollectionRemove() bool {
+	if c.EpisodeCollectionRemove == nil {
+		return false // Default: disabled, removal is destructive
+	}
+	return *c.EpisodeCollectionRemove
+}
+
 func (c Config) GetShowRate() bool {
 	if c.ShowRate == nil {
 		return true
@@ -189,3 +351,24 @@ func (c Config) GetSeasonRate() bool {
 	}
 	return *c.SeasonRate
 }
+
+func (c Config) GetWatchedThreshold() int {
+	if c.WatchedThreshold == nil {
+		return DefaultWatchedThreshold
+	}
+	return min(max(*c.WatchedThreshold, MinWatchedThreshold), 100)
+}
+
+func (c Config) GetMinProgress() int {
+	if c.MinProgress == nil {
+		return DefaultMinProgress
+	}
+	return min(max(*c.MinProgress, DefaultMinProgress), MaxMinProgress)
+}
+
+func (c Config) GetUseScrobbleEvent() bool {
+	if c.UseScrobbleEvent == nil {
+		return true
+	}
+	return *c.UseScrobbleEvent
+}
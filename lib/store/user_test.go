@@ -0,0 +1,20 @@
+package store
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMatchesAccount(t *testing.T) {
+	user := User{PlexUsername: "Dad", PlexAccounts: []string{"Dad-Bedroom", "12345"}}
+
+	assert.True(t, user.MatchesAccount("", "dad"))
+	assert.True(t, user.MatchesAccount("1", "DAD-BEDROOM"))
+	// A renamed profile still matches by ID
+	assert.True(t, user.MatchesAccount("12345", "Father"))
+	assert.False(t, user.MatchesAccount("54321", "Mum"))
+	assert.False(t, user.MatchesAccount("", ""))
+
+	assert.False(t, User{}.MatchesAccount("", ""))
+}
@@ -0,0 +1,125 @@
+package trakt
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/viscerous/goplaxt/lib/media"
+	"github.com/viscerous/goplaxt/lib/store"
+)
+
+const (
+	// resolvedTTL is how long an item found on Trakt is remembered. Trakt IDs don't change.
+	resolvedTTL = 7 * 24 * time.Hour
+
+	// missingTTL is how long an item Trakt doesn't have is remembered, so it is found once added
+	missingTTL = 6 * time.Hour
+)
+
+// notFoundError is returned for items Trakt has no match for
+type notFoundError struct {
+	kind string
+}
+
+func (e notFoundError) Error() string {
+	return "could not find " + e.kind
+}
+
+// IDCache remembers which Trakt movie or episode a media server item resolved to,
+// including items that couldn't be found, so that each play, pause and stop of an
+// item doesn't search Trakt again. A nil cache remembers nothing.
+type IDCache struct {
+	store store.Cache
+}
+
+// NewIDCache creates a cache kept in the given store
+func NewIDCache(c store.Cache) *IDCache {
+	return &IDCache{store: c}
+}
+
+// cachedItem is a resolved item, or a record that none was found
+type cachedItem struct {
+	Found bool            `json:"found"`
+	Item  json.RawMessage `json:"item,omitempty"`
+}
+
+// cacheKeys returns the keys an item is cached under: each of its external IDs,
+// and its ID on the media server
+func cacheKeys(e media.MediaEvent) []string {
+	var keys []string
+	for _, id := range e.IDs {
+		keys = append(keys, fmt.Sprintf("trakt:%s:%s:%s", e.Kind, id.Service, id.ID))
+	}
+	if e.ItemID != "" {
+		keys = append(keys, fmt.Sprintf("trakt:%s:%s:%s:%s", e.Kind, e.Source, e.Server.UUID, e.ItemID))
+	}
+	return keys
+}
+
+// cachedClient is implemented by clients that share an IDCache
+type cachedClient interface {
+	IDCache() *IDCache
+}
+
+// cacheFor returns the client's cache, or nil if it has none
+func cacheFor(client Client) *IDCache {
+	if c, ok := client.(cachedClient); ok {
+		return c.IDCache()
+	}
+	return nil
+}
+
+// resolve looks an item up in the cache, falling back to find. Items that find
+// reports as not found are remembered for a shorter time; other errors are not cached.
+func resolve[T any](c *IDCache, e media.MediaEvent, find func() (T, error)) (T, error) {
+	var item T
+	keys := cacheKeys(e)
+	if c == nil || len(keys) == 0 {
+		return find()
+	}
+
+	for _, key := range keys {
+		data, ok := c.store.GetCache(key)
+		if !ok {
+			continue
+		}
+		var cached cachedItem
+		if err := json.Unmarshal(data, &cached); err != nil {
+			continue
+		}
+		if !cached.Found {
+			slog.Debug("Item not found on Trakt (cached)", "key", key)
+			return item, notFoundError{e.Kind}
+		}
+		if err := json.Unmarshal(cached.Item, &item); err == nil {
+			slog.Debug("Resolved item from cache", "key", key)
+			return item, nil
+		}
+	}
+
+	item, err := find()
+	var cached cachedItem
+	ttl := missingTTL
+	switch {
+	case errors.As(err, new(notFoundError)):
+	case err != nil:
+		return item, err
+	default:
+		data, err := json.Marshal(item)
+		if err != nil {
+			return item, nil
+		}
+		cached, ttl = cachedItem{Found: true, Item: data}, resolvedTTL
+	}
+
+	data, _ := json.Marshal(cached)
+	for _, key := range keys {
+		if err := c.store.WriteCache(key, data, ttl); err != nil {
+			slog.Warn("Failed to cache Trakt item", "key", key, "error", err)
+		}
+	}
+	return item, err
+}
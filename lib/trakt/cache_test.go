@@ -0,0 +1,89 @@
+package trakt
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/viscerous/goplaxt/lib/media"
+	"github.com/viscerous/goplaxt/lib/store"
+)
+
+// cachingMockClient is a mock client with an IDCache
+type cachingMockClient struct {
+	*MockTraktClient
+	cache *IDCache
+}
+
+func (c cachingMockClient) IDCache() *IDCache {
+	return c.cache
+}
+
+func TestIDCache(t *testing.T) {
+	mockClient := &MockTraktClient{MakeRequestResponses: map[string][]byte{
+		"/search/imdb/tt1375666?type=movie": []byte(`[{"movie":{"title":"Inception","year":2010,"ids":{"trakt":16662}}}]`),
+		"/search/movie?query=Unknown":       []byte(`[]`),
+	}}
+	mockClient.On("MakeRequest", mock.Anything, "/search/movie?query=Broken").Return(nil, errors.New("timeout"))
+	mockClient.On("MakeRequest", mock.Anything, "/search/tmdb/1?type=movie").Return(nil, &APIError{Status: http.StatusTooManyRequests, Retryable: true})
+	mockClient.On("MakeRequest", mock.Anything, "/search/imdb/bad?type=movie").Return(nil, &APIError{Status: http.StatusBadRequest})
+	mockClient.On("MakeRequest", mock.Anything, mock.Anything).Return([]byte(`[]`), nil)
+	client := cachingMockClient{mockClient, NewIDCache(&store.MemoryCache{})}
+	ctx := context.Background()
+
+	inception := media.MediaEvent{Source: media.SourcePlex, Kind: media.KindMovie, ItemID: "1234", Title: "Inception", IDs: []media.ExternalID{{Service: "imdb", ID: "tt1375666"}}}
+	for range 3 {
+		movie, err := findMovie(ctx, client, inception)
+		assert.NoError(t, err)
+		assert.Equal(t, 16662, movie.Ids.Trakt)
+	}
+	mockClient.AssertNumberOfCalls(t, "MakeRequest", 1)
+
+	// The item is also cached under its ID on the media server
+	movie, err := findMovie(ctx, client, media.MediaEvent{Source: media.SourcePlex, Kind: media.KindMovie, ItemID: "1234"})
+	assert.NoError(t, err)
+	assert.Equal(t, "Inception", movie.Title)
+	mockClient.AssertNumberOfCalls(t, "MakeRequest", 1)
+
+	// Items Trakt doesn't have are remembered too
+	unknown := media.MediaEvent{Kind: media.KindMovie, ItemID: "5678", Title: "Unknown"}
+	for range 2 {
+		_, err = findMovie(ctx, client, unknown)
+		assert.EqualError(t, err, "could not find movie")
+	}
+	mockClient.AssertNumberOfCalls(t, "MakeRequest", 2)
+
+	// Failed searches are not
+	broken := media.MediaEvent{Kind: media.KindMovie, ItemID: "9012", Title: "Broken"}
+	for range 2 {
+		_, err = findMovie(ctx, client, broken)
+		assert.Error(t, err)
+	}
+	mockClient.AssertNumberOfCalls(t, "MakeRequest", 4)
+
+	// Nor are external ID searches that may succeed later, which aren't followed by a title search
+	limited := media.MediaEvent{Kind: media.KindMovie, ItemID: "3456", Title: "Unknown", IDs: []media.ExternalID{{Service: "tmdb", ID: "1"}}}
+	for range 2 {
+		_, err = findMovie(ctx, client, limited)
+		assert.True(t, IsRetryable(err))
+		assert.NotErrorAs(t, err, new(notFoundError))
+	}
+	mockClient.AssertNumberOfCalls(t, "MakeRequest", 6)
+
+	// or ones that failed for good, as the item might still be on Trakt
+	invalid := media.MediaEvent{Kind: media.KindMovie, ItemID: "7890", Title: "Unknown", IDs: []media.ExternalID{{Service: "imdb", ID: "bad"}}}
+	for range 2 {
+		_, err = findMovie(ctx, client, invalid)
+		assert.False(t, IsRetryable(err))
+		assert.NotErrorAs(t, err, new(notFoundError))
+	}
+	mockClient.AssertNumberOfCalls(t, "MakeRequest", 10)
+
+	// A nil cache remembers nothing
+	_, err = findMovie(ctx, mockClient, inception)
+	assert.NoError(t, err)
+	mockClient.AssertNumberOfCalls(t, "MakeRequest", 11)
+}
@@ -10,24 +10,14 @@ import (
 	"log/slog"
 	"net/http"
 	"strings"
+	"sync"
+	"time"
 
-	"github.com/viscerous/goplaxt/lib/config"
 	"golang.org/x/time/rate"
 )
 
-var (
-	BaseURL         = "https://api.trakt.tv"
-	ErrInvalidToken = errors.New("invalid_token")
-)
-
-// Package-level HTTP client for connection pooling and reuse
-var httpClient = &http.Client{
-	Timeout: HTTPTimeout,
-}
-
-// Rate limiter: Trakt allows 1000 calls per 5 minutes = ~3.3/sec
-// We use 2/sec with burst of 5 to be conservative
-var rateLimiter = rate.NewLimiter(rate.Limit(2), 5)
+// DefaultBaseURL is the Trakt API used unless WithBaseURL is given
+const DefaultBaseURL = "https://api.trakt.tv"
 
 type Client interface {
 	MakeRequest(ctx context.Context, url string) ([]byte, error)
@@ -36,157 +26,259 @@ type Client interface {
 	DeleteCheckin(ctx context.Context, token string) error
 }
 
-type RealTraktClient struct{}
+// RetryPolicy decides how often failed requests are retried
+type RetryPolicy struct {
+	// Attempts is the number of times a request is sent, including the first
+	Attempts int
+	// Backoff returns how long to wait after the given 0-indexed attempt fails
+	Backoff func(attempt int) time.Duration
+	// MaxRetryAfter is the longest Retry-After waited out after a 429. Requests asked
+	// to wait longer fail, so that they can be retried later. Zero waits any time.
+	MaxRetryAfter time.Duration
+}
+
+// DefaultRetryPolicy makes MaxRetries attempts, waiting a second longer after each,
+// and waits up to a minute when Trakt's rate limit is exceeded
+var DefaultRetryPolicy = RetryPolicy{
+	Attempts:      MaxRetries,
+	Backoff:       func(attempt int) time.Duration { return time.Duration(attempt+1) * time.Second },
+	MaxRetryAfter: time.Minute,
+}
+
+// RealTraktClient sends requests to the Trakt API. Create one with NewClient.
+type RealTraktClient struct {
+	baseURL      string
+	clientID     string
+	clientSecret string
+	httpClient   *http.Client
+	limiter      *rate.Limiter
+	retry        RetryPolicy
+	cache        *IDCache
+
+	// mu guards the rate limit state reported by Trakt
+	mu          sync.Mutex
+	limits      map[string]RateLimit
+	pausedUntil time.Time
+	throttled   int
+}
+
+// Option configures a client created by NewClient
+type Option func(*RealTraktClient)
+
+// WithBaseURL sends requests to another Trakt API, such as a stand-in for testing
+func WithBaseURL(baseURL string) Option {
+	return func(c *RealTraktClient) {
+		if baseURL != "" {
+			c.baseURL = strings.TrimSuffix(baseURL, "/")
+		}
+	}
+}
+
+// WithCredentials sets the Trakt application's client ID and secret
+func WithCredentials(clientID, clientSecret string) Option {
+	return func(c *RealTraktClient) {
+		c.clientID = clientID
+		c.clientSecret = clientSecret
+	}
+}
+
+// WithHTTPClient replaces the HTTP client, for example to change its timeout
+func WithHTTPClient(httpClient *http.Client) Option {
+	return func(c *RealTraktClient) {
+		c.httpClient = httpClient
+	}
+}
+
+// WithLimiter replaces the rate limiter shared by the client's API requests
+func WithLimiter(limiter *rate.Limiter) Option {
+	return func(c *RealTraktClient) {
+		c.limiter = limiter
+	}
+}
+
+// WithRetryPolicy changes how failed requests are retried
+func WithRetryPolicy(policy RetryPolicy) Option {
+	return func(c *RealTraktClient) {
+		c.retry = policy
+	}
+}
+
+// WithIDCache remembers resolved items between requests
+func WithIDCache(cache *IDCache) Option {
+	return func(c *RealTraktClient) {
+		c.cache = cache
+	}
+}
+
+// NewClient creates a Trakt client. Trakt allows 1000 calls per 5 minutes (~3.3/sec),
+// so by default requests are limited to 2/sec with a burst of 5 to be conservative.
+func NewClient(opts ...Option) *RealTraktClient {
+	c := &RealTraktClient{
+		baseURL:    DefaultBaseURL,
+		httpClient: &http.Client{Timeout: HTTPTimeout},
+		limiter:    rate.NewLimiter(rate.Limit(2), 5),
+		retry:      DefaultRetryPolicy,
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	c.retry.Attempts = max(c.retry.Attempts, 1)
+	return c
+}
+
+// IDCache returns the cache shared by the client's requests
+func (c *RealTraktClient) IDCache() *IDCache {
+	return c.cache
+}
 
+// MakeRequest sends a GET request to a path of the API, or to a full URL
 func (c *RealTraktClient) MakeRequest(ctx context.Context, url string) ([]byte, error) {
-	return makeRequest(ctx, url)
+	if !strings.HasPrefix(url, "http") {
+		url = c.url(url)
+	}
+	return c.doRequest(ctx, "GET", url, nil, "")
 }
 
 func (c *RealTraktClient) ScrobbleRequest(ctx context.Context, action string, body []byte, token string) ([]byte, error) {
-	return scrobbleRequest(ctx, action, body, token)
+	return c.doRequest(ctx, "POST", c.url("/scrobble/"+action), body, token)
 }
 
 func (c *RealTraktClient) SyncRequest(ctx context.Context, endpoint string, body []byte, token string) ([]byte, error) {
-	return syncRequest(ctx, endpoint, body, token)
+	return c.doRequest(ctx, "POST", c.url("/sync/"+endpoint), body, token)
 }
 
 func (c *RealTraktClient) DeleteCheckin(ctx context.Context, token string) error {
-	return deleteCheckin(ctx, token)
+	_, err := c.doRequest(ctx, "DELETE", c.url("/checkin"), nil, token)
+	// There was no checkin to delete
+	var apiErr *APIError
+	if errors.As(err, &apiErr) && apiErr.Status == http.StatusNotFound {
+		return nil
+	}
+	return err
+}
+
+// url returns the full URL of an API path
+func (c *RealTraktClient) url(path string) string {
+	return fmt.Sprintf("%s/%s", c.baseURL, strings.TrimPrefix(path, "/"))
+}
+
+// wait sleeps after a failed attempt, returning early if the context is cancelled
+func (c *RealTraktClient) wait(ctx context.Context, attempt int) error {
+	if attempt == c.retry.Attempts-1 || c.retry.Backoff == nil {
+		return ctx.Err()
+	}
+	timer := time.NewTimer(c.retry.Backoff(attempt))
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
 }
 
 // AuthRequest authorises the connection with Trakt
-func AuthRequest(root, code, refreshToken, grantType string) (map[string]interface{}, error) {
+func (c *RealTraktClient) AuthRequest(root, code, refreshToken, grantType string) (map[string]interface{}, error) {
 	values := map[string]string{
 		"code":          code,
 		"refresh_token": refreshToken,
-		"client_id":     config.TraktClientId,
-		"client_secret": config.TraktClientSecret,
+		"client_id":     c.clientID,
+		"client_secret": c.clientSecret,
 		"redirect_uri":  fmt.Sprintf("%s/authorize", root),
 		"grant_type":    grantType,
 	}
 
-	result, err := doPost(context.Background(), "/oauth/token", values)
+	result, err := c.doPost(context.Background(), "/oauth/token", values)
+	// Trakt rejects a revoked refresh token with invalid_grant, as a 400 or 401.
+	// Other rejections, such as of the client's credentials, leave the user's tokens valid.
+	var apiErr *APIError
+	if errors.As(err, &apiErr) && (apiErr.Status == http.StatusBadRequest || apiErr.Status == http.StatusUnauthorized) &&
+		strings.Contains(apiErr.Body, "invalid_grant") {
+		apiErr.Err = ErrInvalidGrant
+		return nil, apiErr
+	}
 	if err != nil {
-		if strings.Contains(err.Error(), "400") || strings.Contains(err.Error(), "401") {
-			return nil, ErrInvalidToken
-		}
 		return nil, err
 	}
 	return result, nil
 }
 
 // GetDeviceCode initiates the Device Flow
-func GetDeviceCode() (map[string]interface{}, error) {
+func (c *RealTraktClient) GetDeviceCode() (map[string]interface{}, error) {
 	values := map[string]string{
-		"client_id": config.TraktClientId,
+		"client_id": c.clientID,
 	}
-	return doPost(context.Background(), "/oauth/device/code", values)
+	return c.doPost(context.Background(), "/oauth/device/code", values)
 }
 
-// PollDeviceToken polls for the user token
-func PollDeviceToken(deviceCode string) (map[string]interface{}, error) {
+// PollDeviceToken polls for the user token. It returns nil while authorisation is pending,
+// and an APIError with status 404, 409 or 410 for an invalid, used or expired code.
+func (c *RealTraktClient) PollDeviceToken(deviceCode string) (map[string]interface{}, error) {
 	values := map[string]string{
 		"code":          deviceCode,
-		"client_id":     config.TraktClientId,
-		"client_secret": config.TraktClientSecret,
+		"client_id":     c.clientID,
+		"client_secret": c.clientSecret,
 	}
 	jsonValue, err := json.Marshal(values)
 	if err != nil {
 		return nil, fmt.Errorf("failed to marshal request body: %w", err)
 	}
 
-	var lastErr error
-	for i := 0; i < MaxRetries; i++ {
-		resp, err := http.Post(fmt.Sprintf("%s/oauth/device/token", BaseURL), "application/json", bytes.NewBuffer(jsonValue))
-		if err != nil {
-			lastErr = err
-			retryBackoff(i)
-			continue
-		}
-		defer resp.Body.Close()
-
-		// Special handling for polling status codes
-		if resp.StatusCode == http.StatusBadRequest {
-			return nil, nil // Pending (not yet authorised)
+	status, respBody, err := c.send(context.Background(), func() (*http.Request, error) {
+		req, err := http.NewRequest("POST", c.url("/oauth/device/token"), bytes.NewReader(jsonValue))
+		if err == nil {
+			req.Header.Set("Content-Type", "application/json")
 		}
-		if resp.StatusCode == http.StatusNotFound {
-			return nil, fmt.Errorf("invalid code")
-		}
-		if resp.StatusCode == http.StatusConflict {
-			return nil, fmt.Errorf("already used code")
-		}
-		if resp.StatusCode == http.StatusGone {
-			return nil, fmt.Errorf("expired code")
-		}
-
-		if resp.StatusCode >= 500 {
-			lastErr = fmt.Errorf("server error: %d", resp.StatusCode)
-			retryBackoff(i)
-			continue
-		}
-
-		if resp.StatusCode != http.StatusOK {
-			return nil, fmt.Errorf("unexpected status code: %d", resp.StatusCode)
-		}
-
-		var result map[string]interface{}
-		if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
-			return nil, fmt.Errorf("failed to decode response: %w", err)
-		}
-
-		return result, nil
+		return req, err
+	})
+	if err != nil {
+		return nil, err
+	}
+	if status == http.StatusBadRequest {
+		return nil, nil // Pending (not yet authorised)
+	}
+	if status != http.StatusOK {
+		return nil, newStatusError(status, respBody)
 	}
 
-	return nil, fmt.Errorf("request failed after 3 attempts: %w", lastErr)
+	var result map[string]interface{}
+	if err := json.Unmarshal(respBody, &result); err != nil {
+		return nil, fmt.Errorf("failed to decode response: %w", err)
+	}
+	return result, nil
 }
 
 // doPost is a internal helper for OAuth requests with retries
-func doPost(ctx context.Context, endpoint string, values map[string]string) (map[string]interface{}, error) {
+func (c *RealTraktClient) doPost(ctx context.Context, endpoint string, values map[string]string) (map[string]interface{}, error) {
 	jsonValue, err := json.Marshal(values)
 	if err != nil {
 		return nil, fmt.Errorf("failed to marshal request body: %w", err)
 	}
 
-	apiUrl := fmt.Sprintf("%s/%s", BaseURL, strings.TrimPrefix(endpoint, "/"))
-
-	var lastErr error
-	for i := 0; i < MaxRetries; i++ {
-		req, err := http.NewRequestWithContext(ctx, "POST", apiUrl, bytes.NewBuffer(jsonValue))
-		if err != nil {
-			return nil, fmt.Errorf("failed to create request: %w", err)
-		}
-		req.Header.Set("Content-Type", "application/json")
-
-		resp, err := httpClient.Do(req)
-		if err != nil {
-			lastErr = err
-			retryBackoff(i)
-			continue
-		}
-		defer resp.Body.Close()
-
-		if resp.StatusCode >= 500 {
-			lastErr = fmt.Errorf("server error: %d", resp.StatusCode)
-			retryBackoff(i)
-			continue
-		}
-
-		if resp.StatusCode != http.StatusOK {
-			return nil, fmt.Errorf("trakt api returned bad status: %d", resp.StatusCode)
+	status, respBody, err := c.send(ctx, func() (*http.Request, error) {
+		req, err := http.NewRequestWithContext(ctx, "POST", c.url(endpoint), bytes.NewReader(jsonValue))
+		if err == nil {
+			req.Header.Set("Content-Type", "application/json")
 		}
+		return req, err
+	})
+	if err != nil {
+		return nil, err
+	}
+	if status != http.StatusOK {
+		return nil, newStatusError(status, respBody)
+	}
 
-		var result map[string]interface{}
-		if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
-			return nil, fmt.Errorf("failed to decode response: %w", err)
-		}
-		return result, nil
+	var result map[string]interface{}
+	if err := json.Unmarshal(respBody, &result); err != nil {
+		return nil, fmt.Errorf("failed to decode response: %w", err)
 	}
-	return nil, fmt.Errorf("request failed after 3 attempts: %w", lastErr)
+	return result, nil
 }
 
 // GetUserProfile fetches the authenticated user's profile
-func GetUserProfile(token string) (map[string]interface{}, error) {
-	respBody, err := doRequest(context.Background(), "GET", fmt.Sprintf("%s/users/me", BaseURL), nil, token)
+func (c *RealTraktClient) GetUserProfile(token string) (map[string]interface{}, error) {
+	respBody, err := c.doRequest(context.Background(), "GET", c.url("/users/me"), nil, token)
 	if err != nil {
 		return nil, err
 	}
@@ -199,52 +291,18 @@ func GetUserProfile(token string) (map[string]interface{}, error) {
 	return result, nil
 }
 
-func makeRequest(ctx context.Context, url string) ([]byte, error) {
-	// If url starts with http, use it, otherwise prepend BaseURL
-	if !strings.HasPrefix(url, "http") {
-		url = fmt.Sprintf("%s/%s", BaseURL, strings.TrimPrefix(url, "/"))
-	}
-	return doRequest(ctx, "GET", url, nil, "")
-}
-
-func scrobbleRequest(ctx context.Context, action string, body []byte, accessToken string) ([]byte, error) {
-	apiUrl := fmt.Sprintf("%s/scrobble/%s", BaseURL, action)
-	return doRequest(ctx, "POST", apiUrl, body, accessToken)
-}
-
-func syncRequest(ctx context.Context, endpoint string, body []byte, accessToken string) ([]byte, error) {
-	apiUrl := fmt.Sprintf("%s/sync/%s", BaseURL, endpoint)
-	return doRequest(ctx, "POST", apiUrl, body, accessToken)
-}
-
-func deleteCheckin(ctx context.Context, accessToken string) error {
-	_, err := doRequest(ctx, "DELETE", fmt.Sprintf("%s/checkin", BaseURL), nil, accessToken)
-	if err != nil {
-		if strings.Contains(err.Error(), "404") {
-			return nil
-		}
-		return err
-	}
-	return nil
-}
-
-func doRequest(ctx context.Context, method, url string, body []byte, accessToken string) ([]byte, error) {
-	var lastErr error
-	for i := 0; i < MaxRetries; i++ {
+func (c *RealTraktClient) doRequest(ctx context.Context, method, url string, body []byte, accessToken string) ([]byte, error) {
+	status, respBody, err := c.send(ctx, func() (*http.Request, error) {
 		// Rate limiting
-		if err := rateLimiter.Wait(ctx); err != nil {
+		if err := c.limiter.Wait(ctx); err != nil {
 			return nil, fmt.Errorf("rate limiter cancelled: %w", err)
 		}
 
-		var req *http.Request
-		var err error
-
+		var reqBody io.Reader
 		if len(body) > 0 {
-			req, err = http.NewRequestWithContext(ctx, method, url, bytes.NewBuffer(body))
-		} else {
-			req, err = http.NewRequestWithContext(ctx, method, url, nil)
+			reqBody = bytes.NewReader(body)
 		}
-
+		req, err := http.NewRequestWithContext(ctx, method, url, reqBody)
 		if err != nil {
 			return nil, fmt.Errorf("failed to create request: %w", err)
 		}
@@ -254,37 +312,72 @@ func doRequest(ctx context.Context, method, url string, body []byte, accessToken
 			req.Header.Add("Authorization", fmt.Sprintf("Bearer %s", accessToken))
 		}
 		req.Header.Add("trakt-api-version", "2")
-		req.Header.Add("trakt-api-key", config.TraktClientId)
+		req.Header.Add("trakt-api-key", c.clientID)
+		return req, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if status >= 400 {
+		slog.Error("Trakt client error", "status", status, "url", url, "response", string(respBody))
+		return nil, newStatusError(status, respBody)
+	}
+	if status == http.StatusNoContent {
+		return nil, nil
+	}
+	return respBody, nil
+}
 
-		resp, err := httpClient.Do(req)
+// send sends the request newRequest builds under the retry policy, and returns the status
+// and body of the first response that isn't a server error or a 429. Network and server
+// errors use up an attempt each; up to maxRateLimitRetries 429s are waited out on top.
+func (c *RealTraktClient) send(ctx context.Context, newRequest func() (*http.Request, error)) (int, []byte, error) {
+	var lastErr error
+	rateLimited := 0
+	for attempt := 0; attempt < c.retry.Attempts; {
+		if err := c.waitForPause(ctx); err != nil {
+			return 0, nil, fmt.Errorf("rate limiter cancelled: %w", err)
+		}
+		req, err := newRequest()
 		if err != nil {
-			lastErr = err
-			slog.Warn("Trakt request failed", "attempt", i+1, "method", method, "url", url, "error", err)
-			retryBackoff(i)
-			continue
+			return 0, nil, err
 		}
 
-		defer resp.Body.Close()
-
-		if resp.StatusCode >= 500 {
-			lastErr = fmt.Errorf("server error: %d", resp.StatusCode)
-			slog.Warn("Trakt server error", "status", resp.StatusCode, "attempt", i+1)
-			retryBackoff(i)
-			continue
+		resp, err := c.httpClient.Do(req)
+		var respBody []byte
+		if err == nil {
+			c.observe(resp.Header)
+			respBody, err = io.ReadAll(resp.Body)
+			resp.Body.Close()
 		}
 
-		if resp.StatusCode >= 400 {
-			respBody, _ := io.ReadAll(resp.Body)
-			slog.Error("Trakt client error", "status", resp.StatusCode, "url", url, "response", string(respBody))
-			return nil, fmt.Errorf("trakt api returned bad status: %d", resp.StatusCode)
+		switch {
+		case err != nil:
+			lastErr = &APIError{Retryable: true, Err: err}
+			slog.Warn("Trakt request failed", "attempt", attempt+1, "method", req.Method, "url", req.URL, "error", err)
+		case resp.StatusCode == http.StatusTooManyRequests:
+			wait := c.throttle(resp.Header)
+			rateLimited++
+			lastErr = &APIError{Status: resp.StatusCode, RetryAfter: wait, Retryable: true}
+			if rateLimited > maxRateLimitRetries || (c.retry.MaxRetryAfter > 0 && wait > c.retry.MaxRetryAfter) {
+				return 0, nil, lastErr
+			}
+			slog.Warn("Trakt rate limit exceeded", "retry_after", wait, "url", req.URL)
+			// Waiting out the limit doesn't use up an attempt
+			continue
+		case resp.StatusCode >= 500:
+			lastErr = newStatusError(resp.StatusCode, nil)
+			slog.Warn("Trakt server error", "status", resp.StatusCode, "attempt", attempt+1)
+		default:
+			return resp.StatusCode, respBody, nil
 		}
 
-		if resp.StatusCode == http.StatusNoContent {
-			return nil, nil
+		if err := c.wait(ctx, attempt); err != nil {
+			return 0, nil, err
 		}
-
-		return io.ReadAll(resp.Body)
+		attempt++
 	}
 
-	return nil, fmt.Errorf("request failed after %d attempts: %w", MaxRetries, lastErr)
+	return 0, nil, fmt.Errorf("request failed after %d attempts: %w", c.retry.Attempts, lastErr)
 }
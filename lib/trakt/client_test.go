@@ -2,19 +2,17 @@ package trakt
 
 import (
 	"context"
+	"encoding/json"
 	"net/http"
 	"net/http/httptest"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
-	"github.com/viscerous/goplaxt/lib/config"
 )
 
 func TestRealTraktClient_DoRequest_Headers(t *testing.T) {
-	// Setup config
-	config.TraktClientId = "test-client-id"
-
 	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/scrobble/start", r.URL.Path)
 		assert.Equal(t, "test-client-id", r.Header.Get("trakt-api-key"))
 		assert.Equal(t, "2", r.Header.Get("trakt-api-version"))
 		assert.Equal(t, "application/json", r.Header.Get("Content-Type"))
@@ -24,12 +22,7 @@ func TestRealTraktClient_DoRequest_Headers(t *testing.T) {
 	}))
 	defer server.Close()
 
-	// Override BaseURL for testing
-	originalBaseURL := BaseURL
-	BaseURL = server.URL
-	defer func() { BaseURL = originalBaseURL }()
-
-	client := &RealTraktClient{}
+	client := NewClient(WithBaseURL(server.URL), WithCredentials("test-client-id", "test-secret"))
 
 	// Test ScrobbleRequest (uses doRequest internally)
 	_, err := client.ScrobbleRequest(context.Background(), "start", []byte("{}"), "test-token")
@@ -37,9 +30,6 @@ func TestRealTraktClient_DoRequest_Headers(t *testing.T) {
 }
 
 func TestRealTraktClient_DoRequest_Retry(t *testing.T) {
-	// Setup config
-	config.TraktClientId = "test-client-id"
-
 	attempts := 0
 	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		attempts++
@@ -52,14 +42,60 @@ func TestRealTraktClient_DoRequest_Retry(t *testing.T) {
 	}))
 	defer server.Close()
 
-	// Override BaseURL for testing
-	originalBaseURL := BaseURL
-	BaseURL = server.URL
-	defer func() { BaseURL = originalBaseURL }()
-
-	client := &RealTraktClient{}
+	client := NewClient(WithBaseURL(server.URL), WithRetryPolicy(RetryPolicy{Attempts: 3}))
 
 	_, err := client.ScrobbleRequest(context.Background(), "start", []byte("{}"), "test-token")
 	assert.NoError(t, err)
 	assert.Equal(t, 3, attempts, "Should have retried 3 times")
+
+	// Requests give up after the policy's attempts
+	attempts = 0
+	client = NewClient(WithBaseURL(server.URL), WithRetryPolicy(RetryPolicy{Attempts: 2}))
+	_, err = client.ScrobbleRequest(context.Background(), "start", []byte("{}"), "test-token")
+	assert.EqualError(t, err, "request failed after 2 attempts: server error: 500")
+	assert.Equal(t, 2, attempts)
+}
+
+func TestRealTraktClient_Auth(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var values map[string]string
+		json.NewDecoder(r.Body).Decode(&values)
+		assert.Equal(t, "test-client-id", values["client_id"])
+
+		switch r.URL.Path {
+		case "/oauth/device/code":
+			w.Write([]byte(`{"device_code": "device", "user_code": "ABCD1234"}`))
+		case "/oauth/device/token":
+			assert.Equal(t, "test-secret", values["client_secret"])
+			w.WriteHeader(http.StatusBadRequest)
+		case "/oauth/token":
+			if values["refresh_token"] == "revoked" {
+				w.WriteHeader(http.StatusBadRequest)
+				w.Write([]byte(`{"error": "invalid_grant", "error_description": "The provided authorization grant is invalid"}`))
+				return
+			}
+			w.WriteHeader(http.StatusUnauthorized)
+			w.Write([]byte(`{"error": "invalid_client"}`))
+		}
+	}))
+	defer server.Close()
+
+	client := NewClient(WithBaseURL(server.URL+"/"), WithCredentials("test-client-id", "test-secret"), WithRetryPolicy(RetryPolicy{Attempts: 1}))
+
+	code, err := client.GetDeviceCode()
+	assert.NoError(t, err)
+	assert.Equal(t, "ABCD1234", code["user_code"])
+
+	// A pending authorisation has no result
+	result, err := client.PollDeviceToken("device")
+	assert.NoError(t, err)
+	assert.Nil(t, result)
+
+	_, err = client.AuthRequest("", "", "revoked", "refresh_token")
+	assert.ErrorIs(t, err, ErrInvalidGrant)
+
+	// Only invalid_grant means the refresh token is no longer accepted
+	_, err = client.AuthRequest("", "", "valid", "refresh_token")
+	assert.Error(t, err)
+	assert.NotErrorIs(t, err, ErrInvalidGrant)
 }
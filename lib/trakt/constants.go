@@ -16,25 +16,19 @@ const (
 	// HTTPTimeout is the default timeout for HTTP requests
 	HTTPTimeout = 30 * time.Second
 
-	// MaxRetries is the number of retry attempts for failed requests
+	// MaxRetries is the default number of attempts for failed requests
 	MaxRetries = 3
 )
 
-// retryBackoff sleeps for an exponentially increasing duration based on attempt number.
-// Attempt should be 0-indexed.
-func retryBackoff(attempt int) {
-	time.Sleep(time.Duration(attempt+1) * time.Second)
-}
-
 // formatAppDate returns the current date in YYYY-MM-DD format for Trakt
 func formatAppDate() string {
 	return time.Now().Format(DateFormat)
 }
 
-// formatCollectedAt converts a Unix timestamp to ISO 8601 UTC format for Trakt collection
-func formatCollectedAt(unixTimestamp int64) string {
-	if unixTimestamp == 0 {
+// formatCollectedAt converts a time to ISO 8601 UTC format for Trakt collection
+func formatCollectedAt(t time.Time) string {
+	if t.IsZero() {
 		return ""
 	}
-	return time.Unix(unixTimestamp, 0).UTC().Format(time.RFC3339)
+	return t.UTC().Format(time.RFC3339)
 }
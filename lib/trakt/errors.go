@@ -0,0 +1,119 @@
+package trakt
+
+import (
+	"cmp"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Errors matched by APIErrors with the corresponding status, for use with errors.Is
+var (
+	// ErrInvalidToken is a revoked or expired access or refresh token (401)
+	ErrInvalidToken = errors.New("invalid_token")
+	// ErrDuplicate is a scrobble Trakt already recorded within the last hour (409)
+	ErrDuplicate = errors.New("already scrobbled")
+	// ErrValidation is a request Trakt rejected as invalid (422)
+	ErrValidation = errors.New("validation failed")
+	// ErrLocked is a locked or deactivated Trakt account (423)
+	ErrLocked = errors.New("account locked")
+	// ErrInvalidGrant is a refresh token or code Trakt no longer accepts, so the user
+	// has to sign in again. Other rejected token requests don't say anything about the user's tokens.
+	ErrInvalidGrant = errors.New("invalid_grant")
+)
+
+// statusErrors maps statuses to the errors they match
+var statusErrors = map[int]error{
+	http.StatusUnauthorized:        ErrInvalidToken,
+	http.StatusConflict:            ErrDuplicate,
+	http.StatusUnprocessableEntity: ErrValidation,
+	http.StatusLocked:              ErrLocked,
+}
+
+// APIError is a failed request to the Trakt API
+type APIError struct {
+	// Status is the HTTP status, or 0 if no response was received
+	Status int
+	// Body is Trakt's response, which may describe the error
+	Body string
+	// RetryAfter is how long Trakt asked to wait before retrying a 429
+	RetryAfter time.Duration
+	// Retryable reports whether the request may succeed if sent again later
+	Retryable bool
+	// Err is the underlying cause, if any
+	Err error
+}
+
+// newStatusError builds the error for an unsuccessful response. Server errors and
+// rate limiting are retryable; other client errors will fail the same way again.
+func newStatusError(status int, body []byte) *APIError {
+	return &APIError{
+		Status:    status,
+		Body:      string(body),
+		Retryable: status >= 500 || status == http.StatusTooManyRequests,
+	}
+}
+
+func (e *APIError) Error() string {
+	if e.Status == 0 && e.Err != nil {
+		return e.Err.Error()
+	}
+
+	var msg string
+	switch {
+	case e.Status == 0:
+		msg = "trakt request failed"
+	case e.Status == http.StatusTooManyRequests:
+		msg = "trakt rate limit exceeded"
+		if e.RetryAfter > 0 {
+			msg += fmt.Sprintf(", retry after %s", e.RetryAfter)
+		}
+	case e.Status >= 500:
+		msg = fmt.Sprintf("server error: %d", e.Status)
+	default:
+		msg = fmt.Sprintf("trakt api returned bad status: %d", e.Status)
+		if description := e.Description(); description != "" {
+			msg += " (" + description + ")"
+		}
+	}
+	if e.Err != nil {
+		return msg + ": " + e.Err.Error()
+	}
+	return msg
+}
+
+// Description returns the error Trakt gave in its response body, if any
+func (e *APIError) Description() string {
+	var body struct {
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}
+	if err := json.Unmarshal([]byte(e.Body), &body); err != nil {
+		return ""
+	}
+	return strings.TrimSpace(cmp.Or(body.ErrorDescription, body.Error))
+}
+
+// Unwrap returns the cause
+func (e *APIError) Unwrap() error {
+	return e.Err
+}
+
+// Is matches the error for the response's status, such as ErrLocked for a 423
+func (e *APIError) Is(target error) bool {
+	err, ok := statusErrors[e.Status]
+	return ok && err == target
+}
+
+// IsRetryable reports whether a failed request may succeed if sent again.
+// Errors that didn't come from the Trakt API are assumed to be retryable.
+func IsRetryable(err error) bool {
+	var apiErr *APIError
+	if errors.As(err, &apiErr) {
+		return apiErr.Retryable
+	}
+	return true
+}
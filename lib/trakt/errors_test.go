@@ -0,0 +1,65 @@
+package trakt
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAPIError(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/scrobble/start":
+			w.WriteHeader(http.StatusConflict)
+			w.Write([]byte(`{"watched_at": "2024-01-01T00:00:00.000Z"}`))
+		case "/sync/ratings":
+			w.WriteHeader(http.StatusUnprocessableEntity)
+			w.Write([]byte(`{"error": "invalid rating"}`))
+		case "/sync/history":
+			w.WriteHeader(http.StatusLocked)
+		case "/checkin":
+			w.WriteHeader(http.StatusNotFound)
+		default:
+			w.WriteHeader(http.StatusBadGateway)
+		}
+	}))
+	defer server.Close()
+
+	client := NewClient(WithBaseURL(server.URL), WithRetryPolicy(RetryPolicy{Attempts: 1}))
+	ctx := context.Background()
+
+	_, err := client.ScrobbleRequest(ctx, "start", nil, "token")
+	var apiErr *APIError
+	assert.True(t, errors.As(err, &apiErr))
+	assert.Equal(t, http.StatusConflict, apiErr.Status)
+	assert.ErrorIs(t, err, ErrDuplicate)
+	assert.False(t, IsRetryable(err))
+
+	_, err = client.SyncRequest(ctx, "ratings", nil, "token")
+	assert.ErrorIs(t, err, ErrValidation)
+	assert.EqualError(t, err, "trakt api returned bad status: 422 (invalid rating)")
+
+	_, err = client.SyncRequest(ctx, "history", nil, "token")
+	assert.ErrorIs(t, err, ErrLocked)
+	assert.NotErrorIs(t, err, ErrInvalidToken)
+
+	// Deleting a checkin that doesn't exist succeeds
+	assert.NoError(t, client.DeleteCheckin(ctx, "token"))
+
+	// Server errors can be retried, even once wrapped
+	_, err = client.MakeRequest(ctx, "/users/me")
+	assert.EqualError(t, err, "request failed after 1 attempts: server error: 502")
+	assert.True(t, IsRetryable(fmt.Errorf("failed to find item: %w", err)))
+
+	// So can failures to reach Trakt at all
+	server.Close()
+	_, err = client.MakeRequest(ctx, "/users/me")
+	assert.True(t, errors.As(err, &apiErr))
+	assert.Zero(t, apiErr.Status)
+	assert.True(t, IsRetryable(err))
+}
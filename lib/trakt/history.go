@@ -0,0 +1,62 @@
+package trakt
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/viscerous/goplaxt/lib/media"
+)
+
+// HistoryItem is a movie or episode watched at a given time
+type HistoryItem struct {
+	Title     string `json:"-"`
+	Ids       Ids    `json:"ids"`
+	WatchedAt string `json:"watched_at"`
+}
+
+// HistoryBody represents the watched history payload to Trakt
+type HistoryBody struct {
+	Movies   []HistoryItem `json:"movies,omitempty"`
+	Episodes []HistoryItem `json:"episodes,omitempty"`
+}
+
+// Len returns the number of items in the body
+func (b HistoryBody) Len() int {
+	return len(b.Movies) + len(b.Episodes)
+}
+
+// FindHistoryItem resolves a movie or episode to Trakt by its external IDs, then by title
+func FindHistoryItem(ctx context.Context, client Client, e media.MediaEvent, watchedAt time.Time) (HistoryItem, error) {
+	item := HistoryItem{WatchedAt: formatCollectedAt(watchedAt)}
+	switch e.Kind {
+	case media.KindMovie:
+		movie, err := findMovie(ctx, client, e)
+		if err != nil {
+			return item, err
+		}
+		item.Title, item.Ids = movie.Title, movie.Ids
+	case media.KindEpisode:
+		episode, err := findEpisode(ctx, client, e)
+		if err != nil {
+			return item, err
+		}
+		item.Title, item.Ids = episode.Title, episode.Ids
+	default:
+		return item, fmt.Errorf("unsupported media type %q", e.Kind)
+	}
+	return item, nil
+}
+
+// AddHistory adds watched movies and episodes to the user's Trakt history
+func AddHistory(ctx context.Context, client Client, body HistoryBody, token string) error {
+	jsonBody, err := json.Marshal(body)
+	if err != nil {
+		return fmt.Errorf("failed to marshal history body: %w", err)
+	}
+	if _, err := client.SyncRequest(ctx, "history", jsonBody, token); err != nil {
+		return fmt.Errorf("failed to add history: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,86 @@
+package trakt
+
+import (
+	"slices"
+	"strings"
+
+	"github.com/viscerous/goplaxt/lib/media"
+)
+
+// audioChannels are the layouts Trakt accepts
+var audioChannels = []string{"1.0", "2.0", "2.1", "3.0", "3.1", "4.0", "4.1", "5.0", "5.1", "5.1.2", "5.1.4", "6.1", "7.1", "7.1.2", "7.1.4", "9.1", "10.1"}
+
+// audioCodecs maps ffmpeg codec names to Trakt's audio values
+var audioCodecs = map[string]string{
+	"aac":    "aac",
+	"ac3":    "dolby_digital",
+	"eac3":   "dolby_digital_plus",
+	"truehd": "dolby_truehd",
+	"dca":    "dts",
+	"dts":    "dts",
+	"flac":   "flac",
+	"mp2":    "mp2",
+	"mp3":    "mp3",
+	"opus":   "ogg_opus",
+	"vorbis": "ogg",
+	"wmav2":  "wma",
+	"wmapro": "wma",
+}
+
+// collectionMetadata maps the file a media server holds to Trakt's collection metadata.
+// Trakt keeps the latest values, so collecting a better copy updates them.
+func collectionMetadata(f media.File) CollectionMetadata {
+	if f == (media.File{}) {
+		return CollectionMetadata{}
+	}
+
+	m := CollectionMetadata{
+		MediaType: "digital",
+		HDR:       f.HDR,
+		Audio:     audioCodec(f),
+		ThreeD:    f.ThreeD,
+	}
+	if slices.Contains(audioChannels, f.AudioChannels) {
+		m.AudioChannels = f.AudioChannels
+	}
+
+	scan := "p"
+	if f.Interlaced {
+		scan = "i"
+	}
+	switch f.Resolution {
+	case "4k":
+		m.Resolution = "uhd_4k"
+	case "1080":
+		m.Resolution = "hd_1080" + scan
+	case "720":
+		m.Resolution = "hd_720p"
+	case "576":
+		m.Resolution = "sd_576" + scan
+	case "480", "sd":
+		m.Resolution = "sd_480" + scan
+	}
+	return m
+}
+
+// audioCodec returns Trakt's name for the file's audio
+func audioCodec(f media.File) string {
+	switch {
+	case f.AudioCodec == "truehd" && f.Atmos:
+		return "dolby_atmos"
+	case f.AudioCodec == "eac3" && f.Atmos:
+		return "dolby_digital_plus_atmos"
+	case f.AudioCodec == "dca" || f.AudioCodec == "dts":
+		switch f.AudioProfile {
+		case "ma":
+			return "dts_ma"
+		case "hra":
+			return "dts_hr"
+		case "x":
+			return "dts_x"
+		}
+	case strings.HasPrefix(f.AudioCodec, "pcm"):
+		return "lpcm"
+	}
+	return audioCodecs[f.AudioCodec]
+}
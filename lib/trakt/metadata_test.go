@@ -0,0 +1,43 @@
+package trakt
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/viscerous/goplaxt/lib/media"
+)
+
+func TestCollectionMetadata(t *testing.T) {
+	tests := []struct {
+		name string
+		file media.File
+		want CollectionMetadata
+	}{
+		{"unknown", media.File{}, CollectionMetadata{}},
+		{
+			"uhd atmos",
+			media.File{Resolution: "4k", HDR: "dolby_vision", AudioCodec: "truehd", Atmos: true, AudioChannels: "7.1", ThreeD: true},
+			CollectionMetadata{MediaType: "digital", Resolution: "uhd_4k", HDR: "dolby_vision", Audio: "dolby_atmos", AudioChannels: "7.1", ThreeD: true},
+		},
+		{
+			"dts master audio",
+			media.File{Resolution: "1080", AudioCodec: "dca", AudioProfile: "ma", AudioChannels: "5.1"},
+			CollectionMetadata{MediaType: "digital", Resolution: "hd_1080p", Audio: "dts_ma", AudioChannels: "5.1"},
+		},
+		{
+			"interlaced sd",
+			media.File{Resolution: "sd", Interlaced: true, AudioCodec: "pcm_s16le", AudioChannels: "2.0"},
+			CollectionMetadata{MediaType: "digital", Resolution: "sd_480i", Audio: "lpcm", AudioChannels: "2.0"},
+		},
+		{
+			"values trakt doesn't know are left out",
+			media.File{Resolution: "2k", AudioCodec: "alac", AudioChannels: "6.0(front)"},
+			CollectionMetadata{MediaType: "digital"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, collectionMetadata(tt.file))
+		})
+	}
+}
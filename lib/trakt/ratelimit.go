@@ -0,0 +1,147 @@
+package trakt
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+const (
+	// maxRateLimitRetries is how many 429 responses a request waits out before failing.
+	// They don't use up the retry policy's attempts.
+	maxRateLimitRetries = 5
+
+	// defaultRetryAfter is the pause after a 429 without a Retry-After header
+	defaultRetryAfter = 10 * time.Second
+
+	// rateLimitMargin keeps the adapted rate below Trakt's limit
+	rateLimitMargin = 0.9
+)
+
+// RateLimit is one of Trakt's rate limits, as reported in its X-Ratelimit header
+type RateLimit struct {
+	Name string `json:"name"`
+	// Period is the length of the limit's window in seconds
+	Period    int       `json:"period"`
+	Limit     int       `json:"limit"`
+	Remaining int       `json:"remaining"`
+	Until     time.Time `json:"until"`
+}
+
+// RateLimitStatus is the client's view of Trakt's rate limits
+type RateLimitStatus struct {
+	// Rate is the requests per second currently allowed
+	Rate  float64 `json:"rate"`
+	Burst int     `json:"burst"`
+	// PausedUntil is set while requests wait for a 429's Retry-After
+	PausedUntil time.Time `json:"paused_until,omitzero"`
+	// Throttled counts the 429 responses received
+	Throttled int         `json:"throttled"`
+	Limits    []RateLimit `json:"limits"`
+}
+
+// RateLimitStatus reports the current limiter state and the last limits Trakt reported
+func (c *RealTraktClient) RateLimitStatus() RateLimitStatus {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	status := RateLimitStatus{
+		Rate:      float64(c.limiter.Limit()),
+		Burst:     c.limiter.Burst(),
+		Throttled: c.throttled,
+		Limits:    []RateLimit{},
+	}
+	if time.Now().Before(c.pausedUntil) {
+		status.PausedUntil = c.pausedUntil
+	}
+	for _, limit := range c.limits {
+		status.Limits = append(status.Limits, limit)
+	}
+	slices.SortFunc(status.Limits, func(a, b RateLimit) int { return strings.Compare(a.Name, b.Name) })
+	return status
+}
+
+// observe records the rate limit reported with a response and adapts the limiter to it.
+// POST limits are per user, so only the shared GET limits change the rate.
+func (c *RealTraktClient) observe(header http.Header) {
+	var limit RateLimit
+	if err := json.Unmarshal([]byte(header.Get("X-Ratelimit")), &limit); err != nil || limit.Name == "" {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.limits == nil {
+		c.limits = make(map[string]RateLimit)
+	}
+	c.limits[limit.Name] = limit
+	if limit.Limit <= 0 || limit.Period <= 0 || strings.Contains(limit.Name, "POST") {
+		return
+	}
+
+	// Spread what's left of the window over the time until it resets,
+	// never faster than the limit's own average
+	allowed := float64(limit.Limit) / float64(limit.Period)
+	if left := time.Until(limit.Until).Seconds(); left > 0 {
+		if limit.Remaining <= 0 {
+			c.pausedUntil = limit.Until
+		}
+		allowed = min(allowed, float64(limit.Remaining)/left)
+	}
+	allowed = max(allowed*rateLimitMargin, 0.1)
+
+	if current := float64(c.limiter.Limit()); current != allowed {
+		slog.Debug("Adapting Trakt rate limit", "name", limit.Name, "remaining", limit.Remaining, "rate", allowed)
+		c.limiter.SetLimit(rate.Limit(allowed))
+	}
+}
+
+// throttle pauses all requests after a 429 and returns how long for
+func (c *RealTraktClient) throttle(header http.Header) time.Duration {
+	wait := retryAfter(header.Get("Retry-After"))
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.throttled++
+	if until := time.Now().Add(wait); until.After(c.pausedUntil) {
+		c.pausedUntil = until
+	}
+	return wait
+}
+
+// retryAfter parses a Retry-After header, given in seconds or as an HTTP date
+func retryAfter(value string) time.Duration {
+	if seconds, err := strconv.Atoi(strings.TrimSpace(value)); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if t, err := http.ParseTime(value); err == nil {
+		return max(time.Until(t), 0)
+	}
+	return defaultRetryAfter
+}
+
+// waitForPause blocks while requests are paused after a 429
+func (c *RealTraktClient) waitForPause(ctx context.Context) error {
+	c.mu.Lock()
+	wait := time.Until(c.pausedUntil)
+	c.mu.Unlock()
+	if wait <= 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
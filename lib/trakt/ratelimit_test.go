@@ -0,0 +1,164 @@
+package trakt
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/time/rate"
+)
+
+func TestRealTraktClient_RateLimited(t *testing.T) {
+	attempts := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts++
+		if attempts <= 2 {
+			w.Header().Set("Retry-After", "0")
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		w.Write([]byte(`[]`))
+	}))
+	defer server.Close()
+
+	// 429s are waited out without using up attempts
+	client := NewClient(WithBaseURL(server.URL), WithRetryPolicy(RetryPolicy{Attempts: 1}))
+	_, err := client.MakeRequest(context.Background(), "/search/movie?query=Heat")
+	assert.NoError(t, err)
+	assert.Equal(t, 3, attempts)
+	assert.Equal(t, 2, client.RateLimitStatus().Throttled)
+
+	// Waits longer than the policy allows fail so the job can be retried later
+	limited := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Retry-After", "120")
+		w.WriteHeader(http.StatusTooManyRequests)
+	}))
+	defer limited.Close()
+	client = NewClient(WithBaseURL(limited.URL), WithRetryPolicy(RetryPolicy{Attempts: 1, MaxRetryAfter: time.Minute}))
+	_, err = client.MakeRequest(context.Background(), "/search/movie?query=Heat")
+	assert.EqualError(t, err, "trakt rate limit exceeded, retry after 2m0s")
+	assert.WithinDuration(t, time.Now().Add(2*time.Minute), client.RateLimitStatus().PausedUntil, 5*time.Second)
+
+	// Later requests wait for the pause
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err = client.MakeRequest(ctx, "/search/movie?query=Heat")
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+}
+
+func TestRealTraktClient_RateLimitHeaders(t *testing.T) {
+	var header string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Ratelimit", header)
+		w.Write([]byte(`[]`))
+	}))
+	defer server.Close()
+
+	client := NewClient(WithBaseURL(server.URL), WithLimiter(rate.NewLimiter(2, 5)))
+	request := func(limit string) {
+		header = limit
+		_, err := client.MakeRequest(context.Background(), "/search/movie?query=Heat")
+		assert.NoError(t, err)
+	}
+	until := time.Now().Add(100 * time.Second).UTC().Format(time.RFC3339)
+
+	// Plenty remaining allows the limit's own average, less a margin
+	request(fmt.Sprintf(`{"name":"UNAUTHED_API_GET_LIMIT","period":300,"limit":1000,"remaining":900,"until":"%s"}`, until))
+	assert.InDelta(t, 1000.0/300*rateLimitMargin, client.RateLimitStatus().Rate, 0.01)
+
+	// Little remaining spreads it over the rest of the window
+	request(fmt.Sprintf(`{"name":"UNAUTHED_API_GET_LIMIT","period":300,"limit":1000,"remaining":50,"until":"%s"}`, until))
+	assert.InDelta(t, 0.5*rateLimitMargin, client.RateLimitStatus().Rate, 0.05)
+
+	// Per-user POST limits are reported but don't slow down everyone
+	request(`{"name":"AUTHED_API_POST_LIMIT","period":1,"limit":1,"remaining":0,"until":"2030-01-01T00:00:00Z"}`)
+	status := client.RateLimitStatus()
+	assert.InDelta(t, 0.5*rateLimitMargin, status.Rate, 0.05)
+	assert.Zero(t, status.PausedUntil)
+	if assert.Len(t, status.Limits, 2) {
+		assert.Equal(t, "AUTHED_API_POST_LIMIT", status.Limits[0].Name)
+		assert.Equal(t, 50, status.Limits[1].Remaining)
+	}
+
+	// Missing or invalid headers are ignored
+	request(`not json`)
+	assert.Len(t, client.RateLimitStatus().Limits, 2)
+}
+
+func TestRetryAfter(t *testing.T) {
+	assert.Equal(t, 30*time.Second, retryAfter("30"))
+	assert.Equal(t, defaultRetryAfter, retryAfter(""))
+	assert.InDelta(t, float64(time.Minute), float64(retryAfter(time.Now().Add(time.Minute).UTC().Format(http.TimeFormat))), float64(2*time.Second))
+}
+
+// closeCounter counts how many response bodies were closed
+type closeCounter struct {
+	transport http.RoundTripper
+	closed    int
+}
+
+type countedBody struct {
+	io.ReadCloser
+	counter *closeCounter
+}
+
+func (b countedBody) Close() error {
+	b.counter.closed++
+	return b.ReadCloser.Close()
+}
+
+func (c *closeCounter) RoundTrip(r *http.Request) (*http.Response, error) {
+	resp, err := c.transport.RoundTrip(r)
+	if err == nil {
+		resp.Body = countedBody{resp.Body, c}
+	}
+	return resp, err
+}
+
+func TestRealTraktClient_RateLimitRetries(t *testing.T) {
+	attempts := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts++
+		w.Header().Set("Retry-After", "0")
+		w.WriteHeader(http.StatusTooManyRequests)
+	}))
+	defer server.Close()
+
+	// Endless 429s are only waited out so often, and every response is closed
+	counter := &closeCounter{transport: http.DefaultTransport}
+	client := NewClient(WithBaseURL(server.URL), WithRetryPolicy(RetryPolicy{Attempts: 2}), WithHTTPClient(&http.Client{Transport: counter}))
+	_, err := client.MakeRequest(context.Background(), "/search/movie?query=Heat")
+	assert.True(t, IsRetryable(err))
+	assert.Equal(t, maxRateLimitRetries+1, attempts)
+	assert.Equal(t, attempts, counter.closed)
+}
+
+func TestRealTraktClient_OAuthRateLimited(t *testing.T) {
+	requests := map[string]int{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests[r.URL.Path]++
+		if requests[r.URL.Path] == 1 {
+			w.Header().Set("Retry-After", "0")
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		w.Write([]byte(`{"access_token": "access"}`))
+	}))
+	defer server.Close()
+
+	// OAuth requests wait out 429s too
+	client := NewClient(WithBaseURL(server.URL), WithRetryPolicy(RetryPolicy{Attempts: 1}))
+	result, err := client.AuthRequest("", "code", "", "authorization_code")
+	assert.NoError(t, err)
+	assert.Equal(t, "access", result["access_token"])
+	result, err = client.PollDeviceToken("device-code")
+	assert.NoError(t, err)
+	assert.Equal(t, "access", result["access_token"])
+	assert.Equal(t, map[string]int{"/oauth/token": 2, "/oauth/device/token": 2}, requests)
+	assert.Equal(t, 2, client.RateLimitStatus().Throttled)
+}
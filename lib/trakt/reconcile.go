@@ -0,0 +1,95 @@
+package trakt
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"slices"
+
+	"github.com/viscerous/goplaxt/lib/media"
+	"github.com/viscerous/goplaxt/lib/store"
+)
+
+// collectedItems records a collected movie or episode by the server's own external IDs.
+// Items the server doesn't identify are left out, as they couldn't be found in its library later.
+func collectedItems(kind string, ids Ids, title string, serverIDs []media.ExternalID) []store.CollectedItem {
+	if ids.Trakt == 0 || len(serverIDs) == 0 {
+		return nil
+	}
+	item := store.CollectedItem{Kind: kind, Trakt: ids.Trakt, Title: title}
+	for _, id := range serverIDs {
+		item.IDs = append(item.IDs, externalIDKey(id))
+	}
+	return []store.CollectedItem{item}
+}
+
+// externalIDKey formats an external ID as "service://id"
+func externalIDKey(id media.ExternalID) string {
+	return id.Service + "://" + id.ID
+}
+
+// Reconcile removes the movies and episodes Plaxt collected from a media server that the
+// server no longer holds. Only the given collected items are considered, so anything
+// collected by hand or from another server is left alone. It returns the items removed.
+func Reconcile(ctx context.Context, client Client, held []media.LibraryItem, collected []store.CollectedItem, user store.User) (Result, []store.CollectedItem, error) {
+	if !user.Config.GetLibraryReconcile() {
+		return skipped("library reconciliation disabled"), nil, nil
+	}
+	// An empty library is more likely a misconfigured server than one that was emptied
+	if len(held) == 0 {
+		return skipped("server library is empty"), nil, nil
+	}
+
+	// A held item without IDs could be any collected item of its kind, so none of those are removed
+	heldKeys := make(map[string]bool)
+	unidentified := make(map[string]bool)
+	for _, item := range held {
+		if len(item.IDs) == 0 {
+			unidentified[item.Kind] = true
+		}
+		for _, id := range item.IDs {
+			heldKeys[item.Kind+":"+externalIDKey(id)] = true
+		}
+	}
+	for kind := range unidentified {
+		slog.Warn("Server library has items without external IDs, not removing any from the collection", "user_id", user.ID, "kind", kind)
+	}
+
+	var removed []store.CollectedItem
+	removeBody := CollectionBody{}
+	for _, item := range collected {
+		if len(item.IDs) == 0 || unidentified[item.Kind] {
+			continue
+		}
+		if slices.ContainsFunc(item.IDs, func(id string) bool { return heldKeys[item.Kind+":"+id] }) {
+			continue
+		}
+		switch item.Kind {
+		case media.KindMovie:
+			removeBody.Movies = append(removeBody.Movies, CollectionMovie{Title: item.Title, Ids: Ids{Trakt: item.Trakt}})
+		case media.KindEpisode:
+			removeBody.Episodes = append(removeBody.Episodes, CollectionEpisode{Title: item.Title, Ids: Ids{Trakt: item.Trakt}})
+		default:
+			continue
+		}
+		removed = append(removed, item)
+	}
+	if len(removed) == 0 {
+		return skipped("nothing to remove"), nil, nil
+	}
+
+	result := Result{
+		Action: "collection/remove",
+		Title:  fmt.Sprintf("%d movies, %d episodes", len(removeBody.Movies), len(removeBody.Episodes)),
+	}
+	jsonBody, err := json.Marshal(removeBody)
+	if err != nil {
+		return result, nil, fmt.Errorf("failed to marshal collection removal body: %w", err)
+	}
+	if _, err := client.SyncRequest(ctx, "collection/remove", jsonBody, user.AccessToken); err != nil {
+		return result, nil, err
+	}
+	slog.Info("Removed media no longer on the server from the collection", "user_id", user.ID, "movies", len(removeBody.Movies), "episodes", len(removeBody.Episodes))
+	return result, removed, nil
+}
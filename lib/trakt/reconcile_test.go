@@ -0,0 +1,101 @@
+package trakt
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/viscerous/goplaxt/lib/media"
+	"github.com/viscerous/goplaxt/lib/store"
+)
+
+func TestReconcile(t *testing.T) {
+	ctx := context.Background()
+	tTrue := true
+	user := store.User{ID: "id", AccessToken: "token", Config: store.Config{LibraryReconcile: &tTrue}}
+	held := []media.LibraryItem{
+		{Kind: media.KindMovie, IDs: []media.ExternalID{{Service: "imdb", ID: "tt1375666"}}},
+		{Kind: media.KindEpisode, IDs: []media.ExternalID{{Service: "tvdb", ID: "8229221"}}},
+	}
+	collected := []store.CollectedItem{
+		{Server: "plex-uuid", Kind: media.KindMovie, Trakt: 1, Title: "Inception", IDs: []string{"imdb://tt1375666", "tmdb://27205"}},
+		{Server: "plex-uuid", Kind: media.KindMovie, Trakt: 2, Title: "Tenet", IDs: []string{"imdb://tt6723592"}},
+		{Server: "plex-uuid", Kind: media.KindEpisode, Trakt: 11, Title: "Good News About Hell", IDs: []string{"tvdb://8229221"}},
+		{Server: "plex-uuid", Kind: media.KindEpisode, Trakt: 12, Title: "Half Loop", IDs: []string{"tvdb://8229222"}},
+		// Never removed, as it can't be found in the library
+		{Server: "plex-uuid", Kind: media.KindEpisode, Trakt: 13, Title: "In Perpetuity"},
+	}
+	newClient := func() (*MockTraktClient, *string) {
+		client := &MockTraktClient{}
+		var sent string
+		client.On("SyncRequest", mock.Anything, "collection/remove", mock.Anything, "token").Run(func(args mock.Arguments) {
+			sent = string(args.Get(2).([]byte))
+		}).Return([]byte(`{}`), nil)
+		return client, &sent
+	}
+
+	t.Run("removes what the server no longer holds", func(t *testing.T) {
+		client, sent := newClient()
+		result, removed, err := Reconcile(ctx, client, held, collected, user)
+		assert.NoError(t, err)
+		assert.Equal(t, "collection/remove", result.Action)
+		assert.Equal(t, "1 movies, 1 episodes", result.Title)
+		assert.Equal(t, []store.CollectedItem{collected[1], collected[3]}, removed)
+		assert.JSONEq(t, `{
+			"movies":[{"title":"Tenet","year":0,"ids":{"trakt":2,"tvdb":0,"imdb":"","tmdb":0,"tvrage":0}}],
+			"episodes":[{"season":0,"number":0,"title":"Half Loop","ids":{"trakt":12,"tvdb":0,"imdb":"","tmdb":0,"tvrage":0}}]
+		}`, *sent)
+	})
+
+	t.Run("library has unidentified items", func(t *testing.T) {
+		client, sent := newClient()
+		unidentified := append(held[:1:1], media.LibraryItem{Kind: media.KindEpisode})
+		result, removed, err := Reconcile(ctx, client, unidentified, collected, user)
+		assert.NoError(t, err)
+		assert.Equal(t, "1 movies, 0 episodes", result.Title)
+		assert.Equal(t, []store.CollectedItem{collected[1]}, removed)
+		assert.NotContains(t, *sent, "episodes")
+	})
+
+	t.Run("library has only unidentified items", func(t *testing.T) {
+		client, _ := newClient()
+		unidentified := []media.LibraryItem{{Kind: media.KindMovie}, {Kind: media.KindEpisode}}
+		result, removed, err := Reconcile(ctx, client, unidentified, collected, user)
+		assert.NoError(t, err)
+		assert.Equal(t, "nothing to remove", result.Skipped)
+		assert.Empty(t, removed)
+		client.AssertNotCalled(t, "SyncRequest", mock.Anything, mock.Anything, mock.Anything, mock.Anything)
+	})
+
+	t.Run("reconciliation disabled", func(t *testing.T) {
+		client, _ := newClient()
+		tFalse := false
+		disabled := store.User{AccessToken: "token", Config: store.Config{MovieCollectionRemove: &tTrue, EpisodeCollectionRemove: &tTrue, LibraryReconcile: &tFalse}}
+		result, removed, err := Reconcile(ctx, client, held, collected, disabled)
+		assert.NoError(t, err)
+		assert.Equal(t, "library reconciliation disabled", result.Skipped)
+		assert.Empty(t, removed)
+		client.AssertNotCalled(t, "SyncRequest", mock.Anything, mock.Anything, mock.Anything, mock.Anything)
+	})
+
+	t.Run("empty library", func(t *testing.T) {
+		client, _ := newClient()
+		result, _, err := Reconcile(ctx, client, nil, collected, user)
+		assert.NoError(t, err)
+		assert.Equal(t, "server library is empty", result.Skipped)
+		client.AssertNotCalled(t, "SyncRequest", mock.Anything, mock.Anything, mock.Anything, mock.Anything)
+	})
+
+	t.Run("nothing to remove", func(t *testing.T) {
+		client, _ := newClient()
+		all := append(held,
+			media.LibraryItem{Kind: media.KindMovie, IDs: []media.ExternalID{{Service: "tmdb", ID: "577922"}, {Service: "imdb", ID: "tt6723592"}}},
+			media.LibraryItem{Kind: media.KindEpisode, IDs: []media.ExternalID{{Service: "tvdb", ID: "8229222"}}},
+		)
+		result, _, err := Reconcile(ctx, client, all, collected, user)
+		assert.NoError(t, err)
+		assert.Equal(t, "nothing to remove", result.Skipped)
+		client.AssertNotCalled(t, "SyncRequest", mock.Anything, mock.Anything, mock.Anything, mock.Anything)
+	})
+}
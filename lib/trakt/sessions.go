@@ -0,0 +1,152 @@
+package trakt
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/viscerous/goplaxt/lib/media"
+)
+
+// State is where a viewing is up to, as last reported to Trakt
+type State int
+
+const (
+	StatePlaying State = iota + 1
+	StatePaused
+	// StateStopped means playback ended before the item was watched
+	StateStopped
+	// StateScrobbled means the item was marked as watched
+	StateScrobbled
+)
+
+const (
+	// duplicateStartWindow is how long a repeated start for a playing item is suppressed.
+	// After that it is sent again so Trakt's "watching" status doesn't expire.
+	duplicateStartWindow = 10 * time.Minute
+
+	// sessionTTL is how long an idle viewing is remembered
+	sessionTTL = 24 * time.Hour
+)
+
+// SessionKey identifies one viewing of an item by a user on a player
+type SessionKey struct {
+	UserID string
+	Player string
+	Item   string
+}
+
+// NewSessionKey returns the key for the viewing an event belongs to
+func NewSessionKey(userID string, e media.MediaEvent) SessionKey {
+	player := e.Player.UUID
+	if player == "" {
+		player = e.Player.Name
+	}
+	item := e.ItemID
+	if item == "" {
+		item = fmt.Sprintf("%s/%s/%d/%d", e.Kind, e.Title, e.Season, e.Episode)
+	}
+	return SessionKey{UserID: userID, Player: player, Item: item}
+}
+
+// session is the tracked state of a viewing
+type session struct {
+	State    State
+	Progress float64
+	Updated  time.Time
+}
+
+// SessionTracker remembers what was last sent to Trakt for each viewing, so that
+// duplicate events are suppressed and exactly one stop is sent per viewing.
+// A nil tracker suppresses nothing.
+type SessionTracker struct {
+	mu       sync.Mutex
+	sessions map[SessionKey]session
+	now      func() time.Time
+}
+
+// NewSessionTracker creates an empty tracker
+func NewSessionTracker() *SessionTracker {
+	return &SessionTracker{
+		sessions: make(map[SessionKey]session),
+		now:      time.Now,
+	}
+}
+
+// nextState returns the state after a scrobble action. A media.stop that is sent
+// as a pause because too little was watched ends the viewing.
+func nextState(action, event string) State {
+	switch action {
+	case "start":
+		return StatePlaying
+	case "stop":
+		return StateScrobbled
+	}
+	if event == media.EventStop {
+		return StateStopped
+	}
+	return StatePaused
+}
+
+// Check reports why a scrobble action should not be sent to Trakt, or "" if it should.
+// watched is the user's watched threshold. Suppressed actions still update the tracked state.
+func (t *SessionTracker) Check(key SessionKey, action, event string, progress, watched float64) string {
+	if t == nil {
+		return ""
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	s, ok := t.sessions[key]
+	if !ok || t.now().Sub(s.Updated) > sessionTTL {
+		return ""
+	}
+
+	var reason string
+	switch action {
+	case "start":
+		switch {
+		case s.State == StatePlaying && t.now().Sub(s.Updated) < duplicateStartWindow:
+			reason = "already playing"
+		case s.State == StateScrobbled && progress >= watched:
+			// Resuming during the credits is not a new viewing
+			reason = "already scrobbled"
+		}
+	case "pause":
+		switch s.State {
+		case StatePaused:
+			reason = "already paused"
+		case StateStopped:
+			reason = "already stopped"
+		case StateScrobbled:
+			reason = "already scrobbled"
+		}
+	case "stop":
+		if s.State == StateScrobbled {
+			reason = "already scrobbled"
+		}
+	}
+
+	// A viewing that was scrobbled stays scrobbled until a new one starts
+	if reason != "" && s.State != StateScrobbled {
+		t.sessions[key] = session{State: nextState(action, event), Progress: progress, Updated: t.now()}
+	}
+	return reason
+}
+
+// Record stores the state after an action was sent to Trakt
+func (t *SessionTracker) Record(key SessionKey, action, event string, progress float64) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := t.now()
+	for k, s := range t.sessions {
+		if now.Sub(s.Updated) > sessionTTL {
+			delete(t.sessions, k)
+		}
+	}
+	t.sessions[key] = session{State: nextState(action, event), Progress: progress, Updated: now}
+}
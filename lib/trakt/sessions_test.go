@@ -0,0 +1,101 @@
+package trakt
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/viscerous/goplaxt/lib/media"
+	"github.com/viscerous/goplaxt/lib/store"
+)
+
+func TestSessionTracker(t *testing.T) {
+	now := time.Now()
+	tracker := NewSessionTracker()
+	tracker.now = func() time.Time { return now }
+	key := SessionKey{UserID: "user1", Player: "tv", Item: "1234"}
+	watched := float64(store.DefaultWatchedThreshold)
+
+	// A new viewing is always sent
+	assert.Equal(t, "", tracker.Check(key, "start", media.EventPlay, 0, watched))
+	tracker.Record(key, "start", media.EventPlay, 0)
+	assert.Equal(t, "already playing", tracker.Check(key, "start", media.EventPlay, 1, watched))
+
+	// The start is refreshed once Trakt's status could have expired
+	now = now.Add(duplicateStartWindow + time.Minute)
+	assert.Equal(t, "", tracker.Check(key, "start", media.EventPlay, 20, watched))
+
+	tracker.Record(key, "pause", media.EventPause, 30)
+	assert.Equal(t, "already paused", tracker.Check(key, "pause", media.EventPause, 30, watched))
+	// A resume after a long pause is sent
+	now = now.Add(2 * time.Hour)
+	assert.Equal(t, "", tracker.Check(key, "start", media.EventResume, 30, watched))
+	tracker.Record(key, "start", media.EventResume, 30)
+
+	// Plex's scrobble is the only stop sent, the later media.stop is suppressed
+	tracker.Record(key, "stop", media.EventScrobble, 90)
+	assert.Equal(t, "already scrobbled", tracker.Check(key, "stop", media.EventStop, 98, watched))
+	assert.Equal(t, "already scrobbled", tracker.Check(key, "pause", media.EventPause, 95, watched))
+	assert.Equal(t, "already scrobbled", tracker.Check(key, "start", media.EventResume, 95, watched))
+
+	// Resuming counts as a new viewing until past the user's own watched threshold
+	assert.Equal(t, "", tracker.Check(key, "start", media.EventResume, 85, 95))
+	assert.Equal(t, "already scrobbled", tracker.Check(key, "start", media.EventResume, 85, 80))
+
+	// Starting again from the beginning is a new viewing
+	assert.Equal(t, "", tracker.Check(key, "start", media.EventPlay, 2, watched))
+
+	// Other players and items are tracked separately
+	assert.Equal(t, "", tracker.Check(SessionKey{UserID: "user1", Player: "phone", Item: "1234"}, "stop", media.EventStop, 95, watched))
+	assert.Equal(t, "", tracker.Check(SessionKey{UserID: "user2", Player: "tv", Item: "1234"}, "stop", media.EventStop, 95, watched))
+
+	// A stop before the end ends the viewing without a scrobble
+	other := SessionKey{UserID: "user1", Player: "tv", Item: "5678"}
+	tracker.Record(other, "pause", media.EventPause, 40)
+	assert.Equal(t, "already paused", tracker.Check(other, "pause", media.EventStop, 40, watched))
+	assert.Equal(t, "already stopped", tracker.Check(other, "pause", media.EventPause, 40, watched))
+	assert.Equal(t, "", tracker.Check(other, "start", media.EventPlay, 40, watched))
+
+	// Idle viewings are forgotten
+	now = now.Add(sessionTTL + time.Hour)
+	assert.Equal(t, "", tracker.Check(key, "stop", media.EventStop, 95, watched))
+	tracker.Record(other, "start", media.EventPlay, 0)
+	assert.Len(t, tracker.sessions, 1)
+
+	// A nil tracker suppresses nothing
+	var none *SessionTracker
+	assert.Equal(t, "", none.Check(key, "stop", media.EventStop, 95, watched))
+	none.Record(key, "stop", media.EventStop, 95)
+}
+
+func TestHandleSuppressesDuplicateStop(t *testing.T) {
+	tTrue := true
+	user := store.User{ID: "user1", AccessToken: "token", Config: store.Config{MovieScrobbleStart: &tTrue, MovieScrobbleStop: &tTrue}}
+	client := &MockTraktClient{MakeRequestResponses: map[string][]byte{
+		"/search/movie?query=Inception": []byte(`[{"movie":{"title":"Inception","year":2010,"ids":{"trakt":123}}}]`),
+	}}
+	client.On("MakeRequest", mock.Anything, mock.Anything)
+	client.On("ScrobbleRequest", mock.Anything, mock.Anything, mock.Anything, "token").Return([]byte(`{}`), nil)
+
+	sessions := NewSessionTracker()
+	event := media.MediaEvent{Kind: media.KindMovie, ItemID: "1234", Title: "Inception", Player: media.Player{UUID: "tv"}}
+	for _, e := range []struct {
+		event    string
+		progress float64
+	}{
+		{media.EventPlay, 0},
+		{media.EventPlay, 0},
+		{media.EventScrobble, 0},
+		{media.EventStop, 97},
+	} {
+		event.Event, event.Progress = e.event, e.progress
+		_, err := Handle(context.Background(), client, sessions, event, user)
+		assert.NoError(t, err)
+	}
+
+	client.AssertNumberOfCalls(t, "ScrobbleRequest", 2)
+	client.AssertCalled(t, "ScrobbleRequest", mock.Anything, "start", mock.Anything, "token")
+	client.AssertCalled(t, "ScrobbleRequest", mock.Anything, "stop", mock.Anything, "token")
+}
@@ -1,5 +1,7 @@
 package trakt
 
+import "time"
+
 // Ids represents the IDs representing a media item across the metadata providers
 type Ids struct {
 	Trakt  int    `json:"trakt"`
@@ -33,11 +35,14 @@ type Episode struct {
 	Number int    `json:"number"`
 	Title  string `json:"title"`
 	Ids    Ids    `json:"ids"`
+	// FirstAired is only returned with extended=full
+	FirstAired *time.Time `json:"first_aired,omitempty"`
 }
 
 // Season represents a season
 type Season struct {
 	Number   int
+	Ids      Ids
 	Episodes []Episode
 }
 
@@ -69,6 +74,7 @@ type MovieScrobbleBody struct {
 type RateBody struct {
 	Movies   []MovieRating   `json:"movies,omitempty"`
 	Shows    []ShowRating    `json:"shows,omitempty"`
+	Seasons  []SeasonRating  `json:"seasons,omitempty"`
 	Episodes []EpisodeRating `json:"episodes,omitempty"`
 }
 
@@ -86,17 +92,33 @@ type ShowRating struct {
 	Ids    Ids    `json:"ids"`
 }
 
+type SeasonRating struct {
+	Rating int `json:"rating"`
+	Ids    Ids `json:"ids"`
+}
+
 type EpisodeRating struct {
 	Rating  int     `json:"rating"`
 	Episode Episode `json:"episode"`
 }
 
+// CollectionMetadata describes the copy that was collected
+type CollectionMetadata struct {
+	MediaType     string `json:"media_type,omitempty"`
+	Resolution    string `json:"resolution,omitempty"`
+	HDR           string `json:"hdr,omitempty"`
+	Audio         string `json:"audio,omitempty"`
+	AudioChannels string `json:"audio_channels,omitempty"`
+	ThreeD        bool   `json:"3d,omitempty"`
+}
+
 // CollectionMovie represents a movie for collection sync with collected_at timestamp
 type CollectionMovie struct {
 	Title       string `json:"title"`
 	Year        int    `json:"year"`
 	Ids         Ids    `json:"ids"`
 	CollectedAt string `json:"collected_at,omitempty"`
+	CollectionMetadata
 }
 
 // CollectionEpisode represents an episode for collection sync with collected_at timestamp
@@ -106,11 +128,26 @@ type CollectionEpisode struct {
 	Title       string `json:"title"`
 	Ids         Ids    `json:"ids"`
 	CollectedAt string `json:"collected_at,omitempty"`
+	CollectionMetadata
+}
+
+// CollectionSeason represents a season's episodes for collection sync
+type CollectionSeason struct {
+	Number   int                 `json:"number"`
+	Episodes []CollectionEpisode `json:"episodes"`
+}
+
+// CollectionShow represents a show's seasons for collection sync
+type CollectionShow struct {
+	Title   string             `json:"title"`
+	Year    int                `json:"year"`
+	Ids     Ids                `json:"ids"`
+	Seasons []CollectionSeason `json:"seasons"`
 }
 
 // CollectionBody represents the collection payload to Trakt
 type CollectionBody struct {
 	Movies   []CollectionMovie   `json:"movies,omitempty"`
-	Shows    []Show              `json:"shows,omitempty"`
+	Shows    []CollectionShow    `json:"shows,omitempty"`
 	Episodes []CollectionEpisode `json:"episodes,omitempty"`
 }
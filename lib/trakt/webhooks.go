@@ -3,65 +3,87 @@ package trakt
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log/slog"
 	"net/url"
-	"strings"
+	"slices"
+	"time"
 
+	"github.com/viscerous/goplaxt/lib/media"
 	"github.com/viscerous/goplaxt/lib/store"
-	"github.com/xanderstrike/plexhooks"
 )
 
-// PlexFullPayload is used to manual extract fields missing in plexhooks.PlexResponse
-type PlexFullPayload struct {
-	ViewOffset int64 `json:"viewOffset"`
-	Metadata   struct {
-		Duration   int64       `json:"duration"`
-		UserRating float64     `json:"userRating"`
-		RawRating  interface{} `json:"rating"` // Could be float or array
-	} `json:"Metadata"`
+// Result describes what was sent to Trakt for an event
+type Result struct {
+	// Action is the Trakt operation performed, e.g. "scrobble/start" or "ratings"
+	Action string
+	// Title and Ids identify the matched Trakt item
+	Title string
+	Ids   Ids
+	// Skipped explains why nothing was sent to Trakt
+	Skipped string
+	// Collected lists the items a collection added that the server identified, so that
+	// they can be removed again once the server no longer holds them
+	Collected []store.CollectedItem
 }
 
-// Handle determines if an item is a show or a movie and routes appropriately
-func Handle(ctx context.Context, client Client, pr plexhooks.PlexResponse, body []byte, user store.User) {
-	var full PlexFullPayload
-	if err := json.Unmarshal(body, &full); err != nil {
-		slog.Warn("Error unmarshalling full payload", "error", err)
-	}
-
-	slog.Debug("Webhook payload details",
-		"event", pr.Event,
-		"offset", full.ViewOffset,
-		"duration", full.Metadata.Duration,
-		"userRating", full.Metadata.UserRating)
+// skipped returns a Result for an event that was deliberately not sent to Trakt
+func skipped(reason string) Result {
+	return Result{Skipped: reason}
+}
 
+// Handle determines if an item is a show or a movie and routes appropriately.
+// Scrobbles are checked against sessions to suppress duplicates.
+func Handle(ctx context.Context, client Client, sessions *SessionTracker, e media.MediaEvent, user store.User) (Result, error) {
+	slog.Debug("Webhook event details",
+		"event", e.Event,
+		"source", e.Source,
+		"kind", e.Kind,
+		"progress", e.Progress,
+		"rating", e.Rating)
+
+	var result Result
 	var err error
-	switch pr.Event {
-	case "media.rate":
-		err = handleRate(ctx, client, pr, full, user)
-	case "library.new":
-		err = handleCollection(ctx, client, pr, body, user)
-	case "media.play", "media.pause", "media.resume", "media.stop", "media.scrobble":
-		switch pr.Metadata.LibrarySectionType {
-		case "show":
-			err = handleShow(ctx, client, pr, full, user)
-		case "movie":
-			err = handleMovie(ctx, client, pr, full, user)
+	switch e.Event {
+	case media.EventRate:
+		result, err = handleRate(ctx, client, e, user)
+	case media.EventAdded:
+		result, err = handleCollection(ctx, client, e, user)
+	case media.EventRemoved:
+		result, err = handleCollectionRemove(ctx, client, e, user)
+	case media.EventPlay, media.EventPause, media.EventResume, media.EventStop, media.EventScrobble:
+		switch e.Kind {
+		case media.KindEpisode:
+			result, err = handleShow(ctx, client, sessions, e, user)
+		case media.KindMovie:
+			result, err = handleMovie(ctx, client, sessions, e, user)
+		default:
+			result = skipped("unsupported media type")
 		}
 	default:
-		slog.Debug("Event not handled", "event", pr.Event)
+		slog.Debug("Event not handled", "event", e.Event)
+		result = skipped("event not handled")
 	}
 
+	var notFound notFoundError
+	if errors.As(err, &notFound) {
+		// Retrying won't help until Trakt adds the item
+		slog.Info("Item not found on Trakt", "event", e.Event, "kind", e.Kind)
+		result.Skipped = notFound.Error() + " on Trakt"
+		return result, nil
+	}
 	if err != nil {
-		slog.Error("Failed to handle event", "event", pr.Event, "error", err)
+		return result, fmt.Errorf("failed to handle %s: %w", e.Event, err)
 	}
+	return result, nil
 }
 
 // handleShow starts the scrobbling for a show
-func handleShow(ctx context.Context, client Client, pr plexhooks.PlexResponse, full PlexFullPayload, user store.User) error {
-	finder := func() (interface{}, string, error) {
-		ep, err := findEpisode(ctx, client, pr)
-		return ep, ep.Title, err
+func handleShow(ctx context.Context, client Client, sessions *SessionTracker, e media.MediaEvent, user store.User) (Result, error) {
+	finder := func() (interface{}, string, Ids, error) {
+		ep, err := findEpisode(ctx, client, e)
+		return ep, ep.Title, ep.Ids, err
 	}
 	builder := func(p float64, i interface{}) interface{} {
 		return map[string]interface{}{
@@ -71,14 +93,14 @@ func handleShow(ctx context.Context, client Client, pr plexhooks.PlexResponse, f
 			"app_date":    formatAppDate(),
 		}
 	}
-	return handleScrobble(ctx, client, pr, full, user, user.Config.GetEpisodeScrobbleStart(), user.Config.GetEpisodeScrobbleStop(), finder, builder)
+	return handleScrobble(ctx, client, sessions, e, user, user.Config.GetEpisodeScrobbleStart(), user.Config.GetEpisodeScrobbleStop(), finder, builder)
 }
 
 // handleMovie starts the scrobbling for a movie
-func handleMovie(ctx context.Context, client Client, pr plexhooks.PlexResponse, full PlexFullPayload, user store.User) error {
-	finder := func() (interface{}, string, error) {
-		m, err := findMovie(ctx, client, pr)
-		return m, m.Title, err
+func handleMovie(ctx context.Context, client Client, sessions *SessionTracker, e media.MediaEvent, user store.User) (Result, error) {
+	finder := func() (interface{}, string, Ids, error) {
+		m, err := findMovie(ctx, client, e)
+		return m, m.Title, m.Ids, err
 	}
 	builder := func(p float64, i interface{}) interface{} {
 		return map[string]interface{}{
@@ -88,244 +110,465 @@ func handleMovie(ctx context.Context, client Client, pr plexhooks.PlexResponse,
 			"app_date":    formatAppDate(),
 		}
 	}
-	return handleScrobble(ctx, client, pr, full, user, user.Config.GetMovieScrobbleStart(), user.Config.GetMovieScrobbleStop(), finder, builder)
+	return handleScrobble(ctx, client, sessions, e, user, user.Config.GetMovieScrobbleStart(), user.Config.GetMovieScrobbleStop(), finder, builder)
 }
 
-func handleScrobble(ctx context.Context, client Client, pr plexhooks.PlexResponse, full PlexFullPayload, user store.User,
+func handleScrobble(ctx context.Context, client Client, sessions *SessionTracker, e media.MediaEvent, user store.User,
 	startEnabled, stopEnabled bool,
-	findItem func() (interface{}, string, error),
-	buildBody func(float64, interface{}) interface{}) error {
+	findItem func() (interface{}, string, Ids, error),
+	buildBody func(float64, interface{}) interface{}) (Result, error) {
+
+	if e.Event == media.EventScrobble && !user.Config.GetUseScrobbleEvent() {
+		return skipped("scrobble event disabled"), nil
+	}
 
-	event, progress := getAction(pr, full)
+	event, progress := getAction(e, user.Config)
 	if event == "" {
-		return nil
+		return skipped("no scrobble action"), nil
+	}
+
+	key := NewSessionKey(user.ID, e)
+	if reason := sessions.Check(key, event, e.Event, progress, float64(user.Config.GetWatchedThreshold())); reason != "" {
+		slog.Debug("Suppressing redundant scrobble", "action", event, "reason", reason, "player", key.Player, "item", key.Item)
+		return skipped(reason), nil
 	}
 
 	// Trakt 422 Error Prevention
-	if (event == "pause" || event == "stop") && progress < 1.0 {
+	if (event == "pause" || event == "stop") && progress < float64(user.Config.GetMinProgress()) {
 		slog.Info("Progress too low for scrobble, clearing status instead", "event", event, "progress", progress)
 		_ = client.DeleteCheckin(ctx, user.AccessToken)
-		return nil
+		sessions.Record(key, "pause", e.Event, progress)
+		return Result{Action: "checkin/clear"}, nil
 	}
 
 	if event == "start" && !startEnabled {
-		slog.Debug("Start Scrobble disabled by user", "type", pr.Metadata.LibrarySectionType)
-		return nil
+		slog.Debug("Start Scrobble disabled by user", "kind", e.Kind)
+		return skipped("start scrobble disabled"), nil
 	}
 	if event == "stop" && !stopEnabled {
-		slog.Debug("Stop Scrobble disabled by user", "type", pr.Metadata.LibrarySectionType)
-		return nil
+		slog.Debug("Stop Scrobble disabled by user", "kind", e.Kind)
+		return skipped("stop scrobble disabled"), nil
 	}
 
-	item, title, err := findItem()
+	item, title, ids, err := findItem()
 	if err != nil {
-		return fmt.Errorf("failed to find item: %w", err)
+		return Result{}, fmt.Errorf("failed to find item: %w", err)
 	}
 
+	result := Result{Action: "scrobble/" + event, Title: title, Ids: ids}
 	body := buildBody(progress, item)
 	jsonBody, err := json.Marshal(body)
 	if err != nil {
-		return fmt.Errorf("failed to marshal scrobble object: %w", err)
+		return result, fmt.Errorf("failed to marshal scrobble object: %w", err)
 	}
 
 	_, err = client.ScrobbleRequest(ctx, event, jsonBody, user.AccessToken)
+	if errors.Is(err, ErrDuplicate) {
+		// Trakt already has this scrobble, which is what we wanted
+		slog.Info("Scrobble already recorded", "action", event, "item", title)
+		sessions.Record(key, event, e.Event, progress)
+		result.Skipped = "already scrobbled"
+		return result, nil
+	}
 	if err == nil {
 		slog.Info("Scrobble successful", "action", event, "item", title, "progress", progress)
+		sessions.Record(key, event, e.Event, progress)
 	}
-	return err
+	return result, err
 }
 
-func handleRate(ctx context.Context, client Client, pr plexhooks.PlexResponse, full PlexFullPayload, user store.User) error {
-	rating := full.Metadata.UserRating
-	if rating == 0 {
-		// Fallback to 'rating' field if userRating is 0 (handles both float and array formats)
-		switch val := full.Metadata.RawRating.(type) {
-		case float64:
-			rating = val
-		case []interface{}:
-			if len(val) > 0 {
-				if r, ok := val[0].(float64); ok {
-					rating = r
-				}
-			}
-		}
-	}
-
+func handleRate(ctx context.Context, client Client, e media.MediaEvent, user store.User) (Result, error) {
+	rating := e.Rating
 	intRating := int(rating)
 	if intRating < 1 && rating > 0 {
 		intRating = 1
 	}
 
-	slog.Debug("Handling rate event", "rating", intRating, "user_rating", full.Metadata.UserRating)
+	slog.Debug("Handling rate event", "rating", intRating, "raw_rating", rating)
 
 	if intRating == 0 {
-		return handleRatingRemove(ctx, client, pr, user)
+		return handleRatingRemove(ctx, client, e, user)
 	}
 
+	result := Result{Action: "ratings"}
 	rateBody := RateBody{}
-	switch pr.Metadata.LibrarySectionType {
-	case "movie":
+	switch e.Kind {
+	case media.KindMovie:
 		if !user.Config.GetMovieRate() {
 			slog.Debug("Movie Rating Sync disabled by user")
-			return nil
+			return skipped("movie rating sync disabled"), nil
 		}
 
-		movie, err := findMovie(ctx, client, pr)
+		movie, err := findMovie(ctx, client, e)
 		if err != nil {
-			return fmt.Errorf("failed to find movie: %w", err)
+			return result, fmt.Errorf("failed to find movie: %w", err)
 		}
+		result.Title, result.Ids = movie.Title, movie.Ids
 		rateBody.Movies = []MovieRating{{
 			Rating: intRating,
 			Title:  movie.Title,
 			Year:   movie.Year,
 			Ids:    movie.Ids,
 		}}
-	case "show":
-		switch pr.Metadata.Type {
-		case "episode":
-			if !user.Config.GetEpisodeRate() {
-				slog.Debug("Episode Rating Sync disabled by user")
-				return nil
-			}
-			episode, err := findEpisode(ctx, client, pr)
-			if err != nil {
-				return fmt.Errorf("failed to find episode: %w", err)
-			}
-			rateBody.Episodes = []EpisodeRating{{
-				Rating:  intRating,
-				Episode: episode,
-			}}
-		case "show":
-			if !user.Config.GetShowRate() {
-				slog.Debug("Show Rating Sync disabled by user")
-				return nil
-			}
-			slog.Debug("Rating shows directly not fully supported yet")
-			return nil
+	case media.KindEpisode:
+		if !user.Config.GetEpisodeRate() {
+			slog.Debug("Episode Rating Sync disabled by user")
+			return skipped("episode rating sync disabled"), nil
+		}
+		episode, err := findEpisode(ctx, client, e)
+		if err != nil {
+			return result, fmt.Errorf("failed to find episode: %w", err)
+		}
+		result.Title, result.Ids = episode.Title, episode.Ids
+		rateBody.Episodes = []EpisodeRating{{
+			Rating:  intRating,
+			Episode: episode,
+		}}
+	case media.KindShow:
+		if !user.Config.GetShowRate() {
+			slog.Debug("Show Rating Sync disabled by user")
+			return skipped("show rating sync disabled"), nil
+		}
+		show, err := findShow(ctx, client, e)
+		if err != nil {
+			return result, fmt.Errorf("failed to find show: %w", err)
+		}
+		result.Title, result.Ids = show.Title, show.Ids
+		rateBody.Shows = []ShowRating{{
+			Rating: intRating,
+			Title:  show.Title,
+			Year:   show.Year,
+			Ids:    show.Ids,
+		}}
+	case media.KindSeason:
+		if !user.Config.GetSeasonRate() {
+			slog.Debug("Season Rating Sync disabled by user")
+			return skipped("season rating sync disabled"), nil
+		}
+		show, season, err := findSeason(ctx, client, e)
+		if err != nil {
+			return result, fmt.Errorf("failed to find season: %w", err)
 		}
+		result.Title, result.Ids = seasonTitle(show, season), season.Ids
+		rateBody.Seasons = []SeasonRating{{
+			Rating: intRating,
+			Ids:    season.Ids,
+		}}
+	default:
+		return skipped("unsupported media type"), nil
 	}
 
 	jsonBody, err := json.Marshal(rateBody)
 	if err != nil {
-		return fmt.Errorf("failed to marshal rate body: %w", err)
+		return result, fmt.Errorf("failed to marshal rate body: %w", err)
 	}
 
 	_, err = client.SyncRequest(ctx, "ratings", jsonBody, user.AccessToken)
 	if err == nil {
 		slog.Info("Rating synced successfully", "rating", intRating)
 	}
-	return err
+	return result, err
 }
 
-func handleRatingRemove(ctx context.Context, client Client, pr plexhooks.PlexResponse, user store.User) error {
+func handleRatingRemove(ctx context.Context, client Client, e media.MediaEvent, user store.User) (Result, error) {
 	slog.Debug("Handling rating removal event")
 
+	result := Result{Action: "ratings/remove"}
 	removeBody := RateBody{}
-	switch pr.Metadata.LibrarySectionType {
-	case "movie":
+	switch e.Kind {
+	case media.KindMovie:
 		if !user.Config.GetMovieRate() {
-			return nil
+			return skipped("movie rating sync disabled"), nil
 		}
-		movie, err := findMovie(ctx, client, pr)
+		movie, err := findMovie(ctx, client, e)
 		if err != nil {
-			return fmt.Errorf("failed to find movie: %w", err)
+			return result, fmt.Errorf("failed to find movie: %w", err)
 		}
+		result.Title, result.Ids = movie.Title, movie.Ids
 		removeBody.Movies = []MovieRating{{
 			Title: movie.Title,
 			Year:  movie.Year,
 			Ids:   movie.Ids,
 		}}
-	case "show":
-		if pr.Metadata.Type == "episode" {
-			if !user.Config.GetEpisodeRate() {
-				return nil
-			}
-			episode, err := findEpisode(ctx, client, pr)
-			if err != nil {
-				return fmt.Errorf("failed to find episode: %w", err)
-			}
-			removeBody.Episodes = []EpisodeRating{{
-				Episode: episode,
-			}}
-		} else {
-			slog.Debug("Rating removal for show directly not supported yet")
-			return nil
+	case media.KindEpisode:
+		if !user.Config.GetEpisodeRate() {
+			return skipped("episode rating sync disabled"), nil
 		}
+		episode, err := findEpisode(ctx, client, e)
+		if err != nil {
+			return result, fmt.Errorf("failed to find episode: %w", err)
+		}
+		result.Title, result.Ids = episode.Title, episode.Ids
+		removeBody.Episodes = []EpisodeRating{{
+			Episode: episode,
+		}}
+	case media.KindShow:
+		if !user.Config.GetShowRate() {
+			return skipped("show rating sync disabled"), nil
+		}
+		show, err := findShow(ctx, client, e)
+		if err != nil {
+			return result, fmt.Errorf("failed to find show: %w", err)
+		}
+		result.Title, result.Ids = show.Title, show.Ids
+		removeBody.Shows = []ShowRating{{
+			Title: show.Title,
+			Year:  show.Year,
+			Ids:   show.Ids,
+		}}
+	case media.KindSeason:
+		if !user.Config.GetSeasonRate() {
+			return skipped("season rating sync disabled"), nil
+		}
+		show, season, err := findSeason(ctx, client, e)
+		if err != nil {
+			return result, fmt.Errorf("failed to find season: %w", err)
+		}
+		result.Title, result.Ids = seasonTitle(show, season), season.Ids
+		removeBody.Seasons = []SeasonRating{{
+			Ids: season.Ids,
+		}}
+	default:
+		return skipped("unsupported media type"), nil
 	}
 
 	jsonBody, err := json.Marshal(removeBody)
 	if err != nil {
-		return fmt.Errorf("failed to marshal remove body: %w", err)
+		return result, fmt.Errorf("failed to marshal remove body: %w", err)
 	}
 
 	_, err = client.SyncRequest(ctx, "ratings/remove", jsonBody, user.AccessToken)
 	if err == nil {
 		slog.Info("Rating removal synced successfully")
 	}
-	return err
+	return result, err
 }
 
-func handleCollection(ctx context.Context, client Client, pr plexhooks.PlexResponse, body []byte, user store.User) error {
+func handleCollection(ctx context.Context, client Client, e media.MediaEvent, user store.User) (Result, error) {
 	slog.Debug("Handling collection add event")
 
-	collectedAt := extractCollectedAt(body)
+	collectedAt := formatCollectedAt(e.AddedAt)
 
+	result := Result{Action: "collection"}
 	collectionBody := CollectionBody{}
-	switch pr.Metadata.LibrarySectionType {
-	case "movie":
+	switch e.Kind {
+	case media.KindMovie:
 		if !user.Config.GetMovieCollection() {
 			slog.Debug("Movie Collection Sync disabled by user")
-			return nil
+			return skipped("movie collection sync disabled"), nil
 		}
-		movie, err := findMovie(ctx, client, pr)
+		movie, err := findMovie(ctx, client, e)
 		if err != nil {
-			return fmt.Errorf("failed to find movie: %w", err)
+			return result, fmt.Errorf("failed to find movie: %w", err)
 		}
+		result.Title, result.Ids = movie.Title, movie.Ids
+		result.Collected = collectedItems(media.KindMovie, movie.Ids, movie.Title, e.IDs)
 		collectionBody.Movies = []CollectionMovie{{
-			Title:       movie.Title,
-			Year:        movie.Year,
-			Ids:         movie.Ids,
-			CollectedAt: collectedAt,
+			Title:              movie.Title,
+			Year:               movie.Year,
+			Ids:                movie.Ids,
+			CollectedAt:        collectedAt,
+			CollectionMetadata: collectionMetadata(e.File),
 		}}
-	case "show":
-		if pr.Metadata.Type == "episode" {
-			if !user.Config.GetEpisodeCollection() {
-				slog.Debug("Episode Collection Sync disabled by user")
-				return nil
-			}
-			episode, err := findEpisode(ctx, client, pr)
-			if err != nil {
-				return fmt.Errorf("failed to find episode: %w", err)
+	case media.KindEpisode:
+		if !user.Config.GetEpisodeCollection() {
+			slog.Debug("Episode Collection Sync disabled by user")
+			return skipped("episode collection sync disabled"), nil
+		}
+		episode, err := findEpisode(ctx, client, e)
+		if err != nil {
+			return result, fmt.Errorf("failed to find episode: %w", err)
+		}
+		result.Title, result.Ids = episode.Title, episode.Ids
+		result.Collected = collectedItems(media.KindEpisode, episode.Ids, episode.Title, e.IDs)
+		collectionBody.Episodes = []CollectionEpisode{{
+			Season:             episode.Season,
+			Number:             episode.Number,
+			Title:              episode.Title,
+			Ids:                episode.Ids,
+			CollectedAt:        collectedAt,
+			CollectionMetadata: collectionMetadata(e.File),
+		}}
+	case media.KindShow, media.KindSeason:
+		if !user.Config.GetEpisodeCollection() {
+			slog.Debug("Episode Collection Sync disabled by user")
+			return skipped("episode collection sync disabled"), nil
+		}
+		show, err := findShow(ctx, client, e)
+		if err != nil {
+			return result, fmt.Errorf("failed to find show: %w", err)
+		}
+		seasons, err := getSeasons(ctx, client, show, "full,episodes")
+		if err != nil {
+			return result, err
+		}
+		result.Title, result.Ids = show.Title, show.Ids
+		if e.Kind == media.KindSeason {
+			result.Title = seasonTitle(show, Season{Number: e.Season})
+		}
+
+		collected := collectSeasons(seasons, e, collectedAt, time.Now())
+		if len(collected) == 0 {
+			// Nothing has aired yet, which retrying won't change until it does
+			result.Skipped = "no aired or held episodes to collect"
+			return result, nil
+		}
+		for _, season := range collected {
+			for _, episode := range season.Episodes {
+				for _, held := range e.Episodes {
+					if held.Season == episode.Season && held.Episode == episode.Number {
+						result.Collected = append(result.Collected, collectedItems(media.KindEpisode, episode.Ids, episode.Title, held.IDs)...)
+					}
+				}
 			}
-			collectionBody.Episodes = []CollectionEpisode{{
-				Season:      episode.Season,
-				Number:      episode.Number,
-				Title:       episode.Title,
-				Ids:         episode.Ids,
-				CollectedAt: collectedAt,
-			}}
-		} else {
-			slog.Debug("Collection add for show directly not supported yet")
-			return nil
 		}
+		collectionBody.Shows = []CollectionShow{{
+			Title:   show.Title,
+			Year:    show.Year,
+			Ids:     show.Ids,
+			Seasons: collected,
+		}}
+	default:
+		return skipped("unsupported media type"), nil
 	}
 
 	jsonBody, err := json.Marshal(collectionBody)
 	if err != nil {
-		return fmt.Errorf("failed to marshal collection body: %w", err)
+		return result, fmt.Errorf("failed to marshal collection body: %w", err)
 	}
 
 	_, err = client.SyncRequest(ctx, "collection", jsonBody, user.AccessToken)
 	if err == nil {
 		slog.Info("Collection added successfully")
 	}
-	return err
+	return result, err
 }
 
-func findEpisode(ctx context.Context, client Client, pr plexhooks.PlexResponse) (Episode, error) {
-	// Try GUID search
+func handleCollectionRemove(ctx context.Context, client Client, e media.MediaEvent, user store.User) (Result, error) {
+	slog.Debug("Handling collection removal event")
+
+	result := Result{Action: "collection/remove"}
+	removeBody := CollectionBody{}
+	switch e.Kind {
+	case media.KindMovie:
+		if !user.Config.GetMovieCollectionRemove() {
+			slog.Debug("Movie Collection Removal disabled by user")
+			return skipped("movie collection removal disabled"), nil
+		}
+		movie, err := findMovie(ctx, client, e)
+		if err != nil {
+			return result, fmt.Errorf("failed to find movie: %w", err)
+		}
+		result.Title, result.Ids = movie.Title, movie.Ids
+		removeBody.Movies = []CollectionMovie{{
+			Title: movie.Title,
+			Year:  movie.Year,
+			Ids:   movie.Ids,
+		}}
+	case media.KindEpisode:
+		if !user.Config.GetEpisodeCollectionRemove() {
+			slog.Debug("Episode Collection Removal disabled by user")
+			return skipped("episode collection removal disabled"), nil
+		}
+		episode, err := findEpisode(ctx, client, e)
+		if err != nil {
+			return result, fmt.Errorf("failed to find episode: %w", err)
+		}
+		result.Title, result.Ids = episode.Title, episode.Ids
+		removeBody.Episodes = []CollectionEpisode{{
+			Season: episode.Season,
+			Number: episode.Number,
+			Title:  episode.Title,
+			Ids:    episode.Ids,
+		}}
+	default:
+		return skipped("unsupported media type"), nil
+	}
+
+	jsonBody, err := json.Marshal(removeBody)
+	if err != nil {
+		return result, fmt.Errorf("failed to marshal collection removal body: %w", err)
+	}
+
+	_, err = client.SyncRequest(ctx, "collection/remove", jsonBody, user.AccessToken)
+	if err == nil {
+		slog.Info("Collection removal synced successfully")
+	}
+	return result, err
+}
+
+// collectSeasons lists the episodes of a new show or season that the server holds.
+// When the event doesn't say which those are, every episode that has aired is
+// collected instead, from the regular seasons of a show or all of a season.
+func collectSeasons(seasons []Season, e media.MediaEvent, collectedAt string, now time.Time) []CollectionSeason {
+	held := func(season int, episode Episode) bool {
+		if len(e.Episodes) > 0 {
+			return slices.ContainsFunc(e.Episodes, func(held media.EpisodeNumber) bool {
+				return held.Season == season && held.Episode == episode.Number
+			})
+		}
+		return episode.FirstAired != nil && episode.FirstAired.Before(now)
+	}
+
+	var collected []CollectionSeason
+	for _, season := range seasons {
+		if e.Kind == media.KindSeason && season.Number != e.Season {
+			continue
+		}
+		if e.Kind == media.KindShow && season.Number == 0 && len(e.Episodes) == 0 {
+			continue
+		}
+
+		collectionSeason := CollectionSeason{Number: season.Number}
+		for _, episode := range season.Episodes {
+			if !held(season.Number, episode) {
+				continue
+			}
+			collectionSeason.Episodes = append(collectionSeason.Episodes, CollectionEpisode{
+				Season:      season.Number,
+				Number:      episode.Number,
+				Title:       episode.Title,
+				Ids:         episode.Ids,
+				CollectedAt: collectedAt,
+			})
+		}
+		if len(collectionSeason.Episodes) > 0 {
+			collected = append(collected, collectionSeason)
+		}
+	}
+	return collected
+}
+
+// getSeasons lists a show's seasons, with the extended info requested, e.g. "episodes"
+func getSeasons(ctx context.Context, client Client, show Show, extended string) ([]Season, error) {
+	apiUrl := fmt.Sprintf("/shows/%d/seasons", show.Ids.Trakt)
+	if extended != "" {
+		apiUrl += "?extended=" + extended
+	}
+
+	respBody, err := client.MakeRequest(ctx, apiUrl)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get seasons: %w", err)
+	}
+	var seasons []Season
+	if err := json.Unmarshal(respBody, &seasons); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal seasons: %w", err)
+	}
+	return seasons, nil
+}
+
+// findEpisode finds an episode, using the client's cache if it has one
+func findEpisode(ctx context.Context, client Client, e media.MediaEvent) (Episode, error) {
+	return resolve(cacheFor(client), e, func() (Episode, error) {
+		return searchEpisode(ctx, client, e)
+	})
+}
+
+// searchEpisode searches Trakt for an episode by its external IDs, then by its show's title
+func searchEpisode(ctx context.Context, client Client, e media.MediaEvent) (Episode, error) {
+	// Try external ID search
 	var episode Episode
-	found, err := searchByGuids(ctx, client, pr.Metadata.ExternalGuid, "episode", func(body []byte) bool {
+	found, err := searchByIDs(ctx, client, e.IDs, "episode", func(body []byte) bool {
 		var showInfo []ShowInfo
 		if err := json.Unmarshal(body, &showInfo); err != nil {
 			return false
@@ -337,16 +580,17 @@ func findEpisode(ctx context.Context, client Client, pr plexhooks.PlexResponse)
 		}
 		return false
 	})
-	if err != nil {
-		slog.Debug("GUID search error", "error", err)
-	}
 	if found {
 		return episode, nil
 	}
+	if err != nil && IsRetryable(err) {
+		return Episode{}, err
+	}
+	idErr := err
 
 	// Fallback with title/year
-	slog.Debug("Finding episode by title", "title", pr.Metadata.GrandparentTitle, "year", pr.Metadata.Year)
-	apiUrl := fmt.Sprintf("%s/search/show?query=%s", BaseURL, url.PathEscape(pr.Metadata.GrandparentTitle))
+	slog.Debug("Finding episode by title", "title", e.ShowTitle, "year", e.Year)
+	apiUrl := fmt.Sprintf("/search/show?query=%s", url.PathEscape(e.ShowTitle))
 
 	respBody, err := client.MakeRequest(ctx, apiUrl)
 	if err != nil {
@@ -361,28 +605,22 @@ func findEpisode(ctx context.Context, client Client, pr plexhooks.PlexResponse)
 	var show *Show
 
 	for _, result := range results {
-		if pr.Metadata.Year == 0 || result.Show.Year == pr.Metadata.Year {
+		if e.Year == 0 || result.Show.Year == e.Year {
 			show = &result.Show
 			break
 		}
 	}
 
 	if show != nil {
-		apiUrl = fmt.Sprintf("%s/shows/%d/seasons?extended=episodes", BaseURL, show.Ids.Trakt)
-
-		respBody, err = client.MakeRequest(ctx, apiUrl)
+		seasons, err := getSeasons(ctx, client, *show, "episodes")
 		if err != nil {
-			return Episode{}, fmt.Errorf("failed to get seasons: %w", err)
-		}
-		var seasons []Season
-		if err := json.Unmarshal(respBody, &seasons); err != nil {
-			return Episode{}, fmt.Errorf("failed to unmarshal seasons: %w", err)
+			return Episode{}, err
 		}
 
 		for _, season := range seasons {
-			if season.Number == pr.Metadata.ParentIndex {
+			if season.Number == e.Season {
 				for _, episode := range season.Episodes {
-					if episode.Number == pr.Metadata.Index {
+					if episode.Number == e.Episode {
 						slog.Info("Tracking episode via title search", "show", show.Title, "season", season.Number, "number", episode.Number)
 
 						return episode, nil
@@ -392,13 +630,110 @@ func findEpisode(ctx context.Context, client Client, pr plexhooks.PlexResponse)
 		}
 	}
 
-	return Episode{}, fmt.Errorf("could not find episode")
+	// The item is only known to be missing if every search succeeded
+	if idErr != nil {
+		return Episode{}, idErr
+	}
+	return Episode{}, notFoundError{media.KindEpisode}
 }
 
-func findMovie(ctx context.Context, client Client, pr plexhooks.PlexResponse) (Movie, error) {
-	// Try GUID search
+// findShow finds a show, or the show a season belongs to
+func findShow(ctx context.Context, client Client, e media.MediaEvent) (Show, error) {
+	// A season's external IDs are its own, so only a show's are searched
+	var idErr error
+	if e.Kind == media.KindShow {
+		var show Show
+		found, err := searchByIDs(ctx, client, e.IDs, "show", func(body []byte) bool {
+			var shows []ShowSearchResult
+			if err := json.Unmarshal(body, &shows); err != nil {
+				return false
+			}
+			if len(shows) > 0 {
+				show = shows[0].Show
+				slog.Info("Tracking show", "title", show.Title)
+				return true
+			}
+			return false
+		})
+		if found {
+			return show, nil
+		}
+		if err != nil && IsRetryable(err) {
+			return Show{}, err
+		}
+		idErr = err
+	}
+
+	// Fallback with title/year. A season's year is when it aired, not the show's.
+	year := e.Year
+	if e.Kind != media.KindShow {
+		year = 0
+	}
+	slog.Debug("Finding show by title", "title", e.ShowTitle, "year", year)
+	apiUrl := fmt.Sprintf("/search/show?query=%s", url.PathEscape(e.ShowTitle))
+
+	respBody, err := client.MakeRequest(ctx, apiUrl)
+	if err != nil {
+		return Show{}, fmt.Errorf("failed to search show: %w", err)
+	}
+
+	var results []ShowSearchResult
+	if err := json.Unmarshal(respBody, &results); err != nil {
+		return Show{}, fmt.Errorf("failed to unmarshal show search results: %w", err)
+	}
+
+	for _, result := range results {
+		if year == 0 || result.Show.Year == year {
+			slog.Info("Tracking show via title search", "title", result.Show.Title)
+			return result.Show, nil
+		}
+	}
+
+	// The show is only known to be missing if every search succeeded
+	if idErr != nil {
+		return Show{}, idErr
+	}
+	return Show{}, notFoundError{media.KindShow}
+}
+
+// findSeason finds a season and the show it belongs to
+func findSeason(ctx context.Context, client Client, e media.MediaEvent) (Show, Season, error) {
+	show, err := findShow(ctx, client, e)
+	if err != nil {
+		return Show{}, Season{}, err
+	}
+
+	seasons, err := getSeasons(ctx, client, show, "")
+	if err != nil {
+		return show, Season{}, err
+	}
+
+	for _, season := range seasons {
+		if season.Number == e.Season {
+			slog.Info("Tracking season", "show", show.Title, "season", season.Number)
+			return show, season, nil
+		}
+	}
+	return show, Season{}, notFoundError{media.KindSeason}
+}
+
+// seasonTitle names a season for the activity list
+func seasonTitle(show Show, season Season) string {
+	return fmt.Sprintf("%s - Season %d", show.Title, season.Number)
+}
+
+// findMovie finds a movie, using the client's cache if it has one
+func findMovie(ctx context.Context, client Client, e media.MediaEvent) (Movie, error) {
+	return resolve(cacheFor(client), e, func() (Movie, error) {
+		return searchMovie(ctx, client, e)
+	})
+}
+
+// searchMovie searches Trakt for a movie by its external IDs, then by title
+func searchMovie(ctx context.Context, client Client, e media.MediaEvent) (Movie, error) {
+	// Try external ID search
 	var movie Movie
-	found, err := searchByGuids(ctx, client, pr.Metadata.ExternalGuid, "movie", func(body []byte) bool {
+	found, err := searchByIDs(ctx, client, e.IDs, "movie", func(body []byte) bool {
 		var movies []MovieSearchResult
 		if err := json.Unmarshal(body, &movies); err != nil {
 			return false
@@ -410,16 +745,17 @@ func findMovie(ctx context.Context, client Client, pr plexhooks.PlexResponse) (M
 		}
 		return false
 	})
-	if err != nil {
-		slog.Debug("GUID search error", "error", err)
-	}
 	if found {
 		return movie, nil
 	}
+	if err != nil && IsRetryable(err) {
+		return Movie{}, err
+	}
+	idErr := err
 
 	// Fallback with title/year
-	slog.Debug("Finding movie by title", "title", pr.Metadata.Title, "year", pr.Metadata.Year)
-	apiUrl := fmt.Sprintf("%s/search/movie?query=%s", BaseURL, url.PathEscape(pr.Metadata.Title))
+	slog.Debug("Finding movie by title", "title", e.Title, "year", e.Year)
+	apiUrl := fmt.Sprintf("/search/movie?query=%s", url.PathEscape(e.Title))
 
 	respBody, err := client.MakeRequest(ctx, apiUrl)
 	if err != nil {
@@ -432,30 +768,38 @@ func findMovie(ctx context.Context, client Client, pr plexhooks.PlexResponse) (M
 	}
 
 	for _, result := range results {
-		if pr.Metadata.Year == 0 || result.Movie.Year == pr.Metadata.Year {
+		if e.Year == 0 || result.Movie.Year == e.Year {
 			slog.Info("Tracking movie via title search", "title", result.Movie.Title)
 			return result.Movie, nil
 		}
 	}
 
-	return Movie{}, fmt.Errorf("could not find movie")
+	// The item is only known to be missing if every search succeeded
+	if idErr != nil {
+		return Movie{}, idErr
+	}
+	return Movie{}, notFoundError{media.KindMovie}
 }
 
-func searchByGuids(ctx context.Context, client Client, guids []plexhooks.ExternalGuid, typeStr string, parser func([]byte) bool) (bool, error) {
-	for _, guid := range guids {
-		index := strings.Index(guid.Id, "://")
-		if index == -1 {
-			continue
-		}
-		traktService := guid.Id[:index]
-		id := guid.Id[index+3:]
-
-		slog.Debug("Finding item by guid", "id", id, "service", traktService, "type", typeStr)
-		apiUrl := fmt.Sprintf("%s/search/%s/%s?type=%s", BaseURL, traktService, id, typeStr)
+// searchByIDs searches Trakt by each external ID until the parser accepts a response.
+// A failed search that may succeed later is returned straight away; other failed
+// searches are skipped, and the first of them is returned if nothing is found.
+func searchByIDs(ctx context.Context, client Client, ids []media.ExternalID, typeStr string, parser func([]byte) bool) (bool, error) {
+	var failed error
+	for _, id := range ids {
+		slog.Debug("Finding item by external id", "id", id.ID, "service", id.Service, "type", typeStr)
+		apiUrl := fmt.Sprintf("/search/%s/%s?type=%s", id.Service, url.PathEscape(id.ID), typeStr)
 
 		respBody, err := client.MakeRequest(ctx, apiUrl)
 		if err != nil {
-			slog.Debug("Error searching by guid", "error", err)
+			err = fmt.Errorf("failed to search %s by %s id: %w", typeStr, id.Service, err)
+			if IsRetryable(err) {
+				return false, err
+			}
+			slog.Debug("Error searching by external id", "error", err)
+			if failed == nil {
+				failed = err
+			}
 			continue
 		}
 
@@ -463,31 +807,27 @@ func searchByGuids(ctx context.Context, client Client, guids []plexhooks.Externa
 			return true, nil
 		}
 	}
-	return false, nil
+	return false, failed
 }
 
-func getAction(pr plexhooks.PlexResponse, full PlexFullPayload) (string, float64) {
-	progress := 0.0
-	if full.Metadata.Duration > 0 {
-		progress = (float64(full.ViewOffset) / float64(full.Metadata.Duration)) * 100.0
-	}
-
-	if progress > 100.0 {
-		progress = 100.0
-	}
+// getAction maps an event to a Trakt scrobble action and the progress to send
+func getAction(e media.MediaEvent, c store.Config) (string, float64) {
+	progress := e.Progress
+	threshold := float64(c.GetWatchedThreshold())
 
-	switch pr.Event {
-	case "media.play", "media.resume":
+	switch e.Event {
+	case media.EventPlay, media.EventResume:
 		return "start", progress
-	case "media.pause":
+	case media.EventPause:
 		return "pause", progress
-	case "media.stop":
-		if progress >= 90.0 {
+	case media.EventStop:
+		if progress >= threshold {
 			return "stop", progress
 		}
 		return "pause", progress // Trakt 422 if we 'stop' too early? Pause is safer.
-	case "media.scrobble":
-		return "stop", 90.0
+	case media.EventScrobble:
+		// The server decided it was watched, so make sure Trakt agrees
+		return "stop", max(progress, threshold)
 	}
 	return "", 0.0
 }
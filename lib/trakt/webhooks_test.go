@@ -2,12 +2,14 @@ package trakt
 
 import (
 	"context"
+	"encoding/json"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
+	"github.com/viscerous/goplaxt/lib/media"
 	"github.com/viscerous/goplaxt/lib/store"
-	"github.com/xanderstrike/plexhooks"
 )
 
 type MockTraktClient struct {
@@ -55,7 +57,7 @@ func TestFindEpisode(t *testing.T) {
 
 	type testCase struct {
 		Name              string
-		Payload           plexhooks.PlexResponse
+		Event             media.MediaEvent
 		ApiCallsResponses map[string][]byte
 		ExpectedEpisode   Episode
 	}
@@ -63,24 +65,11 @@ func TestFindEpisode(t *testing.T) {
 	var cases = []testCase{
 		{
 			Name: "Severance S02E03 with tvdb",
-			Payload: plexhooks.PlexResponse{
-				Metadata: plexhooks.Metadata{
-					Guid: "plex://episode/669013e833d03eeac35f5d09",
-					ExternalGuid: []plexhooks.ExternalGuid{
-						{
-							Id: "tvdb://10592760",
-						},
-						{
-							Id: "tmdb://5469117",
-						},
-						{
-							Id: "imdb://tt15241840",
-						},
-					},
-				},
+			Event: media.MediaEvent{
+				IDs: []media.ExternalID{{Service: "tvdb", ID: "10592760"}, {Service: "tmdb", ID: "5469117"}, {Service: "imdb", ID: "tt15241840"}},
 			},
 			ApiCallsResponses: map[string][]byte{
-				"https://api.trakt.tv/search/tvdb/10592760?type=episode": []byte(`[
+				"/search/tvdb/10592760?type=episode": []byte(`[
             {"episode": {
 				"title": "Who Is Alive?",
 				"season": 2, 
@@ -104,21 +93,11 @@ func TestFindEpisode(t *testing.T) {
 		},
 		{
 			Name: "Severance S02E03 with tmdb",
-			Payload: plexhooks.PlexResponse{
-				Metadata: plexhooks.Metadata{
-					Guid: "plex://episode/669013e833d03eeac35f5d09",
-					ExternalGuid: []plexhooks.ExternalGuid{
-						{
-							Id: "tmdb://5469117",
-						},
-						{
-							Id: "imdb://tt15241840",
-						},
-					},
-				},
+			Event: media.MediaEvent{
+				IDs: []media.ExternalID{{Service: "tmdb", ID: "5469117"}, {Service: "imdb", ID: "tt15241840"}},
 			},
 			ApiCallsResponses: map[string][]byte{
-				"https://api.trakt.tv/search/tmdb/5469117?type=episode": []byte(`[
+				"/search/tmdb/5469117?type=episode": []byte(`[
             {"episode": {
 				"title": "Who Is Alive?",
 				"season": 2, 
@@ -142,18 +121,11 @@ func TestFindEpisode(t *testing.T) {
 		},
 		{
 			Name: "Severance S02E03 with imdb",
-			Payload: plexhooks.PlexResponse{
-				Metadata: plexhooks.Metadata{
-					Guid: "plex://episode/669013e833d03eeac35f5d09",
-					ExternalGuid: []plexhooks.ExternalGuid{
-						{
-							Id: "imdb://tt15241840",
-						},
-					},
-				},
+			Event: media.MediaEvent{
+				IDs: []media.ExternalID{{Service: "imdb", ID: "tt15241840"}},
 			},
 			ApiCallsResponses: map[string][]byte{
-				"https://api.trakt.tv/search/imdb/tt15241840?type=episode": []byte(`[
+				"/search/imdb/tt15241840?type=episode": []byte(`[
             {"episode": {
 				"title": "Who Is Alive?",
 				"season": 2, 
@@ -177,20 +149,17 @@ func TestFindEpisode(t *testing.T) {
 		},
 		{
 			Name: "Severance S02E03 with title",
-			Payload: plexhooks.PlexResponse{
-				Metadata: plexhooks.Metadata{
-					Guid:             "plex://episode/669013e833d03eeac35f5d09",
-					GrandparentTitle: "Severance",
-					Index:            3,
-					ParentIndex:      2,
-					Year:             2022,
-				},
+			Event: media.MediaEvent{
+				ShowTitle: "Severance",
+				Episode:   3,
+				Season:    2,
+				Year:      2022,
 			},
 			ApiCallsResponses: map[string][]byte{
-				"https://api.trakt.tv/search/show?query=Severance": []byte(`[
+				"/search/show?query=Severance": []byte(`[
             {"type":"show","score":97.20612,"show":{"title":"Severance","year":2022,"ids":{"trakt":154997,"slug":"severance","tvdb":371980,"imdb":"tt11280740","tmdb":95396,"tvrage":null}}}
         ]`),
-				"https://api.trakt.tv/shows/154997/seasons?extended=episodes": []byte(`
+				"/shows/154997/seasons?extended=episodes": []byte(`
 [{"number":0,"ids":{"trakt":444956,"tvdb":1985531,"tmdb":443382,"tvrage":null},"episodes":[{"season":0,"number":1,"title":"Welcome to Lumon","ids":{"trakt":12840119,"tvdb":10948626,"imdb":"tt26448621","tmdb":5995805,"tvrage":null}}]},{"number":1,"ids":{"trakt":236735,"tvdb":1971742,"tmdb":135726,"tvrage":null},"episodes":[{"season":1,"number":1,"title":"Good News About Hell","ids":{"trakt":4648809,"tvdb":8891221,"imdb":"tt11650328","tmdb":1982925,"tvrage":null}},{"season":1,"number":2,"title":"Half Loop","ids":{"trakt":5769062,"tvdb":8891222,"imdb":"tt13393872","tmdb":3396429,"tvrage":null}},{"season":1,"number":3,"title":"In Perpetuity","ids":{"trakt":5769063,"tvdb":8891223,"imdb":"tt13399816","tmdb":3396430,"tvrage":null}},{"season":1,"number":4,"title":"The You You Are","ids":{"trakt":5769064,"tvdb":8891224,"imdb":"tt13411248","tmdb":3396431,"tvrage":null}},{"season":1,"number":5,"title":"The Grim Barbarity of Optics and Design","ids":{"trakt":5769066,"tvdb":8891225,"imdb":"tt13424090","tmdb":3396432,"tvrage":null}},{"season":1,"number":6,"title":"Hide and Seek","ids":{"trakt":5769067,"tvdb":8891226,"imdb":"tt13424092","tmdb":3396433,"tvrage":null}},{"season":1,"number":7,"title":"Defiant Jazz","ids":{"trakt":5769068,"tvdb":8891227,"imdb":"tt13424094","tmdb":3396434,"tvrage":null}},{"season":1,"number":8,"title":"What's for Dinner?","ids":{"trakt":5769069,"tvdb":8891228,"imdb":"tt13424096","tmdb":3396435,"tvrage":null}},{"season":1,"number":9,"title":"The We We Are","ids":{"trakt":5769070,"tvdb":8891229,"imdb":"tt13424098","tmdb":3396436,"tvrage":null}}]},{"number":2,"ids":{"trakt":324357,"tvdb":2136511,"tmdb":401674,"tvrage":null},"episodes":[{"season":2,"number":1,"title":"Hello, Ms. Cobel","ids":{"trakt":12102389,"tvdb":10586352,"imdb":"tt15180436","tmdb":5469028,"tvrage":null}},{"season":2,"number":2,"title":"Goodbye, Mrs. Selvig","ids":{"trakt":12103028,"tvdb":10592759,"imdb":"tt15237910","tmdb":5469115,"tvrage":null}},{"season":2,"number":3,"title":"Who Is Alive?","ids":{"trakt":12103029,"tvdb":10592760,"imdb":"tt15241840","tmdb":5469117,"tvrage":null}},{"season":2,"number":4,"title":"Woe's Hollow","ids":{"trakt":12103030,"tvdb":10592761,"imdb":"tt15241844","tmdb":5469118,"tvrage":null}},{"season":2,"number":5,"title":"Trojan's Horse","ids":{"trakt":12103031,"tvdb":10592762,"imdb":"tt15242966","tmdb":5469120,"tvrage":null}},{"season":2,"number":6,"title":"Attila","ids":{"trakt":12103032,"tvdb":10592763,"imdb":"tt15242972","tmdb":5469123,"tvrage":null}},{"season":2,"number":7,"title":"Chikhai Bardo","ids":{"trakt":12103033,"tvdb":10592764,"imdb":"tt15242980","tmdb":5469128,"tvrage":null}},{"season":2,"number":8,"title":"Sweet Vitriol","ids":{"trakt":12103034,"tvdb":10592765,"imdb":"tt15242986","tmdb":5469133,"tvrage":null}},{"season":2,"number":9,"title":"The After Hours","ids":{"trakt":12103035,"tvdb":10592766,"imdb":"tt15242994","tmdb":5469139,"tvrage":null}},{"season":2,"number":10,"title":"Cold Harbor","ids":{"trakt":12103036,"tvdb":10592768,"imdb":"tt15242998","tmdb":5469142,"tvrage":null}}]},{"number":3,"ids":{"trakt":453841,"tvdb":null,"tmdb":447475,"tvrage":null},"episodes":[]}]
 `),
 			},
@@ -209,21 +178,18 @@ func TestFindEpisode(t *testing.T) {
 		},
 		{
 			Name: "37 secondes S01E05 with title",
-			Payload: plexhooks.PlexResponse{
-				Metadata: plexhooks.Metadata{
-					Guid:             "plex://episode/669013e833d03eeac35f5d09",
-					GrandparentTitle: "37 secondes",
-					Index:            5,
-					ParentIndex:      1,
-					Year:             2025,
-					Title:            "",
-				},
+			Event: media.MediaEvent{
+				ShowTitle: "37 secondes",
+				Episode:   5,
+				Season:    1,
+				Year:      2025,
+				Title:     "",
 			},
 			ApiCallsResponses: map[string][]byte{
-				"https://api.trakt.tv/search/show?query=37%20secondes": []byte(`[
+				"/search/show?query=37%20secondes": []byte(`[
             {"type":"show","score":119.65823,"show":{"title":"37 secondes","year":2025,"ids":{"trakt":232082,"slug":"37-secondes","tvdb":460657,"imdb":"tt32228145","tmdb":237811,"tvrage":null}}}
         ]`),
-				"https://api.trakt.tv/shows/232082/seasons?extended=episodes": []byte(`
+				"/shows/232082/seasons?extended=episodes": []byte(`
 [{"number":1,"ids":{"trakt":374539,"tvdb":null,"tmdb":362030,"tvrage":null},"episodes":[{"season":1,"number":1,"title":"Episode 1","ids":{"trakt":11658360,"tvdb":null,"imdb":null,"tmdb":4837828,"tvrage":null}},{"season":1,"number":2,"title":"Episode 2","ids":{"trakt":11722088,"tvdb":null,"imdb":null,"tmdb":5322127,"tvrage":null}},{"season":1,"number":3,"title":"Episode 3","ids":{"trakt":11722089,"tvdb":null,"imdb":null,"tmdb":5322128,"tvrage":null}},{"season":1,"number":4,"title":"Episode 4","ids":{"trakt":11722090,"tvdb":null,"imdb":null,"tmdb":5322129,"tvrage":null}},{"season":1,"number":5,"title":"Episode 5","ids":{"trakt":11722092,"tvdb":null,"imdb":null,"tmdb":5322130,"tvrage":null}},{"season":1,"number":6,"title":"Episode 6","ids":{"trakt":11722093,"tvdb":null,"imdb":null,"tmdb":5322131,"tvrage":null}}]}]`),
 			},
 			ExpectedEpisode: Episode{
@@ -248,7 +214,7 @@ func TestFindEpisode(t *testing.T) {
 			}
 			client.On("MakeRequest", mock.Anything, mock.Anything)
 
-			episode, err := findEpisode(context.Background(), client, c.Payload)
+			episode, err := findEpisode(context.Background(), client, c.Event)
 			assert.NoError(t, err)
 
 			assert.Equal(t, c.ExpectedEpisode.Title, episode.Title, "Title mismatch")
@@ -263,7 +229,7 @@ func TestFindMovie(t *testing.T) {
 
 	type testCase struct {
 		Name              string
-		Payload           plexhooks.PlexResponse
+		Event             media.MediaEvent
 		ApiCallsResponses map[string][]byte
 		ExpectedMovie     Movie
 	}
@@ -271,21 +237,11 @@ func TestFindMovie(t *testing.T) {
 	var cases = []testCase{
 		{
 			Name: "Apollo 13 with tmdb",
-			Payload: plexhooks.PlexResponse{
-				Metadata: plexhooks.Metadata{
-					Guid: "plex://movie/5d776826151a60001f24a9d0",
-					ExternalGuid: []plexhooks.ExternalGuid{
-						{
-							Id: "tmdb://568",
-						},
-						{
-							Id: "imdb://tt0112384",
-						},
-					},
-				},
+			Event: media.MediaEvent{
+				IDs: []media.ExternalID{{Service: "tmdb", ID: "568"}, {Service: "imdb", ID: "tt0112384"}},
 			},
 			ApiCallsResponses: map[string][]byte{
-				"https://api.trakt.tv/search/tmdb/568?type=movie": []byte(`
+				"/search/tmdb/568?type=movie": []byte(`
 [{"type":"movie","score":1000,"movie":{"title":"Apollo 13","year":1995,"ids":{"trakt":448,"slug":"apollo-13-1995","imdb":"tt0112384","tmdb":568}}}]`)},
 			ExpectedMovie: Movie{
 				Title: "Apollo 13",
@@ -301,18 +257,11 @@ func TestFindMovie(t *testing.T) {
 		},
 		{
 			Name: "Apollo 13 with imdb",
-			Payload: plexhooks.PlexResponse{
-				Metadata: plexhooks.Metadata{
-					Guid: "plex://movie/5d776826151a60001f24a9d0",
-					ExternalGuid: []plexhooks.ExternalGuid{
-						{
-							Id: "imdb://tt0112384",
-						},
-					},
-				},
+			Event: media.MediaEvent{
+				IDs: []media.ExternalID{{Service: "imdb", ID: "tt0112384"}},
 			},
 			ApiCallsResponses: map[string][]byte{
-				"https://api.trakt.tv/search/imdb/tt0112384?type=movie": []byte(`
+				"/search/imdb/tt0112384?type=movie": []byte(`
 [{"type":"movie","score":1000,"movie":{"title":"Apollo 13","year":1995,"ids":{"trakt":448,"slug":"apollo-13-1995","imdb":"tt0112384","tmdb":568}}}]`)},
 			ExpectedMovie: Movie{
 				Title: "Apollo 13",
@@ -328,15 +277,12 @@ func TestFindMovie(t *testing.T) {
 		},
 		{
 			Name: "Apollo 13 with title",
-			Payload: plexhooks.PlexResponse{
-				Metadata: plexhooks.Metadata{
-					Guid:  "plex://movie/5d776826151a60001f24a9d0",
-					Title: "Apollo 13",
-					Year:  1995,
-				},
+			Event: media.MediaEvent{
+				Title: "Apollo 13",
+				Year:  1995,
 			},
 			ApiCallsResponses: map[string][]byte{
-				"https://api.trakt.tv/search/movie?query=Apollo%2013": []byte(`
+				"/search/movie?query=Apollo%2013": []byte(`
 [{"type":"movie","score":109.99295,"movie":{"title":"Apollo 13","year":1995,"ids":{"trakt":448,"slug":"apollo-13-1995","imdb":"tt0112384","tmdb":568}}},{"type":"movie","score":1937.7615,"movie":{"title":"Apollo 13: Survival","year":2024,"ids":{"trakt":1012041,"slug":"apollo-13-survival-2024","imdb":"tt31852716","tmdb":1249216}}},{"type":"movie","score":1390.2266,"movie":{"title":"13 Factors That Saved Apollo 13","year":2014,"ids":{"trakt":306899,"slug":"13-factors-that-saved-apollo-13-2014","imdb":"tt3884428","tmdb":363864}}},{"type":"movie","score":1286.7507,"movie":{"title":"Apollo 13: Home Safe","year":2020,"ids":{"trakt":537216,"slug":"apollo-13-home-safe-2020","imdb":null,"tmdb":692970}}},{"type":"movie","score":1281.8206,"movie":{"title":"Lost Moon: The Triumph of Apollo 13","year":1996,"ids":{"trakt":94420,"slug":"lost-moon-the-triumph-of-apollo-13-1996","imdb":"tt0327018","tmdb":141498}}},{"type":"movie","score":1186.8324,"movie":{"title":"Apollo 13: The Untold Story","year":1995,"ids":{"trakt":173213,"slug":"apollo-13-the-untold-story-1995","imdb":null,"tmdb":275435}}},{"type":"movie","score":1155.6042,"movie":{"title":"Apollo 13: To the Edge and Back","year":1994,"ids":{"trakt":88112,"slug":"apollo-13-to-the-edge-and-back-1994","imdb":"tt0180443","tmdb":128857}}},{"type":"movie","score":1106.6807,"movie":{"title":"Salyut-7","year":2017,"ids":{"trakt":284879,"slug":"salyut-7-2017","imdb":"tt6537238","tmdb":438740}}},{"type":"movie","score":1087.2601,"movie":{"title":"Apollo 11","year":2019,"ids":{"trakt":399358,"slug":"apollo-11-2019","imdb":"tt8760684","tmdb":549559}}},{"type":"movie","score":1085.604,"movie":{"title":"Apartment 1303 3D","year":2012,"ids":{"trakt":103563,"slug":"apartment-1303-3d-2012","imdb":"tt1540767","tmdb":160070}}}]`),
 			},
 			ExpectedMovie: Movie{
@@ -360,7 +306,7 @@ func TestFindMovie(t *testing.T) {
 			}
 			client.On("MakeRequest", mock.Anything, mock.Anything)
 
-			movie, err := findMovie(context.Background(), client, c.Payload)
+			movie, err := findMovie(context.Background(), client, c.Event)
 			assert.NoError(t, err)
 
 			assert.Equal(t, c.ExpectedMovie.Title, movie.Title, "Title mismatch")
@@ -377,23 +323,12 @@ func TestHandleRate(t *testing.T) {
 		mockClient := new(MockTraktClient)
 		tTrue := true
 		user := store.User{AccessToken: "token", Config: store.Config{MovieRate: &tTrue}}
-		pr := plexhooks.PlexResponse{
-			Event: "media.rate",
-			Metadata: plexhooks.Metadata{
-				LibrarySectionType: "movie",
-				Title:              "Inception",
-				Year:               2010,
-				Guid:               "plex://movie/12345",
-			},
-		}
-		full := PlexFullPayload{
-			Metadata: struct {
-				Duration   int64       `json:"duration"`
-				UserRating float64     `json:"userRating"`
-				RawRating  interface{} `json:"rating"`
-			}{
-				UserRating: 8.0,
-			},
+		e := media.MediaEvent{
+			Event:  media.EventRate,
+			Kind:   media.KindMovie,
+			Title:  "Inception",
+			Year:   2010,
+			Rating: 8.0,
 		}
 
 		// Mock Search
@@ -401,7 +336,7 @@ func TestHandleRate(t *testing.T) {
 		// Mock Sync
 		mockClient.On("SyncRequest", mock.Anything, "ratings", mock.Anything, "token").Return([]byte(`{}`), nil)
 
-		err := handleRate(ctx, mockClient, pr, full, user)
+		_, err := handleRate(ctx, mockClient, e, user)
 		assert.NoError(t, err)
 		mockClient.AssertExpectations(t)
 	})
@@ -410,23 +345,11 @@ func TestHandleRate(t *testing.T) {
 		mockClient := new(MockTraktClient)
 		tTrue := true
 		user := store.User{AccessToken: "token", Config: store.Config{MovieRate: &tTrue}}
-		pr := plexhooks.PlexResponse{
-			Event: "media.rate",
-			Metadata: plexhooks.Metadata{
-				LibrarySectionType: "movie",
-				Title:              "Inception",
-				Year:               2010,
-				Guid:               "plex://movie/12345",
-			},
-		}
-		full := PlexFullPayload{
-			Metadata: struct {
-				Duration   int64       `json:"duration"`
-				UserRating float64     `json:"userRating"`
-				RawRating  interface{} `json:"rating"`
-			}{
-				UserRating: 0.0,
-			},
+		e := media.MediaEvent{
+			Event: media.EventRate,
+			Kind:  media.KindMovie,
+			Title: "Inception",
+			Year:  2010,
 		}
 
 		// Mock Search
@@ -434,8 +357,333 @@ func TestHandleRate(t *testing.T) {
 		// Mock Removal Sync
 		mockClient.On("SyncRequest", mock.Anything, "ratings/remove", mock.Anything, "token").Return([]byte(`{}`), nil)
 
-		err := handleRate(ctx, mockClient, pr, full, user)
+		_, err := handleRate(ctx, mockClient, e, user)
 		assert.NoError(t, err)
 		mockClient.AssertExpectations(t)
 	})
+
+	severance := map[string][]byte{
+		"/search/tvdb/371980?type=show": []byte(`[{"show":{"title":"Severance","year":2022,"ids":{"trakt":154997}}}]`),
+		"/search/show?query=Severance":  []byte(`[{"show":{"title":"Severance","year":2022,"ids":{"trakt":154997}}}]`),
+		"/shows/154997/seasons":         []byte(`[{"number":1,"ids":{"trakt":210355}},{"number":2,"ids":{"trakt":290112}}]`),
+	}
+	tests := []struct {
+		name     string
+		event    media.MediaEvent
+		endpoint string
+		title    string
+		body     string
+	}{
+		{
+			"show rating",
+			media.MediaEvent{Event: media.EventRate, Kind: media.KindShow, Title: "Severance", ShowTitle: "Severance", IDs: []media.ExternalID{{Service: "tvdb", ID: "371980"}}, Rating: 9},
+			"ratings", "Severance",
+			`{"shows":[{"rating":9,"title":"Severance","year":2022,"ids":{"trakt":154997,"tvdb":0,"imdb":"","tmdb":0,"tvrage":0}}]}`,
+		},
+		{
+			"show rating removal",
+			media.MediaEvent{Event: media.EventRate, Kind: media.KindShow, Title: "Severance", ShowTitle: "Severance", Year: 2022},
+			"ratings/remove", "Severance",
+			`{"shows":[{"rating":0,"title":"Severance","year":2022,"ids":{"trakt":154997,"tvdb":0,"imdb":"","tmdb":0,"tvrage":0}}]}`,
+		},
+		{
+			"season rating",
+			media.MediaEvent{Event: media.EventRate, Kind: media.KindSeason, ShowTitle: "Severance", Season: 2, Year: 2025, Rating: 7},
+			"ratings", "Severance - Season 2",
+			`{"seasons":[{"rating":7,"ids":{"trakt":290112,"tvdb":0,"imdb":"","tmdb":0,"tvrage":0}}]}`,
+		},
+		{
+			"season rating removal",
+			media.MediaEvent{Event: media.EventRate, Kind: media.KindSeason, ShowTitle: "Severance", Season: 1},
+			"ratings/remove", "Severance - Season 1",
+			`{"seasons":[{"rating":0,"ids":{"trakt":210355,"tvdb":0,"imdb":"","tmdb":0,"tvrage":0}}]}`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := &MockTraktClient{MakeRequestResponses: severance}
+			client.On("MakeRequest", mock.Anything, mock.Anything)
+			var sent string
+			client.On("SyncRequest", mock.Anything, tt.endpoint, mock.Anything, "token").Run(func(args mock.Arguments) {
+				sent = string(args.Get(2).([]byte))
+			}).Return([]byte(`{}`), nil)
+
+			result, err := handleRate(ctx, client, tt.event, store.User{AccessToken: "token"})
+			assert.NoError(t, err)
+			assert.Equal(t, tt.title, result.Title)
+			assert.JSONEq(t, tt.body, sent)
+		})
+	}
+
+	t.Run("Missing Season", func(t *testing.T) {
+		client := &MockTraktClient{MakeRequestResponses: severance}
+		client.On("MakeRequest", mock.Anything, mock.Anything)
+		e := media.MediaEvent{Event: media.EventRate, Kind: media.KindSeason, ShowTitle: "Severance", Season: 5, Rating: 7}
+		_, err := handleRate(ctx, client, e, store.User{AccessToken: "token"})
+		assert.Error(t, err)
+		client.AssertNotCalled(t, "SyncRequest", mock.Anything, mock.Anything, mock.Anything, mock.Anything)
+	})
+
+	t.Run("Season Rating Disabled", func(t *testing.T) {
+		tFalse := false
+		client := new(MockTraktClient)
+		e := media.MediaEvent{Event: media.EventRate, Kind: media.KindSeason, ShowTitle: "Severance", Season: 1, Rating: 7}
+		result, err := handleRate(ctx, client, e, store.User{Config: store.Config{SeasonRate: &tFalse}})
+		assert.NoError(t, err)
+		assert.Equal(t, "season rating sync disabled", result.Skipped)
+	})
+}
+
+func TestHandle(t *testing.T) {
+	ctx := context.Background()
+	tTrue := true
+	user := store.User{AccessToken: "token", Config: store.Config{MovieScrobbleStart: &tTrue, MovieScrobbleStop: &tTrue, EpisodeCollection: &tTrue}}
+	inception := `[{"movie":{"title":"Inception","year":2010,"ids":{"trakt":123}}}]`
+
+	tests := []struct {
+		name     string
+		event    media.MediaEvent
+		action   string
+		progress float64
+		skipped  string
+	}{
+		{"play", media.MediaEvent{Event: media.EventPlay, Kind: media.KindMovie, Title: "Inception", Progress: 10}, "scrobble/start", 10, ""},
+		{"stop near the end", media.MediaEvent{Event: media.EventStop, Kind: media.KindMovie, Title: "Inception", Progress: 95}, "scrobble/stop", 95, ""},
+		{"early stop pauses", media.MediaEvent{Event: media.EventStop, Kind: media.KindMovie, Title: "Inception", Progress: 50}, "scrobble/pause", 50, ""},
+		{"scrobble", media.MediaEvent{Event: media.EventScrobble, Kind: media.KindMovie, Title: "Inception"}, "scrobble/stop", 90, ""},
+		{"no progress clears", media.MediaEvent{Event: media.EventPause, Kind: media.KindMovie, Title: "Inception"}, "checkin/clear", 0, ""},
+		{"season playback", media.MediaEvent{Event: media.EventPlay, Kind: media.KindSeason}, "", 0, "unsupported media type"},
+		{"unknown event", media.MediaEvent{Event: "media.unknown", Kind: media.KindMovie}, "", 0, "event not handled"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := &MockTraktClient{MakeRequestResponses: map[string][]byte{
+				"/search/movie?query=Inception": []byte(inception),
+			}}
+			client.On("MakeRequest", mock.Anything, mock.Anything)
+			client.On("DeleteCheckin", mock.Anything, "token").Return(nil)
+			var sent map[string]interface{}
+			client.On("ScrobbleRequest", mock.Anything, mock.Anything, mock.Anything, "token").Run(func(args mock.Arguments) {
+				_ = json.Unmarshal(args.Get(2).([]byte), &sent)
+			}).Return([]byte(`{}`), nil)
+
+			result, err := Handle(ctx, client, nil, tt.event, user)
+			assert.NoError(t, err)
+			assert.Equal(t, tt.action, result.Action)
+			assert.Equal(t, tt.skipped, result.Skipped)
+			if sent != nil {
+				assert.Equal(t, tt.progress, sent["progress"])
+				assert.Equal(t, "Inception", result.Title)
+			}
+		})
+	}
+
+	t.Run("not found", func(t *testing.T) {
+		client := &MockTraktClient{MakeRequestResponses: map[string][]byte{
+			"/search/movie?query=Unknown": []byte(`[]`),
+		}}
+		client.On("MakeRequest", mock.Anything, mock.Anything)
+		e := media.MediaEvent{Event: media.EventStop, Kind: media.KindMovie, Title: "Unknown", Progress: 95}
+		result, err := Handle(ctx, client, nil, e, user)
+		assert.NoError(t, err)
+		assert.Equal(t, "could not find movie on Trakt", result.Skipped)
+		client.AssertNotCalled(t, "ScrobbleRequest", mock.Anything, mock.Anything, mock.Anything, mock.Anything)
+	})
+
+	t.Run("collection", func(t *testing.T) {
+		client := &MockTraktClient{MakeRequestResponses: map[string][]byte{
+			"/search/tvdb/10592760?type=episode": []byte(`[{"episode":{"title":"Who Is Alive?","season":2,"number":3,"ids":{"trakt":12103029}}}]`),
+		}}
+		client.On("MakeRequest", mock.Anything, mock.Anything)
+		var body CollectionBody
+		client.On("SyncRequest", mock.Anything, "collection", mock.Anything, "token").Run(func(args mock.Arguments) {
+			_ = json.Unmarshal(args.Get(2).([]byte), &body)
+		}).Return([]byte(`{}`), nil)
+
+		e := media.MediaEvent{
+			Event:   media.EventAdded,
+			Kind:    media.KindEpisode,
+			IDs:     []media.ExternalID{{Service: "tvdb", ID: "10592760"}},
+			AddedAt: time.Unix(1707494400, 0),
+			File:    media.File{Resolution: "4k", HDR: "hdr10", AudioCodec: "eac3", AudioChannels: "5.1"},
+		}
+		result, err := Handle(ctx, client, nil, e, user)
+		assert.NoError(t, err)
+		assert.Equal(t, []store.CollectedItem{{Kind: media.KindEpisode, Trakt: 12103029, Title: "Who Is Alive?", IDs: []string{"tvdb://10592760"}}}, result.Collected)
+		if assert.Len(t, body.Episodes, 1) {
+			assert.Equal(t, "2024-02-09T16:00:00Z", body.Episodes[0].CollectedAt)
+			assert.Equal(t, CollectionMetadata{MediaType: "digital", Resolution: "uhd_4k", HDR: "hdr10", Audio: "dolby_digital_plus", AudioChannels: "5.1"}, body.Episodes[0].CollectionMetadata)
+		}
+	})
+
+	severance := map[string][]byte{
+		"/search/show?query=Severance": []byte(`[{"show":{"title":"Severance","year":2022,"ids":{"trakt":154997}}}]`),
+		// Season 2's second episode hasn't aired, and the special has no air date
+		"/shows/154997/seasons?extended=full,episodes": []byte(`[
+			{"number":0,"episodes":[{"season":0,"number":1,"title":"Main Title Sequence","ids":{"trakt":1}}]},
+			{"number":1,"episodes":[{"season":1,"number":1,"title":"Good News About Hell","ids":{"trakt":11},"first_aired":"2022-02-18T02:00:00.000Z"},{"season":1,"number":2,"title":"Half Loop","ids":{"trakt":12},"first_aired":"2022-02-18T02:00:00.000Z"}]},
+			{"number":2,"episodes":[{"season":2,"number":1,"title":"Hello, Ms. Cobel","ids":{"trakt":21},"first_aired":"2025-01-17T02:00:00.000Z"},{"season":2,"number":2,"title":"Goodbye, Mrs. Selvig","ids":{"trakt":22},"first_aired":"2999-01-01T02:00:00.000Z"}]}
+		]`),
+	}
+	for _, tt := range []struct {
+		name     string
+		kind     string
+		season   int
+		held     []media.EpisodeNumber
+		title    string
+		seasons  []int
+		episodes int
+	}{
+		{"show collection", media.KindShow, 0, nil, "Severance", []int{1, 2}, 3},
+		{"season collection", media.KindSeason, 1, nil, "Severance - Season 1", []int{1}, 2},
+		{"specials collection", media.KindSeason, 0, []media.EpisodeNumber{{Season: 0, Episode: 1}}, "Severance - Season 0", []int{0}, 1},
+		{"partial season", media.KindSeason, 1, []media.EpisodeNumber{{Season: 1, Episode: 2, IDs: []media.ExternalID{{Service: "tvdb", ID: "8229222"}}}}, "Severance - Season 1", []int{1}, 1},
+		{"partial show", media.KindShow, 0, []media.EpisodeNumber{{Season: 0, Episode: 1}, {Season: 2, Episode: 1}}, "Severance", []int{0, 2}, 2},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			client := &MockTraktClient{MakeRequestResponses: severance}
+			client.On("MakeRequest", mock.Anything, mock.Anything)
+			var body CollectionBody
+			client.On("SyncRequest", mock.Anything, "collection", mock.Anything, "token").Run(func(args mock.Arguments) {
+				_ = json.Unmarshal(args.Get(2).([]byte), &body)
+			}).Return([]byte(`{}`), nil)
+
+			e := media.MediaEvent{Event: media.EventAdded, Kind: tt.kind, ShowTitle: "Severance", Season: tt.season, Episodes: tt.held, AddedAt: time.Unix(1707494400, 0)}
+			result, err := Handle(ctx, client, nil, e, user)
+			assert.NoError(t, err)
+			assert.Equal(t, tt.title, result.Title)
+			// Only held episodes the server identifies are recorded
+			if tt.name == "partial season" {
+				assert.Equal(t, []store.CollectedItem{{Kind: media.KindEpisode, Trakt: 12, Title: "Half Loop", IDs: []string{"tvdb://8229222"}}}, result.Collected)
+			} else {
+				assert.Empty(t, result.Collected)
+			}
+			// One batched request for the whole show or season
+			client.AssertNumberOfCalls(t, "SyncRequest", 1)
+			if assert.Len(t, body.Shows, 1) {
+				var seasons []int
+				episodes := 0
+				for _, season := range body.Shows[0].Seasons {
+					seasons = append(seasons, season.Number)
+					for _, episode := range season.Episodes {
+						assert.Equal(t, "2024-02-09T16:00:00Z", episode.CollectedAt)
+						episodes++
+					}
+				}
+				assert.Equal(t, 154997, body.Shows[0].Ids.Trakt)
+				assert.Equal(t, tt.seasons, seasons)
+				assert.Equal(t, tt.episodes, episodes)
+			}
+		})
+	}
+
+	t.Run("collection removal", func(t *testing.T) {
+		client := &MockTraktClient{MakeRequestResponses: map[string][]byte{
+			"/search/movie?query=Inception": []byte(inception),
+		}}
+		client.On("MakeRequest", mock.Anything, mock.Anything)
+		var sent string
+		client.On("SyncRequest", mock.Anything, "collection/remove", mock.Anything, "token").Run(func(args mock.Arguments) {
+			sent = string(args.Get(2).([]byte))
+		}).Return([]byte(`{}`), nil)
+		e := media.MediaEvent{Event: media.EventRemoved, Kind: media.KindMovie, Title: "Inception"}
+
+		// Removal is off unless enabled
+		result, err := Handle(ctx, client, nil, e, user)
+		assert.NoError(t, err)
+		assert.Equal(t, "movie collection removal disabled", result.Skipped)
+		client.AssertNotCalled(t, "SyncRequest", mock.Anything, mock.Anything, mock.Anything, mock.Anything)
+
+		remover := user
+		remover.Config.MovieCollectionRemove = &tTrue
+		result, err = Handle(ctx, client, nil, e, remover)
+		assert.NoError(t, err)
+		assert.Equal(t, "collection/remove", result.Action)
+		assert.JSONEq(t, `{"movies":[{"title":"Inception","year":2010,"ids":{"trakt":123,"tvdb":0,"imdb":"","tmdb":0,"tvrage":0}}]}`, sent)
+	})
+
+	// A season Trakt doesn't list or that hasn't aired is skipped rather than failed, as retrying won't help
+	for name, e := range map[string]media.MediaEvent{
+		"unknown season collection":   {Event: media.EventAdded, Kind: media.KindSeason, ShowTitle: "Severance", Season: 5},
+		"unlisted episode collection": {Event: media.EventAdded, Kind: media.KindSeason, ShowTitle: "Severance", Season: 2, Episodes: []media.EpisodeNumber{{Season: 2, Episode: 3}}},
+	} {
+		t.Run(name, func(t *testing.T) {
+			client := &MockTraktClient{MakeRequestResponses: severance}
+			client.On("MakeRequest", mock.Anything, mock.Anything)
+			result, err := Handle(ctx, client, nil, e, user)
+			assert.NoError(t, err)
+			assert.Equal(t, "no aired or held episodes to collect", result.Skipped)
+			client.AssertNotCalled(t, "SyncRequest", mock.Anything, mock.Anything, mock.Anything, mock.Anything)
+		})
+	}
+}
+
+func TestGetAction(t *testing.T) {
+	intPtr := func(i int) *int { return &i }
+	custom := store.Config{WatchedThreshold: intPtr(85)}
+
+	tests := []struct {
+		name     string
+		event    string
+		progress float64
+		config   store.Config
+		action   string
+		sent     float64
+	}{
+		{"play", media.EventPlay, 10, store.Config{}, "start", 10},
+		{"stop before threshold", media.EventStop, 86, store.Config{}, "pause", 86},
+		{"stop after threshold", media.EventStop, 92, store.Config{}, "stop", 92},
+		{"stop after custom threshold", media.EventStop, 86, custom, "stop", 86},
+		{"scrobble without progress", media.EventScrobble, 0, store.Config{}, "stop", 90},
+		{"scrobble with custom threshold", media.EventScrobble, 0, custom, "stop", 85},
+		{"scrobble keeps later progress", media.EventScrobble, 97, store.Config{}, "stop", 97},
+		{"rate", media.EventRate, 0, store.Config{}, "", 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			action, progress := getAction(media.MediaEvent{Event: tt.event, Progress: tt.progress}, tt.config)
+			assert.Equal(t, tt.action, action)
+			assert.Equal(t, tt.sent, progress)
+		})
+	}
+}
+
+func TestHandleScrobbleSettings(t *testing.T) {
+	ctx := context.Background()
+	tTrue, tFalse := true, false
+	floor := 10
+	user := store.User{AccessToken: "token", Config: store.Config{
+		MovieScrobbleStart: &tTrue, MovieScrobbleStop: &tTrue,
+		MinProgress: &floor, UseScrobbleEvent: &tFalse,
+	}}
+	client := new(MockTraktClient)
+	client.On("DeleteCheckin", mock.Anything, "token").Return(nil)
+
+	// Plex's scrobble is ignored in favour of our own threshold
+	result, err := Handle(ctx, client, nil, media.MediaEvent{Event: media.EventScrobble, Kind: media.KindMovie}, user)
+	assert.NoError(t, err)
+	assert.Equal(t, "scrobble event disabled", result.Skipped)
+
+	// Stops below the floor clear the checkin
+	result, err = Handle(ctx, client, nil, media.MediaEvent{Event: media.EventStop, Kind: media.KindMovie, Progress: 8}, user)
+	assert.NoError(t, err)
+	assert.Equal(t, "checkin/clear", result.Action)
+	client.AssertNumberOfCalls(t, "DeleteCheckin", 1)
+}
+
+func TestHandleScrobbleDuplicate(t *testing.T) {
+	ctx := context.Background()
+	user := store.User{AccessToken: "token"}
+	event := media.MediaEvent{Event: media.EventStop, Kind: media.KindMovie, Progress: 95, Title: "Inception"}
+	client := &MockTraktClient{MakeRequestResponses: map[string][]byte{
+		"/search/movie?query=Inception": []byte(`[{"movie":{"title":"Inception","year":2010,"ids":{"trakt":1}}}]`),
+	}}
+	client.On("MakeRequest", mock.Anything, mock.Anything).Return(nil, nil)
+	client.On("ScrobbleRequest", mock.Anything, "stop", mock.Anything, "token").Return(nil, &APIError{Status: 409})
+
+	// Trakt already has the scrobble, so there is nothing to retry
+	result, err := Handle(ctx, client, nil, event, user)
+	assert.NoError(t, err)
+	assert.Equal(t, "scrobble/stop", result.Action)
+	assert.Equal(t, "already scrobbled", result.Skipped)
 }
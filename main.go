@@ -2,6 +2,7 @@ package main
 
 import (
 	"cmp"
+	"context"
 	"embed"
 	"log"
 	"log/slog"
@@ -11,7 +12,10 @@ import (
 
 	"github.com/gorilla/handlers"
 	"github.com/viscerous/goplaxt/lib/api"
+	"github.com/viscerous/goplaxt/lib/config"
+	"github.com/viscerous/goplaxt/lib/plex"
 	"github.com/viscerous/goplaxt/lib/store"
+	"github.com/viscerous/goplaxt/lib/trakt"
 )
 
 //go:embed static
@@ -19,30 +23,52 @@ var staticContent embed.FS
 
 func main() {
 	setupLogging()
-	slog.Info("Starting Plaxt...")
 
-	var storage store.Store
-	if os.Getenv("POSTGRESQL_URL") != "" {
-		storage = store.NewPostgresqlStore(store.NewPostgresqlClient(os.Getenv("POSTGRESQL_URL")))
-		slog.Info("Storage initialised", "type", "postgresql")
-	} else if os.Getenv("REDIS_URI") != "" {
-		storage = store.NewRedisStore(store.NewRedisClient(os.Getenv("REDIS_URI"), os.Getenv("REDIS_PASSWORD")))
-		slog.Info("Storage initialised", "type", "redis", "uri", os.Getenv("REDIS_URI"))
-	} else {
-		storage = store.NewDiskStore()
-		slog.Info("Storage initialised", "type", "disk")
+	if len(os.Args) > 1 && os.Args[1] == "backfill" {
+		if err := runBackfill(os.Args[2:]); err != nil {
+			slog.Error("Backfill failed", "error", err)
+			os.Exit(1)
+		}
+		return
 	}
 
-	apiHandler := api.New(storage, staticContent)
+	slog.Info("Starting Plaxt...")
+
+	storage := openStorage()
+	apiHandler := api.New(storage, staticContent, newTraktClient(storage))
+	if config.PlexURL != "" {
+		apiHandler.Plex = plex.NewClient(config.PlexURL, config.PlexToken)
+	}
+	apiHandler.AllowLegacyWebhooks = config.AllowLegacyWebhooks
+	if config.WebhookMaxAttempts > 0 {
+		apiHandler.Queue.MaxAttempts = config.WebhookMaxAttempts
+	}
+	apiHandler.MigrateWebhookSecrets()
+	apiHandler.Queue.Start(context.Background())
+	apiHandler.StartTokenRefresh(context.Background())
+	apiHandler.StartLibraryReconcile(context.Background())
 
 	mux := http.NewServeMux()
 
+	// State-changing routes used from the browser require the session's CSRF token
+	csrf := func(h http.HandlerFunc) http.Handler { return apiHandler.CSRFHandler(h) }
+
 	mux.HandleFunc("GET /api/auth/device/code", apiHandler.StartAuth)
 	mux.HandleFunc("GET /api/auth/device/poll", apiHandler.PollAuth)
 	mux.HandleFunc("POST /api", apiHandler.WebhookHandler)
-	mux.HandleFunc("POST /config", apiHandler.ConfigHandler)
-	mux.HandleFunc("POST /logout", apiHandler.LogoutHandler)
+	mux.HandleFunc("POST /api/server", apiHandler.ServerWebhookHandler)
+	mux.HandleFunc("POST /api/jellyfin", apiHandler.JellyfinHandler)
+	mux.HandleFunc("POST /api/emby", apiHandler.EmbyHandler)
+	mux.HandleFunc("POST /api/tautulli", apiHandler.TautulliHandler)
+	mux.Handle("POST /api/webhook/rotate", csrf(apiHandler.RotateWebhookHandler))
+	mux.HandleFunc("GET /api/history", apiHandler.HistoryHandler)
+	mux.HandleFunc("GET /api/jobs/failed", apiHandler.DeadJobsHandler)
+	mux.Handle("POST /api/jobs/failed/{id}/retry", csrf(apiHandler.RequeueJobHandler))
+	mux.Handle("POST /config", csrf(apiHandler.ConfigHandler))
+	mux.Handle("POST /logout", csrf(apiHandler.LogoutHandler))
+	mux.Handle("POST /logout/others", csrf(apiHandler.LogoutOthersHandler))
 	mux.Handle("GET /healthcheck", apiHandler.HealthcheckHandler())
+	mux.HandleFunc("GET /api/ratelimit", apiHandler.RateLimitHandler)
 	mux.Handle("GET /static/", http.StripPrefix("/static/", http.FileServer(http.Dir("./static/"))))
 	mux.HandleFunc("GET /", apiHandler.RootHandler)
 
@@ -64,6 +90,29 @@ func main() {
 	}
 }
 
+// openStorage connects to the store selected by the environment
+func openStorage() store.Store {
+	if os.Getenv("POSTGRESQL_URL") != "" {
+		slog.Info("Storage initialised", "type", "postgresql")
+		return store.NewPostgresqlStore(store.NewPostgresqlClient(os.Getenv("POSTGRESQL_URL")))
+	}
+	if os.Getenv("REDIS_URI") != "" {
+		slog.Info("Storage initialised", "type", "redis", "uri", os.Getenv("REDIS_URI"))
+		return store.NewRedisStore(store.NewRedisClient(os.Getenv("REDIS_URI"), os.Getenv("REDIS_PASSWORD")))
+	}
+	slog.Info("Storage initialised", "type", "disk")
+	return store.NewDiskStore()
+}
+
+// newTraktClient creates the Trakt client shared by all requests
+func newTraktClient(storage store.Store) *trakt.RealTraktClient {
+	return trakt.NewClient(
+		trakt.WithBaseURL(config.TraktAPIURL),
+		trakt.WithCredentials(config.TraktClientId, config.TraktClientSecret),
+		trakt.WithIDCache(trakt.NewIDCache(storage)),
+	)
+}
+
 func setupLogging() {
 	opts := &slog.HandlerOptions{
 		Level: slog.LevelInfo,
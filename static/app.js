@@ -90,8 +90,49 @@ function copyWebhookWizard() {
     copyToClipboard("webhook-url-wizard", document.querySelector("#step-2 .copy-btn"));
 }
 
+// Recent Activity
+function traktLink(entry) {
+    var ids = entry.trakt_ids || {};
+    if (ids.imdb) return "https://trakt.tv/search/imdb/" + ids.imdb;
+    if (ids.trakt) return "https://trakt.tv/search/trakt/" + ids.trakt;
+    return null;
+}
+
+function loadHistory() {
+    $.getJSON("/api/history", function (entries) {
+        var $list = $("#history-list").empty();
+        $("#history-empty").toggle(entries.length === 0);
+
+        $.each(entries, function (i, entry) {
+            var $title = $("<div>").addClass("history-title");
+            var link = traktLink(entry);
+            var title = entry.title || entry.event;
+            if (link) {
+                $title.append($("<a>").attr({ href: link, target: "_blank", rel: "noopener" }).text(title));
+            } else {
+                $title.text(title);
+            }
+
+            var meta = [new Date(entry.time).toLocaleString(), entry.event];
+            if (entry.action) meta.push(entry.action);
+            if (entry.detail) meta.push(entry.detail);
+
+            $("<li>")
+                .addClass("history-item")
+                .append($("<div>").append($title, $("<div>").addClass("history-meta").text(meta.join(" · "))))
+                .append($("<span>").addClass("history-outcome " + entry.outcome).text(entry.outcome))
+                .appendTo($list);
+        });
+    });
+}
+
 // jQuery Ready Handler
 $(document).ready(function () {
+    // Send the CSRF token with every AJAX request
+    $.ajaxSetup({
+        headers: { "X-CSRF-Token": $('meta[name="csrf-token"]').attr("content") },
+    });
+
     // Device Auth Setup
     $(".js-authorise").click(function (e) {
         if (!isAuthReady) {
@@ -171,6 +212,24 @@ $(document).ready(function () {
         });
     });
 
+    // Webhook Secret Rotation
+    $(".js-rotate-webhook").click(function (e) {
+        e.preventDefault();
+        if (!confirm("The current webhook URL will stop working. You will need to update it in Plex. Continue?")) {
+            return;
+        }
+        $.post("/api/webhook/rotate", function (data) {
+            $("#webhook-url").text(data.url);
+        }).fail(function () {
+            alert("Failed to regenerate the webhook URL");
+        });
+    });
+
+    // Recent Activity
+    if ($("#history-list").length) {
+        loadHistory();
+    }
+
     // Reactive Save Preferences Button
     var $form = $("#preferences-form");
     var $submitBtn = $("#save-prefs-btn");
@@ -178,7 +237,7 @@ $(document).ready(function () {
     if ($form.length && $submitBtn.length) {
         var initialState = $form.serialize();
 
-        $form.on("change input", "input", function () {
+        $form.on("change input", "input, textarea, select", function () {
             var currentState = $form.serialize();
             $submitBtn.prop("disabled", currentState === initialState);
         });
@@ -13,7 +13,8 @@ func main() {
 	event := flag.String("event", "media.play", "Event type: media.play, media.pause, media.rate, library.new")
 	media := flag.String("media", "movie", "Media type: movie, show, episode")
 	rating := flag.Int("rating", 0, "Rating (1-10) for media.rate event")
-	user := flag.String("user", "test-user-id", "User ID query param")
+	token := flag.String("token", "", "Webhook token query param")
+	user := flag.String("user", "", "User ID query param (legacy webhook URLs)")
 	url := flag.String("url", "http://localhost:8000/api", "Target URL")
 	title := flag.String("title", "Test Title", "Media title")
 	year := flag.Int("year", 2024, "Media year")
@@ -26,11 +27,11 @@ func main() {
 	flag.Parse()
 
 	// Minified JSON payload to ensure regex matching works on server
-	payload := fmt.Sprintf(`{"event":"%s","viewOffset":%d,"Account":{"title":"%s"},"Metadata":{"librarySectionType":"%s","type":"%s","title":"%s","grandparentTitle":"%s","year":%d,"guid":"%s","rating":%d,"duration":%d,"userRating":%d,"addedAt":%d,"ExternalGuid":[{"id":"imdb://tt1234567"},{"id":"tmdb://12345"}]}}`,
+	payload := fmt.Sprintf(`{"event":"%s","viewOffset":%d,"Account":{"title":"%s"},"Metadata":{"librarySectionType":"%s","type":"%s","title":"%s","grandparentTitle":"%s","year":%d,"guid":"%s","rating":%d,"duration":%d,"userRating":%d,"addedAt":%d,"Guid":[{"id":"imdb://tt1234567"},{"id":"tmdb://12345"}]}}`,
 		*event, *offset, *username, *media, *media, *title, *title, *year, *guid, *rating, *duration, *rating, *addedAt)
 
 	if *media == "episode" {
-		payload = fmt.Sprintf(`{"event":"%s","viewOffset":%d,"Account":{"title":"%s"},"Metadata":{"librarySectionType":"show","type":"episode","title":"Episode Title","grandparentTitle":"%s","parentIndex":1,"index":1,"year":%d,"guid":"%s","rating":%d,"duration":%d,"userRating":%d,"addedAt":%d,"ExternalGuid":[{"id":"imdb://tt1234567"},{"id":"tmdb://12345"}]}}`,
+		payload = fmt.Sprintf(`{"event":"%s","viewOffset":%d,"Account":{"title":"%s"},"Metadata":{"librarySectionType":"show","type":"episode","title":"Episode Title","grandparentTitle":"%s","parentIndex":1,"index":1,"year":%d,"guid":"%s","rating":%d,"duration":%d,"userRating":%d,"addedAt":%d,"Guid":[{"id":"imdb://tt1234567"},{"id":"tmdb://12345"}]}}`,
 			*event, *offset, *username, *title, *year, *guid, *rating, *duration, *rating, *addedAt)
 	}
 
@@ -48,7 +49,10 @@ func main() {
 	part.Write([]byte(payload))
 	writer.Close()
 
-	fullURL := fmt.Sprintf("%s?id=%s", *url, *user)
+	fullURL := fmt.Sprintf("%s?token=%s", *url, *token)
+	if *user != "" {
+		fullURL = fmt.Sprintf("%s?id=%s", *url, *user)
+	}
 	req, err := http.NewRequest("POST", fullURL, body)
 	if err != nil {
 		panic(err)
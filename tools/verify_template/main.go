@@ -14,6 +14,7 @@ type AuthorisePage struct {
 	URL         string
 	User        store.User
 	CurrentStep int // 1, 2, 3, 4 (Dashboard)
+	CSRFToken   string
 }
 
 func main() {
@@ -30,8 +31,9 @@ func main() {
 	}
 	defer outputFile.Close()
 
-	// Helper for pointers
+	// Helpers for pointers
 	boolPtr := func(b bool) *bool { return &b }
+	intPtr := func(i int) *int { return &i }
 
 	// Prepare template
 	tpl, err := template.ParseFiles("../../static/index.html")
@@ -77,6 +79,7 @@ func main() {
 		User: store.User{
 			Username:     "testuser",
 			PlexUsername: "plexuser",
+			PlexAccounts: []string{"plexuser-bedroom"},
 			Config: store.Config{
 				MovieScrobbleStart:   boolPtr(true),
 				MovieScrobbleStop:    boolPtr(true),
@@ -84,6 +87,11 @@ func main() {
 				EpisodeScrobbleStart: boolPtr(true),
 				EpisodeScrobbleStop:  boolPtr(true),
 				EpisodeRate:          boolPtr(true),
+				WatchedThreshold:     intPtr(85),
+				UseScrobbleEvent:     boolPtr(false),
+				Libraries:            store.Rules{Exclude: []string{"Home Videos", "Kids"}},
+				Players:              store.Rules{Exclude: []string{"Kids Tablet"}},
+				PlayerLocation:       store.PlayerLocationLocal,
 			},
 		},
 	})